@@ -0,0 +1,205 @@
+package hypervisor
+
+import (
+	"fmt"
+	"math"
+	"unsafe"
+)
+
+// AllocOptions configures AllocRegion.
+type AllocOptions struct {
+	// Label names the region, and its guard pages, in Regions.
+	Label string
+	// GuardPages is the number of pages mapped without any guest access on
+	// each side of the region, so that a guest running off either end
+	// takes a permission fault instead of reaching whatever is mapped
+	// next. The guard pages occupy guest physical addresses below and
+	// above the region.
+	GuardPages int
+	// Scrub zeroes the memory when it is released. Sparse regions are
+	// released unscrubbed, since their pages are discarded rather than
+	// reused, and scrubbing would commit every one of them first.
+	Scrub bool
+	// Sparse reserves the range without backing it: each page is mapped
+	// the first time the guest or WriteAt touches it, so a huge window
+	// costs only the pages used. Regions and Metrics report the committed
+	// bytes. A guest access to a guard page of a sparse region exits with
+	// a translation fault.
+	Sparse bool
+	// Provider, if set, makes the region sparse and demand-paged: each page
+	// is filled by Provider.Fetch when first touched, including by ReadAt,
+	// instead of reading as zero.
+	Provider PageProvider
+}
+
+// AllocRegion maps size bytes of zeroed host memory the library allocates
+// at guestPhys, surrounded by opts.GuardPages guard pages, and returns the
+// region. The memory is released once Unmap has removed all of the region,
+// which also unmaps its guard pages, or when the VM is closed.
+func (vm *VM) AllocRegion(guestPhys, size uint64, perms MemPerm, opts AllocOptions) (Region, error) {
+	regions, err := vm.allocRegion(guestPhys, size, perms, opts)
+	if err != nil {
+		return Region{}, &OpError{Op: "alloc region", GPA: guestPhys, Size: size, Err: err}
+	}
+	vm.notify(func(o Observer) {
+		for _, r := range regions {
+			o.Mapped(vm, r)
+		}
+	})
+	return regions[len(regions)/2], nil
+}
+
+// allocRegion returns the regions it mapped in address order: the region
+// itself, between its guard regions if it has any.
+func (vm *VM) allocRegion(guestPhys, size uint64, perms MemPerm, opts AllocOptions) ([]Region, error) {
+	if vm == nil {
+		return nil, errVMNil
+	}
+
+	// Security: Lock so that Close frees the memory only after it is owned
+	vm.closeMu.Lock()
+	defer vm.closeMu.Unlock()
+
+	if vm.closed {
+		return nil, ErrVMClosed
+	}
+	if size == 0 {
+		return nil, fmt.Errorf("hv: zero size")
+	}
+	if opts.GuardPages < 0 {
+		return nil, fmt.Errorf("hv: negative guard page count %d", opts.GuardPages)
+	}
+
+	// Security: Bound the allocation before making it
+	page := uint64(pageSize())
+	if size > math.MaxInt || uint64(opts.GuardPages) > (math.MaxInt-size)/(2*page) {
+		vm.metrics.recordSecurityError()
+		return nil, fmt.Errorf("hv: size too large (max %d bytes)", math.MaxInt)
+	}
+	guard := uint64(opts.GuardPages) * page
+	if guestPhys < guard {
+		return nil, fmt.Errorf("hv: guard pages below guest physical address 0")
+	}
+
+	// Performance: Fast alignment checks using cached masks
+	if !isPageAligned(guestPhys) {
+		return nil, fmt.Errorf("%w: guestPhys 0x%x (page size: %d)", ErrInvalidAlignment, guestPhys, pageSize())
+	}
+	if !isPageAligned(size) {
+		return nil, fmt.Errorf("%w: size %d (page size: %d)", ErrInvalidAlignment, size, pageSize())
+	}
+
+	opts.Sparse = opts.Sparse || opts.Provider != nil
+	alloc := allocHost
+	if opts.Sparse {
+		alloc = reserveHost
+	}
+	mem, err := alloc(int(size + 2*guard))
+	if err != nil {
+		vm.metrics.recordResourceError()
+		return nil, fmt.Errorf("hv: failed to allocate %d bytes: %w", size+2*guard, err)
+	}
+	a := hostAlloc{mem: mem, guard: guard, scrub: opts.Scrub, reserved: opts.Sparse}
+
+	r, err := vm.mapRegion(Region{GPA: guestPhys - guard, Perms: perms, Label: opts.Label, Sparse: opts.Sparse, Host: mem}, opts.Provider)
+	if err != nil {
+		a.free()
+		return nil, err
+	}
+	if guard == 0 {
+		vm.own(a)
+		return []Region{r}, nil
+	}
+
+	lo, hi := r.sub(r.GPA, guestPhys), r.sub(guestPhys+size, r.End())
+	for _, g := range []Region{lo, hi} {
+		if err := vm.protectRange(g.GPA, g.Size, 0); err != nil {
+			vm.unmapRange(r.GPA, r.Size)
+			a.free()
+			return nil, err
+		}
+	}
+	vm.own(a)
+	lo.Perms, hi.Perms = 0, 0
+	return []Region{lo, r.sub(guestPhys, guestPhys+size), hi}, nil
+}
+
+// hostAlloc is host memory the library allocated for the VM.
+type hostAlloc struct {
+	mem      []byte
+	guard    uint64 // bytes of guard pages at each end of mem
+	scrub    bool   // zero mem before freeing it
+	reserved bool   // mem came from reserveHost
+}
+
+// holds reports whether host lies in a's memory, and whether it lies in a
+// guard page.
+func (a hostAlloc) holds(host []byte) (in, guard bool) {
+	base := uintptr(unsafe.Pointer(unsafe.SliceData(a.mem)))
+	p := uintptr(unsafe.Pointer(unsafe.SliceData(host)))
+	if p < base || p >= base+uintptr(len(a.mem)) {
+		return false, false
+	}
+	off := uint64(p - base)
+	return true, off < a.guard || off >= uint64(len(a.mem))-a.guard
+}
+
+func (a hostAlloc) free() {
+	// Performance: Never scrub a reservation, which may be far larger than
+	// the host's memory; freeHost discards its pages.
+	if a.scrub && !a.reserved {
+		clear(a.mem)
+	}
+	freeHost(a.mem)
+}
+
+// own hands a to the VM, which frees it once it is no longer mapped.
+func (vm *VM) own(a hostAlloc) {
+	vm.regions.mu.Lock()
+	defer vm.regions.mu.Unlock()
+	vm.owned = append(vm.owned, a)
+}
+
+// releaseLocked frees the allocations that no region outside their guard
+// pages uses any more, unmapping the guard pages first. It returns the
+// guard regions it unmapped.
+func (vm *VM) releaseLocked() []Region {
+	var unmapped []Region
+	kept := vm.owned[:0]
+	for _, a := range vm.owned {
+		var guards []Region
+		used := false
+		for _, r := range vm.regions.regions {
+			in, guard := a.holds(r.Host)
+			if in && !guard {
+				used = true
+				break
+			}
+			if in {
+				guards = append(guards, r)
+			}
+		}
+		for _, g := range guards {
+			if used {
+				break
+			}
+			if err := vm.backend.Unmap(g.GPA, g.Size); err != nil {
+				// Keep the memory the backend may still use.
+				vm.metrics.recordResourceError()
+				used = true
+				break
+			}
+			vm.metrics.recordUnmap(vm.regions.removeLocked(g.GPA, g.Size))
+			vm.untrackLocked(g.GPA, g.Size)
+			unmapped = append(unmapped, g)
+		}
+		if used {
+			kept = append(kept, a)
+			continue
+		}
+		a.free()
+	}
+	clear(vm.owned[len(kept):])
+	vm.owned = kept
+	return unmapped
+}
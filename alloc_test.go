@@ -0,0 +1,173 @@
+package hypervisor
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+func TestAllocRegion(t *testing.T) {
+	vm, backend := newFakeVM(t)
+	rec := &recorder{}
+	vm.AddObserver(rec)
+	page := uint64(pageSize())
+	const base = 0x200000
+
+	r, err := vm.AllocRegion(base, 2*page, MemRead|MemWrite, AllocOptions{Label: "stack", GuardPages: 1, Scrub: true})
+	if err != nil {
+		t.Fatalf("AllocRegion failed: %v", err)
+	}
+	if r.GPA != base || r.Size != 2*page || r.Perms != MemRead|MemWrite || r.Label != "stack" || len(r.Host) != int(2*page) {
+		t.Errorf("AllocRegion = %v with %d host bytes, want 0x%x-0x%x rw- stack", r, len(r.Host), base, base+2*page)
+	}
+	if !isPageAligned(uint64(uintptr(unsafe.Pointer(unsafe.SliceData(r.Host))))) {
+		t.Errorf("host memory is not page-aligned")
+	}
+
+	got := vm.Regions()
+	for i := range got {
+		got[i].Host = nil
+	}
+	want := []Region{
+		{GPA: base - page, Size: page, Perms: 0, Label: "stack", Committed: page},
+		{GPA: base, Size: 2 * page, Perms: MemRead | MemWrite, Label: "stack", Committed: 2 * page},
+		{GPA: base + 2*page, Size: page, Perms: 0, Label: "stack", Committed: page},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Regions = %v, want %v", got, want)
+	}
+	for _, m := range backend.Mappings() {
+		guard := m.GuestPhys < base || m.GuestPhys >= base+2*page
+		if guard && m.Perms != 0 {
+			t.Errorf("guard page 0x%x perms = %v, want ---", m.GuestPhys, m.Perms)
+		}
+	}
+
+	// A partial unmap keeps the memory; unmapping the rest frees it along
+	// with the guard pages.
+	if err := vm.Unmap(base, page); err != nil {
+		t.Fatal(err)
+	}
+	if len(vm.owned) != 1 {
+		t.Fatalf("%d allocations after a partial unmap, want 1", len(vm.owned))
+	}
+	if err := vm.Unmap(base+page, page); err != nil {
+		t.Fatal(err)
+	}
+	if len(vm.owned) != 0 || len(vm.Regions()) != 0 || len(backend.Mappings()) != 0 {
+		t.Errorf("after Unmap: %d allocations, regions %v, %d backend pages; want none",
+			len(vm.owned), vm.Regions(), len(backend.Mappings()))
+	}
+	wantEvents := []string{
+		fmt.Sprintf("map 0x%x+%d ---", base-page, page),
+		fmt.Sprintf("map 0x%x+%d rw-", base, 2*page),
+		fmt.Sprintf("map 0x%x+%d ---", base+2*page, page),
+		fmt.Sprintf("unmap 0x%x+%d", base, page),
+		fmt.Sprintf("unmap 0x%x+%d", base+page, page),
+		fmt.Sprintf("unmap 0x%x+%d", base-page, page),
+		fmt.Sprintf("unmap 0x%x+%d", base+2*page, page),
+	}
+	if !reflect.DeepEqual(rec.events, wantEvents) {
+		t.Errorf("events = %q, want %q", rec.events, wantEvents)
+	}
+}
+
+func TestAllocRegionErrors(t *testing.T) {
+	page := uint64(pageSize())
+	const base = 0x200000
+
+	tests := []struct {
+		name    string
+		gpa     uint64
+		size    uint64
+		perms   MemPerm
+		opts    AllocOptions
+		wantErr error
+	}{
+		{"zero size", base, 0, MemRead, AllocOptions{}, errAny},
+		{"unaligned", base + 1, page, MemRead, AllocOptions{}, ErrInvalidAlignment},
+		{"no permissions", base, page, 0, AllocOptions{}, errAny},
+		{"negative guards", base, page, MemRead, AllocOptions{GuardPages: -1}, errAny},
+		{"guard below zero", 0, page, MemRead, AllocOptions{GuardPages: 1}, errAny},
+		{"guard overlaps", base + 2*page, page, MemRead, AllocOptions{GuardPages: 1}, errAny},
+		{"too large", base, 1 << 63, MemRead, AllocOptions{}, errAny},
+		{"guards overflow", base, page, MemRead, AllocOptions{GuardPages: 1 << 62}, errAny},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm, _ := newFakeVM(t)
+			if err := vm.Map(alignedBuffer(t, int(page)), base+page, MemRead); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := vm.AllocRegion(tt.gpa, tt.size, tt.perms, tt.opts)
+			if err == nil {
+				t.Fatal("AllocRegion succeeded, want an error")
+			}
+			if tt.wantErr != errAny && !errors.Is(err, tt.wantErr) {
+				t.Errorf("AllocRegion error = %v, want %v", err, tt.wantErr)
+			}
+			if len(vm.owned) != 0 || len(vm.Regions()) != 1 {
+				t.Errorf("failed AllocRegion left %d allocations and regions %v", len(vm.owned), vm.Regions())
+			}
+		})
+	}
+}
+
+func TestAllocRegionGuardFault(t *testing.T) {
+	page := uint64(pageSize())
+	vm, vcpu, _ := newInterpVM(t,
+		0xD2A00401,                    // movz x1, #0x20, lsl #16 (x1 = 0x200000)
+		0xF9000020|uint32(page/8)<<10, // str  x0, [x1, #page]
+		0xD4200000,                    // brk  #0
+	)
+	if _, err := vm.AllocRegion(0x200000, page, MemRead|MemWrite, AllocOptions{GuardPages: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := vcpu.Run()
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if da, ok := info.DataAbort(); !ok || !da.DFSC.IsPermission() || info.IPA != 0x200000+page {
+		t.Errorf("exit = %v, want a permission fault at the guard page 0x%x", info, 0x200000+page)
+	}
+}
+
+func TestAllocRegionScrubSparse(t *testing.T) {
+	switch runtime.GOOS {
+	case "windows", "plan9", "js", "wasip1":
+		t.Skipf("%s cannot reserve memory without backing it", runtime.GOOS)
+	}
+	page := uint64(pageSize())
+	const base = 0x200000
+	const size = 1 << 36 // far more than the host can commit
+
+	vm, _ := newFakeVM(t)
+	for _, opts := range []AllocOptions{
+		{Label: "sparse", Sparse: true, Scrub: true},
+		{Label: "provider", Provider: &pageSource{}, Scrub: true},
+	} {
+		t.Run(opts.Label, func(t *testing.T) {
+			if _, err := vm.AllocRegion(base, size, MemRead|MemWrite, opts); err != nil {
+				t.Fatalf("AllocRegion failed: %v", err)
+			}
+			if _, err := vm.WriteAt([]byte{1}, int64(base+size-page)); err != nil {
+				t.Fatal(err)
+			}
+			// Scrubbing the whole reservation would commit all of it.
+			if err := vm.Unmap(base, size); err != nil {
+				t.Fatalf("Unmap failed: %v", err)
+			}
+			if len(vm.owned) != 0 {
+				t.Errorf("%d allocations after Unmap, want 0", len(vm.owned))
+			}
+			if m := vm.Metrics(); m.CommittedBytes != 0 {
+				t.Errorf("CommittedBytes = %d, want 0", m.CommittedBytes)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package hypervisor
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Backend is the execution engine behind VM and VCPU.
+//
+// The public VM and VCPU types validate arguments, record metrics and
+// manage lifetimes; a Backend only has to perform the operation. Each VM
+// gets its own Backend instance from the registered BackendFactory.
+type Backend interface {
+	// Name returns the name the backend was registered under.
+	Name() string
+	// CreateVM creates the underlying virtual machine.
+	CreateVM() error
+	// DestroyVM releases the underlying virtual machine.
+	DestroyVM() error
+	// Map maps host memory into the guest physical address space.
+	// Arguments have already been validated by VM.Map.
+	Map(host []byte, guestPhys uint64, perms MemPerm) error
+	// Unmap removes a guest physical range. Arguments have already been
+	// validated by VM.Unmap.
+	Unmap(guestPhys, size uint64) error
+	// Protect changes the permissions of a mapped guest physical range.
+	// Arguments have already been validated by VM.Protect, and the range
+	// is entirely mapped.
+	Protect(guestPhys, size uint64, perms MemPerm) error
+	// CreateVCPU creates a new vCPU.
+	CreateVCPU() (BackendVCPU, error)
+}
+
+// BackendVCPU is the per-vCPU half of a Backend.
+type BackendVCPU interface {
+	// ID returns a backend specific identifier for the vCPU.
+	ID() uint64
+	// GetReg reads a register. r has already been range checked.
+	GetReg(r Reg) (uint64, error)
+	// SetReg writes a register. r has already been range checked.
+	SetReg(r Reg, v uint64) error
+	// GetSysReg reads a system register. r is one of SysRegs.
+	GetSysReg(r SysReg) (uint64, error)
+	// SetSysReg writes a system register. r is one of SysRegs.
+	SetSysReg(r SysReg, v uint64) error
+	// GetSIMD reads a SIMD&FP register. q has already been range checked.
+	GetSIMD(q SIMDReg) ([16]byte, error)
+	// SetSIMD writes a SIMD&FP register. q has already been range checked.
+	SetSIMD(q SIMDReg, v [16]byte) error
+	// SetPendingInterrupt raises or lowers an interrupt line, which keeps
+	// that level for the following runs. t has already been range checked.
+	SetPendingInterrupt(t InterruptType, pending bool) error
+	// GetVTimerMask reports whether the virtual timer is masked, so that it
+	// cannot exit with ExitTimer.
+	GetVTimerMask() (bool, error)
+	// SetVTimerMask masks or unmasks the virtual timer. The backend masks
+	// it itself whenever it exits with ExitTimer.
+	SetVTimerMask(masked bool) error
+	// Run executes the vCPU until it exits.
+	Run() (ExitInfo, error)
+	// Exit makes a Run in progress return ExitCanceled as soon as possible,
+	// or the next Run return it immediately if none is. Unlike the other
+	// methods it may be called from any thread.
+	Exit() error
+	// Destroy releases the vCPU.
+	Destroy() error
+}
+
+// BackendFactory returns a fresh Backend instance for a new VM.
+type BackendFactory func() (Backend, error)
+
+var (
+	backendsMu sync.RWMutex
+	backends   = make(map[string]BackendFactory)
+
+	// platformBackend is the backend used by NewVM when HV_BACKEND is unset.
+	// It is set by the platform specific files.
+	platformBackend string
+)
+
+// RegisterBackend makes a backend available under name. It panics if name is
+// empty, factory is nil or the name is already registered.
+func RegisterBackend(name string, factory BackendFactory) {
+	if name == "" {
+		panic("hypervisor: RegisterBackend with empty name")
+	}
+	if factory == nil {
+		panic("hypervisor: RegisterBackend factory is nil for " + name)
+	}
+
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+
+	if _, dup := backends[name]; dup {
+		panic("hypervisor: RegisterBackend called twice for " + name)
+	}
+	backends[name] = factory
+}
+
+// Backends returns the sorted names of all registered backends.
+func Backends() []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DefaultBackend returns the backend name NewVM uses: the HV_BACKEND
+// environment variable if set, otherwise the platform backend.
+func DefaultBackend() string {
+	if name := os.Getenv("HV_BACKEND"); name != "" {
+		return name
+	}
+	return platformBackend
+}
+
+// openBackend instantiates the backend registered under name.
+func openBackend(name string) (Backend, error) {
+	if name == "" {
+		return nil, fmt.Errorf("hypervisor: not supported on this platform")
+	}
+
+	backendsMu.RLock()
+	factory, ok := backends[name]
+	backendsMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("hv: unknown backend %q (available: %v)", name, Backends())
+	}
+	return factory()
+}
@@ -0,0 +1,242 @@
+package hypervisor
+
+import (
+	"errors"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+	"unsafe"
+)
+
+// alignedBuffer returns a page-aligned, page-multiple slice from the Go heap.
+func alignedBuffer(t *testing.T, size int) []byte {
+	t.Helper()
+	page := os.Getpagesize()
+	raw := make([]byte, size+page)
+	off := (page - int(uintptr(unsafe.Pointer(&raw[0]))%uintptr(page))) % page
+	return raw[off : off+size : off+size]
+}
+
+// newFakeVM creates a VM on the fake backend and closes it with the test.
+func newFakeVM(t *testing.T) (*VM, *FakeBackend) {
+	t.Helper()
+	vm, err := NewVMWithBackend("fake")
+	if err != nil {
+		t.Fatalf("NewVMWithBackend(fake) failed: %v", err)
+	}
+	t.Cleanup(func() { vm.Close() })
+	return vm, vm.Backend().(*FakeBackend)
+}
+
+func TestBackendRegistry(t *testing.T) {
+	if !slices.Contains(Backends(), "fake") {
+		t.Fatalf("Backends() = %v, want it to contain %q", Backends(), "fake")
+	}
+
+	t.Run("unknown backend", func(t *testing.T) {
+		if _, err := NewVMWithBackend("does-not-exist"); err == nil {
+			t.Error("Expected error for unknown backend, got nil")
+		}
+	})
+
+	t.Run("duplicate registration panics", func(t *testing.T) {
+		defer func() {
+			if recover() == nil {
+				t.Error("Expected panic when registering a backend twice")
+			}
+		}()
+		RegisterBackend("fake", func() (Backend, error) { return NewFakeBackend(), nil })
+	})
+
+	t.Run("HV_BACKEND overrides default", func(t *testing.T) {
+		t.Setenv("HV_BACKEND", "fake")
+		if got := DefaultBackend(); got != "fake" {
+			t.Fatalf("DefaultBackend() = %q, want %q", got, "fake")
+		}
+		vm, err := NewVM()
+		if err != nil {
+			t.Fatalf("NewVM() failed: %v", err)
+		}
+		defer vm.Close()
+		if got := vm.Backend().Name(); got != "fake" {
+			t.Errorf("vm.Backend().Name() = %q, want %q", got, "fake")
+		}
+	})
+}
+
+func TestFakeBackendMapping(t *testing.T) {
+	vm, fake := newFakeVM(t)
+	page := os.Getpagesize()
+	buf := alignedBuffer(t, 2*page)
+
+	if err := vm.Map(buf, 0x10000, MemRead|MemExec); err != nil {
+		t.Fatalf("Map failed: %v", err)
+	}
+
+	maps := fake.Mappings()
+	if len(maps) != 2 {
+		t.Fatalf("len(Mappings()) = %d, want 2", len(maps))
+	}
+	if maps[1].GuestPhys != 0x10000+uint64(page) {
+		t.Errorf("second page GPA = 0x%x, want 0x%x", maps[1].GuestPhys, 0x10000+page)
+	}
+	if maps[0].Perms != MemRead|MemExec {
+		t.Errorf("Perms = %v, want %v", maps[0].Perms, MemRead|MemExec)
+	}
+
+	t.Run("overlapping map", func(t *testing.T) {
+		if err := vm.Map(alignedBuffer(t, page), 0x10000, MemRead); err == nil {
+			t.Error("Expected error for overlapping map, got nil")
+		}
+	})
+
+	t.Run("validation runs before backend", func(t *testing.T) {
+		if err := vm.Map(buf, 0x10001, MemRead); err == nil {
+			t.Error("Expected error for unaligned guest address, got nil")
+		}
+		if err := vm.Map(buf, 0x40000, 0); err == nil {
+			t.Error("Expected error for empty permissions, got nil")
+		}
+	})
+
+	if err := vm.Unmap(0x10000, uint64(2*page)); err != nil {
+		t.Fatalf("Unmap failed: %v", err)
+	}
+	if n := len(fake.Mappings()); n != 0 {
+		t.Errorf("len(Mappings()) after Unmap = %d, want 0", n)
+	}
+	if err := vm.Unmap(0x10000, uint64(page)); err == nil {
+		t.Error("Expected error unmapping an unmapped range, got nil")
+	}
+}
+
+func TestFakeBackendVCPU(t *testing.T) {
+	vm, fake := newFakeVM(t)
+
+	vcpu, err := vm.NewVCPU()
+	if err != nil {
+		t.Fatalf("NewVCPU failed: %v", err)
+	}
+	defer vcpu.Close()
+
+	if err := vcpu.SetReg(RegX3, 0x5a5a5a5a5a5a5a5a); err != nil {
+		t.Fatalf("SetReg failed: %v", err)
+	}
+	if got, _ := vcpu.GetReg(RegX3); got != 0x5a5a5a5a5a5a5a5a {
+		t.Errorf("GetReg(X3) = 0x%x, want 0x5a5a5a5a5a5a5a5a", got)
+	}
+	if _, err := vcpu.GetReg(regCount); err == nil {
+		t.Error("Expected error for out-of-range register, got nil")
+	}
+
+	t.Run("default exit is BRK", func(t *testing.T) {
+		info, err := vcpu.Run()
+		if err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		if info.Reason != ExitException || info.ESR != fakeBRKSyndrome {
+			t.Errorf("Run() = %+v, want BRK exception", info)
+		}
+	})
+
+	t.Run("queued exits replay in order", func(t *testing.T) {
+		fake.QueueExit(ExitInfo{Reason: ExitTimer}, ExitInfo{Reason: ExitUnknown})
+		for _, want := range []ExitReason{ExitTimer, ExitUnknown, ExitException} {
+			info, err := vcpu.Run()
+			if err != nil {
+				t.Fatalf("Run failed: %v", err)
+			}
+			if info.Reason != want {
+				t.Errorf("Run().Reason = %d, want %d", info.Reason, want)
+			}
+		}
+	})
+
+	if err := vcpu.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if _, err := vcpu.Run(); err == nil {
+		t.Error("Expected error running a closed vCPU, got nil")
+	}
+}
+
+func TestVMCloseIdempotent(t *testing.T) {
+	vm, _ := newFakeVM(t)
+	if err := vm.Close(); err != nil {
+		t.Fatalf("first Close failed: %v", err)
+	}
+	if err := vm.Close(); err != nil {
+		t.Errorf("second Close failed: %v", err)
+	}
+	if _, err := vm.NewVCPU(); err == nil {
+		t.Error("Expected error creating vCPU on closed VM, got nil")
+	}
+}
+
+func TestVMCloseConcurrent(t *testing.T) {
+	page := uint64(pageSize())
+	for i := 0; i < 50; i++ {
+		vm, _ := newFakeVM(t)
+		for _, gpa := range []uint64{0x300000, 0x500000, 0x600000} {
+			if err := vm.Map(alignedBuffer(t, int(page)), gpa, MemRead|MemWrite); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := vm.EnableDirtyTracking(Region{GPA: 0x600000, Size: page}); err != nil {
+			t.Fatal(err)
+		}
+		host := alignedBuffer(t, int(page))
+
+		ops := map[string]func() error{
+			"NewVCPU": func() error { _, err := vm.NewVCPU(); return err },
+			"AllocRegion": func() error {
+				_, err := vm.AllocRegion(0x200000, page, MemRead|MemWrite, AllocOptions{})
+				return err
+			},
+			"Map":     func() error { return vm.Map(host, 0x400000, MemRead) },
+			"Unmap":   func() error { return vm.Unmap(0x300000, page) },
+			"Protect": func() error { return vm.Protect(0x500000, page, MemRead) },
+			"dirty tracking": func() error {
+				if _, err := vm.CollectDirty(); err != nil {
+					return err
+				}
+				return vm.DisableDirtyTracking(Region{GPA: 0x600000})
+			},
+			"Checkpoint": func() error {
+				cp, err := vm.Checkpoint()
+				if err != nil {
+					return err
+				}
+				return vm.Reset(cp)
+			},
+		}
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		errs := make(map[string]error)
+		for name, op := range ops {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := op()
+				mu.Lock()
+				errs[name] = err
+				mu.Unlock()
+			}()
+		}
+		if err := vm.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+		wg.Wait()
+
+		// Each either completed before Close or saw the VM closed.
+		for name, err := range errs {
+			if err != nil && !errors.Is(err, ErrVMClosed) {
+				t.Errorf("%s racing Close = %v, want success or ErrVMClosed", name, err)
+			}
+		}
+		if len(vm.owned) != 0 || len(vm.Regions()) != 0 {
+			t.Errorf("after Close: %d allocations, regions %v; want none", len(vm.owned), vm.Regions())
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package hypervisor
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Checkpoint is a VM state captured by VM.Checkpoint, for VM.Reset to
+// return to.
+type Checkpoint struct {
+	vm      *VM
+	vcpus   []vcpuCheckpoint
+	regions []Region // copies of guest memory, in address order; nil Host is zero
+}
+
+type vcpuCheckpoint struct {
+	vcpu  *VCPU
+	state *CPUState
+}
+
+// Checkpoint captures the registers of every vCPU and the contents of all
+// mapped memory, none of which may be running, and enables dirty tracking
+// on the memory not already tracked, so that Reset only copies back what
+// changed. Its cost is proportional to the memory mapped, counting only
+// the committed pages of sparse regions.
+//
+// Tracked ranges Checkpoint adds are reported by CollectDirty like any
+// other.
+func (vm *VM) Checkpoint() (*Checkpoint, error) {
+	cp, err := vm.checkpoint()
+	if err != nil {
+		return nil, &OpError{Op: "checkpoint", Err: err}
+	}
+	return cp, nil
+}
+
+func (vm *VM) checkpoint() (*Checkpoint, error) {
+	if vm == nil {
+		return nil, errVMNil
+	}
+
+	// Security: Lock to keep Close from tearing the VM down meanwhile
+	vm.closeMu.Lock()
+	defer vm.closeMu.Unlock()
+
+	if vm.closed {
+		return nil, ErrVMClosed
+	}
+
+	cp := &Checkpoint{vm: vm}
+	for _, c := range vm.VCPUs() {
+		s, err := c.SaveState()
+		if err != nil {
+			return nil, err
+		}
+		cp.vcpus = append(cp.vcpus, vcpuCheckpoint{vcpu: c, state: s})
+	}
+
+	vm.regions.mu.Lock()
+	defer vm.regions.mu.Unlock()
+
+	for _, r := range vm.regions.regions {
+		if err := vm.trackGapsLocked(r.GPA, r.Size); err != nil {
+			return nil, err
+		}
+	}
+	// Memory now matches cp, so pages written since the previous
+	// checkpoint no longer differ from it.
+	if err := vm.clearResetLocked(); err != nil {
+		return nil, err
+	}
+	cp.regions = make([]Region, 0, len(vm.regions.regions))
+	for _, r := range vm.regions.regions {
+		if !r.Sparse {
+			r.Host = append([]byte(nil), r.Host...)
+			cp.regions = append(cp.regions, r)
+			continue
+		}
+		// Performance: Copy only the committed pages of sparse regions,
+		// and leave the rest without host memory.
+		save := func(lo, hi uint64, committed bool) {
+			part := r.sub(lo, hi)
+			part.Host = nil
+			if committed {
+				part.Host = append([]byte(nil), r.Host[lo-r.GPA:hi-r.GPA]...)
+			}
+			cp.regions = append(cp.regions, part)
+		}
+		next := r.GPA
+		vm.eachBackedLocked(r.GPA, r.Size, func(_ Region, gpa, size uint64) error {
+			if gpa > next {
+				save(next, gpa, false)
+			}
+			save(gpa, gpa+size, true)
+			next = gpa + size
+			return nil
+		})
+		if next < r.End() {
+			save(next, r.End(), false)
+		}
+	}
+	vm.baseline = cp
+	return cp, nil
+}
+
+// Reset returns the VM to cp: the vCPUs it captured get their registers
+// back, and the memory it captured its contents. After a Reset to the most
+// recent checkpoint, or a Checkpoint, only the pages written since are
+// copied, so the cost is proportional to the pages the guest touched;
+// resetting to an older checkpoint, or after DisableDirtyTracking, copies
+// all of its memory. Pages of sparse regions committed since cp are
+// released again, and fetched again from their provider when next touched.
+//
+// Reset does not undo Map or Unmap, restore vCPUs closed since cp, or reset
+// MMIO devices. Pages written through slices returned by Slice are not
+// restored. No vCPU may be running.
+func (vm *VM) Reset(cp *Checkpoint) error {
+	if err := vm.reset(cp); err != nil {
+		return &OpError{Op: "reset", Err: err}
+	}
+	return nil
+}
+
+func (vm *VM) reset(cp *Checkpoint) error {
+	if vm == nil {
+		return errVMNil
+	}
+	if cp == nil {
+		return fmt.Errorf("hv: checkpoint is nil")
+	}
+	if cp.vm != vm {
+		return fmt.Errorf("hv: checkpoint belongs to another VM")
+	}
+
+	// Security: Lock to keep Close from tearing the VM down meanwhile
+	vm.closeMu.Lock()
+	defer vm.closeMu.Unlock()
+
+	if vm.closed {
+		return ErrVMClosed
+	}
+
+	// Restore registers first: RestoreState fails for running vCPUs,
+	// before any memory has changed.
+	for _, v := range cp.vcpus {
+		if err := v.vcpu.RestoreState(v.state); err != nil {
+			if errors.Is(err, ErrVCPUClosed) {
+				continue
+			}
+			return err
+		}
+	}
+
+	vm.regions.mu.Lock()
+	defer vm.regions.mu.Unlock()
+
+	if vm.baseline == cp {
+		for _, d := range vm.regions.dirty {
+			err := d.resetBitmap().runs(func(gpa, size uint64) error {
+				return vm.restoreLocked(cp.regions, gpa, size)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		// Track all mapped memory again, as Checkpoint did, so that the
+		// next Reset to cp may copy only the pages written since.
+		for _, r := range vm.regions.regions {
+			if err := vm.trackGapsLocked(r.GPA, r.Size); err != nil {
+				return err
+			}
+		}
+		for _, r := range cp.regions {
+			if err := vm.restoreLocked(cp.regions, r.GPA, r.Size); err != nil {
+				return err
+			}
+			vm.eachBackedLocked(r.GPA, r.Size, func(_ Region, gpa, size uint64) error {
+				vm.regions.markDirtyLocked(gpa, size)
+				return nil
+			})
+		}
+		vm.baseline = cp
+	}
+	return vm.clearResetLocked()
+}
+
+// trackGapsLocked enables dirty tracking on the parts of [gpa, gpa+size)
+// no range tracks yet.
+func (vm *VM) trackGapsLocked(gpa, size uint64) error {
+	end := gpa + size
+	for gpa < end {
+		if d := vm.regions.trackedLocked(gpa); d != nil {
+			gpa = d.end()
+			continue
+		}
+		next := end
+		for _, d := range vm.regions.dirty {
+			if d.gpa > gpa && d.gpa < next {
+				next = d.gpa
+			}
+		}
+		if err := vm.writeProtectLocked(gpa, next-gpa); err != nil {
+			return err
+		}
+		vm.regions.dirty = append(vm.regions.dirty, newDirtyRange(gpa, next-gpa))
+		gpa = next
+	}
+	return nil
+}
+
+// clearResetLocked forgets the pages written since the last Checkpoint or
+// Reset, write-protecting them again. Pages Reset restored count as
+// written for CollectDirty.
+func (vm *VM) clearResetLocked() error {
+	for _, d := range vm.regions.dirty {
+		if err := d.resetBitmap().runs(vm.writeProtectLocked); err != nil {
+			return err
+		}
+		for i, w := range d.reset {
+			d.bits[i] |= w
+			d.reset[i] = 0
+		}
+	}
+	return nil
+}
+
+// restoreLocked copies the saved memory in [gpa, gpa+size) back into the
+// regions still mapped there. Saved parts without host memory were
+// uncommitted, and are uncommitted again where they have been committed
+// since.
+func (vm *VM) restoreLocked(saved []Region, gpa, size uint64) error {
+	t := &vm.regions
+	end := gpa + size
+	for i := t.find(gpa); i < len(t.regions) && t.regions[i].GPA < end; i++ {
+		r := t.regions[i]
+		if r.readOnly {
+			continue // nothing can have written it
+		}
+		lo, hi := max(r.GPA, gpa), min(r.End(), end)
+		j := sort.Search(len(saved), func(j int) bool { return saved[j].End() > lo })
+		for ; j < len(saved) && saved[j].GPA < hi; j++ {
+			s := saved[j]
+			from, to := max(lo, s.GPA), min(hi, s.End())
+			if s.Host != nil {
+				copy(r.Host[from-r.GPA:to-r.GPA], s.Host[from-s.GPA:to-s.GPA])
+				continue
+			}
+			if !r.Sparse {
+				clear(r.Host[from-r.GPA : to-r.GPA])
+				continue
+			}
+			if sp := t.sparseLocked(from); sp != nil {
+				if err := vm.uncommitLocked(sp, r, from, to-from); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package hypervisor
+
+import (
+	"testing"
+)
+
+func TestCheckpointReset(t *testing.T) {
+	vm, vcpu, data := newInterpVM(t,
+		0xD2800540, // movz x0, #0x2a
+		0xD2A00201, // movz x1, #0x10, lsl #16 (x1 = interpDataGPA)
+		0xF9000020, // str  x0, [x1]
+		0xD4200000, // brk  #0
+	)
+	page := uint64(pageSize())
+	heap := alignedBuffer(t, int(2*page))
+	if err := vm.Map(heap, interpDataGPA+page, MemRead|MemWrite); err != nil {
+		t.Fatal(err)
+	}
+	data[0] = 7
+	heap[page] = 9
+
+	cp, err := vm.Checkpoint()
+	if err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+
+	check := func(name string, wantData, wantHeap byte) {
+		t.Helper()
+		if data[0] != wantData || heap[page] != wantHeap {
+			t.Errorf("%s: memory = 0x%x, 0x%x; want 0x%x, 0x%x", name, data[0], heap[page], wantData, wantHeap)
+		}
+		pc, _ := vcpu.GetReg(RegPC)
+		x0, _ := vcpu.GetReg(RegX0)
+		if pc != interpCodeGPA || x0 != 0 {
+			t.Errorf("%s: PC, X0 = 0x%x, 0x%x; want 0x%x, 0", name, pc, x0, interpCodeGPA)
+		}
+	}
+	dirty := func() int {
+		t.Helper()
+		maps, err := vm.CollectDirty()
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for _, m := range maps {
+			n += m.Count()
+		}
+		return n
+	}
+
+	for i := range 3 {
+		if _, err := vm.WriteAt([]byte{0xff}, int64(interpDataGPA+2*page)); err != nil {
+			t.Fatal(err)
+		}
+		if info, err := vcpu.Run(); err != nil || info.Class() != ECBRK {
+			t.Fatalf("run %d: Run = %v, %v; want BRK", i, info, err)
+		}
+		if data[0] != 0x2a {
+			t.Fatalf("run %d: data[0] = 0x%x, want 0x2a", i, data[0])
+		}
+		if err := vm.Reset(cp); err != nil {
+			t.Fatalf("run %d: Reset failed: %v", i, err)
+		}
+		check("Reset", 7, 9)
+		// The guest's page and the host write are restored, nothing else.
+		if n := dirty(); n != 2 {
+			t.Errorf("run %d: %d pages dirty, want 2", i, n)
+		}
+	}
+
+	// Resetting to an older checkpoint restores everything it captured.
+	data[0], heap[page] = 1, 2
+	cp2, err := vm.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Reset(cp); err != nil {
+		t.Fatalf("Reset to older checkpoint failed: %v", err)
+	}
+	check("older checkpoint", 7, 9)
+	if err := vm.Reset(cp2); err != nil {
+		t.Fatal(err)
+	}
+	check("newer checkpoint", 1, 2)
+
+	other, _ := newFakeVM(t)
+	if err := other.Reset(cp); err == nil {
+		t.Error("Reset with another VM's checkpoint succeeded")
+	}
+	if err := vm.Reset(nil); err == nil {
+		t.Error("Reset(nil) succeeded")
+	}
+}
+
+func TestResetUntracked(t *testing.T) {
+	page := uint64(pageSize())
+	const base = 0x200000
+	tests := []struct {
+		name string
+		// drop stops tracking part of the memory after Checkpoint.
+		drop func(vm *VM) error
+	}{
+		{"disable", func(vm *VM) error {
+			return vm.DisableDirtyTracking(Region{GPA: base})
+		}},
+		{"unmap", func(vm *VM) error {
+			return vm.Unmap(base+page, page)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm, _ := newFakeVM(t)
+			if err := vm.Map(alignedBuffer(t, int(2*page)), base, MemRead|MemWrite); err != nil {
+				t.Fatal(err)
+			}
+			if err := vm.EnableDirtyTracking(Region{GPA: base, Size: 2 * page}); err != nil {
+				t.Fatal(err)
+			}
+			cp, err := vm.Checkpoint()
+			if err != nil {
+				t.Fatalf("Checkpoint failed: %v", err)
+			}
+			if err := tt.drop(vm); err != nil {
+				t.Fatal(err)
+			}
+
+			// Reset twice: the second runs with cp as the baseline again.
+			for i := range 2 {
+				if _, err := vm.WriteAt([]byte{0xaa}, base); err != nil {
+					t.Fatal(err)
+				}
+				if err := vm.Reset(cp); err != nil {
+					t.Fatalf("Reset %d failed: %v", i, err)
+				}
+				got := []byte{0xff}
+				if _, err := vm.ReadAt(got, base); err != nil {
+					t.Fatal(err)
+				}
+				if got[0] != 0 {
+					t.Errorf("Reset %d: byte = 0x%x, want 0", i, got[0])
+				}
+			}
+		})
+	}
+}
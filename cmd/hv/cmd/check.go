@@ -45,6 +45,7 @@ var checkCmd = &cobra.Command{
 		} else {
 			fmt.Printf("hv support: %v\n", ok)
 		}
+		fmt.Printf("backend: %s (available: %v)\n", hypervisor.DefaultBackend(), hypervisor.Backends())
 
 		exe, _ := os.Executable()
 		if exe != "" {
@@ -24,6 +24,7 @@ package cmd
 import (
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/blacktop/go-hypervisor"
 	"github.com/blacktop/go-hypervisor/cmd/hv/cmd/utils"
@@ -41,7 +42,7 @@ type EmulateResult struct {
 		Size      uint64 `json:"size"`
 	} `json:"function"`
 	InitialSP uint64              `json:"initial_sp"`
-	State     CPUState            `json:"state"`
+	State     hypervisor.CPUState `json:"state"`
 	ExitInfo  hypervisor.ExitInfo `json:"exit_info"`
 	Memory    map[string][]byte   `json:"memory,omitempty"`
 	Error     string              `json:"error,omitempty"`
@@ -54,6 +55,7 @@ func init() {
 	emulateCmd.Flags().IntP("mem-size", "m", 0x10000, "Memory size to allocate (bytes)")
 	emulateCmd.Flags().Uint64P("stack", "s", 0x8000, "Stack pointer address (within allocated memory)")
 	emulateCmd.Flags().Bool("json", false, "Output results as JSON")
+	emulateCmd.Flags().Duration("timeout", 0, "Stop the guest after this long (0 = no limit)")
 }
 
 var emulateCmd = &cobra.Command{
@@ -63,9 +65,8 @@ var emulateCmd = &cobra.Command{
 	Args:    cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		// Check hypervisor support
-		ok, err := hypervisor.Supported()
-		if err != nil || !ok {
-			return fmt.Errorf("hypervisor not supported: %v", err)
+		if err := checkBackend(); err != nil {
+			return err
 		}
 
 		// Get flags
@@ -100,6 +101,11 @@ var emulateCmd = &cobra.Command{
 			return fmt.Errorf("failed to get json flag: %w", err)
 		}
 
+		timeout, err := cmd.Flags().GetDuration("timeout")
+		if err != nil {
+			return fmt.Errorf("failed to get timeout flag: %w", err)
+		}
+
 		// Validate stack pointer is within memory range
 		baseAddr := uint64(0x4000) // Base address from execute command
 		if stackPtr < baseAddr || stackPtr >= baseAddr+uint64(memSize) {
@@ -155,7 +161,7 @@ var emulateCmd = &cobra.Command{
 		instrs = append(instrs, 0x00, 0x00, 0x20, 0xd4) // brk #0
 
 		// Execute the function
-		execResult, err := emulateFunction(instrs, stackPtr, memSize)
+		execResult, err := emulateFunction(instrs, stackPtr, memSize, timeout)
 
 		// Create emulation result
 		emulateResult := &EmulateResult{
@@ -172,6 +178,7 @@ var emulateCmd = &cobra.Command{
 			emulateResult.State = execResult.State
 			emulateResult.ExitInfo = execResult.ExitInfo
 			emulateResult.Memory = execResult.Memory
+			emulateResult.Error = execResult.Error
 		}
 
 		if jsonOutput {
@@ -188,15 +195,19 @@ var emulateCmd = &cobra.Command{
 
 			// Print results
 			fmt.Printf("\n=== Execution Results ===\n")
-			fmt.Printf("Exit Reason: %v\n", execResult.ExitInfo.Reason)
+			fmt.Printf("Exit Reason: %v\n", execResult.ExitInfo)
+			if execResult.Error != "" {
+				fmt.Printf("Error: %s\n", execResult.Error)
+			}
 			fmt.Printf("Final SP: 0x%x (moved %d bytes)\n",
 				execResult.State.SP, int64(execResult.State.SP)-int64(stackPtr))
 
 			fmt.Printf("\nRegisters:\n")
 			fmt.Printf("  X0=0x%x  X1=0x%x  X2=0x%x  X3=0x%x\n",
-				execResult.State.X0, execResult.State.X1, execResult.State.X2, execResult.State.X3)
+				execResult.State.X[0], execResult.State.X[1], execResult.State.X[2], execResult.State.X[3])
 			fmt.Printf("  PC=0x%x  SP=0x%x  FP=0x%x  LR=0x%x\n",
-				execResult.State.PC, execResult.State.SP, execResult.State.FP, execResult.State.LR)
+				execResult.State.PC, execResult.State.SP,
+				execResult.State.Reg(hypervisor.RegFP), execResult.State.Reg(hypervisor.RegLR))
 
 			// Print stack contents
 			printStackContents(execResult.Memory, baseAddr, stackPtr, execResult.State.SP)
@@ -206,8 +217,12 @@ var emulateCmd = &cobra.Command{
 	},
 }
 
-// emulateFunction executes the function bytes and returns the result
-func emulateFunction(code []byte, stackPtr uint64, memSize int) (*ExecuteResult, error) {
+// cpsrEL1t is EL1 using SP_EL0 with DAIF masked.
+const cpsrEL1t = 0x3c4
+
+// emulateFunction executes the function bytes, for at most timeout if it is
+// nonzero, and returns the result
+func emulateFunction(code []byte, stackPtr uint64, memSize int, timeout time.Duration) (*ExecuteResult, error) {
 	// Create VM
 	vm, err := hypervisor.NewVM()
 	if err != nil {
@@ -222,29 +237,27 @@ func emulateFunction(code []byte, stackPtr uint64, memSize int) (*ExecuteResult,
 	}
 	defer vcpu.Close()
 
-	// Allocate memory
-	hostMem, err := unix.Mmap(-1, 0, memSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
-	if err != nil {
-		return nil, fmt.Errorf("failed to allocate memory: %w", err)
-	}
-	defer unix.Munmap(hostMem)
-
-	// Copy code to memory
-	if len(code) > len(hostMem) {
-		return nil, fmt.Errorf("code size (%d) exceeds memory size (%d)", len(code), len(hostMem))
+	if len(code) > memSize {
+		return nil, fmt.Errorf("code size (%d) exceeds memory size (%d)", len(code), memSize)
 	}
-	copy(hostMem, code)
 
-	// Map memory into guest
+	// Allocate and map guest memory
 	baseAddr := uint64(0x4000)
 	perms := hypervisor.MemRead | hypervisor.MemWrite | hypervisor.MemExec
-	err = vm.Map(hostMem, baseAddr, perms)
-	if err != nil {
+	if _, err := vm.AllocRegion(baseAddr, uint64(memSize), perms, hypervisor.AllocOptions{Label: "code"}); err != nil {
 		return nil, fmt.Errorf("failed to map memory: %w", err)
 	}
-	defer vm.Unmap(baseAddr, uint64(len(hostMem)))
 
-	// Set initial CPU state
+	// Copy code to memory
+	if _, err := vm.WriteAt(code, int64(baseAddr)); err != nil {
+		return nil, fmt.Errorf("failed to load code: %w", err)
+	}
+
+	// Set initial CPU state. Run at EL1t so that RegSP (SP_EL0) is the
+	// stack pointer the function actually uses.
+	if err := vcpu.SetReg(hypervisor.RegCPSR, cpsrEL1t); err != nil {
+		return nil, fmt.Errorf("failed to set CPSR: %w", err)
+	}
 	if err := vcpu.SetReg(hypervisor.RegSP, stackPtr); err != nil {
 		return nil, fmt.Errorf("failed to set SP: %w", err)
 	}
@@ -252,27 +265,33 @@ func emulateFunction(code []byte, stackPtr uint64, memSize int) (*ExecuteResult,
 		return nil, fmt.Errorf("failed to set PC: %w", err)
 	}
 
-	// Execute
-	exitInfo, err := vcpu.Run()
+	// Execute until the trailing BRK or any exit nothing handles
+	exitInfo, timedOut, err := runGuest(vcpu, timeout)
 	if err != nil {
 		return nil, fmt.Errorf("failed to execute: %w", err)
 	}
 
 	// Get final CPU state
-	finalState, err := getCPUState(vcpu)
+	finalState, err := vcpu.SaveState()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get final state: %w", err)
 	}
 
 	// Copy the memory for analysis
-	memCopy := make([]byte, len(hostMem))
-	copy(memCopy, hostMem)
+	memCopy := make([]byte, memSize)
+	if _, err := vm.ReadAt(memCopy, int64(baseAddr)); err != nil {
+		return nil, fmt.Errorf("failed to read memory: %w", err)
+	}
 
-	return &ExecuteResult{
+	result := &ExecuteResult{
 		State:    *finalState,
 		ExitInfo: exitInfo,
 		Memory:   map[string][]byte{fmt.Sprintf("0x%x", baseAddr): memCopy},
-	}, nil
+	}
+	if timedOut {
+		result.Error = fmt.Sprintf("execution timed out after %v", timeout)
+	}
+	return result, nil
 }
 
 // printStackContents displays the stack contents in a readable format
@@ -22,8 +22,10 @@ THE SOFTWARE.
 package cmd
 
 import (
+	"fmt"
 	"os"
 
+	"github.com/blacktop/go-hypervisor"
 	"github.com/spf13/cobra"
 )
 
@@ -46,3 +48,16 @@ func Execute() {
 		os.Exit(1)
 	}
 }
+
+// checkBackend verifies that the backend NewVM will use can run here. Only
+// Hypervisor.framework needs hardware support; the interpreter runs anywhere.
+func checkBackend() error {
+	if hypervisor.DefaultBackend() != "hvf" {
+		return nil
+	}
+	ok, err := hypervisor.Supported()
+	if err != nil || !ok {
+		return fmt.Errorf("hypervisor not supported: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+/*
+Copyright © 2025 blacktop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"os"
+
+	"github.com/blacktop/go-hypervisor/supervisor"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(workerCmd)
+}
+
+var workerCmd = &cobra.Command{
+	Use:   "worker",
+	Short: "Serve a supervisor over stdin and stdout",
+	Long: `Run one VM at a time on behalf of a supervisor.Pool in another process.
+Requests arrive as frames on stdin and responses are written to stdout, so
+the command prints nothing else there.`,
+	Hidden: true,
+	Args:   cobra.NoArgs,
+	RunE:   runWorker,
+}
+
+func runWorker(cmd *cobra.Command, args []string) error {
+	return supervisor.Serve(os.Stdin, os.Stdout)
+}
@@ -0,0 +1,394 @@
+package hypervisor
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"sync/atomic"
+)
+
+// DirtyBitmap reports which pages of a tracked range were written.
+type DirtyBitmap struct {
+	// GPA is the guest physical base address of the tracked range.
+	GPA uint64
+	// Size is the length of the tracked range in bytes.
+	Size uint64
+	// PageSize is the granularity of the bitmap.
+	PageSize uint64
+	// Bits has bit i%64 of Bits[i/64] set if page i of the range was
+	// written.
+	Bits []uint64
+}
+
+// Dirty reports whether the page containing gpa was written.
+func (b DirtyBitmap) Dirty(gpa uint64) bool {
+	if gpa < b.GPA || gpa-b.GPA >= b.Size {
+		return false
+	}
+	i := (gpa - b.GPA) / b.PageSize
+	return b.Bits[i/64]&(1<<(i%64)) != 0
+}
+
+// Count returns the number of dirty pages.
+func (b DirtyBitmap) Count() int {
+	n := 0
+	for _, w := range b.Bits {
+		n += bits.OnesCount64(w)
+	}
+	return n
+}
+
+// Pages returns the guest physical address of each dirty page in order.
+func (b DirtyBitmap) Pages() []uint64 {
+	pages := make([]uint64, 0, b.Count())
+	b.runs(func(gpa, size uint64) error {
+		for off := uint64(0); off < size; off += b.PageSize {
+			pages = append(pages, gpa+off)
+		}
+		return nil
+	})
+	return pages
+}
+
+// runs calls fn for each run of consecutive dirty pages, stopping at the
+// first error.
+func (b DirtyBitmap) runs(fn func(gpa, size uint64) error) error {
+	n := b.Size / b.PageSize
+	for i := uint64(0); i < n; {
+		if b.Bits[i/64]&(1<<(i%64)) == 0 {
+			i++
+			continue
+		}
+		j := i + 1
+		for j < n && b.Bits[j/64]&(1<<(j%64)) != 0 {
+			j++
+		}
+		if err := fn(b.GPA+i*b.PageSize, (j-i)*b.PageSize); err != nil {
+			return err
+		}
+		i = j
+	}
+	return nil
+}
+
+// dirtyRange is a guest physical range whose writes are tracked. Its
+// bitmaps are set with atomic operations, so writers holding the region
+// table's read lock may mark pages; clearing them needs the write lock.
+//
+// bits serves CollectDirty and reset serves Reset. Every write sets both,
+// and the backend only grants write access to a page once the guest has
+// dirtied it, so clearing a page's bit in either bitmap must write-protect
+// the page again.
+type dirtyRange struct {
+	gpa, size uint64
+	bits      []uint64 // one bit per page, since the last CollectDirty
+	reset     []uint64 // one bit per page, since the last Checkpoint or Reset
+}
+
+func newDirtyRange(gpa, size uint64) *dirtyRange {
+	pages := size / uint64(pageSize())
+	words := (pages + 63) / 64
+	return &dirtyRange{gpa: gpa, size: size, bits: make([]uint64, words), reset: make([]uint64, words)}
+}
+
+func (d *dirtyRange) end() uint64 { return d.gpa + d.size }
+
+// slice returns a range tracking [lo, hi) of d, with the pages' bits copied
+// from d. The bounds are page-aligned and within d.
+func (d *dirtyRange) slice(lo, hi uint64) *dirtyRange {
+	s := newDirtyRange(lo, hi-lo)
+	page := uint64(pageSize())
+	first := (lo - d.gpa) / page
+	for i := uint64(0); i < s.size/page; i++ {
+		j := first + i
+		s.bits[i/64] |= (atomic.LoadUint64(&d.bits[j/64]) >> (j % 64) & 1) << (i % 64)
+		s.reset[i/64] |= (atomic.LoadUint64(&d.reset[j/64]) >> (j % 64) & 1) << (i % 64)
+	}
+	return s
+}
+
+// mark records writes to the pages overlapping [lo, hi).
+func (d *dirtyRange) mark(lo, hi uint64) {
+	lo, hi = max(lo, d.gpa), min(hi, d.end())
+	if lo >= hi {
+		return
+	}
+	page := uint64(pageSize())
+	for i := (lo - d.gpa) / page; i <= (hi-1-d.gpa)/page; i++ {
+		atomic.OrUint64(&d.bits[i/64], 1<<(i%64))
+		atomic.OrUint64(&d.reset[i/64], 1<<(i%64))
+	}
+}
+
+// bitmap returns the bitmap CollectDirty reports.
+func (d *dirtyRange) bitmap() DirtyBitmap {
+	return DirtyBitmap{GPA: d.gpa, Size: d.size, PageSize: uint64(pageSize()), Bits: d.bits}
+}
+
+// resetBitmap returns the pages written since the last Checkpoint or Reset.
+func (d *dirtyRange) resetBitmap() DirtyBitmap {
+	b := d.bitmap()
+	b.Bits = d.reset
+	return b
+}
+
+// trackedLocked returns the tracked range containing gpa, or nil.
+func (t *regionTable) trackedLocked(gpa uint64) *dirtyRange {
+	for _, d := range t.dirty {
+		if gpa >= d.gpa && gpa < d.end() {
+			return d
+		}
+	}
+	return nil
+}
+
+// markDirtyLocked records a host write to [gpa, gpa+size). The caller holds
+// at least the read lock.
+func (t *regionTable) markDirtyLocked(gpa, size uint64) {
+	for _, d := range t.dirty {
+		d.mark(gpa, gpa+size)
+	}
+}
+
+// EnableDirtyTracking starts recording which pages of r are written, by the
+// guest or through WriteAt. Only r's GPA and Size are used; the range must
+// be page-aligned, mapped, and not already tracked. Writes through slices
+// returned by Slice are not seen.
+//
+// Tracking write-protects the range behind the region table's back: the
+// guest's first write to each page faults, is recorded, and resumes once
+// the page is writable again, without reaching the permission fault
+// handler. Regions reports the permissions set with Map and Protect.
+//
+// Unmapping part of a tracked range stops tracking that part only. The rest
+// stays tracked as one or two ranges, split around the hole, which
+// CollectDirty reports separately and DisableDirtyTracking takes by their
+// own GPA.
+func (vm *VM) EnableDirtyTracking(r Region) error {
+	if err := vm.enableDirtyTracking(r.GPA, r.Size); err != nil {
+		return &OpError{Op: "enable dirty tracking", GPA: r.GPA, Size: r.Size, Err: err}
+	}
+	return nil
+}
+
+func (vm *VM) enableDirtyTracking(gpa, size uint64) error {
+	if vm == nil {
+		return errVMNil
+	}
+
+	// Security: Lock to keep Close from tearing the VM down meanwhile
+	vm.closeMu.Lock()
+	defer vm.closeMu.Unlock()
+
+	if vm.closed {
+		return ErrVMClosed
+	}
+	if size == 0 {
+		return fmt.Errorf("hv: zero size")
+	}
+
+	// Security: Prevent integer overflow vulnerabilities
+	if gpa > math.MaxUint64-size {
+		vm.metrics.recordSecurityError()
+		return errRangeOverflow
+	}
+
+	// Performance: Fast alignment checks using cached masks
+	if !isPageAligned(gpa) {
+		return fmt.Errorf("%w: guestPhys 0x%x (page size: %d)", ErrInvalidAlignment, gpa, pageSize())
+	}
+	if !isPageAligned(size) {
+		return fmt.Errorf("%w: size %d (page size: %d)", ErrInvalidAlignment, size, pageSize())
+	}
+
+	vm.regions.mu.Lock()
+	defer vm.regions.mu.Unlock()
+
+	if !vm.regions.coveredLocked(gpa, size) {
+		return ErrMemoryNotMapped
+	}
+	for _, d := range vm.regions.dirty {
+		if d.gpa < gpa+size && gpa < d.end() {
+			return fmt.Errorf("hv: range overlaps tracked range 0x%x-0x%x", d.gpa, d.end())
+		}
+	}
+	if err := vm.writeProtectLocked(gpa, size); err != nil {
+		vm.restoreWriteLocked(gpa, size)
+		return err
+	}
+	vm.regions.dirty = append(vm.regions.dirty, newDirtyRange(gpa, size))
+	return nil
+}
+
+// DisableDirtyTracking stops tracking the range started at r.GPA and gives
+// the guest back write access to it.
+func (vm *VM) DisableDirtyTracking(r Region) error {
+	if err := vm.disableDirtyTracking(r.GPA); err != nil {
+		return &OpError{Op: "disable dirty tracking", GPA: r.GPA, Size: r.Size, Err: err}
+	}
+	return nil
+}
+
+func (vm *VM) disableDirtyTracking(gpa uint64) error {
+	if vm == nil {
+		return errVMNil
+	}
+
+	// Security: Lock to keep Close from tearing the VM down meanwhile
+	vm.closeMu.Lock()
+	defer vm.closeMu.Unlock()
+
+	if vm.closed {
+		return ErrVMClosed
+	}
+
+	vm.regions.mu.Lock()
+	defer vm.regions.mu.Unlock()
+
+	for i, d := range vm.regions.dirty {
+		if d.gpa != gpa {
+			continue
+		}
+		vm.regions.dirty = append(vm.regions.dirty[:i], vm.regions.dirty[i+1:]...)
+		// Writes to the range are no longer seen, so the next Reset
+		// cannot copy only the pages written since the checkpoint.
+		vm.baseline = nil
+		return vm.restoreWriteLocked(d.gpa, d.size)
+	}
+	return fmt.Errorf("hv: no tracked range at 0x%x", gpa)
+}
+
+// CollectDirty returns a bitmap per tracked range of the pages written
+// since tracking was enabled or the previous CollectDirty, in the order the
+// ranges were enabled. The bitmaps are reset atomically: a guest write on
+// any vCPU is reported by exactly one call.
+func (vm *VM) CollectDirty() ([]DirtyBitmap, error) {
+	maps, err := vm.collectDirty()
+	if err != nil {
+		return nil, &OpError{Op: "collect dirty", Err: err}
+	}
+	return maps, nil
+}
+
+func (vm *VM) collectDirty() ([]DirtyBitmap, error) {
+	if vm == nil {
+		return nil, errVMNil
+	}
+
+	// Security: Lock to keep Close from tearing the VM down meanwhile
+	vm.closeMu.Lock()
+	defer vm.closeMu.Unlock()
+
+	if vm.closed {
+		return nil, ErrVMClosed
+	}
+
+	// Faulting vCPUs wait for the lock, so no write lands between
+	// re-protecting a page and resetting its bit.
+	vm.regions.mu.Lock()
+	defer vm.regions.mu.Unlock()
+
+	for _, d := range vm.regions.dirty {
+		if err := d.bitmap().runs(vm.writeProtectLocked); err != nil {
+			return nil, err
+		}
+	}
+	maps := make([]DirtyBitmap, 0, len(vm.regions.dirty))
+	for _, d := range vm.regions.dirty {
+		maps = append(maps, d.bitmap())
+		d.bits = make([]uint64, len(d.bits))
+	}
+	return maps, nil
+}
+
+// writeProtectLocked removes the backend's write access to the writable
+// regions in [gpa, gpa+size), leaving the region table as it is.
+func (vm *VM) writeProtectLocked(gpa, size uint64) error {
+	return vm.reprotectLocked(gpa, size, func(p MemPerm) MemPerm { return p &^ MemWrite })
+}
+
+// restoreWriteLocked gives the backend back the region table's permissions
+// for the writable regions in [gpa, gpa+size).
+func (vm *VM) restoreWriteLocked(gpa, size uint64) error {
+	return vm.reprotectLocked(gpa, size, func(p MemPerm) MemPerm { return p })
+}
+
+func (vm *VM) reprotectLocked(gpa, size uint64, perms func(MemPerm) MemPerm) error {
+	return vm.eachBackedLocked(gpa, size, func(r Region, gpa, size uint64) error {
+		if r.Perms&MemWrite == 0 {
+			return nil
+		}
+		if err := vm.backend.Protect(gpa, size, perms(r.Perms)); err != nil {
+			vm.metrics.recordResourceError()
+			return err
+		}
+		return nil
+	})
+}
+
+// protectTrackedLocked write-protects the tracked pages in [gpa, gpa+size)
+// again after Protect has granted write access to them.
+func (vm *VM) protectTrackedLocked(gpa, size uint64) error {
+	for _, d := range vm.regions.dirty {
+		lo, hi := max(d.gpa, gpa), min(d.end(), gpa+size)
+		if lo >= hi {
+			continue
+		}
+		if err := vm.writeProtectLocked(lo, hi-lo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// untrackLocked stops tracking [gpa, gpa+size), which has just been
+// unmapped. A tracked range overlapping it is trimmed to the part still
+// mapped, or split in two around it, keeping the bits of the pages left.
+func (vm *VM) untrackLocked(gpa, size uint64) {
+	var kept []*dirtyRange
+	for _, d := range vm.regions.dirty {
+		if d.end() <= gpa || d.gpa >= gpa+size {
+			kept = append(kept, d)
+			continue
+		}
+		if d.gpa < gpa {
+			kept = append(kept, d.slice(d.gpa, gpa))
+		}
+		if end := gpa + size; end < d.end() {
+			kept = append(kept, d.slice(end, d.end()))
+		}
+	}
+	vm.regions.dirty = kept
+}
+
+// handleDirtyFault records a guest write that faulted only because its page
+// is tracked, and makes the page writable again, reporting whether it did.
+// It is only called from the goroutine running the vCPU.
+func (c *VCPU) handleDirtyFault(info ExitInfo) (bool, error) {
+	da, ok := info.DataAbort()
+	if !ok || !da.DFSC.IsPermission() || !da.WnR || da.CM {
+		return false, nil
+	}
+
+	vm := c.vm
+	vm.regions.mu.Lock()
+	defer vm.regions.mu.Unlock()
+
+	d := vm.regions.trackedLocked(info.IPA)
+	if d == nil {
+		return false, nil
+	}
+	r, ok := vm.regions.lookupLocked(info.IPA)
+	if !ok || r.Perms&MemWrite == 0 {
+		// Protect denied the write; that fault is the caller's.
+		return false, nil
+	}
+	page := uint64(pageSize())
+	gpa := info.IPA &^ (page - 1)
+	d.mark(gpa, gpa+page)
+	if err := vm.backend.Protect(gpa, page, r.Perms); err != nil {
+		vm.metrics.recordResourceError()
+		return false, fmt.Errorf("hv: failed to restore write access to dirty page 0x%x: %w", gpa, err)
+	}
+	return true, nil
+}
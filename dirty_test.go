@@ -0,0 +1,211 @@
+package hypervisor
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestDirtyTracking(t *testing.T) {
+	vm, vcpu, data := newInterpVM(t,
+		0xD2800540, // movz x0, #0x2a
+		0xD2A00201, // movz x1, #0x10, lsl #16 (x1 = interpDataGPA)
+		0xF9000020, // str  x0, [x1]
+		0xD4200000, // brk  #0
+	)
+	page := uint64(pageSize())
+	data2 := alignedBuffer(t, int(2*page))
+	if err := vm.Map(data2, interpDataGPA+page, MemRead|MemWrite); err != nil {
+		t.Fatal(err)
+	}
+	tracked := Region{GPA: interpDataGPA, Size: 3 * page}
+	if err := vm.EnableDirtyTracking(tracked); err != nil {
+		t.Fatalf("EnableDirtyTracking failed: %v", err)
+	}
+	regions := vm.Regions()
+
+	var faults int
+	vm.SetPermissionFaultHandler(func(*VCPU, PermissionFault) bool {
+		faults++
+		return false
+	})
+
+	run := func() {
+		t.Helper()
+		if err := vcpu.SetPC(interpCodeGPA); err != nil {
+			t.Fatal(err)
+		}
+		info, err := vcpu.Run()
+		if err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		if info.Class() != ECBRK {
+			t.Fatalf("exit = %v, want BRK", info)
+		}
+	}
+	collect := func() DirtyBitmap {
+		t.Helper()
+		maps, err := vm.CollectDirty()
+		if err != nil {
+			t.Fatalf("CollectDirty failed: %v", err)
+		}
+		if len(maps) != 1 || maps[0].GPA != tracked.GPA || maps[0].Size != tracked.Size {
+			t.Fatalf("CollectDirty = %+v, want one bitmap for %v", maps, tracked)
+		}
+		return maps[0]
+	}
+
+	run()
+	if data[0] != 0x2a {
+		t.Errorf("data[0] = 0x%x, want 0x2a", data[0])
+	}
+	if faults != 0 {
+		t.Errorf("permission fault handler called %d times, want 0", faults)
+	}
+	if got := vm.Regions(); !reflect.DeepEqual(got, regions) {
+		t.Errorf("Regions = %v, want %v", got, regions)
+	}
+
+	// Host writes are recorded too, and each write is reported once.
+	if _, err := vm.WriteAt([]byte{1}, int64(interpDataGPA+2*page+8)); err != nil {
+		t.Fatal(err)
+	}
+	b := collect()
+	if got, want := b.Pages(), []uint64{interpDataGPA, interpDataGPA + 2*page}; !reflect.DeepEqual(got, want) {
+		t.Errorf("dirty pages = %#x, want %#x", got, want)
+	}
+	if !b.Dirty(interpDataGPA+8) || b.Dirty(interpDataGPA+page) {
+		t.Errorf("Dirty reports the wrong pages: %+v", b)
+	}
+	if n := collect().Count(); n != 0 {
+		t.Errorf("second CollectDirty found %d dirty pages, want 0", n)
+	}
+
+	// Collecting write-protects the pages again.
+	run()
+	if got := collect().Pages(); !reflect.DeepEqual(got, []uint64{interpDataGPA}) {
+		t.Errorf("dirty pages after rerun = %#x, want [0x%x]", got, interpDataGPA)
+	}
+
+	// A write Protect denies still reaches the handler.
+	if err := vm.Protect(interpDataGPA, page, MemRead); err != nil {
+		t.Fatal(err)
+	}
+	if err := vcpu.SetPC(interpCodeGPA); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := vcpu.Run(); err != nil || info.Class() != ECDataAbortLower {
+		t.Errorf("Run = %v, %v; want a data abort", info, err)
+	}
+	if faults != 1 {
+		t.Errorf("permission fault handler called %d times, want 1", faults)
+	}
+	if err := vm.Protect(interpDataGPA, page, MemRead|MemWrite); err != nil {
+		t.Fatal(err)
+	}
+	run()
+	if n := collect().Count(); n != 1 {
+		t.Errorf("dirty pages after Protect = %d, want 1", n)
+	}
+
+	if err := vm.DisableDirtyTracking(tracked); err != nil {
+		t.Fatalf("DisableDirtyTracking failed: %v", err)
+	}
+	run()
+	if maps, err := vm.CollectDirty(); err != nil || len(maps) != 0 {
+		t.Errorf("CollectDirty after disable = %v, %v; want none", maps, err)
+	}
+}
+
+func TestDirtyTrackingErrors(t *testing.T) {
+	page := uint64(pageSize())
+	const base = 0x200000
+
+	tests := []struct {
+		name    string
+		region  Region
+		wantErr error
+	}{
+		{"unmapped", Region{GPA: base + 4*page, Size: page}, ErrMemoryNotMapped},
+		{"partly unmapped", Region{GPA: base + 3*page, Size: 2 * page}, ErrMemoryNotMapped},
+		{"unaligned", Region{GPA: base + 1, Size: page}, ErrInvalidAlignment},
+		{"overlaps tracked", Region{GPA: base, Size: page}, errAny},
+		{"zero size", Region{GPA: base + 2*page}, errAny},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm, _ := newFakeVM(t)
+			if err := vm.Map(alignedBuffer(t, int(4*page)), base, MemRead|MemWrite); err != nil {
+				t.Fatal(err)
+			}
+			if err := vm.EnableDirtyTracking(Region{GPA: base, Size: 2 * page}); err != nil {
+				t.Fatal(err)
+			}
+
+			err := vm.EnableDirtyTracking(tt.region)
+			if err == nil {
+				t.Fatal("EnableDirtyTracking succeeded, want an error")
+			}
+			if tt.wantErr != errAny && !errors.Is(err, tt.wantErr) {
+				t.Errorf("EnableDirtyTracking error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDirtyTrackingUnmap(t *testing.T) {
+	vm, backend := newFakeVM(t)
+	page := uint64(pageSize())
+	const base = 0x200000
+	if err := vm.Map(alignedBuffer(t, int(4*page)), base, MemRead|MemWrite); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.EnableDirtyTracking(Region{GPA: base, Size: 4 * page}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vm.WriteAt([]byte{1}, int64(base+3*page)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unmapping the second page splits the range around it.
+	if err := vm.Unmap(base+page, page); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vm.WriteAt([]byte{1}, base); err != nil {
+		t.Fatal(err)
+	}
+	maps, err := vm.CollectDirty()
+	if err != nil {
+		t.Fatalf("CollectDirty failed: %v", err)
+	}
+	want := []struct{ gpa, size, dirty uint64 }{
+		{base, page, base},
+		{base + 2*page, 2 * page, base + 3*page},
+	}
+	if len(maps) != len(want) {
+		t.Fatalf("CollectDirty after Unmap = %d bitmaps, want %d", len(maps), len(want))
+	}
+	for i, w := range want {
+		if got := maps[i]; got.GPA != w.gpa || got.Size != w.size || !reflect.DeepEqual(got.Pages(), []uint64{w.dirty}) {
+			t.Errorf("bitmap %d = 0x%x+0x%x dirty %#x, want 0x%x+0x%x dirty [0x%x]",
+				i, got.GPA, got.Size, got.Pages(), w.gpa, w.size, w.dirty)
+		}
+	}
+	for _, m := range backend.Mappings() {
+		if m.Perms != MemRead {
+			t.Errorf("tracked page 0x%x perms = %v, want r--", m.GuestPhys, m.Perms)
+		}
+	}
+
+	// Each piece is disabled by its own GPA.
+	for _, w := range want {
+		if err := vm.DisableDirtyTracking(Region{GPA: w.gpa}); err != nil {
+			t.Fatalf("DisableDirtyTracking(0x%x) failed: %v", w.gpa, err)
+		}
+	}
+	for _, m := range backend.Mappings() {
+		if m.Perms != MemRead|MemWrite {
+			t.Errorf("untracked page 0x%x perms = %v, want rw-", m.GuestPhys, m.Perms)
+		}
+	}
+}
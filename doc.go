@@ -48,6 +48,63 @@
 //	}
 //	defer vm.Unmap(guestPhys, uint64(len(hostMem)))
 //
+// The VM remembers every mapping. Regions lists them, overlapping maps are
+// rejected, and ReadAt, WriteAt and Slice access guest memory by guest
+// physical address, returning ErrMemoryNotMapped for holes:
+//
+//	_, err = vm.WriteAt(code, int64(guestPhys))
+//
+// AllocRegion allocates and maps the host memory itself, optionally between
+// guard pages the guest cannot access, and frees it once it is unmapped or
+// the VM is closed:
+//
+//	stack, err := vm.AllocRegion(0x80000, 0x10000, hypervisor.MemRead|hypervisor.MemWrite,
+//		hypervisor.AllocOptions{Label: "stack", GuardPages: 1})
+//
+// Regions may be larger than 4 GiB. A Sparse allocation only reserves its
+// range: each page is backed the first time the guest or WriteAt touches
+// it, and Regions and Metrics report the bytes committed so far next to the
+// bytes mapped, so a guest can be given a huge address space cheaply:
+//
+//	ram, err := vm.AllocRegion(0x40000000, 64<<30, hypervisor.MemRead|hypervisor.MemWrite,
+//		hypervisor.AllocOptions{Label: "ram", Sparse: true})
+//
+// With a PageProvider the region is demand-paged: the first access to each
+// page, by the guest or by ReadAt and WriteAt, calls Fetch for its contents
+// and resumes, so a multi-gigabyte dump costs only the pages a run uses:
+//
+//	dump, err := vm.AllocRegion(0x40000000, 64<<30, hypervisor.MemRead|hypervisor.MemWrite,
+//		hypervisor.AllocOptions{Label: "dump", Provider: pages})
+//
+// MapFile maps a file, such as firmware, a kernel image or a memory dump,
+// without copying it. The mapping is copy-on-write unless shared, in which
+// case guest writes land in the file:
+//
+//	kernel, err := vm.MapFile(f, 0, 0x80000, size, hypervisor.MemRead|hypervisor.MemExec, false)
+//
+// Protect changes the permissions of mapped memory, splitting regions as
+// needed. Accesses the permissions deny are passed to the handler set with
+// SetPermissionFaultHandler, which can grant them and resume the guest,
+// enough to build W^X policies, guard pages or page access monitors:
+//
+//	vm.SetPermissionFaultHandler(func(_ *hypervisor.VCPU, f hypervisor.PermissionFault) bool {
+//		log.Printf("%v access to %v", f.Access, f.Region)
+//		return false // return the abort from Run
+//	})
+//	err = vm.Protect(guestPhys, 4096, hypervisor.MemRead)
+//
+// EnableDirtyTracking records which pages of a range the guest or WriteAt
+// writes, transparently to the guest and to the permission fault handler.
+// CollectDirty returns and resets a bitmap per tracked range, for
+// incremental snapshots or resetting only the memory a run touched:
+//
+//	err = vm.EnableDirtyTracking(region)
+//	_, err = vcpu.Run()
+//	dirty, err := vm.CollectDirty()
+//	for _, gpa := range dirty[0].Pages() {
+//		// ...
+//	}
+//
 // Register access and execution:
 //
 //	// Set program counter to start execution
@@ -65,7 +122,11 @@
 //	// Handle exit reason
 //	switch exitInfo.Reason {
 //	case hypervisor.ExitException:
-//		fmt.Printf("Guest exception: ESR=0x%x FAR=0x%x\n", exitInfo.ESR, exitInfo.FAR)
+//		if brk, ok := exitInfo.Breakpoint(); ok {
+//			fmt.Printf("Guest hit BRK #%d\n", brk.Comment)
+//		} else {
+//			fmt.Printf("Guest exception: %v\n", exitInfo)
+//		}
 //	case hypervisor.ExitUnknown:
 //		fmt.Println("Unknown exit reason")
 //	}
@@ -77,20 +138,191 @@
 //	}
 //	fmt.Printf("X0 register: 0x%x\n", x0)
 //
+// Beyond the general purpose registers, GetSIMD/SetSIMD access Q0-Q31
+// (FPCR and FPSR are ordinary Reg values) and GetSysReg/SetSysReg access
+// the EL1 system registers listed by SysRegs, such as the translation
+// controls built by the pagetable package:
+//
+//	vcpu.SetSysReg(hypervisor.SysTTBR0_EL1, regs.TTBR0)
+//	vcpu.SetSysReg(hypervisor.SysTCR_EL1, regs.TCR)
+//
+// ParseReg, ParseSIMDReg and ParseSysReg accept register names such as
+// "x0", "q3" and "vbar_el1".
+//
+// SaveState captures all of these into a CPUState, and RestoreState loads
+// one into the same or another vCPU. CPUState round-trips through JSON and
+// a compact binary form, both versioned:
+//
+//	state, err := vcpu.SaveState()
+//	data, err := state.MarshalBinary()
+//	err = other.RestoreState(state)
+//
+// # Run Loop
+//
+// RunLoop re-enters the guest after each exit until a handler stops it,
+// dispatching exceptions by class. Handlers resume, skip the trapping
+// instruction, or stop:
+//
+//	res, err := vcpu.RunLoop(ctx, hypervisor.Handlers{
+//		hypervisor.ECHVC: func(v *hypervisor.VCPU, info hypervisor.ExitInfo) (hypervisor.Action, error) {
+//			return hypervisor.ActionResume, v.SetReg(hypervisor.RegX0, 0)
+//		},
+//		hypervisor.ECBRK: func(*hypervisor.VCPU, hypervisor.ExitInfo) (hypervisor.Action, error) {
+//			return hypervisor.ActionStop, nil
+//		},
+//	})
+//
+// RunContext and RunLoop force the guest out when their context is done, so
+// a deadline bounds even a guest stuck in a loop. The interrupted run
+// returns an ExitCanceled exit with registers consistent for resuming:
+//
+//	ctx, cancel := context.WithTimeout(ctx, time.Second)
+//	defer cancel()
+//	exitInfo, err := vcpu.RunContext(ctx)
+//
+// While a vCPU runs, its register accessors return ErrVCPURunning; Close
+// interrupts the run before destroying the vCPU.
+//
+// # Interrupts
+//
+// SetPendingInterrupt raises or lowers a vCPU's IRQ or FIQ line, even while
+// it runs; the guest takes a raised line through its VBAR_EL1 vectors once
+// it unmasks it. When the virtual timer fires, Run returns an ExitTimer
+// exit and the timer stays masked. SyncVTimer, called after each exit,
+// raises IRQ while the timer is asserted and re-arms it once the guest has
+// handled it:
+//
+//	for {
+//		exitInfo, err := vcpu.Run()
+//		if err != nil {
+//			return err
+//		}
+//		if _, err := vcpu.SyncVTimer(); err != nil {
+//			return err
+//		}
+//		if exitInfo.Reason != hypervisor.ExitTimer {
+//			// handle the exit
+//		}
+//	}
+//
+// The line is only lowered between runs, so a handler should exit, for
+// example through WFI or an MMIO access, once it has quietened the timer.
+//
+// # MMIO
+//
+// RegisterMMIO attaches a Device to an unmapped guest physical range. Run
+// completes the guest's loads and stores to it by calling Device.Read or
+// Device.Write, updating the target register and advancing PC; only exits
+// the bus cannot service are returned to the caller. Accesses the hardware
+// does not describe in the syndrome, such as LDP/STP and pre/post-indexed
+// forms, are decoded from the instruction at PC and replayed in software,
+// including base register writeback:
+//
+//	err = vm.RegisterMMIO(0x9000000, 0x1000, uart)
+//
+// # Snapshots
+//
+// Snapshot writes every mapped region (with its GPA, permissions and label)
+// and the state of every vCPU to an io.Writer, leaving all-zero pages out.
+// RestoreVM reads it back into a new VM, possibly in another process, with
+// memory the VM owns and frees once unmapped. The restored vCPUs are
+// returned by VCPUs; MMIO devices must be registered again:
+//
+//	err = vm.Snapshot(f)
+//	vm2, err := hypervisor.RestoreVM(f)
+//	vcpu := vm2.VCPUs()[0]
+//
+// For running many inputs through one VM, Checkpoint captures the vCPUs
+// and memory in process, and Reset returns to it by copying back only the
+// pages written since, found with dirty tracking:
+//
+//	cp, err := vm.Checkpoint()
+//	for _, input := range inputs {
+//		_, err = vm.WriteAt(input, inputGPA)
+//		exitInfo, err = vcpu.Run()
+//		err = vm.Reset(cp)
+//	}
+//
+// # Metrics
+//
+// Every VM and vCPU counts its operations, errors, exits by reason and
+// exception class, and mapped and committed bytes, with latency histograms for Run, Map
+// and VM creation. VM.Metrics includes the VM's vCPUs and GetMetrics
+// aggregates the whole process. WritePrometheus renders all of them in the
+// Prometheus text format, labeled by vm and vcpu, and PublishExpvar exposes
+// the aggregate through expvar:
+//
+//	hypervisor.PublishExpvar("hypervisor")
+//	err = hypervisor.WritePrometheus(w)
+//
+// # Observers
+//
+// An Observer is told about VM and vCPU creation and destruction, Map and
+// Unmap, register writes and each run's start and exit. AddObserver attaches
+// one to a VM; RegisterObserver attaches one to every VM created afterwards.
+// Embed NopObserver to handle only some events:
+//
+//	type execAudit struct{ hypervisor.NopObserver }
+//
+//	func (execAudit) Mapped(vm *hypervisor.VM, r hypervisor.Region) {
+//		if r.Perms&hypervisor.MemExec != 0 {
+//			log.Printf("executable mapping %v", r)
+//		}
+//	}
+//
+//	remove := vm.AddObserver(execAudit{})
+//
 // # Error Handling
 //
-// All errors implement the standard Go error interface. Hypervisor-specific
-// errors are wrapped in HVError types with Apple Hypervisor.framework
-// error codes.
+// VM and VCPU methods return an *OpError naming the operation and, where
+// one is involved, the guest physical range or register. It wraps the
+// cause, so errors.Is matches sentinels such as ErrVMClosed and
+// ErrMemoryNotMapped, and matches Hypervisor.framework failures by code
+// through HVError:
+//
+//	err := vm.Map(host, gpa, perms)
+//	var opErr *hypervisor.OpError
+//	if errors.As(err, &opErr) {
+//		log.Printf("%s at 0x%x failed", opErr.Op, opErr.GPA)
+//	}
+//	if errors.Is(err, hypervisor.HVError{Code: hypervisor.HV_NO_RESOURCES}) {
+//		// retry later
+//	}
+//
+// With HV_ENV=production, messages leave out addresses, register names and
+// hints.
 //
 // # Resource Management
 //
 // All resources (VMs and vCPUs) must be explicitly closed using Close().
-// Finalizers provide safety net cleanup. Only one VM can exist per process.
+// Finalizers provide safety net cleanup. Only one VM can exist per process;
+// the supervisor package runs VMs in worker processes to have more.
+//
+// Hypervisor.framework binds a vCPU to the OS thread that created it. Each
+// VCPU therefore owns a goroutine locked to its own thread and executes all
+// of its calls there, so a VCPU can be used from any goroutine and separate
+// vCPUs can run in parallel. Close stops that goroutine.
+//
+// # Backends
+//
+// VM and VCPU delegate to a Backend selected by name. The "hvf" backend wraps
+// Hypervisor.framework and is the default on Darwin ARM64. The "interp"
+// backend executes guest code with a pure-Go AArch64 interpreter (integer,
+// branch, load/store, system and basic SIMD register instructions at EL1
+// with the MMU off) and is the default everywhere else. Its exits carry the
+// same ESR/FAR encoding as the hardware. The "fake" backend keeps mappings
+// and registers in memory and replays queued exits, so code built on this
+// package can be exercised on any platform:
+//
+//	vm, err := hypervisor.NewVMWithBackend("fake")
+//
+// NewVM honors the HV_BACKEND environment variable, and RegisterBackend
+// makes additional backends available.
 //
 // # Platform Support
 //
-// Darwin ARM64 only (Apple Silicon). Other platforms return "not supported" errors.
+// Hypervisor.framework requires Darwin ARM64 (Apple Silicon). On other
+// platforms Supported reports false and NewVM uses the interpreter.
 //
 // # Code Signing and Entitlements
 //
@@ -11,44 +11,6 @@ import (
 	"time"
 )
 
-// CPUState matches the structure in cmd/hv/cmd/execute.go
-type CPUState struct {
-	X0   uint64 `json:"x0"`
-	X1   uint64 `json:"x1"`
-	X2   uint64 `json:"x2"`
-	X3   uint64 `json:"x3"`
-	X4   uint64 `json:"x4"`
-	X5   uint64 `json:"x5"`
-	X6   uint64 `json:"x6"`
-	X7   uint64 `json:"x7"`
-	X8   uint64 `json:"x8"`
-	X9   uint64 `json:"x9"`
-	X10  uint64 `json:"x10"`
-	X11  uint64 `json:"x11"`
-	X12  uint64 `json:"x12"`
-	X13  uint64 `json:"x13"`
-	X14  uint64 `json:"x14"`
-	X15  uint64 `json:"x15"`
-	X16  uint64 `json:"x16"`
-	X17  uint64 `json:"x17"`
-	X18  uint64 `json:"x18"`
-	X19  uint64 `json:"x19"`
-	X20  uint64 `json:"x20"`
-	X21  uint64 `json:"x21"`
-	X22  uint64 `json:"x22"`
-	X23  uint64 `json:"x23"`
-	X24  uint64 `json:"x24"`
-	X25  uint64 `json:"x25"`
-	X26  uint64 `json:"x26"`
-	X27  uint64 `json:"x27"`
-	X28  uint64 `json:"x28"`
-	FP   uint64 `json:"fp"`
-	LR   uint64 `json:"lr"`
-	SP   uint64 `json:"sp"`
-	PC   uint64 `json:"pc"`
-	CPSR uint64 `json:"cpsr"`
-}
-
 // ExecuteResult matches the structure in cmd/hv/cmd/execute.go
 type ExecuteResult struct {
 	State    CPUState          `json:"state"`
@@ -178,10 +140,7 @@ func TestHypervisorTester(t *testing.T) {
 		// mov x0, #0x42; brk #0
 		code := []byte{0x40, 0x08, 0x80, 0xd2, 0x00, 0x00, 0x20, 0xd4}
 
-		initialState := &CPUState{
-			X0: 100, // Set initial value
-			X1: 200,
-		}
+		initialState := &CPUState{X: [31]uint64{0: 100, 1: 200}}
 
 		finalState, err := tester.ExecuteInstruction(initialState, code)
 		if err != nil {
@@ -189,14 +148,14 @@ func TestHypervisorTester(t *testing.T) {
 		}
 
 		// Verify results
-		if finalState.X0 != 0x42 {
-			t.Errorf("Expected X0=0x42, got X0=0x%x", finalState.X0)
+		if finalState.X[0] != 0x42 {
+			t.Errorf("Expected X0=0x42, got X0=0x%x", finalState.X[0])
 		}
-		if finalState.X1 != 200 {
-			t.Errorf("Expected X1=200 (unchanged), got X1=%d", finalState.X1)
+		if finalState.X[1] != 200 {
+			t.Errorf("Expected X1=200 (unchanged), got X1=%d", finalState.X[1])
 		}
 
-		t.Logf("Final state: X0=0x%x, X1=%d", finalState.X0, finalState.X1)
+		t.Logf("Final state: X0=0x%x, X1=%d", finalState.X[0], finalState.X[1])
 	})
 
 	// Test 2: ADD instruction
@@ -204,10 +163,7 @@ func TestHypervisorTester(t *testing.T) {
 		// add x0, x1, x2; brk #0
 		code := []byte{0x20, 0x00, 0x02, 0x8b, 0x00, 0x00, 0x20, 0xd4}
 
-		initialState := &CPUState{
-			X1: 10,
-			X2: 20,
-		}
+		initialState := &CPUState{X: [31]uint64{1: 10, 2: 20}}
 
 		finalState, err := tester.ExecuteInstruction(initialState, code)
 		if err != nil {
@@ -215,11 +171,11 @@ func TestHypervisorTester(t *testing.T) {
 		}
 
 		expected := uint64(30) // 10 + 20
-		if finalState.X0 != expected {
-			t.Errorf("Expected X0=%d, got X0=%d", expected, finalState.X0)
+		if finalState.X[0] != expected {
+			t.Errorf("Expected X0=%d, got X0=%d", expected, finalState.X[0])
 		}
 
-		t.Logf("ADD result: %d + %d = %d", initialState.X1, initialState.X2, finalState.X0)
+		t.Logf("ADD result: %d + %d = %d", initialState.X[1], initialState.X[2], finalState.X[0])
 	})
 
 	// Test 3: Complete execution result with memory
@@ -266,13 +222,13 @@ func TestEmulatorVsHypervisor(t *testing.T) {
 		{
 			name:         "MOV immediate",
 			code:         []byte{0x40, 0x08, 0x80, 0xd2, 0x00, 0x00, 0x20, 0xd4},
-			initialState: &CPUState{X0: 999},
+			initialState: &CPUState{X: [31]uint64{0: 999}},
 			description:  "mov x0, #0x42; brk #0",
 		},
 		{
 			name:         "ADD registers",
 			code:         []byte{0x20, 0x00, 0x02, 0x8b, 0x00, 0x00, 0x20, 0xd4},
-			initialState: &CPUState{X1: 15, X2: 25},
+			initialState: &CPUState{X: [31]uint64{1: 15, 2: 25}},
 			description:  "add x0, x1, x2; brk #0",
 		},
 	}
@@ -294,18 +250,21 @@ func TestEmulatorVsHypervisor(t *testing.T) {
 			// compareStates(t, hvResult, emulatorResult)
 
 			t.Logf("Hypervisor result: X0=0x%x, X1=0x%x, X2=0x%x",
-				hvResult.X0, hvResult.X1, hvResult.X2)
+				hvResult.X[0], hvResult.X[1], hvResult.X[2])
 		})
 	}
 }
 
 // Helper to compare CPU states between emulator and hypervisor
 func compareStates(t *testing.T, expected, actual *CPUState) {
-	if expected.X0 != actual.X0 {
-		t.Errorf("X0 mismatch: expected 0x%x, got 0x%x", expected.X0, actual.X0)
+	for r := RegX0; r < regCount; r++ {
+		if e, a := expected.Reg(r), actual.Reg(r); e != a {
+			t.Errorf("%v mismatch: expected 0x%x, got 0x%x", r, e, a)
+		}
 	}
-	if expected.X1 != actual.X1 {
-		t.Errorf("X1 mismatch: expected 0x%x, got 0x%x", expected.X1, actual.X1)
+	for q := RegQ0; q <= RegQ31; q++ {
+		if expected.Q[q] != actual.Q[q] {
+			t.Errorf("%v mismatch: expected %x, got %x", q, expected.Q[q], actual.Q[q])
+		}
 	}
-	// Add more register comparisons as needed...
 }
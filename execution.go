@@ -1,64 +1,155 @@
-//go:build darwin && arm64
-
 package hypervisor
 
-/*
-#cgo darwin LDFLAGS: -framework Hypervisor
-#include <Hypervisor/hv_vcpu.h>
-#include <Hypervisor/hv_vcpu_types.h>
-
-// Helper to get ESR and FAR from the exit information
-static hv_return_t go_hv_get_esr_far(hv_vcpu_t vcpu, uint64_t* esr, uint64_t* far) {
-	// For ARM64, we would get this from the exit structure, but for now
-	// try to get it from system registers
-	hv_return_t r1 = hv_vcpu_get_sys_reg(vcpu, HV_SYS_REG_ESR_EL1, esr);
-	hv_return_t r2 = hv_vcpu_get_sys_reg(vcpu, HV_SYS_REG_FAR_EL1, far);
-	return (r1 != HV_SUCCESS) ? r1 : r2;
-}
-*/
-import "C"
-
 import (
-	"fmt"
+	"context"
 	"time"
 )
 
 // Run executes the vCPU until it exits. Returns ExitInfo best-effort.
+// It is RunContext with a context that is never canceled.
+//
+// Exits the library can complete itself, such as accesses to devices
+// registered with VM.RegisterMMIO, are handled internally and the guest is
+// resumed without returning.
 func (c *VCPU) Run() (ExitInfo, error) {
+	return c.RunContext(context.Background())
+}
+
+// RunContext is like Run, but forces the guest out when ctx is canceled or
+// its deadline passes, even if it never exits on its own. It then returns
+// an ExitInfo with Reason ExitCanceled and a nil error; the guest stopped
+// between instructions, so its registers are consistent and PC is the next
+// instruction to execute, and a later Run resumes it. Closing the vCPU
+// interrupts the run the same way.
+//
+// While the vCPU is running, register accessors return ErrVCPURunning and
+// a second concurrent Run fails the same way.
+func (c *VCPU) RunContext(ctx context.Context) (ExitInfo, error) {
+	if c == nil {
+		return ExitInfo{}, &OpError{Op: "run", Err: errVCPUNil}
+	}
+
 	start := time.Now()
 	defer func() {
-		recordRun(time.Since(start))
+		c.metrics.recordRun(time.Since(start))
 	}()
 
-	var info ExitInfo
-	if c == nil {
-		return info, fmt.Errorf("hv: VCPU is nil")
+	done, err := c.beginRun()
+	if err != nil {
+		return ExitInfo{}, &OpError{Op: "run", Err: err}
 	}
+	c.vm.notify(func(o Observer) { o.RunStarted(c) })
+	info, err := c.run(ctx, done)
+	if err != nil {
+		err = &OpError{Op: "run", Err: err}
+	}
+	c.vm.notify(func(o Observer) { o.RunExited(c, info, err) })
+	return info, err
+}
+
+// run enters the guest until an exit the caller needs to see, then ends the
+// run that beginRun started.
+func (c *VCPU) run(ctx context.Context, done chan struct{}) (ExitInfo, error) {
+	defer c.endRun()
 
+	if ctx.Err() != nil {
+		return ExitInfo{Reason: ExitCanceled}, nil
+	}
+	stop := context.AfterFunc(ctx, func() { c.forceExit(done) })
+	defer stop()
+
+	for {
+		if err := c.syncInterrupts(); err != nil {
+			return ExitInfo{}, err
+		}
+		info, err := c.impl.Run()
+		if err != nil {
+			c.metrics.recordResourceError()
+			return info, err
+		}
+		c.metrics.recordExit(info)
+
+		// A cancellation nobody asked for in this run is left over from
+		// one that had already finished; re-enter the guest.
+		if info.Reason == ExitCanceled && !c.takeExitRequest() {
+			continue
+		}
+
+		handled, err := c.serviceExit(info)
+		if err != nil {
+			return info, err
+		}
+		if !handled {
+			return info, nil
+		}
+	}
+}
+
+// beginRun marks the vCPU running. The returned channel identifies the run
+// and is closed by endRun.
+func (c *VCPU) beginRun() (chan struct{}, error) {
 	// Security: Lock to prevent use-after-free
 	c.closeMu.Lock()
 	defer c.closeMu.Unlock()
 
 	if c.closed {
-		return info, fmt.Errorf("hv: VCPU is closed")
+		return nil, ErrVCPUClosed
+	}
+	if c.running {
+		return nil, ErrVCPURunning
+	}
+	c.running = true
+	c.exitRequested = false
+	c.runDone = make(chan struct{})
+	return c.runDone, nil
+}
+
+// endRun gives the vCPU back to Close and the register accessors.
+func (c *VCPU) endRun() {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+
+	c.running = false
+	c.exitRequested = false
+	close(c.runDone)
+}
+
+// forceExit interrupts the run identified by done, if it is still going.
+func (c *VCPU) forceExit(done chan struct{}) {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+
+	if !c.running || c.runDone != done {
+		return
+	}
+	c.exitRequested = true
+	if err := c.impl.Exit(); err != nil {
+		c.metrics.recordResourceError()
 	}
+}
 
-	ret := C.hv_vcpu_run(C.hv_vcpu_t(c.id))
-	if err := hvErr(ret); err != nil {
-		recordResourceError()
-		return info, fmt.Errorf("failed to run vCPU: %w", err)
+// takeExitRequest reports and clears a pending forced exit.
+func (c *VCPU) takeExitRequest() bool {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+
+	requested := c.exitRequested
+	c.exitRequested = false
+	return requested
+}
+
+// serviceExit completes exits the library handles on the caller's behalf,
+// such as MMIO accesses, so that Run only returns exits the caller needs to
+// see. It is only called from the goroutine running the vCPU.
+func (c *VCPU) serviceExit(info ExitInfo) (bool, error) {
+	if handled, err := c.handleMMIO(info); handled || err != nil {
+		return handled, err
 	}
-	var esr, far C.uint64_t
-	if C.go_hv_get_esr_far(C.hv_vcpu_t(c.id), &esr, &far) == C.HV_SUCCESS {
-		info.ESR = uint64(esr)
-		info.FAR = uint64(far)
-		if info.ESR != 0 {
-			info.Reason = ExitException
-		} else {
-			info.Reason = ExitUnknown
-		}
-	} else {
-		info.Reason = ExitUnknown
+	if handled, err := c.handleSparseFault(info); handled || err != nil {
+		return handled, err
+	}
+	if handled, err := c.handleDirtyFault(info); handled || err != nil {
+		return handled, err
 	}
-	return info, nil
+	return c.handlePermissionFault(info), nil
 }
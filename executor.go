@@ -0,0 +1,131 @@
+package hypervisor
+
+import "runtime"
+
+// executor runs functions one at a time on a dedicated goroutine that is
+// locked to its OS thread. Hypervisor.framework vCPUs may only be used from
+// the thread that created them, so every backend vCPU is created, driven and
+// destroyed through one.
+type executor struct {
+	calls chan func()
+	done  chan struct{}
+}
+
+func newExecutor() *executor {
+	e := &executor{calls: make(chan func()), done: make(chan struct{})}
+	go e.loop()
+	return e
+}
+
+func (e *executor) loop() {
+	// The thread is never unlocked, so the runtime retires it when the
+	// goroutine exits instead of handing it to unrelated goroutines with
+	// vCPU state still attached.
+	runtime.LockOSThread()
+	defer close(e.done)
+	for f := range e.calls {
+		f()
+	}
+}
+
+// do runs f on the executor thread and waits for it to return.
+func (e *executor) do(f func()) {
+	finished := make(chan struct{})
+	e.calls <- func() {
+		defer close(finished)
+		f()
+	}
+	<-finished
+}
+
+// stop ends the executor goroutine. No calls may follow.
+func (e *executor) stop() {
+	close(e.calls)
+	<-e.done
+}
+
+// threadVCPU forwards every BackendVCPU call to the executor thread that
+// created the underlying vCPU.
+type threadVCPU struct {
+	impl BackendVCPU
+	exec *executor
+}
+
+// newThreadVCPU creates a backend vCPU on a new executor thread.
+func newThreadVCPU(b Backend) (*threadVCPU, error) {
+	exec := newExecutor()
+	var impl BackendVCPU
+	var err error
+	exec.do(func() { impl, err = b.CreateVCPU() })
+	if err != nil {
+		exec.stop()
+		return nil, err
+	}
+	return &threadVCPU{impl: impl, exec: exec}, nil
+}
+
+func (v *threadVCPU) ID() uint64 { return v.impl.ID() }
+
+func (v *threadVCPU) GetReg(r Reg) (val uint64, err error) {
+	v.exec.do(func() { val, err = v.impl.GetReg(r) })
+	return val, err
+}
+
+func (v *threadVCPU) SetReg(r Reg, val uint64) (err error) {
+	v.exec.do(func() { err = v.impl.SetReg(r, val) })
+	return err
+}
+
+func (v *threadVCPU) GetSysReg(r SysReg) (val uint64, err error) {
+	v.exec.do(func() { val, err = v.impl.GetSysReg(r) })
+	return val, err
+}
+
+func (v *threadVCPU) SetSysReg(r SysReg, val uint64) (err error) {
+	v.exec.do(func() { err = v.impl.SetSysReg(r, val) })
+	return err
+}
+
+func (v *threadVCPU) GetSIMD(q SIMDReg) (val [16]byte, err error) {
+	v.exec.do(func() { val, err = v.impl.GetSIMD(q) })
+	return val, err
+}
+
+func (v *threadVCPU) SetSIMD(q SIMDReg, val [16]byte) (err error) {
+	v.exec.do(func() { err = v.impl.SetSIMD(q, val) })
+	return err
+}
+
+func (v *threadVCPU) SetPendingInterrupt(t InterruptType, pending bool) (err error) {
+	v.exec.do(func() { err = v.impl.SetPendingInterrupt(t, pending) })
+	return err
+}
+
+func (v *threadVCPU) GetVTimerMask() (masked bool, err error) {
+	v.exec.do(func() { masked, err = v.impl.GetVTimerMask() })
+	return masked, err
+}
+
+func (v *threadVCPU) SetVTimerMask(masked bool) (err error) {
+	v.exec.do(func() { err = v.impl.SetVTimerMask(masked) })
+	return err
+}
+
+func (v *threadVCPU) Run() (info ExitInfo, err error) {
+	v.exec.do(func() { info, err = v.impl.Run() })
+	return info, err
+}
+
+// Exit is forwarded directly: it exists to interrupt a Run that is
+// occupying the executor thread.
+func (v *threadVCPU) Exit() error { return v.impl.Exit() }
+
+// Destroy destroys the vCPU and, if that succeeds, stops the executor. On
+// failure the executor is kept so the caller can retry.
+func (v *threadVCPU) Destroy() (err error) {
+	v.exec.do(func() { err = v.impl.Destroy() })
+	if err == nil {
+		v.exec.stop()
+	}
+	return err
+}
@@ -0,0 +1,205 @@
+package hypervisor
+
+import (
+	"bytes"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func init() {
+	RegisterBackend("affine-test", func() (Backend, error) {
+		return &affineBackend{FakeBackend: NewFakeBackend()}, nil
+	})
+}
+
+// goid returns the current goroutine's ID. A vCPU executor goroutine is
+// locked to its thread, so a matching ID means a matching OS thread.
+func goid() uint64 {
+	var buf [64]byte
+	b := buf[:runtime.Stack(buf[:], false)]
+	b = bytes.TrimPrefix(b, []byte("goroutine "))
+	id, _ := strconv.ParseUint(string(b[:bytes.IndexByte(b, ' ')]), 10, 64)
+	return id
+}
+
+// affineBackend is a FakeBackend whose vCPUs count calls made from any
+// goroutine other than the one that created them.
+type affineBackend struct {
+	*FakeBackend
+	wrongThread atomic.Int64
+	calls       atomic.Int64
+}
+
+func (b *affineBackend) CreateVCPU() (BackendVCPU, error) {
+	impl, err := b.FakeBackend.CreateVCPU()
+	if err != nil {
+		return nil, err
+	}
+	return &affineVCPU{BackendVCPU: impl, backend: b, owner: goid()}, nil
+}
+
+type affineVCPU struct {
+	BackendVCPU
+	backend *affineBackend
+	owner   uint64
+}
+
+func (v *affineVCPU) check() {
+	v.backend.calls.Add(1)
+	if goid() != v.owner {
+		v.backend.wrongThread.Add(1)
+	}
+}
+
+func (v *affineVCPU) GetReg(r Reg) (uint64, error) {
+	v.check()
+	return v.BackendVCPU.GetReg(r)
+}
+
+func (v *affineVCPU) SetReg(r Reg, val uint64) error {
+	v.check()
+	return v.BackendVCPU.SetReg(r, val)
+}
+
+func (v *affineVCPU) GetSysReg(r SysReg) (uint64, error) {
+	v.check()
+	return v.BackendVCPU.GetSysReg(r)
+}
+
+func (v *affineVCPU) SetSysReg(r SysReg, val uint64) error {
+	v.check()
+	return v.BackendVCPU.SetSysReg(r, val)
+}
+
+func (v *affineVCPU) GetSIMD(q SIMDReg) ([16]byte, error) {
+	v.check()
+	return v.BackendVCPU.GetSIMD(q)
+}
+
+func (v *affineVCPU) SetSIMD(q SIMDReg, val [16]byte) error {
+	v.check()
+	return v.BackendVCPU.SetSIMD(q, val)
+}
+
+func (v *affineVCPU) SetPendingInterrupt(t InterruptType, pending bool) error {
+	v.check()
+	return v.BackendVCPU.SetPendingInterrupt(t, pending)
+}
+
+func (v *affineVCPU) GetVTimerMask() (bool, error) {
+	v.check()
+	return v.BackendVCPU.GetVTimerMask()
+}
+
+func (v *affineVCPU) SetVTimerMask(masked bool) error {
+	v.check()
+	return v.BackendVCPU.SetVTimerMask(masked)
+}
+
+func (v *affineVCPU) Run() (ExitInfo, error) {
+	v.check()
+	return v.BackendVCPU.Run()
+}
+
+func (v *affineVCPU) Destroy() error {
+	v.check()
+	return v.BackendVCPU.Destroy()
+}
+
+func TestVCPUThreadAffinity(t *testing.T) {
+	vm, err := NewVMWithBackend("affine-test")
+	if err != nil {
+		t.Fatalf("NewVMWithBackend failed: %v", err)
+	}
+	defer vm.Close()
+	backend := vm.Backend().(*affineBackend)
+
+	vcpu, err := vm.NewVCPU()
+	if err != nil {
+		t.Fatalf("NewVCPU failed: %v", err)
+	}
+
+	// Drive the vCPU from many goroutines; every call must still land on
+	// the thread that created it.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runtime.Gosched()
+			vcpu.SetReg(RegX0+Reg(i), uint64(i))
+			vcpu.GetReg(RegX0 + Reg(i))
+			vcpu.SetSIMD(RegQ0+SIMDReg(i), [16]byte{byte(i)})
+			vcpu.GetSysReg(SysTPIDR_EL0)
+			vcpu.Run()
+		}()
+	}
+	wg.Wait()
+	if _, err := vcpu.SaveState(); err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+	if err := vcpu.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	if n := backend.wrongThread.Load(); n != 0 {
+		t.Errorf("%d of %d vCPU calls ran off the creating thread", n, backend.calls.Load())
+	}
+	if _, err := vcpu.GetReg(RegX0); err == nil {
+		t.Error("Expected error using a closed vCPU")
+	}
+	if err := vcpu.Close(); err != nil {
+		t.Errorf("second Close = %v, want nil", err)
+	}
+}
+
+func TestParallelVCPUs(t *testing.T) {
+	vm, first, _ := newInterpVM(t,
+		0xD2800000, // movz x0, #0
+		0x91000400, // add  x0, x0, #1
+		0xEB01001F, // cmp  x0, x1
+		0x54FFFFC1, // b.ne -8
+		0xD4200000, // brk  #0
+	)
+	vcpus := []*VCPU{first}
+	for i := 0; i < 3; i++ {
+		c, err := vm.NewVCPU()
+		if err != nil {
+			t.Fatalf("NewVCPU failed: %v", err)
+		}
+		defer c.Close()
+		vcpus = append(vcpus, c)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(vcpus))
+	for i, c := range vcpus {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.SetPC(interpCodeGPA); err != nil {
+				errs[i] = err
+				return
+			}
+			if err := c.SetReg(RegX1, uint64(1000*(i+1))); err != nil {
+				errs[i] = err
+				return
+			}
+			_, errs[i] = c.Run()
+		}()
+	}
+	wg.Wait()
+
+	for i, c := range vcpus {
+		if errs[i] != nil {
+			t.Errorf("vCPU %d: %v", i, errs[i])
+			continue
+		}
+		if x0, _ := c.GetReg(RegX0); x0 != uint64(1000*(i+1)) {
+			t.Errorf("vCPU %d: X0 = %d, want %d", i, x0, 1000*(i+1))
+		}
+	}
+}
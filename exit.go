@@ -0,0 +1,436 @@
+package hypervisor
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+var exitReasonNames = [...]string{
+	ExitUnknown:   "unknown",
+	ExitException: "exception",
+	ExitTimer:     "vtimer",
+	ExitCanceled:  "canceled",
+}
+
+func (r ExitReason) String() string {
+	if r >= 0 && int(r) < len(exitReasonNames) {
+		return exitReasonNames[r]
+	}
+	return "ExitReason(" + strconv.Itoa(int(r)) + ")"
+}
+
+func (r ExitReason) MarshalText() ([]byte, error) { return []byte(r.String()), nil }
+
+func (r *ExitReason) UnmarshalText(text []byte) error {
+	for i, name := range exitReasonNames {
+		if string(text) == name {
+			*r = ExitReason(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("hv: unknown exit reason %q", text)
+}
+
+// UnmarshalJSON accepts the string form and, for output produced before
+// reasons were named, the bare integer.
+func (r *ExitReason) UnmarshalJSON(data []byte) error {
+	var n int
+	if err := json.Unmarshal(data, &n); err == nil {
+		*r = ExitReason(n)
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("hv: invalid exit reason %s", data)
+	}
+	return r.UnmarshalText([]byte(s))
+}
+
+// ExceptionClass is the ESR_EL2.EC field of an exception exit.
+type ExceptionClass uint8
+
+// Exception classes a guest can raise to the hypervisor.
+const (
+	ECUnknown               ExceptionClass = 0x00
+	ECWFx                   ExceptionClass = 0x01
+	ECFPAccess              ExceptionClass = 0x07
+	ECIllegalState          ExceptionClass = 0x0E
+	ECSVC                   ExceptionClass = 0x15
+	ECHVC                   ExceptionClass = 0x16
+	ECSMC                   ExceptionClass = 0x17
+	ECSysReg                ExceptionClass = 0x18
+	ECInstructionAbortLower ExceptionClass = 0x20
+	ECInstructionAbort      ExceptionClass = 0x21
+	ECPCAlignment           ExceptionClass = 0x22
+	ECDataAbortLower        ExceptionClass = 0x24
+	ECDataAbort             ExceptionClass = 0x25
+	ECSPAlignment           ExceptionClass = 0x26
+	ECFPException           ExceptionClass = 0x2C
+	ECSError                ExceptionClass = 0x2F
+	ECBreakpointLower       ExceptionClass = 0x30
+	ECSoftwareStepLower     ExceptionClass = 0x32
+	ECWatchpointLower       ExceptionClass = 0x34
+	ECBRK                   ExceptionClass = 0x3C
+)
+
+var exceptionClassNames = map[ExceptionClass]string{
+	ECUnknown:               "unknown",
+	ECWFx:                   "wfx",
+	ECFPAccess:              "fp_access",
+	ECIllegalState:          "illegal_state",
+	ECSVC:                   "svc",
+	ECHVC:                   "hvc",
+	ECSMC:                   "smc",
+	ECSysReg:                "sysreg",
+	ECInstructionAbortLower: "instruction_abort_lower",
+	ECInstructionAbort:      "instruction_abort",
+	ECPCAlignment:           "pc_alignment",
+	ECDataAbortLower:        "data_abort_lower",
+	ECDataAbort:             "data_abort",
+	ECSPAlignment:           "sp_alignment",
+	ECFPException:           "fp_exception",
+	ECSError:                "serror",
+	ECBreakpointLower:       "breakpoint_lower",
+	ECSoftwareStepLower:     "software_step_lower",
+	ECWatchpointLower:       "watchpoint_lower",
+	ECBRK:                   "brk",
+}
+
+func (ec ExceptionClass) String() string {
+	if name, ok := exceptionClassNames[ec]; ok {
+		return name
+	}
+	return fmt.Sprintf("ec_0x%02x", uint8(ec))
+}
+
+func (ec ExceptionClass) MarshalText() ([]byte, error) { return []byte(ec.String()), nil }
+
+// FaultStatus is the DFSC/IFSC field of an abort syndrome.
+type FaultStatus uint8
+
+// Level returns the translation table level the fault was reported at, or
+// -1 if the status is not level-specific.
+func (fs FaultStatus) Level() int {
+	if fs < 0x10 {
+		return int(fs & 3)
+	}
+	return -1
+}
+
+// IsTranslation reports a translation fault (no mapping at the IPA).
+func (fs FaultStatus) IsTranslation() bool { return fs&^3 == 0x04 }
+
+// IsAccessFlag reports an access flag fault.
+func (fs FaultStatus) IsAccessFlag() bool { return fs&^3 == 0x08 }
+
+// IsPermission reports a permission fault (mapping exists but disallows
+// the access).
+func (fs FaultStatus) IsPermission() bool { return fs&^3 == 0x0C }
+
+// IsAlignment reports an alignment fault.
+func (fs FaultStatus) IsAlignment() bool { return fs == 0x21 }
+
+func (fs FaultStatus) String() string {
+	switch {
+	case fs < 4:
+		return fmt.Sprintf("address_size_l%d", fs&3)
+	case fs.IsTranslation():
+		return fmt.Sprintf("translation_l%d", fs&3)
+	case fs.IsAccessFlag():
+		return fmt.Sprintf("access_flag_l%d", fs&3)
+	case fs.IsPermission():
+		return fmt.Sprintf("permission_l%d", fs&3)
+	case fs == 0x10:
+		return "synchronous_external"
+	case fs.IsAlignment():
+		return "alignment"
+	case fs == 0x30:
+		return "tlb_conflict"
+	}
+	return fmt.Sprintf("fsc_0x%02x", uint8(fs))
+}
+
+func (fs FaultStatus) MarshalText() ([]byte, error) { return []byte(fs.String()), nil }
+
+// DataAbort is the decoded ISS of a data abort.
+type DataAbort struct {
+	// ISV reports whether SAS, SSE, SRT, SF and AR are valid. It is clear
+	// for accesses the hardware cannot describe, such as load/store pair or
+	// writeback forms.
+	ISV bool `json:"isv"`
+	// SAS is log2 of the access size in bytes.
+	SAS uint8 `json:"sas"`
+	// SSE is set when a load sign-extends.
+	SSE bool `json:"sse"`
+	// SRT is the transfer register number (31 = XZR).
+	SRT uint8 `json:"srt"`
+	// SF is set for a 64-bit register transfer.
+	SF bool `json:"sf"`
+	// AR is set for acquire/release semantics.
+	AR bool `json:"ar"`
+	// FnV is set when FAR is not valid.
+	FnV bool `json:"fnv"`
+	// EA is set for an external abort.
+	EA bool `json:"ea"`
+	// CM is set for cache maintenance operations.
+	CM bool `json:"cm"`
+	// S1PTW is set for a stage-2 fault on a stage-1 table walk.
+	S1PTW bool `json:"s1ptw"`
+	// WnR is set for a write, clear for a read.
+	WnR bool `json:"wnr"`
+	// DFSC is the data fault status code.
+	DFSC FaultStatus `json:"dfsc"`
+}
+
+// Size returns the access size in bytes. Only meaningful when ISV is set.
+func (d DataAbort) Size() int { return 1 << d.SAS }
+
+// InstructionAbort is the decoded ISS of an instruction abort.
+type InstructionAbort struct {
+	FnV   bool        `json:"fnv"`
+	EA    bool        `json:"ea"`
+	S1PTW bool        `json:"s1ptw"`
+	IFSC  FaultStatus `json:"ifsc"`
+}
+
+// Call is the decoded ISS of an SVC, HVC or SMC.
+type Call struct {
+	Imm uint16 `json:"imm"`
+}
+
+// Breakpoint is the decoded ISS of a BRK instruction.
+type Breakpoint struct {
+	Comment uint16 `json:"comment"`
+}
+
+// SysRegTrap is the decoded ISS of a trapped MSR or MRS.
+type SysRegTrap struct {
+	Op0  uint8 `json:"op0"`
+	Op1  uint8 `json:"op1"`
+	CRn  uint8 `json:"crn"`
+	CRm  uint8 `json:"crm"`
+	Op2  uint8 `json:"op2"`
+	Rt   uint8 `json:"rt"`
+	Read bool  `json:"read"` // MRS when set, MSR otherwise
+}
+
+// Encoding returns the register's MRS encoding
+// (op0<<14 | op1<<11 | CRn<<7 | CRm<<3 | op2), the same packing
+// Hypervisor.framework uses for hv_sys_reg_t.
+func (s SysRegTrap) Encoding() uint16 {
+	return uint16(s.Op0)<<14 | uint16(s.Op1)<<11 | uint16(s.CRn)<<7 | uint16(s.CRm)<<3 | uint16(s.Op2)
+}
+
+func (s SysRegTrap) String() string {
+	return fmt.Sprintf("s%d_%d_c%d_c%d_%d", s.Op0, s.Op1, s.CRn, s.CRm, s.Op2)
+}
+
+// WaitTrap is the decoded ISS of a trapped WFI or WFE.
+type WaitTrap struct {
+	WFE bool `json:"wfe"`
+}
+
+// ExitInfo captures information about a recent vCPU exit.
+type ExitInfo struct {
+	Reason ExitReason
+	// ESR is the exception syndrome (ESR_EL2) for ExitException.
+	ESR uint64
+	// FAR is the faulting guest virtual address for aborts and watchpoints.
+	FAR uint64
+	// IPA is the faulting guest physical address for stage-2 aborts.
+	IPA uint64
+}
+
+// Class returns the exception class. It is ECUnknown unless Reason is
+// ExitException.
+func (e ExitInfo) Class() ExceptionClass {
+	if e.Reason != ExitException {
+		return ECUnknown
+	}
+	return ExceptionClass(e.ESR >> 26)
+}
+
+// ISS returns the instruction specific syndrome bits of ESR.
+func (e ExitInfo) ISS() uint32 { return uint32(e.ESR & 0x1FFFFFF) }
+
+// InstructionLength returns 4 for a 32-bit trapped instruction and 2 for
+// a 16-bit one, as reported by ESR.IL.
+func (e ExitInfo) InstructionLength() int {
+	if e.ESR&(1<<25) != 0 {
+		return 4
+	}
+	return 2
+}
+
+// DataAbort decodes a data abort syndrome.
+func (e ExitInfo) DataAbort() (DataAbort, bool) {
+	if ec := e.Class(); ec != ECDataAbortLower && ec != ECDataAbort {
+		return DataAbort{}, false
+	}
+	iss := e.ISS()
+	return DataAbort{
+		ISV:   iss&(1<<24) != 0,
+		SAS:   uint8(iss>>22) & 3,
+		SSE:   iss&(1<<21) != 0,
+		SRT:   uint8(iss>>16) & 31,
+		SF:    iss&(1<<15) != 0,
+		AR:    iss&(1<<14) != 0,
+		FnV:   iss&(1<<10) != 0,
+		EA:    iss&(1<<9) != 0,
+		CM:    iss&(1<<8) != 0,
+		S1PTW: iss&(1<<7) != 0,
+		WnR:   iss&(1<<6) != 0,
+		DFSC:  FaultStatus(iss & 0x3F),
+	}, true
+}
+
+// InstructionAbort decodes an instruction abort syndrome.
+func (e ExitInfo) InstructionAbort() (InstructionAbort, bool) {
+	if ec := e.Class(); ec != ECInstructionAbortLower && ec != ECInstructionAbort {
+		return InstructionAbort{}, false
+	}
+	iss := e.ISS()
+	return InstructionAbort{
+		FnV:   iss&(1<<10) != 0,
+		EA:    iss&(1<<9) != 0,
+		S1PTW: iss&(1<<7) != 0,
+		IFSC:  FaultStatus(iss & 0x3F),
+	}, true
+}
+
+// Call decodes the immediate of an SVC, HVC or SMC.
+func (e ExitInfo) Call() (Call, bool) {
+	switch e.Class() {
+	case ECSVC, ECHVC, ECSMC:
+		return Call{Imm: uint16(e.ISS())}, true
+	}
+	return Call{}, false
+}
+
+// Breakpoint decodes the comment of a BRK instruction.
+func (e ExitInfo) Breakpoint() (Breakpoint, bool) {
+	if e.Class() != ECBRK {
+		return Breakpoint{}, false
+	}
+	return Breakpoint{Comment: uint16(e.ISS())}, true
+}
+
+// SysRegTrap decodes a trapped MSR or MRS.
+func (e ExitInfo) SysRegTrap() (SysRegTrap, bool) {
+	if e.Class() != ECSysReg {
+		return SysRegTrap{}, false
+	}
+	iss := e.ISS()
+	return SysRegTrap{
+		Op0:  uint8(iss>>20) & 3,
+		Op2:  uint8(iss>>17) & 7,
+		Op1:  uint8(iss>>14) & 7,
+		CRn:  uint8(iss>>10) & 0xF,
+		Rt:   uint8(iss>>5) & 31,
+		CRm:  uint8(iss>>1) & 0xF,
+		Read: iss&1 != 0,
+	}, true
+}
+
+// WaitTrap decodes a trapped WFI or WFE.
+func (e ExitInfo) WaitTrap() (WaitTrap, bool) {
+	if e.Class() != ECWFx {
+		return WaitTrap{}, false
+	}
+	return WaitTrap{WFE: e.ISS()&1 != 0}, true
+}
+
+// Syndrome returns the decoded syndrome as one of DataAbort,
+// InstructionAbort, Call, Breakpoint, SysRegTrap or WaitTrap, or nil if the
+// exception class has no typed decoding.
+func (e ExitInfo) Syndrome() any {
+	if s, ok := e.DataAbort(); ok {
+		return s
+	}
+	if s, ok := e.InstructionAbort(); ok {
+		return s
+	}
+	if s, ok := e.Call(); ok {
+		return s
+	}
+	if s, ok := e.Breakpoint(); ok {
+		return s
+	}
+	if s, ok := e.SysRegTrap(); ok {
+		return s
+	}
+	if s, ok := e.WaitTrap(); ok {
+		return s
+	}
+	return nil
+}
+
+func (e ExitInfo) String() string {
+	if e.Reason != ExitException {
+		return e.Reason.String()
+	}
+	s := fmt.Sprintf("%s (esr=0x%x)", e.Class(), e.ESR)
+	switch syn := e.Syndrome().(type) {
+	case DataAbort:
+		dir := "read"
+		if syn.WnR {
+			dir = "write"
+		}
+		s += fmt.Sprintf(" %s %s far=0x%x ipa=0x%x", dir, syn.DFSC, e.FAR, e.IPA)
+	case InstructionAbort:
+		s += fmt.Sprintf(" %s far=0x%x ipa=0x%x", syn.IFSC, e.FAR, e.IPA)
+	case Call:
+		s += fmt.Sprintf(" #%d", syn.Imm)
+	case Breakpoint:
+		s += fmt.Sprintf(" #%d", syn.Comment)
+	case SysRegTrap:
+		op := "msr"
+		if syn.Read {
+			op = "mrs"
+		}
+		s += fmt.Sprintf(" %s %s x%d", op, syn, syn.Rt)
+	case WaitTrap:
+		if syn.WFE {
+			s += " wfe"
+		} else {
+			s += " wfi"
+		}
+	}
+	return s
+}
+
+// exitInfoJSON is the JSON form of ExitInfo. Class and Syndrome are derived
+// from ESR and ignored when decoding.
+type exitInfoJSON struct {
+	Reason   ExitReason      `json:"reason"`
+	ESR      uint64          `json:"esr"`
+	FAR      uint64          `json:"far"`
+	IPA      uint64          `json:"ipa"`
+	Class    *ExceptionClass `json:"class,omitempty"`
+	Syndrome any             `json:"syndrome,omitempty"`
+}
+
+func (e ExitInfo) MarshalJSON() ([]byte, error) {
+	out := exitInfoJSON{Reason: e.Reason, ESR: e.ESR, FAR: e.FAR, IPA: e.IPA}
+	if e.Reason == ExitException {
+		ec := e.Class()
+		out.Class = &ec
+		out.Syndrome = e.Syndrome()
+	}
+	return json.Marshal(out)
+}
+
+func (e *ExitInfo) UnmarshalJSON(data []byte) error {
+	var in struct {
+		Reason ExitReason `json:"reason"`
+		ESR    uint64     `json:"esr"`
+		FAR    uint64     `json:"far"`
+		IPA    uint64     `json:"ipa"`
+	}
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	*e = ExitInfo{Reason: in.Reason, ESR: in.ESR, FAR: in.FAR, IPA: in.IPA}
+	return nil
+}
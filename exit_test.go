@@ -0,0 +1,161 @@
+package hypervisor
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestExitInfoDecoding(t *testing.T) {
+	exception := func(esr uint64) ExitInfo { return ExitInfo{Reason: ExitException, ESR: esr} }
+
+	t.Run("data abort", func(t *testing.T) {
+		// STR X3, [X1] to a read-only page: ISV SAS=3 SRT=3 SF WnR permission L3
+		info := exception(0x24<<26 | 1<<25 | 1<<24 | 3<<22 | 3<<16 | 1<<15 | 1<<6 | 0x0F)
+		if info.Class() != ECDataAbortLower {
+			t.Fatalf("Class() = %v, want %v", info.Class(), ECDataAbortLower)
+		}
+		da, ok := info.DataAbort()
+		if !ok {
+			t.Fatal("DataAbort() not ok")
+		}
+		want := DataAbort{ISV: true, SAS: 3, SRT: 3, SF: true, WnR: true, DFSC: 0x0F}
+		if da != want {
+			t.Errorf("DataAbort() = %+v, want %+v", da, want)
+		}
+		if da.Size() != 8 || !da.DFSC.IsPermission() || da.DFSC.Level() != 3 {
+			t.Errorf("Size/IsPermission/Level = %d/%v/%d, want 8/true/3",
+				da.Size(), da.DFSC.IsPermission(), da.DFSC.Level())
+		}
+		if _, ok := info.Call(); ok {
+			t.Error("Call() ok for a data abort")
+		}
+	})
+
+	t.Run("instruction abort", func(t *testing.T) {
+		ia, ok := exception(0x20<<26 | 1<<25 | 0x07).InstructionAbort()
+		if !ok || !ia.IFSC.IsTranslation() {
+			t.Errorf("InstructionAbort() = %+v, %v, want translation fault", ia, ok)
+		}
+	})
+
+	t.Run("calls", func(t *testing.T) {
+		for _, ec := range []ExceptionClass{ECSVC, ECHVC, ECSMC} {
+			c, ok := exception(uint64(ec)<<26 | 1<<25 | 0x1234).Call()
+			if !ok || c.Imm != 0x1234 {
+				t.Errorf("%v: Call() = %+v, %v, want imm 0x1234", ec, c, ok)
+			}
+		}
+	})
+
+	t.Run("brk", func(t *testing.T) {
+		b, ok := exception(0xF2000000 | 0x2a).Breakpoint()
+		if !ok || b.Comment != 0x2a {
+			t.Errorf("Breakpoint() = %+v, %v, want comment 0x2a", b, ok)
+		}
+	})
+
+	t.Run("sysreg trap", func(t *testing.T) {
+		// MRS X3, TPIDR_EL0 (op0=3 op1=3 CRn=13 CRm=0 op2=2)
+		iss := uint64(3<<20 | 2<<17 | 3<<14 | 13<<10 | 3<<5 | 0<<1 | 1)
+		s, ok := exception(0x18<<26 | 1<<25 | iss).SysRegTrap()
+		want := SysRegTrap{Op0: 3, Op1: 3, CRn: 13, CRm: 0, Op2: 2, Rt: 3, Read: true}
+		if !ok || s != want {
+			t.Fatalf("SysRegTrap() = %+v, %v, want %+v", s, ok, want)
+		}
+		if s.Encoding() != 0xDE82 {
+			t.Errorf("Encoding() = 0x%x, want 0xde82", s.Encoding())
+		}
+	})
+
+	t.Run("wfx", func(t *testing.T) {
+		w, ok := exception(0x01<<26 | 1<<25 | 1<<24 | 0xE<<20 | 1).WaitTrap()
+		if !ok || !w.WFE {
+			t.Errorf("WaitTrap() = %+v, %v, want WFE", w, ok)
+		}
+	})
+
+	t.Run("non-exception exits have no class", func(t *testing.T) {
+		info := ExitInfo{Reason: ExitCanceled, ESR: 0xF2000000}
+		if info.Class() != ECUnknown || info.Syndrome() != nil {
+			t.Errorf("Class/Syndrome = %v/%v, want unknown/nil", info.Class(), info.Syndrome())
+		}
+	})
+}
+
+func TestExitInfoStrings(t *testing.T) {
+	tests := []struct {
+		info ExitInfo
+		want string
+	}{
+		{ExitInfo{Reason: ExitCanceled}, "canceled"},
+		{ExitInfo{Reason: ExitTimer}, "vtimer"},
+		{ExitInfo{Reason: ExitException, ESR: 0xF2000001}, "brk (esr=0xf2000001) #1"},
+		{
+			ExitInfo{Reason: ExitException, ESR: 0x93C08007, FAR: 0x1008, IPA: 0x1008},
+			"data_abort_lower (esr=0x93c08007) read translation_l3 far=0x1008 ipa=0x1008",
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.info.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+	}
+	if got := ExceptionClass(0x3F).String(); got != "ec_0x3f" {
+		t.Errorf("unknown class String() = %q", got)
+	}
+}
+
+func TestExitInfoJSON(t *testing.T) {
+	info := ExitInfo{Reason: ExitException, ESR: 0x5A000005}
+	data, err := json.Marshal(info)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	for _, want := range []string{`"reason":"exception"`, `"class":"hvc"`, `"syndrome":{"imm":5}`} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("JSON %s missing %s", data, want)
+		}
+	}
+
+	var got ExitInfo
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if got != info {
+		t.Errorf("round trip = %+v, want %+v", got, info)
+	}
+
+	// Output from older hv builds used numeric reasons and Go field names.
+	if err := json.Unmarshal([]byte(`{"Reason":1,"ESR":4060086272,"FAR":0}`), &got); err != nil {
+		t.Fatalf("Unmarshal legacy form failed: %v", err)
+	}
+	if got.Reason != ExitException || got.Class() != ECBRK {
+		t.Errorf("legacy decode = %+v", got)
+	}
+
+	if err := json.Unmarshal([]byte(`{"reason":"bogus"}`), &got); err == nil {
+		t.Error("Expected error for unknown reason")
+	}
+}
+
+func TestInterpExitSyndromes(t *testing.T) {
+	_, vcpu, _ := newInterpVM(t,
+		0xD2A00401, // movz x1, #0x20, lsl #16
+		0xB9400422, // ldr  w2, [x1, #4]
+	)
+	info, err := vcpu.Run()
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	da, ok := info.DataAbort()
+	if !ok {
+		t.Fatalf("exit %v is not a data abort", info)
+	}
+	if !da.ISV || da.WnR || da.SRT != 2 || da.Size() != 4 || !da.DFSC.IsTranslation() {
+		t.Errorf("DataAbort() = %+v", da)
+	}
+	if info.IPA != 0x200004 {
+		t.Errorf("IPA = 0x%x, want 0x200004", info.IPA)
+	}
+}
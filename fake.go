@@ -0,0 +1,240 @@
+package hypervisor
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+func init() {
+	RegisterBackend("fake", func() (Backend, error) { return NewFakeBackend(), nil })
+}
+
+// fakeDefaultCPSR is the reset PSTATE of a fake vCPU: EL1h with DAIF masked,
+// matching what Hypervisor.framework hands out for a fresh vCPU.
+const fakeDefaultCPSR = 0x3c5
+
+// fakeBRKSyndrome is the ESR_EL2 value for BRK #0 (EC=0x3C, IL=1).
+const fakeBRKSyndrome = 0xF2000000
+
+// FakeMapping describes one page-granular mapping held by a FakeBackend.
+type FakeMapping struct {
+	GuestPhys uint64
+	Host      []byte
+	Perms     MemPerm
+}
+
+// FakeBackend is a deterministic in-memory Backend for tests and CI hosts
+// without Hypervisor.framework. It records mappings and register writes but
+// does not execute guest code: Run replays exits queued with QueueExit and
+// otherwise reports a BRK #0 at the current PC. A queued ExitTimer masks
+// the virtual timer, as Hypervisor.framework does.
+type FakeBackend struct {
+	mu     sync.Mutex
+	active bool
+	pages  map[uint64]FakeMapping // page-aligned GPA -> mapping
+	exits  []ExitInfo
+	nextID uint64
+}
+
+// NewFakeBackend returns an empty FakeBackend.
+func NewFakeBackend() *FakeBackend {
+	return &FakeBackend{pages: make(map[uint64]FakeMapping)}
+}
+
+func (b *FakeBackend) Name() string { return "fake" }
+
+func (b *FakeBackend) CreateVM() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.active {
+		return HVError{Code: HV_EXISTS}
+	}
+	b.active = true
+	return nil
+}
+
+func (b *FakeBackend) DestroyVM() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.active = false
+	clear(b.pages)
+	return nil
+}
+
+func (b *FakeBackend) Map(host []byte, guestPhys uint64, perms MemPerm) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	page := uint64(pageSize())
+	for off := uint64(0); off < uint64(len(host)); off += page {
+		if _, ok := b.pages[guestPhys+off]; ok {
+			return HVError{Code: HV_BAD_ARGUMENT}
+		}
+	}
+	for off := uint64(0); off < uint64(len(host)); off += page {
+		b.pages[guestPhys+off] = FakeMapping{
+			GuestPhys: guestPhys + off,
+			Host:      host[off : off+page : off+page],
+			Perms:     perms,
+		}
+	}
+	return nil
+}
+
+func (b *FakeBackend) Unmap(guestPhys, size uint64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	page := uint64(pageSize())
+	found := false
+	for off := uint64(0); off < size; off += page {
+		if _, ok := b.pages[guestPhys+off]; ok {
+			delete(b.pages, guestPhys+off)
+			found = true
+		}
+	}
+	if !found {
+		return HVError{Code: HV_BAD_ARGUMENT}
+	}
+	return nil
+}
+
+func (b *FakeBackend) Protect(guestPhys, size uint64, perms MemPerm) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	page := uint64(pageSize())
+	for off := uint64(0); off < size; off += page {
+		if _, ok := b.pages[guestPhys+off]; !ok {
+			return HVError{Code: HV_BAD_ARGUMENT}
+		}
+	}
+	for off := uint64(0); off < size; off += page {
+		m := b.pages[guestPhys+off]
+		m.Perms = perms
+		b.pages[guestPhys+off] = m
+	}
+	return nil
+}
+
+func (b *FakeBackend) CreateVCPU() (BackendVCPU, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.active {
+		return nil, HVError{Code: HV_BAD_ARGUMENT}
+	}
+	v := &fakeVCPU{id: b.nextID, backend: b, sys: make(map[SysReg]uint64)}
+	v.regs[RegCPSR] = fakeDefaultCPSR
+	v.sys[SysMPIDR_EL1] = 1<<31 | b.nextID
+	b.nextID++
+	return v, nil
+}
+
+// Mappings returns the current page mappings sorted by guest address.
+func (b *FakeBackend) Mappings() []FakeMapping {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	out := make([]FakeMapping, 0, len(b.pages))
+	for _, m := range b.pages {
+		out = append(out, m)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].GuestPhys < out[j].GuestPhys })
+	return out
+}
+
+// QueueExit appends exits that subsequent Run calls return in order, on any
+// vCPU of this backend.
+func (b *FakeBackend) QueueExit(exits ...ExitInfo) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.exits = append(b.exits, exits...)
+}
+
+// nextExit pops the next queued exit, if any.
+func (b *FakeBackend) nextExit() (ExitInfo, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.exits) == 0 {
+		return ExitInfo{}, false
+	}
+	info := b.exits[0]
+	b.exits = b.exits[1:]
+	return info, true
+}
+
+// fakeVCPU is a register file with no execution engine.
+type fakeVCPU struct {
+	id      uint64
+	backend *FakeBackend
+	regs    [regCount]uint64
+	simd    [RegQ31 + 1][16]byte
+	sys     map[SysReg]uint64
+	pending [FIQ + 1]bool // interrupt lines
+	masked  bool          // virtual timer mask
+	exit    atomic.Bool   // Exit requested; consumed by the next Run
+}
+
+func (v *fakeVCPU) ID() uint64 { return v.id }
+
+func (v *fakeVCPU) GetReg(r Reg) (uint64, error) { return v.regs[r], nil }
+
+func (v *fakeVCPU) SetReg(r Reg, val uint64) error {
+	v.regs[r] = val
+	return nil
+}
+
+func (v *fakeVCPU) GetSysReg(r SysReg) (uint64, error) { return v.sys[r], nil }
+
+func (v *fakeVCPU) SetSysReg(r SysReg, val uint64) error {
+	v.sys[r] = val
+	return nil
+}
+
+func (v *fakeVCPU) GetSIMD(q SIMDReg) ([16]byte, error) { return v.simd[q], nil }
+
+func (v *fakeVCPU) SetSIMD(q SIMDReg, val [16]byte) error {
+	v.simd[q] = val
+	return nil
+}
+
+func (v *fakeVCPU) SetPendingInterrupt(t InterruptType, pending bool) error {
+	v.pending[t] = pending
+	return nil
+}
+
+func (v *fakeVCPU) GetVTimerMask() (bool, error) { return v.masked, nil }
+
+func (v *fakeVCPU) SetVTimerMask(masked bool) error {
+	v.masked = masked
+	return nil
+}
+
+func (v *fakeVCPU) Run() (ExitInfo, error) {
+	if v.exit.Swap(false) {
+		return ExitInfo{Reason: ExitCanceled}, nil
+	}
+	if info, ok := v.backend.nextExit(); ok {
+		if info.Reason == ExitTimer {
+			v.masked = true
+		}
+		return info, nil
+	}
+	return ExitInfo{
+		Reason: ExitException,
+		ESR:    fakeBRKSyndrome,
+	}, nil
+}
+
+func (v *fakeVCPU) Exit() error {
+	v.exit.Store(true)
+	return nil
+}
+
+func (v *fakeVCPU) Destroy() error { return nil }
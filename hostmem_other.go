@@ -0,0 +1,41 @@
+//go:build !unix
+
+package hypervisor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"unsafe"
+)
+
+// allocHost returns size bytes of zeroed, page-aligned host memory. Without
+// mmap it is carved out of an over-allocated Go slice.
+func allocHost(size int) ([]byte, error) {
+	page := pageSize()
+	raw := make([]byte, size+page)
+	off := (page - int(uintptr(unsafe.Pointer(&raw[0]))%uintptr(page))) % page
+	return raw[off : off+size : off+size], nil
+}
+
+// reserveHost is allocHost; the Go heap backs memory as it is touched.
+func reserveHost(size int) ([]byte, error) { return allocHost(size) }
+
+func freeHost([]byte) error { return nil }
+
+// mapHostFile reads size bytes of f from offset into memory from allocHost,
+// which is as good as a private mapping. Shared mappings are not possible.
+func mapHostFile(f *os.File, offset int64, size int, shared, _ bool) ([]byte, error) {
+	if shared {
+		return nil, fmt.Errorf("%w: shared file mappings", errors.ErrUnsupported)
+	}
+	mem, err := allocHost(size)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.ReadAt(mem, offset); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return mem, nil
+}
@@ -0,0 +1,37 @@
+//go:build unix
+
+package hypervisor
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// allocHost returns size bytes of zeroed, page-aligned host memory that the
+// garbage collector does not manage. Release it with freeHost.
+func allocHost(size int) ([]byte, error) {
+	return unix.Mmap(-1, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+}
+
+func freeHost(b []byte) error { return unix.Munmap(b) }
+
+// reserveHost is like allocHost but does not reserve swap space for the
+// memory, which is only backed as it is touched.
+func reserveHost(size int) ([]byte, error) {
+	return unix.Mmap(-1, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE|unix.MAP_NORESERVE)
+}
+
+// mapHostFile maps size bytes of f from offset, copy-on-write unless
+// shared. A shared mapping is only writable if writable is set, so that f
+// may be open read-only otherwise. Release it with freeHost.
+func mapHostFile(f *os.File, offset int64, size int, shared, writable bool) ([]byte, error) {
+	flags, prot := unix.MAP_PRIVATE, unix.PROT_READ|unix.PROT_WRITE
+	if shared {
+		flags = unix.MAP_SHARED
+		if !writable {
+			prot = unix.PROT_READ
+		}
+	}
+	return unix.Mmap(int(f.Fd()), offset, size, prot, flags)
+}
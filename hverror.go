@@ -1,13 +1,11 @@
 package hypervisor
 
-/*
-#include <arm64/hv/hv_kern_types.h>
-*/
-import "C"
 import (
+	"errors"
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 )
 
@@ -54,6 +52,26 @@ func (e HVError) Error() string {
 	return e.detailedError()
 }
 
+// Is reports whether target is an HVError with the same code, so callers
+// can match a class of failure with errors.Is(err, HVError{Code: HV_DENIED}).
+// A target with its own message, such as ErrVMClosed, is a specific error
+// and only matches errors with that message.
+func (e HVError) Is(target error) bool {
+	var t HVError
+	switch v := target.(type) {
+	case HVError:
+		t = v
+	case *HVError:
+		if v == nil {
+			return false
+		}
+		t = *v
+	default:
+		return false
+	}
+	return e.Code == t.Code && (t.message == "" || t.message == e.message)
+}
+
 // detailedError provides full error context for development
 func (e HVError) detailedError() string {
 	switch e.Code {
@@ -127,13 +145,42 @@ func isProductionEnv() bool {
 	return false
 }
 
-func hvErr(code C.hv_return_t) error {
-	if code == 0 {
-		return nil
+// OpError is the error returned by VM and VCPU methods. It records the
+// operation that failed, the guest physical range or register it involved,
+// and the underlying error, which errors.Is and errors.As reach through
+// Unwrap.
+type OpError struct {
+	Op   string // operation, such as "map" or "set register"
+	GPA  uint64 // start of the guest physical range, if Size is nonzero
+	Size uint64 // length of the guest physical range, or 0 if none
+	Reg  string // register name, or "" if none
+	Err  error
+}
+
+func (e *OpError) Error() string {
+	var b strings.Builder
+	b.WriteString("hv: ")
+	b.WriteString(e.Op)
+
+	// Security: Keep guest addresses and register names out of production messages
+	if !isProductionEnv() {
+		if e.Reg != "" {
+			b.WriteString(" ")
+			b.WriteString(e.Reg)
+		}
+		if e.Size != 0 {
+			fmt.Fprintf(&b, " 0x%x+0x%x", e.GPA, e.Size)
+		}
 	}
-	return HVError{Code: uint32(code)}
+	if e.Err != nil {
+		b.WriteString(": ")
+		b.WriteString(strings.TrimPrefix(e.Err.Error(), "hv: "))
+	}
+	return b.String()
 }
 
+func (e *OpError) Unwrap() error { return e.Err }
+
 // Common specific errors for API consumers
 var (
 	ErrVMClosed         = &HVError{Code: HV_ERROR, message: "hv: VM is closed"}
@@ -142,4 +189,12 @@ var (
 	ErrInvalidRegister  = &HVError{Code: HV_BAD_ARGUMENT, message: "hv: invalid register"}
 	ErrMemoryNotMapped  = &HVError{Code: HV_BAD_ARGUMENT, message: "hv: memory not mapped"}
 	ErrVMAlreadyActive  = &HVError{Code: HV_BUSY, message: "hv: VM already active in this process"}
+	ErrVCPURunning      = &HVError{Code: HV_BUSY, message: "hv: VCPU is running"}
+)
+
+var (
+	errVMNil         = errors.New("hv: VM is nil")
+	errVCPUNil       = errors.New("hv: VCPU is nil")
+	errRangeOverflow = errors.New("hv: guest address range would overflow")
+	errEmptyHost     = errors.New("hv: empty host buffer")
 )
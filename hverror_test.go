@@ -1,8 +1,7 @@
-//go:build darwin && arm64
-
 package hypervisor
 
 import (
+	"errors"
 	"strings"
 	"testing"
 )
@@ -139,3 +138,160 @@ func TestErrorConstants(t *testing.T) {
 		}
 	}
 }
+
+func TestHVErrorIs(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		target error
+		want   bool
+	}{
+		{"same code", HVError{Code: HV_DENIED}, HVError{Code: HV_DENIED}, true},
+		{"pointer target", HVError{Code: HV_DENIED}, &HVError{Code: HV_DENIED}, true},
+		{"other code", HVError{Code: HV_DENIED}, HVError{Code: HV_BUSY}, false},
+		{"sentinel matches code", ErrInvalidAlignment, HVError{Code: HV_BAD_ARGUMENT}, true},
+		{"sentinel matches itself", ErrVMClosed, ErrVMClosed, true},
+		{"code does not match sentinel", HVError{Code: HV_ERROR}, ErrVMClosed, false},
+		{"sentinels with one code differ", ErrVMClosed, ErrVCPUClosed, false},
+		{"wrapped", &OpError{Op: "map", Err: HVError{Code: HV_NO_RESOURCES}}, HVError{Code: HV_NO_RESOURCES}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errors.Is(tt.err, tt.target); got != tt.want {
+				t.Errorf("errors.Is(%v, %v) = %v, want %v", tt.err, tt.target, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOpErrorString(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        *OpError
+		want       string
+		production string
+	}{
+		{
+			name:       "range",
+			err:        &OpError{Op: "map", GPA: 0x4000, Size: 0x1000, Err: ErrInvalidAlignment},
+			want:       "hv: map 0x4000+0x1000: address not page-aligned",
+			production: "hv: map: address not page-aligned",
+		},
+		{
+			name:       "register",
+			err:        &OpError{Op: "set register", Reg: "X3", Err: HVError{Code: HV_BUSY}},
+			want:       "hv: set register X3: resource busy (HV_BUSY) - another operation is in progress",
+			production: "hv: set register: resource busy",
+		},
+		{
+			name:       "operation only",
+			err:        &OpError{Op: "create vCPU", Err: ErrVMClosed},
+			want:       "hv: create vCPU: VM is closed",
+			production: "hv: create vCPU: VM is closed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("HV_ENV", "")
+			if got := tt.err.Error(); got != tt.want {
+				t.Errorf("Error() = %q, want %q", got, tt.want)
+			}
+			t.Setenv("HV_ENV", "production")
+			if got := tt.err.Error(); got != tt.production {
+				t.Errorf("production Error() = %q, want %q", got, tt.production)
+			}
+		})
+	}
+}
+
+func TestOpErrorFromVM(t *testing.T) {
+	vm, vcpu, _ := newInterpVM(t, 0xD4200000) // brk #0
+	page := uint64(pageSize())
+
+	closedVM, err := NewVMWithBackend("interp")
+	if err != nil {
+		t.Fatalf("NewVMWithBackend failed: %v", err)
+	}
+	closedVM.Close()
+
+	tests := []struct {
+		name   string
+		call   func() error
+		target error
+		want   OpError
+	}{
+		{
+			name:   "unaligned map",
+			call:   func() error { return vm.Map(alignedBuffer(t, int(page)), 0x200001, MemRead) },
+			target: ErrInvalidAlignment,
+			want:   OpError{Op: "map", GPA: 0x200001, Size: page},
+		},
+		{
+			name:   "empty map",
+			call:   func() error { return vm.Map(nil, 0x200000, MemRead) },
+			target: errEmptyHost,
+			want:   OpError{Op: "map", GPA: 0x200000},
+		},
+		{
+			name:   "unmap hole",
+			call:   func() error { return vm.Unmap(0x800000, page) },
+			target: ErrMemoryNotMapped,
+			want:   OpError{Op: "unmap", GPA: 0x800000, Size: page},
+		},
+		{
+			name: "read hole",
+			call: func() error {
+				_, err := vm.ReadAt(make([]byte, 8), 0x800000)
+				return err
+			},
+			target: ErrMemoryNotMapped,
+			want:   OpError{Op: "read", GPA: 0x800000, Size: 8},
+		},
+		{
+			name:   "invalid register",
+			call:   func() error { return vcpu.SetReg(regCount, 1) },
+			target: ErrInvalidRegister,
+			want:   OpError{Op: "set register", Reg: regCount.String()},
+		},
+		{
+			name:   "closed VM",
+			call:   func() error { return closedVM.Map(alignedBuffer(t, int(page)), 0x200000, MemRead) },
+			target: ErrVMClosed,
+			want:   OpError{Op: "map", GPA: 0x200000, Size: page},
+		},
+		{
+			name: "vCPU of closed VM",
+			call: func() error {
+				_, err := closedVM.NewVCPU()
+				return err
+			},
+			target: ErrVMClosed,
+			want:   OpError{Op: "create vCPU"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.call()
+			if !errors.Is(err, tt.target) {
+				t.Fatalf("error %v does not match %v", err, tt.target)
+			}
+			var opErr *OpError
+			if !errors.As(err, &opErr) {
+				t.Fatalf("error %v is not an *OpError", err)
+			}
+			got := *opErr
+			got.Err = nil
+			if got != tt.want {
+				t.Errorf("OpError = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	vcpu.Close()
+	if _, err := vcpu.GetPC(); !errors.Is(err, ErrVCPUClosed) {
+		t.Errorf("GetPC after Close = %v, want %v", err, ErrVCPUClosed)
+	}
+	if _, err := vcpu.Run(); !errors.Is(err, ErrVCPUClosed) {
+		t.Errorf("Run after Close = %v, want %v", err, ErrVCPUClosed)
+	}
+}
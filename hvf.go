@@ -0,0 +1,159 @@
+//go:build darwin && arm64
+
+package hypervisor
+
+/*
+#cgo darwin LDFLAGS: -framework Hypervisor
+#include <Hypervisor/hv.h>
+#include <Hypervisor/hv_error.h>
+#include <Hypervisor/hv_vm.h>
+#include <Hypervisor/hv_vm_config.h>
+#include <Hypervisor/hv_base.h>
+#include <Hypervisor/hv_vcpu.h>
+#include <Hypervisor/hv_vcpu_config.h>
+#include <os/object.h>
+#if __has_include(<Hypervisor/arm64/hv_arch_vcpu.h>)
+#include <Hypervisor/arm64/hv_arch_vcpu.h>
+#endif
+#if __has_include(<Hypervisor/arm64/hv_arch_vtimer.h>)
+#include <Hypervisor/arm64/hv_arch_vtimer.h>
+#endif
+
+// Helper function to create and configure a VM with proper error handling
+static hv_return_t go_hv_vm_create_with_cfg() {
+#if __has_include(<Hypervisor/hv_vm_config.h>)
+	hv_vm_config_t config = hv_vm_config_create();
+	if (!config) {
+		return HV_ERROR;
+	}
+
+	// Get and set default IPA size
+	uint32_t default_ipa_size = 0;
+	hv_return_t ret = hv_vm_config_get_default_ipa_size(&default_ipa_size);
+	if (ret == HV_SUCCESS) {
+		ret = hv_vm_config_set_ipa_size(config, default_ipa_size);
+		if (ret != HV_SUCCESS) {
+			os_release(config);
+			return ret;
+		}
+	}
+
+	// Create the VM with the configuration
+	ret = hv_vm_create(config);
+	os_release(config);
+	return ret;
+#else
+	// Fallback for older macOS versions without hv_vm_config
+	return hv_vm_create(NULL);
+#endif
+}
+
+// Helper function to create a vCPU with proper ARM64 API
+static hv_return_t go_hv_vcpu_create(hv_vcpu_t *vcpu, hv_vcpu_exit_t **exit) {
+	// For now, create with NULL config (uses defaults)
+	hv_return_t ret = hv_vcpu_create(vcpu, exit, NULL);
+	if (ret != HV_SUCCESS) {
+		return ret;
+	}
+	// Route BRK and other debug exceptions to the host so they show up as
+	// exits instead of being delivered to the guest's vector table.
+	ret = hv_vcpu_set_trap_debug_exceptions(*vcpu, true);
+	if (ret != HV_SUCCESS) {
+		hv_vcpu_destroy(*vcpu);
+	}
+	return ret;
+}
+*/
+import "C"
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+func init() {
+	RegisterBackend("hvf", func() (Backend, error) { return &hvfBackend{}, nil })
+	platformBackend = "hvf"
+}
+
+var (
+	vmMu     sync.RWMutex // Use RWMutex for better read performance
+	vmActive bool
+	vmCount  int32 // Atomic counter for debugging
+)
+
+// hvfBackend drives Apple's Hypervisor.framework. The framework allows a
+// single VM per process, so all instances share the vmActive flag.
+type hvfBackend struct{}
+
+func (b *hvfBackend) Name() string { return "hvf" }
+
+func (b *hvfBackend) CreateVM() error {
+	vmMu.Lock()
+	defer vmMu.Unlock()
+
+	// Security: Double-check to prevent race conditions
+	if vmActive {
+		return ErrVMAlreadyActive
+	}
+
+	ret := C.go_hv_vm_create_with_cfg()
+	if err := hvErr(ret); err != nil {
+		return err
+	}
+
+	// Security: Atomic updates to prevent race conditions
+	vmActive = true
+	atomic.AddInt32(&vmCount, 1)
+	return nil
+}
+
+func (b *hvfBackend) DestroyVM() error {
+	vmMu.Lock()
+	defer vmMu.Unlock()
+
+	// Security: Check global state under lock
+	if !vmActive {
+		return nil
+	}
+
+	ret := C.hv_vm_destroy()
+	if err := hvErr(ret); err != nil {
+		return err
+	}
+
+	// Security: Atomic updates to prevent race conditions
+	vmActive = false
+	atomic.AddInt32(&vmCount, -1)
+	return nil
+}
+
+func (b *hvfBackend) CreateVCPU() (BackendVCPU, error) {
+	var vcpu C.hv_vcpu_t
+	var exit *C.hv_vcpu_exit_t
+	ret := C.go_hv_vcpu_create(&vcpu, &exit)
+	if err := hvErr(ret); err != nil {
+		return nil, err
+	}
+	return &hvfVCPU{id: uint64(vcpu), exit: exit}, nil
+}
+
+// hvfVCPU is a Hypervisor.framework vCPU handle.
+type hvfVCPU struct {
+	id      uint64
+	exit    *C.hv_vcpu_exit_t // written by the framework on every hv_vcpu_run
+	pending [FIQ + 1]bool     // interrupt lines, re-asserted before each run
+}
+
+func (v *hvfVCPU) ID() uint64 { return v.id }
+
+func (v *hvfVCPU) Destroy() error {
+	return hvErr(C.hv_vcpu_destroy(C.hv_vcpu_t(v.id)))
+}
+
+func hvErr(code C.hv_return_t) error {
+	if code == 0 {
+		return nil
+	}
+	return HVError{Code: uint32(code)}
+}
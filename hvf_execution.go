@@ -0,0 +1,75 @@
+//go:build darwin && arm64
+
+package hypervisor
+
+/*
+#cgo darwin LDFLAGS: -framework Hypervisor
+#include <Hypervisor/hv_vcpu.h>
+#include <Hypervisor/hv_vcpu_types.h>
+*/
+import "C"
+
+// hvInterrupt returns the framework's interrupt type for t.
+func hvInterrupt(t InterruptType) C.hv_interrupt_type_t {
+	if t == FIQ {
+		return C.HV_INTERRUPT_TYPE_FIQ
+	}
+	return C.HV_INTERRUPT_TYPE_IRQ
+}
+
+func (v *hvfVCPU) SetPendingInterrupt(t InterruptType, pending bool) error {
+	v.pending[t] = pending
+	return hvErr(C.hv_vcpu_set_pending_interrupt(C.hv_vcpu_t(v.id), hvInterrupt(t), C.bool(pending)))
+}
+
+func (v *hvfVCPU) GetVTimerMask() (bool, error) {
+	var masked C.bool
+	if err := hvErr(C.hv_vcpu_get_vtimer_mask(C.hv_vcpu_t(v.id), &masked)); err != nil {
+		return false, err
+	}
+	return bool(masked), nil
+}
+
+func (v *hvfVCPU) SetVTimerMask(masked bool) error {
+	return hvErr(C.hv_vcpu_set_vtimer_mask(C.hv_vcpu_t(v.id), C.bool(masked)))
+}
+
+func (v *hvfVCPU) Run() (ExitInfo, error) {
+	var info ExitInfo
+	// The framework only keeps a pending interrupt for one run, so raised
+	// lines are asserted again before each.
+	for t, pending := range v.pending {
+		if !pending {
+			continue
+		}
+		if err := hvErr(C.hv_vcpu_set_pending_interrupt(C.hv_vcpu_t(v.id), hvInterrupt(InterruptType(t)), true)); err != nil {
+			return info, err
+		}
+	}
+	ret := C.hv_vcpu_run(C.hv_vcpu_t(v.id))
+	if err := hvErr(ret); err != nil {
+		return info, err
+	}
+
+	// The exit record hv_vcpu_create returned is updated in place by each
+	// hv_vcpu_run and stays valid until the vCPU is destroyed.
+	switch v.exit.reason {
+	case C.HV_EXIT_REASON_CANCELED:
+		info.Reason = ExitCanceled
+	case C.HV_EXIT_REASON_EXCEPTION:
+		info.Reason = ExitException
+		info.ESR = uint64(v.exit.exception.syndrome)
+		info.FAR = uint64(v.exit.exception.virtual_address)
+		info.IPA = uint64(v.exit.exception.physical_address)
+	case C.HV_EXIT_REASON_VTIMER_ACTIVATED:
+		info.Reason = ExitTimer
+	default:
+		info.Reason = ExitUnknown
+	}
+	return info, nil
+}
+
+func (v *hvfVCPU) Exit() error {
+	vcpu := C.hv_vcpu_t(v.id)
+	return hvErr(C.hv_vcpus_exit(&vcpu, 1))
+}
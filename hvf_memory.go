@@ -0,0 +1,110 @@
+//go:build darwin && arm64
+
+package hypervisor
+
+/*
+#include <Hypervisor/hv.h>
+#include <Hypervisor/hv_error.h>
+
+#ifndef HV_MEMORY_READ
+#define HV_MEMORY_READ (1<<0)
+#endif
+#ifndef HV_MEMORY_WRITE
+#define HV_MEMORY_WRITE (1<<1)
+#endif
+#ifndef HV_MEMORY_EXEC
+#define HV_MEMORY_EXEC (1<<2)
+#endif
+
+extern int hv_vm_map(void* uva, unsigned long long gpa, size_t size, int flags);
+extern int hv_vm_unmap(unsigned long long gpa, size_t size);
+extern int hv_vm_protect(unsigned long long gpa, size_t size, int flags);
+
+// Wrapper to construct flags using framework macros without exposing values to Go.
+static int go_hv_vm_map(void* addr, unsigned long long gpa, unsigned long long size, int r, int w, int x) {
+	int flags = 0;
+	if (r) flags |= HV_MEMORY_READ;
+	if (w) flags |= HV_MEMORY_WRITE;
+	if (x) flags |= HV_MEMORY_EXEC;
+	return hv_vm_map(addr, gpa, (size_t)size, flags);
+}
+
+static int go_hv_vm_unmap(unsigned long long gpa, unsigned long long size) {
+	return hv_vm_unmap(gpa, (size_t)size);
+}
+
+static int go_hv_vm_protect(unsigned long long gpa, unsigned long long size, int r, int w, int x) {
+	int flags = 0;
+	if (r) flags |= HV_MEMORY_READ;
+	if (w) flags |= HV_MEMORY_WRITE;
+	if (x) flags |= HV_MEMORY_EXEC;
+	return hv_vm_protect(gpa, (size_t)size, flags);
+}
+*/
+import "C"
+
+import (
+	"runtime"
+	"unsafe"
+)
+
+// hvfChunk bounds the size of each Hypervisor.framework memory call, which
+// rejects very large ranges. Larger ranges are split transparently.
+const hvfChunk = 1 << 30
+
+func (b *hvfBackend) Map(host []byte, guestPhys uint64, perms MemPerm) error {
+	// Pin the memory before passing to C to prevent GC from moving it
+	runtime.KeepAlive(host)
+	defer runtime.KeepAlive(host)
+
+	read, write, exec := permFlags(perms)
+	size := uint64(len(host))
+	for off := uint64(0); off < size; off += hvfChunk {
+		n := min(size-off, hvfChunk)
+		ptr := unsafe.Pointer(&host[off])
+		ret := C.go_hv_vm_map(ptr, C.ulonglong(guestPhys+off), C.ulonglong(n), read, write, exec)
+		if err := hvErr(ret); err != nil {
+			if off > 0 {
+				b.Unmap(guestPhys, off)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *hvfBackend) Unmap(guestPhys, size uint64) error {
+	for off := uint64(0); off < size; off += hvfChunk {
+		n := min(size-off, hvfChunk)
+		if err := hvErr(C.go_hv_vm_unmap(C.ulonglong(guestPhys+off), C.ulonglong(n))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *hvfBackend) Protect(guestPhys, size uint64, perms MemPerm) error {
+	read, write, exec := permFlags(perms)
+	for off := uint64(0); off < size; off += hvfChunk {
+		n := min(size-off, hvfChunk)
+		ret := C.go_hv_vm_protect(C.ulonglong(guestPhys+off), C.ulonglong(n), read, write, exec)
+		if err := hvErr(ret); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// permFlags splits perms into the arguments of the C wrappers.
+func permFlags(perms MemPerm) (read, write, exec C.int) {
+	if perms&MemRead != 0 {
+		read = 1
+	}
+	if perms&MemWrite != 0 {
+		write = 1
+	}
+	if perms&MemExec != 0 {
+		exec = 1
+	}
+	return read, write, exec
+}
@@ -0,0 +1,180 @@
+//go:build darwin && arm64
+
+package hypervisor
+
+/*
+#cgo darwin LDFLAGS: -framework Hypervisor
+#include <string.h>
+#include <Hypervisor/hv_vcpu.h>
+#include <Hypervisor/hv_vcpu_types.h>
+
+// hv_simd_fp_uchar16_t is a vector type cgo cannot pass, so copy through
+// plain byte arrays.
+static hv_return_t go_hv_get_simd(hv_vcpu_t vcpu, hv_simd_fp_reg_t reg, uint8_t out[16]) {
+	hv_simd_fp_uchar16_t v;
+	hv_return_t ret = hv_vcpu_get_simd_fp_reg(vcpu, reg, &v);
+	if (ret == HV_SUCCESS) {
+		memcpy(out, &v, 16);
+	}
+	return ret;
+}
+
+static hv_return_t go_hv_set_simd(hv_vcpu_t vcpu, hv_simd_fp_reg_t reg, const uint8_t in[16]) {
+	hv_simd_fp_uchar16_t v;
+	memcpy(&v, in, 16);
+	return hv_vcpu_set_simd_fp_reg(vcpu, reg, v);
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+func (v *hvfVCPU) GetReg(r Reg) (uint64, error) {
+	var val C.ulonglong
+	var ret C.hv_return_t
+
+	// Use system register API for SP
+	if r == RegSP {
+		ret = C.hv_vcpu_get_sys_reg(C.hv_vcpu_t(v.id), C.HV_SYS_REG_SP_EL0, &val)
+	} else {
+		// Security: Additional validation for register mapping
+		hvReg := regToHV(r)
+		if hvReg == C.HV_REG_X0 && r != RegX0 {
+			return 0, fmt.Errorf("hv: register mapping failed for %d", r)
+		}
+		ret = C.hv_vcpu_get_reg(C.hv_vcpu_t(v.id), hvReg, &val)
+	}
+
+	if err := hvErr(ret); err != nil {
+		return 0, err
+	}
+	return uint64(val), nil
+}
+
+func (v *hvfVCPU) SetReg(r Reg, val uint64) error {
+	var ret C.hv_return_t
+
+	// Use system register API for SP
+	if r == RegSP {
+		ret = C.hv_vcpu_set_sys_reg(C.hv_vcpu_t(v.id), C.HV_SYS_REG_SP_EL0, C.ulonglong(val))
+	} else {
+		// Security: Additional validation for register mapping
+		hvReg := regToHV(r)
+		if hvReg == C.HV_REG_X0 && r != RegX0 {
+			return fmt.Errorf("hv: register mapping failed for %d", r)
+		}
+		ret = C.hv_vcpu_set_reg(C.hv_vcpu_t(v.id), hvReg, C.ulonglong(val))
+	}
+
+	return hvErr(ret)
+}
+
+// GetSysReg reads a system register. SysReg values are hv_sys_reg_t
+// encodings.
+func (v *hvfVCPU) GetSysReg(r SysReg) (uint64, error) {
+	var val C.ulonglong
+	if err := hvErr(C.hv_vcpu_get_sys_reg(C.hv_vcpu_t(v.id), C.hv_sys_reg_t(r), &val)); err != nil {
+		return 0, err
+	}
+	return uint64(val), nil
+}
+
+func (v *hvfVCPU) SetSysReg(r SysReg, val uint64) error {
+	return hvErr(C.hv_vcpu_set_sys_reg(C.hv_vcpu_t(v.id), C.hv_sys_reg_t(r), C.ulonglong(val)))
+}
+
+func (v *hvfVCPU) GetSIMD(q SIMDReg) ([16]byte, error) {
+	var val [16]byte
+	ret := C.go_hv_get_simd(C.hv_vcpu_t(v.id), C.hv_simd_fp_reg_t(q), (*C.uint8_t)(unsafe.Pointer(&val[0])))
+	if err := hvErr(ret); err != nil {
+		return [16]byte{}, err
+	}
+	return val, nil
+}
+
+func (v *hvfVCPU) SetSIMD(q SIMDReg, val [16]byte) error {
+	ret := C.go_hv_set_simd(C.hv_vcpu_t(v.id), C.hv_simd_fp_reg_t(q), (*C.uint8_t)(unsafe.Pointer(&val[0])))
+	return hvErr(ret)
+}
+
+// regToHV maps our Reg enum to the Hypervisor framework hv_reg_t constants.
+func regToHV(r Reg) C.hv_reg_t {
+	switch r {
+	case RegX0:
+		return C.HV_REG_X0
+	case RegX1:
+		return C.HV_REG_X1
+	case RegX2:
+		return C.HV_REG_X2
+	case RegX3:
+		return C.HV_REG_X3
+	case RegX4:
+		return C.HV_REG_X4
+	case RegX5:
+		return C.HV_REG_X5
+	case RegX6:
+		return C.HV_REG_X6
+	case RegX7:
+		return C.HV_REG_X7
+	case RegX8:
+		return C.HV_REG_X8
+	case RegX9:
+		return C.HV_REG_X9
+	case RegX10:
+		return C.HV_REG_X10
+	case RegX11:
+		return C.HV_REG_X11
+	case RegX12:
+		return C.HV_REG_X12
+	case RegX13:
+		return C.HV_REG_X13
+	case RegX14:
+		return C.HV_REG_X14
+	case RegX15:
+		return C.HV_REG_X15
+	case RegX16:
+		return C.HV_REG_X16
+	case RegX17:
+		return C.HV_REG_X17
+	case RegX18:
+		return C.HV_REG_X18
+	case RegX19:
+		return C.HV_REG_X19
+	case RegX20:
+		return C.HV_REG_X20
+	case RegX21:
+		return C.HV_REG_X21
+	case RegX22:
+		return C.HV_REG_X22
+	case RegX23:
+		return C.HV_REG_X23
+	case RegX24:
+		return C.HV_REG_X24
+	case RegX25:
+		return C.HV_REG_X25
+	case RegX26:
+		return C.HV_REG_X26
+	case RegX27:
+		return C.HV_REG_X27
+	case RegX28:
+		return C.HV_REG_X28
+	case RegFP:
+		return C.HV_REG_FP
+	case RegLR:
+		return C.HV_REG_LR
+	case RegPC:
+		return C.HV_REG_PC
+	case RegCPSR:
+		return C.HV_REG_CPSR
+	case RegFPCR:
+		return C.HV_REG_FPCR
+	case RegFPSR:
+		return C.HV_REG_FPSR
+	default:
+		// This should not happen due to validation in GetReg/SetReg
+		return C.HV_REG_X0
+	}
+}
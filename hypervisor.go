@@ -1,63 +1,6 @@
-//go:build darwin && arm64
-
 package hypervisor
 
-/*
-#cgo darwin LDFLAGS: -framework Hypervisor
-#include <Hypervisor/hv.h>
-#include <Hypervisor/hv_error.h>
-#include <Hypervisor/hv_vm.h>
-#include <Hypervisor/hv_vm_config.h>
-#include <Hypervisor/hv_base.h>
-#include <Hypervisor/hv_vcpu.h>
-#include <Hypervisor/hv_vcpu_config.h>
-#include <os/object.h>
-#if __has_include(<Hypervisor/arm64/hv_arch_vcpu.h>)
-#include <Hypervisor/arm64/hv_arch_vcpu.h>
-#endif
-#if __has_include(<Hypervisor/arm64/hv_arch_vtimer.h>)
-#include <Hypervisor/arm64/hv_arch_vtimer.h>
-#endif
-
-// Helper function to create and configure a VM with proper error handling
-static hv_return_t go_hv_vm_create_with_cfg() {
-#if __has_include(<Hypervisor/hv_vm_config.h>)
-	hv_vm_config_t config = hv_vm_config_create();
-	if (!config) {
-		return HV_ERROR;
-	}
-
-	// Get and set default IPA size
-	uint32_t default_ipa_size = 0;
-	hv_return_t ret = hv_vm_config_get_default_ipa_size(&default_ipa_size);
-	if (ret == HV_SUCCESS) {
-		ret = hv_vm_config_set_ipa_size(config, default_ipa_size);
-		if (ret != HV_SUCCESS) {
-			os_release(config);
-			return ret;
-		}
-	}
-
-	// Create the VM with the configuration
-	ret = hv_vm_create(config);
-	os_release(config);
-	return ret;
-#else
-	// Fallback for older macOS versions without hv_vm_config
-	return hv_vm_create(NULL);
-#endif
-}
-
-// Helper function to create a vCPU with proper ARM64 API
-static hv_return_t go_hv_vcpu_create(hv_vcpu_t *vcpu, hv_vcpu_exit_t **exit) {
-	// For now, create with NULL config (uses defaults)
-	return hv_vcpu_create(vcpu, exit, NULL);
-}
-*/
-import "C"
-
 import (
-	"fmt"
 	"runtime"
 	"sync"
 	"sync/atomic"
@@ -111,113 +54,194 @@ const (
 	RegSP // Stack pointer (SP_EL0)
 	RegPC
 	RegCPSR
+	RegFPCR
+	RegFPSR
+
+	// regCount is the number of Reg values.
+	regCount
+)
+
+// SIMDReg names one of the 128-bit SIMD&FP registers Q0-Q31.
+type SIMDReg int
+
+const (
+	RegQ0 SIMDReg = iota
+	RegQ1
+	RegQ2
+	RegQ3
+	RegQ4
+	RegQ5
+	RegQ6
+	RegQ7
+	RegQ8
+	RegQ9
+	RegQ10
+	RegQ11
+	RegQ12
+	RegQ13
+	RegQ14
+	RegQ15
+	RegQ16
+	RegQ17
+	RegQ18
+	RegQ19
+	RegQ20
+	RegQ21
+	RegQ22
+	RegQ23
+	RegQ24
+	RegQ25
+	RegQ26
+	RegQ27
+	RegQ28
+	RegQ29
+	RegQ30
+	RegQ31
 )
 
 // ExitReason categorizes vCPU exits.
 type ExitReason int
 
 const (
-	ExitUnknown ExitReason = iota
-	ExitException
-	ExitTimer
+	ExitUnknown   ExitReason = iota
+	ExitException            // guest exception, see ExitInfo.ESR
+	ExitTimer                // virtual timer fired, see VCPU.SyncVTimer
+	ExitCanceled             // run was interrupted by the host
 )
 
-// ExitInfo captures information about a recent vCPU exit.
-type ExitInfo struct {
-	Reason ExitReason
-	ESR    uint64
-	FAR    uint64
-}
-
 // VM represents a single hypervisor VM instance.
 type VM struct {
-	closed  bool
-	closeMu sync.Mutex // Protect against concurrent Close() and finalizer
+	backend   Backend
+	regions   regionTable
+	baseline  *Checkpoint // the checkpoint memory was last made to match, guarded by regions.mu
+	mmio      mmioBus
+	owned     []hostAlloc // host memory allocated by the library, guarded by regions.mu
+	metrics   *metricSet
+	observers observerList
+	permFault atomic.Pointer[PermissionFaultHandler]
+	closed    bool
+	closeMu   sync.Mutex // Serializes Close, the finalizer and operations that must not race them
+
+	vcpuMu sync.Mutex
+	vcpus  []*VCPU // open vCPUs in creation order
 }
 
 // VCPU represents a single vCPU associated with a VM.
 type VCPU struct {
 	id      uint64
+	vm      *VM
+	impl    BackendVCPU
+	metrics *metricSet
 	closed  bool
 	closeMu sync.Mutex // Protect against concurrent Close() and finalizer
-}
 
-var (
-	vmMu     sync.RWMutex // Use RWMutex for better read performance
-	vmActive bool
-	vmCount  int32 // Atomic counter for debugging
-)
+	// Guarded by closeMu. While running, only the running goroutine uses
+	// impl (other than impl.Exit); runDone is closed when the run ends.
+	running       bool
+	runDone       chan struct{}
+	exitRequested bool
+	lines         [FIQ + 1]bool // interrupt lines SetPendingInterrupt raised
+	vtimerIRQ     bool          // IRQ raised by SyncVTimer
+
+	// applied are the interrupt lines the backend has, only used by the
+	// goroutine running the vCPU.
+	applied [FIQ + 1]bool
+}
 
-// NewVM creates a new Hypervisor VM for this process.
+// NewVM creates a new VM for this process using the default backend.
+//
+// The default is the platform backend (Hypervisor.framework on Darwin ARM64)
+// unless overridden with the HV_BACKEND environment variable.
 func NewVM() (*VM, error) {
+	return NewVMWithBackend(DefaultBackend())
+}
+
+// NewVMWithBackend creates a new VM using the backend registered under name.
+func NewVMWithBackend(name string) (*VM, error) {
+	metrics := newVMMetrics()
 	start := time.Now()
 	defer func() {
-		recordVMCreate(time.Since(start))
+		metrics.recordVMCreate(time.Since(start))
 	}()
 
-	vmMu.Lock()
-	defer vmMu.Unlock()
-
-	// Security: Double-check to prevent race conditions
-	if vmActive {
-		recordResourceError()
-		return nil, ErrVMAlreadyActive
+	backend, err := openBackend(name)
+	if err != nil {
+		metrics.recordResourceError()
+		return nil, &OpError{Op: "create VM", Err: err}
 	}
 
-	ret := C.go_hv_vm_create_with_cfg()
-	if err := hvErr(ret); err != nil {
-		recordResourceError()
-		return nil, err
+	if err := backend.CreateVM(); err != nil {
+		metrics.recordResourceError()
+		return nil, &OpError{Op: "create VM", Err: err}
 	}
 
-	// Security: Atomic updates to prevent race conditions
-	vmActive = true
-	atomic.AddInt32(&vmCount, 1)
-	vm := &VM{closed: false}
+	vm := &VM{backend: backend, metrics: metrics, closed: false}
+	vm.observers.list = globalObservers.snapshot()
+	metrics.register()
 
 	// Set finalizer as safety net in case Close() is not called
 	runtime.SetFinalizer(vm, (*VM).finalize)
 
+	vm.notify(func(o Observer) { o.VMCreated(vm) })
 	return vm, nil
 }
 
-// Close destroys the Hypervisor VM. Idempotent.
+// Backend returns the backend this VM delegates to.
+func (vm *VM) Backend() Backend {
+	if vm == nil {
+		return nil
+	}
+	return vm.backend
+}
+
+// Close destroys the VM. Idempotent.
 func (vm *VM) Close() error {
 	if vm == nil {
 		return nil
 	}
+	destroyed, err := vm.destroy()
+	if err != nil {
+		return &OpError{Op: "close VM", Err: err}
+	}
+	if destroyed {
+		vm.notify(func(o Observer) { o.VMClosed(vm) })
+	}
+	return nil
+}
 
+// destroy does the work of Close, reporting whether this call destroyed
+// the VM.
+func (vm *VM) destroy() (bool, error) {
 	// Security: Lock instance first to prevent finalizer race
 	vm.closeMu.Lock()
 	defer vm.closeMu.Unlock()
 
 	if vm.closed {
-		return nil // Already closed
-	}
-
-	vmMu.Lock()
-	defer vmMu.Unlock()
-
-	// Security: Check global state under lock
-	if !vmActive {
-		return nil
+		return false, nil // Already closed
 	}
 
-	ret := C.hv_vm_destroy()
-	if err := hvErr(ret); err != nil {
-		return fmt.Errorf("failed to destroy VM: %w", err)
+	if err := vm.backend.DestroyVM(); err != nil {
+		return false, err
 	}
 
-	// Security: Atomic updates to prevent race conditions
-	vm.closed = true
-	vmActive = false
-	atomic.AddInt32(&vmCount, -1)
+	vm.release(true)
 
 	// Clear finalizer since we've cleaned up properly
 	runtime.SetFinalizer(vm, nil)
+	return true, nil
+}
 
-	recordVMDestroy()
-	return nil
+// release marks the VM closed once its backend VM is gone and settles its
+// memory and metrics. The memory is only freed if the backend destroyed the
+// VM; otherwise it may still be in use.
+func (vm *VM) release(destroyed bool) {
+	vm.closed = true
+	vm.metrics.recordUnmapped(vm.regions.clear())
+	if destroyed {
+		vm.freeOwned()
+	}
+	vm.metrics.recordVMDestroy()
+	vm.metrics.unregister()
 }
 
 // finalize is called by the garbage collector as a safety net
@@ -230,66 +254,153 @@ func (vm *VM) finalize() {
 		defer vm.closeMu.Unlock()
 		if !vm.closed {
 			// Direct cleanup without calling Close() to avoid potential deadlocks
-			// Mark as closed first
-			vm.closed = true
-
-			// Best effort cleanup of hypervisor resources
-			if vmActive {
-				C.hv_vm_destroy()
-				vmActive = false
-				atomic.AddInt32(&vmCount, -1)
-			}
+			// Best effort cleanup of backend resources
+			vm.release(vm.backend.DestroyVM() == nil)
 		}
 	}
 }
 
-// NewVCPU creates a new vCPU for the active VM.
+// NewVCPU creates a new vCPU for the VM. Each vCPU owns a goroutine locked
+// to an OS thread, and all of its methods execute there, so a VCPU may be
+// used from any goroutine and several vCPUs may run in parallel.
 func (vm *VM) NewVCPU() (*VCPU, error) {
+	c, err := vm.newVCPU()
+	if err != nil {
+		return nil, &OpError{Op: "create vCPU", Err: err}
+	}
+	vm.notify(func(o Observer) { o.VCPUCreated(c) })
+	return c, nil
+}
+
+func (vm *VM) newVCPU() (*VCPU, error) {
 	if vm == nil {
-		return nil, fmt.Errorf("hv: VM is nil")
+		return nil, errVMNil
+	}
+
+	// Security: Hold closeMu so that Close cannot destroy the backend VM
+	// before the vCPU is created and recorded
+	vm.closeMu.Lock()
+	defer vm.closeMu.Unlock()
+
+	if vm.closed {
+		return nil, ErrVMClosed
 	}
-	var vcpu C.hv_vcpu_t
-	var exit *C.hv_vcpu_exit_t
-	ret := C.go_hv_vcpu_create(&vcpu, &exit)
-	if err := hvErr(ret); err != nil {
+
+	// The vCPU lives on its own locked OS thread; every call to it is
+	// forwarded there.
+	impl, err := newThreadVCPU(vm.backend)
+	if err != nil {
+		vm.metrics.recordResourceError()
 		return nil, err
 	}
 
-	c := &VCPU{id: uint64(vcpu), closed: false}
+	c := &VCPU{id: impl.ID(), vm: vm, impl: impl, metrics: newVCPUMetrics(vm.metrics, impl.ID()), closed: false}
+	c.metrics.register()
+
+	vm.vcpuMu.Lock()
+	vm.vcpus = append(vm.vcpus, c)
+	vm.vcpuMu.Unlock()
 
 	// Set finalizer as safety net in case Close() is not called
 	runtime.SetFinalizer(c, (*VCPU).finalize)
 
-	recordVCPUCreate()
+	c.metrics.recordVCPUCreate()
 	return c, nil
 }
 
+// VCPUs returns the VM's open vCPUs in the order they were created.
+func (vm *VM) VCPUs() []*VCPU {
+	if vm == nil {
+		return nil
+	}
+	vm.vcpuMu.Lock()
+	defer vm.vcpuMu.Unlock()
+	return append([]*VCPU(nil), vm.vcpus...)
+}
+
+// forget drops c from the VM's vCPU list.
+func (vm *VM) forget(c *VCPU) {
+	vm.vcpuMu.Lock()
+	defer vm.vcpuMu.Unlock()
+	for i, v := range vm.vcpus {
+		if v == c {
+			vm.vcpus = append(vm.vcpus[:i], vm.vcpus[i+1:]...)
+			return
+		}
+	}
+}
+
+// freeOwned releases host memory the library allocated for the VM. The
+// backend must no longer reference it.
+func (vm *VM) freeOwned() {
+	vm.regions.mu.Lock()
+	defer vm.regions.mu.Unlock()
+	for _, a := range vm.owned {
+		a.free()
+	}
+	vm.owned = nil
+}
+
+// ID returns the backend identifier of this vCPU.
+func (c *VCPU) ID() uint64 {
+	if c == nil {
+		return 0
+	}
+	return c.id
+}
+
 // Close destroys this vCPU.
 func (c *VCPU) Close() error {
 	if c == nil {
 		return nil
 	}
+	destroyed, err := c.destroy()
+	if err != nil {
+		return &OpError{Op: "close vCPU", Err: err}
+	}
+	if destroyed {
+		c.vm.notify(func(o Observer) { o.VCPUClosed(c) })
+	}
+	return nil
+}
 
+// destroy does the work of Close, reporting whether this call destroyed
+// the vCPU.
+func (c *VCPU) destroy() (bool, error) {
 	// Security: Lock instance to prevent finalizer race
 	c.closeMu.Lock()
 	defer c.closeMu.Unlock()
 
 	if c.closed {
-		return nil // Already closed
+		return false, nil // Already closed
 	}
 
-	ret := C.hv_vcpu_destroy(C.hv_vcpu_t(c.id))
-	if err := hvErr(ret); err != nil {
-		return fmt.Errorf("failed to destroy vCPU: %w", err)
+	// Force a running guest out and wait for Run to give the vCPU back.
+	for c.running {
+		done := c.runDone
+		c.exitRequested = true
+		c.impl.Exit()
+		c.closeMu.Unlock()
+		<-done
+		c.closeMu.Lock()
+	}
+	if c.closed {
+		return false, nil
+	}
+
+	if err := c.impl.Destroy(); err != nil {
+		return false, err
 	}
 
 	c.closed = true
+	c.vm.forget(c)
 
 	// Clear finalizer since we've cleaned up properly
 	runtime.SetFinalizer(c, nil)
 
-	recordVCPUDestroy()
-	return nil
+	c.metrics.recordVCPUDestroy()
+	c.metrics.unregister()
+	return true, nil
 }
 
 // finalize is called by the garbage collector as a safety net
@@ -303,7 +414,9 @@ func (c *VCPU) finalize() {
 		if !c.closed {
 			// Log that we're using the finalizer (indicates a resource leak)
 			// Note: We can't use log package here as it might cause issues in finalizers
-			c.Close() // Best effort cleanup
+			c.closed = true
+			c.impl.Destroy() // Best effort cleanup
+			c.metrics.unregister()
 		}
 	}
 }
@@ -0,0 +1,178 @@
+package a64
+
+import "math/bits"
+
+// addWithCarry implements the AddWithCarry pseudocode for 32 or 64-bit
+// operands, returning the result and NZCV in bits 3:0.
+func addWithCarry(x, y uint64, carry uint64, sf bool) (uint64, uint64) {
+	if !sf {
+		x &= 0xFFFFFFFF
+		y &= 0xFFFFFFFF
+		sum := x + y + carry
+		result := sum & 0xFFFFFFFF
+		var nzcv uint64
+		if result>>31 != 0 {
+			nzcv |= 8
+		}
+		if result == 0 {
+			nzcv |= 4
+		}
+		if sum>>32 != 0 {
+			nzcv |= 2
+		}
+		if (^(x^y)&(x^result))>>31&1 != 0 {
+			nzcv |= 1
+		}
+		return result, nzcv
+	}
+
+	result, c1 := bits.Add64(x, y, carry)
+	var nzcv uint64
+	if result>>63 != 0 {
+		nzcv |= 8
+	}
+	if result == 0 {
+		nzcv |= 4
+	}
+	if c1 != 0 {
+		nzcv |= 2
+	}
+	if (^(x^y)&(x^result))>>63 != 0 {
+		nzcv |= 1
+	}
+	return result, nzcv
+}
+
+// logicFlags returns NZCV for a logical result (C and V cleared).
+func logicFlags(result uint64, sf bool) uint64 {
+	var nzcv uint64
+	if !sf {
+		result &= 0xFFFFFFFF
+		if result>>31 != 0 {
+			nzcv |= 8
+		}
+	} else if result>>63 != 0 {
+		nzcv |= 8
+	}
+	if result == 0 {
+		nzcv |= 4
+	}
+	return nzcv
+}
+
+// shiftReg applies an A64 register shift (LSL, LSR, ASR, ROR).
+func shiftReg(v uint64, shift uint32, amount uint32, sf bool) uint64 {
+	width := uint32(64)
+	if !sf {
+		width = 32
+		v &= 0xFFFFFFFF
+	}
+	amount %= width
+	switch shift {
+	case 0: // LSL
+		v <<= amount
+	case 1: // LSR
+		v >>= amount
+	case 2: // ASR
+		if sf {
+			v = uint64(int64(v) >> amount)
+		} else {
+			v = uint64(uint32(int32(uint32(v)) >> amount))
+		}
+	case 3: // ROR
+		if sf {
+			v = bits.RotateLeft64(v, -int(amount))
+		} else {
+			v = uint64(bits.RotateLeft32(uint32(v), -int(amount)))
+		}
+	}
+	if !sf {
+		v &= 0xFFFFFFFF
+	}
+	return v
+}
+
+// extendReg applies an A64 register extend (UXTB..SXTX) followed by a left
+// shift of 0-4.
+func extendReg(v uint64, option uint32, shift uint32) uint64 {
+	switch option {
+	case 0: // UXTB
+		v = uint64(uint8(v))
+	case 1: // UXTH
+		v = uint64(uint16(v))
+	case 2: // UXTW
+		v = uint64(uint32(v))
+	case 3: // UXTX
+	case 4: // SXTB
+		v = uint64(int64(int8(v)))
+	case 5: // SXTH
+		v = uint64(int64(int16(v)))
+	case 6: // SXTW
+		v = uint64(int64(int32(v)))
+	case 7: // SXTX
+	}
+	return v << shift
+}
+
+// signExtend sign extends the low n bits of v.
+func signExtend(v uint64, n uint) uint64 {
+	shift := 64 - n
+	return uint64(int64(v<<shift) >> shift)
+}
+
+// ones returns a value with the low n bits set.
+func ones(n uint32) uint64 {
+	if n >= 64 {
+		return ^uint64(0)
+	}
+	return 1<<n - 1
+}
+
+// ror rotates the low width bits of v right by amount.
+func ror(v uint64, amount, width uint32) uint64 {
+	if amount == 0 {
+		return v
+	}
+	v &= ones(width)
+	return (v>>amount | v<<(width-amount)) & ones(width)
+}
+
+// replicate repeats the low esize bits of v across width bits.
+func replicate(v uint64, esize, width uint32) uint64 {
+	var out uint64
+	for i := uint32(0); i < width; i += esize {
+		out |= v << i
+	}
+	return out & ones(width)
+}
+
+// decodeBitMasks implements DecodeBitMasks for logical immediates and
+// bitfield moves. It returns wmask, tmask and false if the encoding is
+// reserved.
+func decodeBitMasks(n, imms, immr uint32, immediate bool, width uint32) (uint64, uint64, bool) {
+	combined := n<<6 | (^imms & 0x3F)
+	if combined == 0 {
+		return 0, 0, false
+	}
+	length := uint32(bits.Len32(combined)) - 1
+	if length < 1 {
+		return 0, 0, false
+	}
+	levels := uint32(1)<<length - 1
+	if immediate && imms&levels == levels {
+		return 0, 0, false
+	}
+	s := imms & levels
+	r := immr & levels
+	diff := (s - r) & levels
+	esize := uint32(1) << length
+	if esize > width {
+		return 0, 0, false
+	}
+
+	welem := ones(s + 1)
+	telem := ones(diff + 1)
+	wmask := replicate(ror(welem, r, esize), esize, width)
+	tmask := replicate(telem, esize, width)
+	return wmask, tmask, true
+}
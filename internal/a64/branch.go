@@ -0,0 +1,197 @@
+package a64
+
+// execBranchSys handles "Branches, Exception Generating and System
+// instructions" (op0 = 101x).
+func (c *CPU) execBranchSys(insn uint32) {
+	switch {
+	case insn&0xFF000010 == 0x54000000: // B.cond
+		if c.condHolds(insn & 0xF) {
+			c.nextPC = c.PC + signExtend(uint64((insn>>5)&0x7FFFF)<<2, 21)
+		}
+
+	case insn&0xFF000000 == 0xD4000000:
+		c.execExceptionGen(insn)
+
+	case insn&0xFFC00000 == 0xD5000000:
+		c.execSystem(insn)
+
+	case insn&0xFE000000 == 0xD6000000:
+		c.execBranchReg(insn)
+
+	case insn&0x7C000000 == 0x14000000: // B, BL
+		if insn>>31 != 0 {
+			c.X[30] = c.PC + 4
+		}
+		c.nextPC = c.PC + signExtend(uint64(insn&0x3FFFFFF)<<2, 28)
+
+	case insn&0x7E000000 == 0x34000000: // CBZ, CBNZ
+		sf := insn>>31 != 0
+		v := c.x(insn & 31)
+		if !sf {
+			v &= 0xFFFFFFFF
+		}
+		if (v == 0) == (insn&(1<<24) == 0) {
+			c.nextPC = c.PC + signExtend(uint64((insn>>5)&0x7FFFF)<<2, 21)
+		}
+
+	case insn&0x7E000000 == 0x36000000: // TBZ, TBNZ
+		bit := (insn>>31)<<5 | (insn>>19)&0x1F
+		set := c.x(insn&31)>>bit&1 != 0
+		if set == (insn&(1<<24) != 0) {
+			c.nextPC = c.PC + signExtend(uint64((insn>>5)&0x3FFF)<<2, 16)
+		}
+
+	default:
+		c.undefined()
+	}
+}
+
+// execExceptionGen implements SVC, HVC, SMC and BRK, all of which stop the
+// interpreter with the matching syndrome.
+func (c *CPU) execExceptionGen(insn uint32) {
+	opc := (insn >> 21) & 7
+	ll := insn & 3
+	imm16 := (insn >> 5) & 0xFFFF
+	if (insn>>2)&7 != 0 {
+		c.undefined()
+		return
+	}
+
+	switch {
+	case opc == 0 && ll == 1:
+		c.exception(ECSVC64, imm16, 0, 0)
+	case opc == 0 && ll == 2:
+		c.exception(ECHVC64, imm16, 0, 0)
+	case opc == 0 && ll == 3:
+		c.exception(ECSMC64, imm16, 0, 0)
+	case opc == 1 && ll == 0:
+		c.exception(ECBRK64, imm16, 0, 0)
+	default:
+		c.undefined()
+	}
+}
+
+// execBranchReg implements BR, BLR, RET and ERET, treating the pointer
+// authentication variants as their plain counterparts.
+func (c *CPU) execBranchReg(insn uint32) {
+	opc := (insn >> 21) & 0xF
+	op2 := (insn >> 16) & 0x1F
+	op3 := (insn >> 10) & 0x3F
+	rn := (insn >> 5) & 31
+	if op2 != 0x1F || (op3 != 0 && op3 != 2 && op3 != 3) {
+		c.undefined()
+		return
+	}
+
+	switch opc {
+	case 0, 8: // BR, BRAA*
+		c.nextPC = c.x(rn)
+	case 1, 9: // BLR, BLRAA*
+		target := c.x(rn)
+		c.X[30] = c.PC + 4
+		c.nextPC = target
+	case 2: // RET, RETAA/RETAB
+		if op3 != 0 {
+			rn = 30
+		}
+		c.nextPC = c.x(rn)
+	case 4: // ERET
+		if rn != 31 || c.el() == 0 {
+			c.undefined()
+			return
+		}
+		c.PSTATE = c.Sys[SysSPSR_EL1]
+		c.nextPC = c.Sys[SysELR_EL1]
+		c.monitorValid = false
+	default:
+		c.undefined()
+	}
+}
+
+// execSystem implements hints, barriers, PSTATE writes, cache maintenance
+// and MRS/MSR.
+func (c *CPU) execSystem(insn uint32) {
+	l := (insn >> 21) & 1
+	op0 := (insn >> 19) & 3
+	op1 := (insn >> 16) & 7
+	crn := (insn >> 12) & 0xF
+	crm := (insn >> 8) & 0xF
+	op2 := (insn >> 5) & 7
+	rt := insn & 31
+
+	switch {
+	case op0 == 0 && l == 0 && crn == 2 && op1 == 3 && rt == 31: // hints
+		switch crm<<3 | op2 {
+		case 2: // WFE
+			c.exception(ECWFx, 1<<24|0xE<<20|1, 0, 0)
+		case 3: // WFI
+			c.exception(ECWFx, 1<<24|0xE<<20, 0, 0)
+		}
+		// NOP, YIELD, SEV, BTI, PAC hints and friends have no effect here.
+
+	case op0 == 0 && l == 0 && crn == 3 && op1 == 3 && rt == 31: // barriers
+		if op2 == 2 { // CLREX
+			c.monitorValid = false
+		}
+
+	case op0 == 0 && l == 0 && crn == 4 && rt == 31: // MSR (immediate)
+		c.msrImmediate(op1, op2, crm)
+
+	case op0 == 1: // SYS, SYSL
+		if l == 0 && op1 == 3 && crn == 7 && crm == 4 && op2 == 1 { // DC ZVA
+			var zero [dczBlockSize]byte
+			c.access(c.x(rt)&^(dczBlockSize-1), zero[:], AccessWrite, 0)
+			return
+		}
+		if l == 1 {
+			c.undefined()
+		}
+		// Remaining cache and TLB maintenance is a no-op without caches or an MMU.
+
+	case op0 >= 2: // MRS, MSR (register)
+		key := uint16((insn >> 5) & 0xFFFF)
+		if l == 1 {
+			v, ok := c.readSysReg(key)
+			if !ok {
+				c.trapSysReg(insn)
+				return
+			}
+			c.setX(rt, v, true)
+		} else if !c.writeSysReg(key, c.x(rt)) {
+			c.trapSysReg(insn)
+		}
+
+	default:
+		c.undefined()
+	}
+}
+
+// msrImmediate implements the PSTATE field writes.
+func (c *CPU) msrImmediate(op1, op2, crm uint32) {
+	switch op1<<3 | op2 {
+	case 0x05: // SPSel
+		if c.el() == 0 {
+			c.undefined()
+			return
+		}
+		c.PSTATE = c.PSTATE&^1 | uint64(crm&1)
+	case 0x1E: // DAIFSet
+		c.PSTATE |= uint64(crm) << 6
+	case 0x1F: // DAIFClr
+		c.PSTATE &^= uint64(crm) << 6
+	}
+}
+
+// trapSysReg raises the MSR/MRS trap syndrome for insn.
+func (c *CPU) trapSysReg(insn uint32) {
+	op0 := (insn >> 19) & 3
+	op1 := (insn >> 16) & 7
+	crn := (insn >> 12) & 0xF
+	crm := (insn >> 8) & 0xF
+	op2 := (insn >> 5) & 7
+	rt := insn & 31
+	dir := (insn >> 21) & 1
+
+	iss := op0<<20 | op2<<17 | op1<<14 | crn<<10 | rt<<5 | crm<<1 | dir
+	c.exception(ECSysReg, iss, 0, 0)
+}
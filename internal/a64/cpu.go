@@ -0,0 +1,357 @@
+// Package a64 is a software model of an AArch64 processor executing at EL1
+// or EL0 with the MMU off.
+//
+// It covers the A64 integer, branch, load/store and system-instruction
+// subset along with the SIMD&FP register file, which is what short guest
+// routines and compiler generated functions need. Execution stops with the
+// same exception syndrome (ESR_EL2) a hypervisor would receive on BRK, HVC,
+// SVC, SMC, WFI/WFE, trapped system register accesses, undefined
+// instructions and memory faults, or when the virtual timer fires. IRQ and
+// FIQ lines raised by the host are taken through the EL1 vector table.
+package a64
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+)
+
+// Exception classes (ESR_ELx.EC) produced by the interpreter.
+const (
+	ECUnknown        = 0x00
+	ECWFx            = 0x01
+	ECSVC64          = 0x15
+	ECHVC64          = 0x16
+	ECSMC64          = 0x17
+	ECSysReg         = 0x18
+	ECInstAbortLower = 0x20
+	ECPCAlign        = 0x22
+	ECDataAbortLower = 0x24
+	ECSPAlign        = 0x26
+	ECBRK64          = 0x3C
+)
+
+// Fault status codes (DFSC/IFSC) produced by the interpreter.
+const (
+	FSCTranslationL3 = 0x07
+	FSCPermissionL3  = 0x0F
+	FSCAlignment     = 0x21
+)
+
+const (
+	esrIL       = 1 << 25
+	issISV      = 1 << 24
+	issWnR      = 1 << 6
+	pstateN     = 1 << 31
+	pstateZ     = 1 << 30
+	pstateC     = 1 << 29
+	pstateV     = 1 << 28
+	pstateNZCV  = pstateN | pstateZ | pstateC | pstateV
+	pstateDAIF  = 0xF << 6
+	pstateI     = 1 << 7
+	pstateF     = 1 << 6
+	pstateModeM = 0xF
+)
+
+// Access is the kind of memory access being translated.
+type Access int
+
+const (
+	AccessRead Access = iota
+	AccessWrite
+	AccessFetch
+)
+
+// Fault describes why a translation failed.
+type Fault int
+
+const (
+	FaultNone Fault = iota
+	FaultTranslation
+	FaultPermission
+)
+
+// Memory resolves guest physical addresses to host memory.
+type Memory interface {
+	// Translate returns the host bytes backing addr through the end of its
+	// mapping. It returns a Fault if addr is unmapped or the mapping does not
+	// permit acc.
+	Translate(addr uint64, acc Access) ([]byte, Fault)
+}
+
+// Exit describes why Run stopped.
+type Exit struct {
+	// ESR is the exception syndrome as ESR_EL2 would report it.
+	ESR uint64
+	// FAR is the faulting virtual address for aborts.
+	FAR uint64
+	// IPA is the faulting intermediate physical address for aborts.
+	IPA uint64
+	// Canceled is set when Run returned because of Stop.
+	Canceled bool
+	// VTimer is set when the virtual timer fired, which also sets
+	// CPU.VTimerMasked.
+	VTimer bool
+}
+
+// Class returns the exception class of the exit.
+func (e Exit) Class() uint8 { return uint8(e.ESR >> 26) }
+
+// CPU is the architectural state of one processing element.
+type CPU struct {
+	X      [31]uint64
+	SP     uint64 // SP_EL0
+	PC     uint64
+	PSTATE uint64 // in SPSR/CPSR layout
+	V      [32][16]byte
+	FPCR   uint64
+	FPSR   uint64
+
+	// Sys holds EL1 system registers keyed by their MRS encoding
+	// (op0<<14 | op1<<11 | CRn<<7 | CRm<<3 | op2).
+	Sys map[uint16]uint64
+
+	// Mem is the guest physical address space.
+	Mem Memory
+
+	// Retired counts executed instructions and drives CNTVCT_EL0.
+	Retired uint64
+
+	// MPIDR affinity of this CPU.
+	Affinity uint64
+
+	// IRQ and FIQ are the interrupt lines. A raised line is taken whenever
+	// PSTATE does not mask it, until the host lowers it.
+	IRQ, FIQ bool
+
+	// VTimerMasked stops the virtual timer from exiting to the host. It is
+	// set when the timer fires, as Hypervisor.framework does.
+	VTimerMasked bool
+
+	nextPC       uint64
+	monitorAddr  uint64
+	monitorValid bool
+	pending      *Exit
+	stop         atomic.Bool
+}
+
+// ResetPSTATE is the PSTATE of a freshly created vCPU: EL1h with DAIF masked.
+const ResetPSTATE = 0x3c5
+
+// New returns a CPU in its reset state attached to mem.
+func New(mem Memory) *CPU {
+	c := &CPU{Mem: mem, PSTATE: ResetPSTATE, Sys: make(map[uint16]uint64)}
+	c.Sys[SysSCTLR_EL1] = 0x30d00800 // RES1 bits, MMU and caches off
+	return c
+}
+
+// Run executes instructions until the CPU takes an exception that a
+// hypervisor would see, or Stop is called.
+func (c *CPU) Run() Exit {
+	for {
+		if c.stop.Swap(false) {
+			return Exit{Canceled: true}
+		}
+		if exit, ok := c.Step(); ok {
+			return exit
+		}
+	}
+}
+
+// Stop asks a concurrent Run to return after the current instruction with a
+// canceled Exit. If no Run is in progress the next one returns immediately.
+// It is safe to call from any goroutine.
+func (c *CPU) Stop() { c.stop.Store(true) }
+
+// Step executes a single instruction. It reports the exit and true if the
+// instruction raised an exception visible to the hypervisor.
+func (c *CPU) Step() (Exit, bool) {
+	c.pending = nil
+
+	if !c.VTimerMasked && c.vtimerAsserted() {
+		c.VTimerMasked = true
+		return Exit{VTimer: true}, true
+	}
+	c.takeInterrupt()
+
+	if c.PC&3 != 0 {
+		return c.exception(ECPCAlign, 0, c.PC, 0), true
+	}
+
+	var word [4]byte
+	if !c.fetch(c.PC, word[:]) {
+		return *c.pending, true
+	}
+	insn := binary.LittleEndian.Uint32(word[:])
+
+	c.nextPC = c.PC + 4
+	c.execute(insn)
+	if c.pending != nil {
+		// SVC and HVC report the following instruction as the preferred
+		// return address; everything else reports the faulting one.
+		if ec := c.pending.Class(); ec == ECSVC64 || ec == ECHVC64 {
+			c.PC = c.nextPC
+			c.Retired++
+		}
+		return *c.pending, true
+	}
+	c.PC = c.nextPC
+	c.Retired++
+	return Exit{}, false
+}
+
+// execute dispatches on the A64 top-level encoding groups (op0, bits 28:25).
+func (c *CPU) execute(insn uint32) {
+	switch op0 := (insn >> 25) & 0xF; {
+	case op0&0xE == 0x8:
+		c.execDataProcImm(insn)
+	case op0&0xE == 0xA:
+		c.execBranchSys(insn)
+	case op0&0x5 == 0x4:
+		c.execLoadStore(insn)
+	case op0&0x7 == 0x5:
+		c.execDataProcReg(insn)
+	case op0&0x7 == 0x7:
+		c.execSIMD(insn)
+	default:
+		c.undefined()
+	}
+}
+
+// exception records a pending exit with the given class and ISS.
+func (c *CPU) exception(ec uint32, iss uint32, far, ipa uint64) Exit {
+	exit := Exit{
+		ESR: uint64(ec)<<26 | esrIL | uint64(iss&0x1FFFFFF),
+		FAR: far,
+		IPA: ipa,
+	}
+	c.pending = &exit
+	return exit
+}
+
+// takeInterrupt enters the IRQ or FIQ vector at EL1 if its line is raised
+// and PSTATE does not mask it.
+func (c *CPU) takeInterrupt() {
+	var off uint64
+	switch {
+	case c.FIQ && c.PSTATE&pstateF == 0:
+		off = 0x100
+	case c.IRQ && c.PSTATE&pstateI == 0:
+		off = 0x80
+	default:
+		return
+	}
+	switch {
+	case c.el() == 0:
+		off += 0x400 // lower EL using AArch64
+	case c.spSel():
+		off += 0x200 // current EL with SP_ELx
+	}
+	c.Sys[SysSPSR_EL1] = c.PSTATE
+	c.Sys[SysELR_EL1] = c.PC
+	c.PSTATE = c.PSTATE&pstateNZCV | pstateDAIF | 0x5 // EL1h
+	c.PC = c.Sys[SysVBAR_EL1] + off
+	c.monitorValid = false
+}
+
+// undefined raises an Unknown-reason exception for the current instruction.
+func (c *CPU) undefined() { c.exception(ECUnknown, 0, 0, 0) }
+
+// el returns the current exception level.
+func (c *CPU) el() uint64 { return (c.PSTATE >> 2) & 3 }
+
+// spSel reports whether SP_ELx (rather than SP_EL0) is the current stack pointer.
+func (c *CPU) spSel() bool { return c.el() != 0 && c.PSTATE&1 != 0 }
+
+// sp returns the current stack pointer.
+func (c *CPU) sp() uint64 {
+	if c.spSel() {
+		return c.Sys[SysSP_EL1]
+	}
+	return c.SP
+}
+
+// setSP writes the current stack pointer.
+func (c *CPU) setSP(v uint64) {
+	if c.spSel() {
+		c.Sys[SysSP_EL1] = v
+	} else {
+		c.SP = v
+	}
+}
+
+// x reads general purpose register n, where 31 is the zero register.
+func (c *CPU) x(n uint32) uint64 {
+	if n == 31 {
+		return 0
+	}
+	return c.X[n]
+}
+
+// xsp reads general purpose register n, where 31 is the stack pointer.
+func (c *CPU) xsp(n uint32) uint64 {
+	if n == 31 {
+		return c.sp()
+	}
+	return c.X[n]
+}
+
+// setX writes general purpose register n, where 31 is the zero register.
+// 32-bit writes zero the upper half.
+func (c *CPU) setX(n uint32, v uint64, sf bool) {
+	if n == 31 {
+		return
+	}
+	if !sf {
+		v &= 0xFFFFFFFF
+	}
+	c.X[n] = v
+}
+
+// setXSP writes general purpose register n, where 31 is the stack pointer.
+func (c *CPU) setXSP(n uint32, v uint64, sf bool) {
+	if !sf {
+		v &= 0xFFFFFFFF
+	}
+	if n == 31 {
+		c.setSP(v)
+		return
+	}
+	c.X[n] = v
+}
+
+// condHolds evaluates an A64 condition code against PSTATE.NZCV.
+func (c *CPU) condHolds(cond uint32) bool {
+	n := c.PSTATE&pstateN != 0
+	z := c.PSTATE&pstateZ != 0
+	cf := c.PSTATE&pstateC != 0
+	v := c.PSTATE&pstateV != 0
+
+	var result bool
+	switch cond >> 1 {
+	case 0:
+		result = z
+	case 1:
+		result = cf
+	case 2:
+		result = n
+	case 3:
+		result = v
+	case 4:
+		result = cf && !z
+	case 5:
+		result = n == v
+	case 6:
+		result = n == v && !z
+	case 7:
+		result = true
+	}
+	if cond&1 != 0 && cond != 0xF {
+		result = !result
+	}
+	return result
+}
+
+// setNZCV replaces PSTATE.NZCV with the low four bits of nzcv.
+func (c *CPU) setNZCV(nzcv uint64) {
+	c.PSTATE = c.PSTATE&^pstateNZCV | (nzcv&0xF)<<28
+}
@@ -0,0 +1,441 @@
+package a64
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+const (
+	codeBase = 0x10000
+	dataBase = 0x20000
+	roBase   = 0x30000
+)
+
+type testRegion struct {
+	base  uint64
+	buf   []byte
+	write bool
+	exec  bool
+}
+
+// testMem is a flat set of guest regions: code (RX), data (RW) and
+// read-only data.
+type testMem []testRegion
+
+func (m testMem) Translate(addr uint64, acc Access) ([]byte, Fault) {
+	for _, r := range m {
+		if addr < r.base || addr >= r.base+uint64(len(r.buf)) {
+			continue
+		}
+		if (acc == AccessWrite && !r.write) || (acc == AccessFetch && !r.exec) {
+			return nil, FaultPermission
+		}
+		return r.buf[addr-r.base:], FaultNone
+	}
+	return nil, FaultTranslation
+}
+
+// newTestCPU loads prog at codeBase and returns a CPU about to execute it
+// together with its data and read-only regions.
+func newTestCPU(t *testing.T, prog ...uint32) (*CPU, []byte, []byte) {
+	t.Helper()
+	code := make([]byte, 0x1000)
+	for i, insn := range prog {
+		binary.LittleEndian.PutUint32(code[4*i:], insn)
+	}
+	data := make([]byte, 0x4000)
+	ro := make([]byte, 0x1000)
+	c := New(testMem{
+		{base: codeBase, buf: code, exec: true},
+		{base: dataBase, buf: data, write: true},
+		{base: roBase, buf: ro},
+	})
+	c.PC = codeBase
+	return c, data, ro
+}
+
+func TestArithmetic(t *testing.T) {
+	c, _, _ := newTestCPU(t,
+		0xD2824680, // movz x0, #0x1234
+		0x91000401, // add  x1, x0, #1
+		0xEB000022, // subs x2, x1, x0
+		0x92401C23, // and  x3, x1, #0xff
+		0xB200F3E4, // orr  x4, xzr, #0x5555555555555555
+		0xD4200000, // brk  #0
+	)
+	exit := c.Run()
+
+	if got := exit.Class(); got != ECBRK64 {
+		t.Fatalf("exit class = %#x, want %#x", got, ECBRK64)
+	}
+	if c.PC != codeBase+20 {
+		t.Errorf("PC = %#x, want %#x", c.PC, codeBase+20)
+	}
+	want := map[int]uint64{0: 0x1234, 1: 0x1235, 2: 1, 3: 0x35, 4: 0x5555555555555555}
+	for n, v := range want {
+		if c.X[n] != v {
+			t.Errorf("X%d = %#x, want %#x", n, c.X[n], v)
+		}
+	}
+	if nzcv := c.PSTATE >> 28; nzcv != 0x2 {
+		t.Errorf("NZCV = %#x, want %#x", nzcv, 0x2)
+	}
+	if c.Retired != 5 {
+		t.Errorf("Retired = %d, want 5", c.Retired)
+	}
+}
+
+func TestExceptionGeneration(t *testing.T) {
+	tests := []struct {
+		name   string
+		insn   uint32
+		ec     uint8
+		iss    uint64
+		wantPC uint64
+	}{
+		{"svc", 0xD4000021, ECSVC64, 1, codeBase + 4},
+		{"hvc", 0xD40000A2, ECHVC64, 5, codeBase + 4},
+		{"smc", 0xD4000003, ECSMC64, 0, codeBase},
+		{"brk", 0xD4200020, ECBRK64, 1, codeBase},
+		{"wfi", 0xD503207F, ECWFx, 1<<24 | 0xE<<20, codeBase},
+		{"wfe", 0xD503205F, ECWFx, 1<<24 | 0xE<<20 | 1, codeBase},
+		{"udf", 0x00000000, ECUnknown, 0, codeBase},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _, _ := newTestCPU(t, tt.insn)
+			exit := c.Run()
+			if got := exit.Class(); got != tt.ec {
+				t.Errorf("exit class = %#x, want %#x", got, tt.ec)
+			}
+			if got := exit.ESR & 0x1FFFFFF; got != tt.iss {
+				t.Errorf("ISS = %#x, want %#x", got, tt.iss)
+			}
+			if c.PC != tt.wantPC {
+				t.Errorf("PC = %#x, want %#x", c.PC, tt.wantPC)
+			}
+		})
+	}
+}
+
+func TestLoadStore(t *testing.T) {
+	c, data, _ := newTestCPU(t,
+		0xD2840001, // movz x1, #0x2000, lsl #0 (x1 = 0x2000)
+		0xF2A00041, // movk x1, #0x2, lsl #16   (x1 = 0x22000)
+		0xD29BDE00, // movz x0, #0xdef0
+		0xF9000020, // str  x0, [x1]
+		0xF9000420, // str  x0, [x1, #8]
+		0xA9401023, // ldp  x3, x4, [x1]
+		0xB8404425, // ldr  w5, [x1], #4
+		0x389FD026, // ldursb x6, [x1, #-3]
+		0xD4200000, // brk  #0
+	)
+	exit := c.Run()
+	if got := exit.Class(); got != ECBRK64 {
+		t.Fatalf("exit class = %#x (ESR %#x), want BRK", got, exit.ESR)
+	}
+	if got := binary.LittleEndian.Uint64(data[0x2000:]); got != 0xdef0 {
+		t.Errorf("memory = %#x, want %#x", got, 0xdef0)
+	}
+	if c.X[3] != 0xdef0 || c.X[4] != 0xdef0 {
+		t.Errorf("ldp loaded %#x, %#x, want 0xdef0 twice", c.X[3], c.X[4])
+	}
+	if c.X[5] != 0xdef0 {
+		t.Errorf("X5 = %#x, want %#x", c.X[5], 0xdef0)
+	}
+	if c.X[1] != dataBase+0x2004 {
+		t.Errorf("post-index base = %#x, want %#x", c.X[1], dataBase+0x2004)
+	}
+	if want := uint64(0xFFFFFFFFFFFFFFDE); c.X[6] != want {
+		t.Errorf("X6 = %#x, want %#x", c.X[6], want)
+	}
+}
+
+func TestDataAbortSyndrome(t *testing.T) {
+	tests := []struct {
+		name   string
+		prog   []uint32
+		isv    bool
+		wnr    bool
+		srt    uint64
+		sas    uint64
+		fsc    uint64
+		addr   uint64
+		regsOK func(*CPU) bool
+	}{
+		{
+			name: "ldr unmapped",
+			prog: []uint32{0xD2880001, 0xF9400422}, // movz x1, #0x4000; ldr x2, [x1, #8]
+			isv:  true, srt: 2, sas: 3, fsc: FSCTranslationL3, addr: 0x4008,
+		},
+		{
+			name: "strh read-only",
+			prog: []uint32{0xD2A00061, 0x79000023}, // movz x1, #0x3, lsl #16; strh w3, [x1]
+			isv:  true, wnr: true, srt: 3, sas: 1, fsc: FSCPermissionL3, addr: roBase,
+		},
+		{
+			name: "ldp unmapped has no syndrome",
+			prog: []uint32{0xD2880001, 0xA9401023}, // movz x1, #0x4000; ldp x3, x4, [x1]
+			fsc:  FSCTranslationL3, addr: 0x4000,
+		},
+		{
+			name: "writeback has no syndrome",
+			prog: []uint32{0xD2880001, 0xF8408422}, // movz x1, #0x4000; ldr x2, [x1], #8
+			fsc:  FSCTranslationL3, addr: 0x4000,
+			regsOK: func(c *CPU) bool { return c.X[1] == 0x4000 },
+		},
+		{
+			name: "misaligned ldar",
+			prog: []uint32{0xD2840021, 0xF2A00041, 0xC8DFFC20}, // x1 = 0x22001; ldar x0, [x1]
+			isv:  true, srt: 0, sas: 3, fsc: FSCAlignment, addr: dataBase + 0x2001,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _, _ := newTestCPU(t, tt.prog...)
+			exit := c.Run()
+			if got := exit.Class(); got != ECDataAbortLower {
+				t.Fatalf("exit class = %#x, want %#x", got, ECDataAbortLower)
+			}
+			iss := exit.ESR & 0x1FFFFFF
+			if got := iss&issISV != 0; got != tt.isv {
+				t.Errorf("ISV = %v, want %v", got, tt.isv)
+			}
+			if tt.isv {
+				if got := (iss >> 16) & 31; got != tt.srt {
+					t.Errorf("SRT = %d, want %d", got, tt.srt)
+				}
+				if got := (iss >> 22) & 3; got != tt.sas {
+					t.Errorf("SAS = %d, want %d", got, tt.sas)
+				}
+			}
+			if got := iss&issWnR != 0; got != tt.wnr {
+				t.Errorf("WnR = %v, want %v", got, tt.wnr)
+			}
+			if got := iss & 0x3F; got != tt.fsc {
+				t.Errorf("DFSC = %#x, want %#x", got, tt.fsc)
+			}
+			if exit.FAR != tt.addr || exit.IPA != tt.addr {
+				t.Errorf("FAR/IPA = %#x/%#x, want %#x", exit.FAR, exit.IPA, tt.addr)
+			}
+			if want := uint64(codeBase + 4*(len(tt.prog)-1)); c.PC != want {
+				t.Errorf("PC = %#x, want faulting instruction %#x", c.PC, want)
+			}
+			if tt.regsOK != nil && !tt.regsOK(c) {
+				t.Error("registers were modified by a faulting instruction")
+			}
+		})
+	}
+}
+
+func TestSystemRegisters(t *testing.T) {
+	t.Run("msr and mrs", func(t *testing.T) {
+		c, _, _ := newTestCPU(t,
+			0xD2800540, // movz x0, #0x2a
+			0xD51BD040, // msr  tpidr_el0, x0
+			0xD53BD041, // mrs  x1, tpidr_el0
+			0xD5380002, // mrs  x2, midr_el1
+			0xD4200000, // brk  #0
+		)
+		c.Run()
+		if c.X[1] != 0x2a {
+			t.Errorf("TPIDR_EL0 read back %#x, want %#x", c.X[1], 0x2a)
+		}
+		if c.X[2] != idRegs[SysMIDR_EL1] {
+			t.Errorf("MIDR_EL1 = %#x, want %#x", c.X[2], idRegs[SysMIDR_EL1])
+		}
+	})
+
+	t.Run("unknown register traps", func(t *testing.T) {
+		c, _, _ := newTestCPU(t, 0xD538FFE3) // mrs x3, s3_0_c15_c15_7
+		exit := c.Run()
+		if got := exit.Class(); got != ECSysReg {
+			t.Fatalf("exit class = %#x, want %#x", got, ECSysReg)
+		}
+		want := uint64(3<<20 | 7<<17 | 15<<10 | 3<<5 | 15<<1 | 1)
+		if got := exit.ESR & 0x1FFFFFF; got != want {
+			t.Errorf("ISS = %#x, want %#x", got, want)
+		}
+	})
+
+	t.Run("id registers are read-only", func(t *testing.T) {
+		c, _, _ := newTestCPU(t, 0xD5180000) // msr midr_el1, x0
+		if got := c.Run().Class(); got != ECSysReg {
+			t.Errorf("exit class = %#x, want %#x", got, ECSysReg)
+		}
+	})
+}
+
+func TestExclusives(t *testing.T) {
+	c, data, _ := newTestCPU(t,
+		0xD2840001, // movz x1, #0x2000
+		0xF2A00041, // movk x1, #0x2, lsl #16
+		0xC85F7C20, // ldxr  x0, [x1]
+		0x91000403, // add   x3, x0, #1
+		0xC8027C23, // stxr  w2, x3, [x1]
+		0xC8047C23, // stxr  w4, x3, [x1]   (monitor already cleared)
+		0xD4200000, // brk   #0
+	)
+	binary.LittleEndian.PutUint64(data[0x2000:], 41)
+	c.Run()
+	if c.X[2] != 0 {
+		t.Errorf("first stxr status = %d, want 0", c.X[2])
+	}
+	if c.X[4] != 1 {
+		t.Errorf("second stxr status = %d, want 1", c.X[4])
+	}
+	if got := binary.LittleEndian.Uint64(data[0x2000:]); got != 42 {
+		t.Errorf("memory = %d, want 42", got)
+	}
+}
+
+func TestSIMD(t *testing.T) {
+	c, data, _ := newTestCPU(t,
+		0xD2840001, // movz x1, #0x2000
+		0xF2A00041, // movk x1, #0x2, lsl #16
+		0x4F07E7E0, // movi  v0.16b, #0xff
+		0xAD000020, // stp   q0, q0, [x1]
+		0x6F00E401, // movi  v1.2d, #0
+		0x3DC00022, // ldr   q2, [x1]
+		0x4E083C45, // mov   x5, v2.d[0]
+		0x4E181C22, // mov   v2.d[1], x1
+		0x9E660046, // fmov  x6, d2
+		0x9EAE0047, // fmov  x7, v2.d[1]
+		0xD4200000, // brk   #0
+	)
+	exit := c.Run()
+	if got := exit.Class(); got != ECBRK64 {
+		t.Fatalf("exit class = %#x (ESR %#x), want BRK", got, exit.ESR)
+	}
+	for i := 0; i < 32; i++ {
+		if data[0x2000+i] != 0xFF {
+			t.Fatalf("byte %d = %#x, want 0xff", i, data[0x2000+i])
+		}
+	}
+	if c.V[1] != [16]byte{} {
+		t.Errorf("V1 = %x, want zero", c.V[1])
+	}
+	if c.X[5] != ^uint64(0) || c.X[6] != ^uint64(0) {
+		t.Errorf("X5, X6 = %#x, %#x, want all ones", c.X[5], c.X[6])
+	}
+	if c.X[7] != dataBase+0x2000 {
+		t.Errorf("X7 = %#x, want %#x", c.X[7], dataBase+0x2000)
+	}
+}
+
+func TestStackPointerSelection(t *testing.T) {
+	c, _, _ := newTestCPU(t,
+		0xA9BF03E0, // stp x0, x0, [sp, #-16]!
+		0xD4200000, // brk #0
+	)
+	c.SP = dataBase + 0x100
+	c.Sys[SysSP_EL1] = dataBase + 0x200
+
+	c.Run()
+	if c.Sys[SysSP_EL1] != dataBase+0x1F0 {
+		t.Errorf("SP_EL1 = %#x, want %#x", c.Sys[SysSP_EL1], dataBase+0x1F0)
+	}
+	if c.SP != dataBase+0x100 {
+		t.Errorf("SP_EL0 = %#x, want it untouched", c.SP)
+	}
+}
+
+func TestStop(t *testing.T) {
+	c, _, _ := newTestCPU(t, 0x14000000) // b .
+
+	done := make(chan Exit)
+	go func() { done <- c.Run() }()
+	c.Stop()
+
+	select {
+	case exit := <-done:
+		if !exit.Canceled {
+			t.Errorf("exit = %+v, want Canceled", exit)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after Stop")
+	}
+}
+
+func TestFetchFaults(t *testing.T) {
+	c, _, _ := newTestCPU(t)
+	c.PC = dataBase
+	exit := c.Run()
+	if got := exit.Class(); got != ECInstAbortLower {
+		t.Fatalf("exit class = %#x, want %#x", got, ECInstAbortLower)
+	}
+	if got := exit.ESR & 0x3F; got != FSCPermissionL3 {
+		t.Errorf("IFSC = %#x, want %#x", got, FSCPermissionL3)
+	}
+
+	c.PC = codeBase + 2
+	if got := c.Run().Class(); got != ECPCAlign {
+		t.Errorf("exit class = %#x, want %#x", got, ECPCAlign)
+	}
+}
+
+func TestInterrupts(t *testing.T) {
+	tests := []struct {
+		name       string
+		pstate     uint64
+		irq, fiq   bool
+		wantVector uint64 // offset from VBAR_EL1, or 0 if not taken
+	}{
+		{"irq from EL1h", 0x5, true, false, 0x280},
+		{"fiq from EL1h", 0x5, false, true, 0x300},
+		{"fiq before irq", 0x5, true, true, 0x300},
+		{"irq from EL1t", 0x4, true, false, 0x080},
+		{"irq from EL0", 0x0, true, false, 0x480},
+		{"irq masked", 0x5 | pstateI, true, false, 0},
+		{"fiq masked", 0x5 | pstateF, false, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _, _ := newTestCPU(t, 0xD503201F) // nop
+			c.Sys[SysVBAR_EL1] = 0x80000
+			c.PSTATE = tt.pstate | pstateC
+			c.IRQ, c.FIQ = tt.irq, tt.fiq
+
+			c.takeInterrupt()
+			if tt.wantVector == 0 {
+				if c.PC != codeBase {
+					t.Errorf("PC = %#x, want the interrupt not taken", c.PC)
+				}
+				return
+			}
+			if c.PC != 0x80000+tt.wantVector {
+				t.Errorf("PC = %#x, want %#x", c.PC, 0x80000+tt.wantVector)
+			}
+			if c.Sys[SysELR_EL1] != codeBase || c.Sys[SysSPSR_EL1] != tt.pstate|pstateC {
+				t.Errorf("ELR_EL1, SPSR_EL1 = %#x, %#x; want %#x, %#x",
+					c.Sys[SysELR_EL1], c.Sys[SysSPSR_EL1], codeBase, tt.pstate|pstateC)
+			}
+			if want := uint64(pstateC | pstateDAIF | 0x5); c.PSTATE != want {
+				t.Errorf("PSTATE = %#x, want %#x", c.PSTATE, want)
+			}
+		})
+	}
+}
+
+func TestVTimer(t *testing.T) {
+	c, _, _ := newTestCPU(t, 0x14000000) // b .
+	c.Sys[SysCNTV_CVAL_EL0] = 3
+	c.WriteSysReg(SysCNTV_CTL_EL0, cntvEnable|cntvIStatus)
+
+	exit := c.Run()
+	if !exit.VTimer || !c.VTimerMasked || c.Retired != 3 {
+		t.Fatalf("exit = %+v after %d instructions (masked %v), want VTimer after 3", exit, c.Retired, c.VTimerMasked)
+	}
+	if ctl, _ := c.ReadSysReg(SysCNTV_CTL_EL0); ctl != cntvEnable|cntvIStatus {
+		t.Errorf("CNTV_CTL_EL0 = %#x, want %#x", ctl, cntvEnable|cntvIStatus)
+	}
+
+	// Masked by the guest, the timer no longer asserts its interrupt and
+	// does not exit once the host unmasks it.
+	c.WriteSysReg(SysCNTV_CTL_EL0, cntvEnable|cntvIMask)
+	c.VTimerMasked = false
+	if _, ok := c.Step(); ok || c.vtimerAsserted() {
+		t.Errorf("Step exited with the timer masked by the guest")
+	}
+}
@@ -0,0 +1,209 @@
+package a64
+
+// LoadStore describes a general purpose register load or store decoded by
+// DecodeLoadStore. It carries everything needed to replay the access outside
+// the interpreter, for example when a hypervisor emulates an MMIO access
+// whose syndrome does not identify the registers (ISV=0).
+type LoadStore struct {
+	// Load is set for loads and clear for stores.
+	Load bool
+	// Size is the size of each element in bytes.
+	Size int
+	// Pair is set for LDP/STP/LDNP/STNP/LDPSW: Rt2 is transferred at
+	// address+Size.
+	Pair bool
+	// Signed sign-extends loaded elements.
+	Signed bool
+	// SF writes 64-bit results; otherwise results are zero extended from 32
+	// bits.
+	SF bool
+	// Rt and Rt2 are the transfer registers. 31 is XZR.
+	Rt, Rt2 uint32
+	// Rn is the base register. 31 is SP.
+	Rn uint32
+	// Literal means the address is PC relative and Rn is unused.
+	Literal bool
+	// Imm is the immediate byte offset, already scaled.
+	Imm int64
+	// RegOffset adds Rm, extended by Option and shifted left by Shift.
+	RegOffset bool
+	Rm        uint32
+	Option    uint32
+	Shift     uint32
+	// Writeback stores the updated address back to Rn. PostIndex accesses
+	// the unmodified base.
+	Writeback bool
+	PostIndex bool
+}
+
+// Address returns the address of the first element and the value written
+// back to Rn. base is the value of Rn (or PC for literals) and index the
+// value of Rm.
+func (ls LoadStore) Address(base, index uint64) (addr, writeback uint64) {
+	offset := uint64(ls.Imm)
+	if ls.RegOffset {
+		offset = extendReg(index, ls.Option, ls.Shift)
+	}
+	if ls.PostIndex {
+		return base, base + offset
+	}
+	return base + offset, base + offset
+}
+
+// Extend converts a loaded element to the value written to the register.
+func (ls LoadStore) Extend(v uint64) uint64 {
+	if ls.Size < 8 {
+		v &= ones(uint32(ls.Size * 8))
+	}
+	if ls.Signed {
+		v = signExtend(v, uint(ls.Size*8))
+	}
+	if !ls.SF {
+		v &= 0xFFFFFFFF
+	}
+	return v
+}
+
+// DecodeLoadStore decodes the general purpose register loads and stores
+// that can target device memory: single register accesses in every
+// addressing mode, literal loads, pairs, and LDAR/STLR. Exclusives, SIMD&FP
+// registers and prefetches report false.
+func DecodeLoadStore(insn uint32) (LoadStore, bool) {
+	if insn&(1<<26) != 0 { // SIMD&FP
+		return LoadStore{}, false
+	}
+	switch {
+	case insn&0x3F000000 == 0x08000000:
+		return decodeAcquireRelease(insn)
+	case insn&0x3B000000 == 0x18000000:
+		return decodeLiteral(insn)
+	case insn&0x3A000000 == 0x28000000:
+		return decodePair(insn)
+	case insn&0x3B000000 == 0x39000000: // unsigned immediate
+		ls, ok := decodeSingle(insn)
+		ls.Imm = int64((insn>>10)&0xFFF) << ldstScale(insn)
+		return ls, ok
+	case insn&0x3B200000 == 0x38000000: // unscaled, pre/post-indexed, unprivileged
+		ls, ok := decodeSingle(insn)
+		ls.Imm = int64(signExtend(uint64((insn>>12)&0x1FF), 9))
+		switch (insn >> 10) & 3 {
+		case 1:
+			ls.Writeback, ls.PostIndex = true, true
+		case 3:
+			ls.Writeback = true
+		}
+		return ls, ok
+	case insn&0x3B200C00 == 0x38200800: // register offset
+		ls, ok := decodeSingle(insn)
+		ls.RegOffset = true
+		ls.Rm = (insn >> 16) & 31
+		ls.Option = (insn >> 13) & 7
+		if ls.Option&2 == 0 {
+			return LoadStore{}, false
+		}
+		if insn&(1<<12) != 0 {
+			ls.Shift = ldstScale(insn)
+		}
+		return ls, ok
+	}
+	return LoadStore{}, false
+}
+
+// decodeSingle decodes the size, direction and extension of a single
+// register load or store.
+func decodeSingle(insn uint32) (LoadStore, bool) {
+	size := insn >> 30
+	ls := LoadStore{
+		Size: 1 << size,
+		Rt:   insn & 31,
+		Rn:   (insn >> 5) & 31,
+	}
+	switch (insn >> 22) & 3 {
+	case 0:
+		ls.SF = size == 3
+	case 1:
+		ls.Load = true
+		ls.SF = size == 3
+	case 2:
+		if size == 3 { // PRFM
+			return LoadStore{}, false
+		}
+		ls.Load, ls.Signed, ls.SF = true, true, true
+	case 3:
+		if size >= 2 {
+			return LoadStore{}, false
+		}
+		ls.Load, ls.Signed = true, true
+	}
+	return ls, true
+}
+
+// decodeLiteral decodes LDR (literal) and LDRSW (literal).
+func decodeLiteral(insn uint32) (LoadStore, bool) {
+	ls := LoadStore{
+		Load:    true,
+		Rt:      insn & 31,
+		Literal: true,
+		Imm:     int64(signExtend(uint64((insn>>5)&0x7FFFF)<<2, 21)),
+	}
+	switch insn >> 30 {
+	case 0:
+		ls.Size = 4
+	case 1:
+		ls.Size, ls.SF = 8, true
+	case 2:
+		ls.Size, ls.Signed, ls.SF = 4, true, true
+	default: // PRFM
+		return LoadStore{}, false
+	}
+	return ls, true
+}
+
+// decodePair decodes LDP, STP, LDPSW, LDNP and STNP.
+func decodePair(insn uint32) (LoadStore, bool) {
+	ls := LoadStore{
+		Load: insn&(1<<22) != 0,
+		Pair: true,
+		Rt:   insn & 31,
+		Rn:   (insn >> 5) & 31,
+		Rt2:  (insn >> 10) & 31,
+	}
+	switch insn >> 30 {
+	case 0:
+		ls.Size = 4
+	case 1:
+		if !ls.Load {
+			return LoadStore{}, false
+		}
+		ls.Size, ls.Signed, ls.SF = 4, true, true
+	case 2:
+		ls.Size, ls.SF = 8, true
+	default:
+		return LoadStore{}, false
+	}
+
+	ls.Imm = int64(signExtend(uint64((insn>>15)&0x7F), 7)) * int64(ls.Size)
+	switch (insn >> 23) & 3 {
+	case 1:
+		ls.Writeback, ls.PostIndex = true, true
+	case 3:
+		ls.Writeback = true
+	}
+	return ls, true
+}
+
+// decodeAcquireRelease decodes LDAR and STLR. Exclusives need a monitor and
+// are not replayable.
+func decodeAcquireRelease(insn uint32) (LoadStore, bool) {
+	if (insn>>23)&1 == 0 || (insn>>21)&1 != 0 {
+		return LoadStore{}, false
+	}
+	size := insn >> 30
+	return LoadStore{
+		Load: insn&(1<<22) != 0,
+		Size: 1 << size,
+		SF:   size == 3,
+		Rt:   insn & 31,
+		Rn:   (insn >> 5) & 31,
+	}, true
+}
@@ -0,0 +1,86 @@
+package a64
+
+import "testing"
+
+func TestDecodeLoadStore(t *testing.T) {
+	tests := []struct {
+		name string
+		insn uint32
+		want LoadStore
+	}{
+		{"ldr x0, [x1, #8]", 0xF9400420, LoadStore{Load: true, Size: 8, SF: true, Rt: 0, Rn: 1, Imm: 8}},
+		{"strb w0, [x1]", 0x39000020, LoadStore{Size: 1, Rt: 0, Rn: 1}},
+		{"ldrsh x3, [x1, #8]", 0x79801023, LoadStore{Load: true, Size: 2, Signed: true, SF: true, Rt: 3, Rn: 1, Imm: 8}},
+		{"str w0, [x1], #4", 0xB8004420, LoadStore{Size: 4, Rt: 0, Rn: 1, Imm: 4, Writeback: true, PostIndex: true}},
+		{"ldr x2, [sp, #-16]!", 0xF85F0FE2, LoadStore{Load: true, Size: 8, SF: true, Rt: 2, Rn: 31, Imm: -16, Writeback: true}},
+		{"ldr w0, [x1, x2, lsl #2]", 0xB8627820, LoadStore{Load: true, Size: 4, Rt: 0, Rn: 1, RegOffset: true, Rm: 2, Option: 3, Shift: 2}},
+		{"ldr x0, #8", 0x58000040, LoadStore{Load: true, Size: 8, SF: true, Literal: true, Imm: 8}},
+		{"stp x0, x2, [x1]", 0xA9000820, LoadStore{Size: 8, Pair: true, SF: true, Rt: 0, Rt2: 2, Rn: 1}},
+		{"ldp w3, w4, [x1, #8]!", 0x29C11023, LoadStore{Load: true, Size: 4, Pair: true, Rt: 3, Rt2: 4, Rn: 1, Imm: 8, Writeback: true}},
+		{"ldpsw x5, x6, [x1]", 0x69401825, LoadStore{Load: true, Size: 4, Pair: true, Signed: true, SF: true, Rt: 5, Rt2: 6, Rn: 1}},
+		{"stlr w0, [x1]", 0x889FFC20, LoadStore{Size: 4, Rt: 0, Rn: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := DecodeLoadStore(tt.insn)
+			if !ok {
+				t.Fatalf("DecodeLoadStore(0x%08x) failed", tt.insn)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	rejected := []struct {
+		name string
+		insn uint32
+	}{
+		{"str q0, [x1]", 0x3D800020},
+		{"ldxr x0, [x1]", 0xC85F7C20},
+		{"prfm pldl1keep, [x1]", 0xF9800020},
+		{"add x0, x1, x2", 0x8B020020},
+	}
+	for _, tt := range rejected {
+		if _, ok := DecodeLoadStore(tt.insn); ok {
+			t.Errorf("DecodeLoadStore(%s) succeeded, want rejection", tt.name)
+		}
+	}
+}
+
+func TestLoadStoreAddress(t *testing.T) {
+	tests := []struct {
+		name          string
+		ls            LoadStore
+		base, index   uint64
+		addr, wbValue uint64
+	}{
+		{"offset", LoadStore{Imm: 8}, 0x1000, 0, 0x1008, 0x1008},
+		{"pre-index", LoadStore{Imm: -16, Writeback: true}, 0x1000, 0, 0xFF0, 0xFF0},
+		{"post-index", LoadStore{Imm: 4, Writeback: true, PostIndex: true}, 0x1000, 0, 0x1000, 0x1004},
+		{"register lsl", LoadStore{RegOffset: true, Option: 3, Shift: 3}, 0x1000, 2, 0x1010, 0x1010},
+		{"register sxtw", LoadStore{RegOffset: true, Option: 6}, 0x1000, 0xFFFFFFFF, 0xFFF, 0xFFF},
+	}
+	for _, tt := range tests {
+		addr, wb := tt.ls.Address(tt.base, tt.index)
+		if addr != tt.addr || wb != tt.wbValue {
+			t.Errorf("%s: got 0x%x/0x%x, want 0x%x/0x%x", tt.name, addr, wb, tt.addr, tt.wbValue)
+		}
+	}
+
+	extend := []struct {
+		ls   LoadStore
+		in   uint64
+		want uint64
+	}{
+		{LoadStore{Size: 1, Signed: true, SF: true}, 0x80, 0xFFFFFFFFFFFFFF80},
+		{LoadStore{Size: 2, Signed: true}, 0x8000, 0xFFFF8000},
+		{LoadStore{Size: 4}, 0xAAAA12345678, 0x12345678},
+		{LoadStore{Size: 8, SF: true}, 0xFFFFFFFFFFFFFFFF, 0xFFFFFFFFFFFFFFFF},
+	}
+	for _, tt := range extend {
+		if got := tt.ls.Extend(tt.in); got != tt.want {
+			t.Errorf("Extend(%+v, 0x%x) = 0x%x, want 0x%x", tt.ls, tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package a64
+
+// execDataProcImm handles "Data Processing -- Immediate" (op0 = 100x).
+func (c *CPU) execDataProcImm(insn uint32) {
+	rd := insn & 31
+	rn := (insn >> 5) & 31
+	sf := insn>>31 != 0
+
+	switch (insn >> 23) & 7 {
+	case 0, 1: // PC-rel addressing
+		imm := uint64((insn>>5)&0x7FFFF)<<2 | uint64((insn>>29)&3)
+		if insn>>31 == 0 { // ADR
+			c.setX(rd, c.PC+signExtend(imm, 21), true)
+		} else { // ADRP
+			c.setX(rd, c.PC&^0xFFF+signExtend(imm<<12, 33), true)
+		}
+
+	case 2: // Add/subtract (immediate)
+		imm := uint64((insn >> 10) & 0xFFF)
+		if insn&(1<<22) != 0 {
+			imm <<= 12
+		}
+		sub := insn&(1<<30) != 0
+		setFlags := insn&(1<<29) != 0
+		x := c.xsp(rn)
+		var result, nzcv uint64
+		if sub {
+			result, nzcv = addWithCarry(x, ^imm, 1, sf)
+		} else {
+			result, nzcv = addWithCarry(x, imm, 0, sf)
+		}
+		if setFlags {
+			c.setNZCV(nzcv)
+			c.setX(rd, result, sf)
+		} else {
+			c.setXSP(rd, result, sf)
+		}
+
+	case 4: // Logical (immediate)
+		width := uint32(32)
+		if sf {
+			width = 64
+		}
+		n := (insn >> 22) & 1
+		if !sf && n != 0 {
+			c.undefined()
+			return
+		}
+		imm, _, ok := decodeBitMasks(n, (insn>>10)&0x3F, (insn>>16)&0x3F, true, width)
+		if !ok {
+			c.undefined()
+			return
+		}
+		x := c.x(rn)
+		switch (insn >> 29) & 3 {
+		case 0: // AND
+			c.setXSP(rd, x&imm, sf)
+		case 1: // ORR
+			c.setXSP(rd, x|imm, sf)
+		case 2: // EOR
+			c.setXSP(rd, x^imm, sf)
+		case 3: // ANDS
+			result := x & imm
+			c.setNZCV(logicFlags(result, sf))
+			c.setX(rd, result, sf)
+		}
+
+	case 5: // Move wide (immediate)
+		hw := (insn >> 21) & 3
+		if !sf && hw >= 2 {
+			c.undefined()
+			return
+		}
+		shift := hw * 16
+		imm := uint64((insn>>5)&0xFFFF) << shift
+		switch (insn >> 29) & 3 {
+		case 0: // MOVN
+			c.setX(rd, ^imm, sf)
+		case 2: // MOVZ
+			c.setX(rd, imm, sf)
+		case 3: // MOVK
+			c.setX(rd, c.x(rd)&^(0xFFFF<<shift)|imm, sf)
+		default:
+			c.undefined()
+		}
+
+	case 6: // Bitfield
+		c.execBitfield(insn, sf)
+
+	case 7: // Extract
+		if (insn>>29)&3 != 0 || (insn>>21)&1 != 0 || (insn>>22)&1 != (insn>>31) {
+			c.undefined()
+			return
+		}
+		width := uint32(32)
+		if sf {
+			width = 64
+		}
+		lsb := (insn >> 10) & 0x3F
+		if lsb >= width {
+			c.undefined()
+			return
+		}
+		hi := c.x(rn) & ones(width)
+		lo := c.x((insn>>16)&31) & ones(width)
+		result := lo
+		if lsb != 0 {
+			result = (lo>>lsb | hi<<(width-lsb)) & ones(width)
+		}
+		c.setX(rd, result, sf)
+
+	default:
+		c.undefined()
+	}
+}
+
+// execBitfield implements SBFM, BFM and UBFM.
+func (c *CPU) execBitfield(insn uint32, sf bool) {
+	rd := insn & 31
+	rn := (insn >> 5) & 31
+	opc := (insn >> 29) & 3
+	n := (insn >> 22) & 1
+	immr := (insn >> 16) & 0x3F
+	imms := (insn >> 10) & 0x3F
+
+	width := uint32(32)
+	if sf {
+		width = 64
+	}
+	if opc == 3 || n != (insn>>31) || (!sf && (immr >= 32 || imms >= 32)) {
+		c.undefined()
+		return
+	}
+	wmask, tmask, ok := decodeBitMasks(n, imms, immr, false, width)
+	if !ok {
+		c.undefined()
+		return
+	}
+
+	var dst uint64
+	if opc == 1 { // BFM keeps the destination bits outside the field
+		dst = c.x(rd)
+	}
+	src := c.x(rn) & ones(width)
+	bot := dst&^wmask | ror(src, immr, width)&wmask
+	top := dst
+	if opc == 0 && src>>imms&1 != 0 { // SBFM replicates the sign bit
+		top = ones(width)
+	}
+	c.setX(rd, (top&^tmask|bot&tmask)&ones(width), sf)
+}
@@ -0,0 +1,347 @@
+package a64
+
+import "math/bits"
+
+// execDataProcReg handles "Data Processing -- Register" (op0 = x101).
+func (c *CPU) execDataProcReg(insn uint32) {
+	op1 := (insn >> 28) & 1
+	op2 := (insn >> 21) & 0xF
+
+	switch {
+	case op1 == 0 && op2&0x8 == 0:
+		c.execLogicalShifted(insn)
+	case op1 == 0 && op2&0x9 == 0x8:
+		c.execAddSubShifted(insn)
+	case op1 == 0 && op2&0x9 == 0x9:
+		c.execAddSubExtended(insn)
+	case op1 == 1 && op2 == 0x0:
+		c.execAddSubCarry(insn)
+	case op1 == 1 && op2 == 0x2:
+		c.execCondCompare(insn)
+	case op1 == 1 && op2 == 0x4:
+		c.execCondSelect(insn)
+	case op1 == 1 && op2 == 0x6:
+		if insn&(1<<30) != 0 {
+			c.execDataProc1(insn)
+		} else {
+			c.execDataProc2(insn)
+		}
+	case op1 == 1 && op2&0x8 == 0x8:
+		c.execDataProc3(insn)
+	default:
+		c.undefined()
+	}
+}
+
+func (c *CPU) execLogicalShifted(insn uint32) {
+	sf := insn>>31 != 0
+	imm6 := (insn >> 10) & 0x3F
+	if !sf && imm6 >= 32 {
+		c.undefined()
+		return
+	}
+	rd := insn & 31
+	x := c.x((insn >> 5) & 31)
+	y := shiftReg(c.x((insn>>16)&31), (insn>>22)&3, imm6, sf)
+	if insn&(1<<21) != 0 { // N: invert operand
+		y = ^y
+	}
+
+	var result uint64
+	switch (insn >> 29) & 3 {
+	case 0: // AND, BIC
+		result = x & y
+	case 1: // ORR, ORN
+		result = x | y
+	case 2: // EOR, EON
+		result = x ^ y
+	case 3: // ANDS, BICS
+		result = x & y
+		c.setNZCV(logicFlags(result, sf))
+	}
+	c.setX(rd, result, sf)
+}
+
+func (c *CPU) execAddSubShifted(insn uint32) {
+	sf := insn>>31 != 0
+	shift := (insn >> 22) & 3
+	imm6 := (insn >> 10) & 0x3F
+	if shift == 3 || (!sf && imm6 >= 32) {
+		c.undefined()
+		return
+	}
+	y := shiftReg(c.x((insn>>16)&31), shift, imm6, sf)
+	c.addSub(insn, c.x((insn>>5)&31), y, false)
+}
+
+func (c *CPU) execAddSubExtended(insn uint32) {
+	sf := insn>>31 != 0
+	imm3 := (insn >> 10) & 7
+	if imm3 > 4 || (insn>>22)&3 != 0 {
+		c.undefined()
+		return
+	}
+	y := extendReg(c.x((insn>>16)&31), (insn>>13)&7, imm3)
+	if !sf {
+		y &= 0xFFFFFFFF
+	}
+	c.addSub(insn, c.xsp((insn>>5)&31), y, true)
+}
+
+// addSub finishes an ADD/ADDS/SUB/SUBS. Extended-register forms may write
+// SP when flags are not set.
+func (c *CPU) addSub(insn uint32, x, y uint64, spDest bool) {
+	sf := insn>>31 != 0
+	rd := insn & 31
+	setFlags := insn&(1<<29) != 0
+
+	var result, nzcv uint64
+	if insn&(1<<30) != 0 {
+		result, nzcv = addWithCarry(x, ^y, 1, sf)
+	} else {
+		result, nzcv = addWithCarry(x, y, 0, sf)
+	}
+	if setFlags {
+		c.setNZCV(nzcv)
+	}
+	if spDest && !setFlags {
+		c.setXSP(rd, result, sf)
+	} else {
+		c.setX(rd, result, sf)
+	}
+}
+
+func (c *CPU) execAddSubCarry(insn uint32) {
+	if (insn>>10)&0x3F != 0 {
+		c.undefined()
+		return
+	}
+	sf := insn>>31 != 0
+	x := c.x((insn >> 5) & 31)
+	y := c.x((insn >> 16) & 31)
+	if insn&(1<<30) != 0 { // SBC
+		y = ^y
+	}
+	carry := (c.PSTATE >> 29) & 1
+	result, nzcv := addWithCarry(x, y, carry, sf)
+	if insn&(1<<29) != 0 {
+		c.setNZCV(nzcv)
+	}
+	c.setX(insn&31, result, sf)
+}
+
+// execCondCompare implements CCMN/CCMP with register or immediate operand.
+func (c *CPU) execCondCompare(insn uint32) {
+	if insn&(1<<29) == 0 || insn&(1<<10) != 0 || insn&(1<<4) != 0 {
+		c.undefined()
+		return
+	}
+	sf := insn>>31 != 0
+	cond := (insn >> 12) & 0xF
+	if !c.condHolds(cond) {
+		c.setNZCV(uint64(insn & 0xF))
+		return
+	}
+
+	x := c.x((insn >> 5) & 31)
+	var y uint64
+	if insn&(1<<11) != 0 {
+		y = uint64((insn >> 16) & 31)
+	} else {
+		y = c.x((insn >> 16) & 31)
+	}
+	var nzcv uint64
+	if insn&(1<<30) != 0 { // CCMP
+		_, nzcv = addWithCarry(x, ^y, 1, sf)
+	} else { // CCMN
+		_, nzcv = addWithCarry(x, y, 0, sf)
+	}
+	c.setNZCV(nzcv)
+}
+
+// execCondSelect implements CSEL, CSINC, CSINV and CSNEG.
+func (c *CPU) execCondSelect(insn uint32) {
+	if insn&(1<<29) != 0 || insn&(1<<11) != 0 {
+		c.undefined()
+		return
+	}
+	sf := insn>>31 != 0
+	op := (insn >> 30) & 1
+	op2 := (insn >> 10) & 1
+
+	var result uint64
+	if c.condHolds((insn >> 12) & 0xF) {
+		result = c.x((insn >> 5) & 31)
+	} else {
+		result = c.x((insn >> 16) & 31)
+		switch {
+		case op == 0 && op2 == 1: // CSINC
+			result++
+		case op == 1 && op2 == 0: // CSINV
+			result = ^result
+		case op == 1 && op2 == 1: // CSNEG
+			result = -result
+		}
+	}
+	c.setX(insn&31, result, sf)
+}
+
+// execDataProc1 implements RBIT, REV16, REV32, REV, CLZ and CLS.
+func (c *CPU) execDataProc1(insn uint32) {
+	if (insn>>16)&0x1F != 0 || insn&(1<<29) != 0 {
+		c.undefined()
+		return
+	}
+	sf := insn>>31 != 0
+	x := c.x((insn >> 5) & 31)
+
+	var result uint64
+	switch (insn >> 10) & 0x3F {
+	case 0: // RBIT
+		if sf {
+			result = bits.Reverse64(x)
+		} else {
+			result = uint64(bits.Reverse32(uint32(x)))
+		}
+	case 1: // REV16
+		result = (x&0x00FF00FF00FF00FF)<<8 | (x>>8)&0x00FF00FF00FF00FF
+	case 2: // REV32 (64-bit) or REV (32-bit)
+		if sf {
+			result = uint64(bits.ReverseBytes32(uint32(x))) | uint64(bits.ReverseBytes32(uint32(x>>32)))<<32
+		} else {
+			result = uint64(bits.ReverseBytes32(uint32(x)))
+		}
+	case 3: // REV (64-bit)
+		if !sf {
+			c.undefined()
+			return
+		}
+		result = bits.ReverseBytes64(x)
+	case 4: // CLZ
+		if sf {
+			result = uint64(bits.LeadingZeros64(x))
+		} else {
+			result = uint64(bits.LeadingZeros32(uint32(x)))
+		}
+	case 5: // CLS
+		if sf {
+			result = uint64(bits.LeadingZeros64(x^uint64(int64(x)>>1))) - 1
+		} else {
+			w := uint32(x)
+			result = uint64(bits.LeadingZeros32(w^uint32(int32(w)>>1))) - 1
+		}
+	default:
+		c.undefined()
+		return
+	}
+	c.setX(insn&31, result, sf)
+}
+
+// execDataProc2 implements UDIV, SDIV and the variable shifts.
+func (c *CPU) execDataProc2(insn uint32) {
+	if insn&(1<<29) != 0 {
+		c.undefined()
+		return
+	}
+	sf := insn>>31 != 0
+	x := c.x((insn >> 5) & 31)
+	y := c.x((insn >> 16) & 31)
+	if !sf {
+		x &= 0xFFFFFFFF
+		y &= 0xFFFFFFFF
+	}
+
+	var result uint64
+	switch opcode := (insn >> 10) & 0x3F; opcode {
+	case 2: // UDIV
+		if y != 0 {
+			result = x / y
+		}
+	case 3: // SDIV
+		if y != 0 {
+			if sf {
+				if int64(x) == -1<<63 && int64(y) == -1 {
+					result = x
+				} else {
+					result = uint64(int64(x) / int64(y))
+				}
+			} else {
+				if int32(x) == -1<<31 && int32(y) == -1 {
+					result = x
+				} else {
+					result = uint64(uint32(int32(x) / int32(y)))
+				}
+			}
+		}
+	case 8, 9, 10, 11: // LSLV, LSRV, ASRV, RORV
+		result = shiftReg(x, opcode-8, uint32(y), sf)
+	default:
+		c.undefined()
+		return
+	}
+	c.setX(insn&31, result, sf)
+}
+
+// execDataProc3 implements MADD, MSUB and the widening multiplies.
+func (c *CPU) execDataProc3(insn uint32) {
+	sf := insn>>31 != 0
+	op54 := (insn >> 29) & 3
+	op31 := (insn >> 21) & 7
+	o0 := (insn >> 15) & 1
+	if op54 != 0 {
+		c.undefined()
+		return
+	}
+
+	rd := insn & 31
+	x := c.x((insn >> 5) & 31)
+	y := c.x((insn >> 16) & 31)
+	a := c.x((insn >> 10) & 31)
+
+	switch op31 {
+	case 0: // MADD, MSUB
+		if o0 == 0 {
+			c.setX(rd, a+x*y, sf)
+		} else {
+			c.setX(rd, a-x*y, sf)
+		}
+	case 1, 5: // SMADDL/SMSUBL, UMADDL/UMSUBL
+		if !sf {
+			c.undefined()
+			return
+		}
+		var prod uint64
+		if op31 == 1 {
+			prod = uint64(int64(int32(x)) * int64(int32(y)))
+		} else {
+			prod = uint64(uint32(x)) * uint64(uint32(y))
+		}
+		if o0 == 0 {
+			c.setX(rd, a+prod, true)
+		} else {
+			c.setX(rd, a-prod, true)
+		}
+	case 2: // SMULH
+		if !sf || o0 != 0 {
+			c.undefined()
+			return
+		}
+		hi, _ := bits.Mul64(x, y)
+		if int64(x) < 0 {
+			hi -= y
+		}
+		if int64(y) < 0 {
+			hi -= x
+		}
+		c.setX(rd, hi, true)
+	case 6: // UMULH
+		if !sf || o0 != 0 {
+			c.undefined()
+			return
+		}
+		hi, _ := bits.Mul64(x, y)
+		c.setX(rd, hi, true)
+	default:
+		c.undefined()
+	}
+}
@@ -0,0 +1,315 @@
+package a64
+
+import "encoding/binary"
+
+// execLoadStore handles "Loads and Stores" (op0 = x1x0).
+func (c *CPU) execLoadStore(insn uint32) {
+	switch {
+	case insn&0x3F000000 == 0x08000000:
+		c.execExclusive(insn)
+	case insn&0x3B000000 == 0x18000000:
+		c.execLoadLiteral(insn)
+	case insn&0x3A000000 == 0x28000000:
+		c.execPair(insn)
+	case insn&0x3B000000 == 0x39000000: // unsigned immediate
+		scale := ldstScale(insn)
+		offset := uint64((insn>>10)&0xFFF) << scale
+		c.ldstSingle(insn, c.xsp((insn>>5)&31)+offset, false, 0)
+	case insn&0x3B200000 == 0x38000000: // unscaled, pre/post-indexed, unprivileged
+		base := c.xsp((insn >> 5) & 31)
+		offset := signExtend(uint64((insn>>12)&0x1FF), 9)
+		switch (insn >> 10) & 3 {
+		case 0, 2: // LDUR/STUR, LDTR/STTR
+			c.ldstSingle(insn, base+offset, false, 0)
+		case 1: // post-index
+			c.ldstSingle(insn, base, true, base+offset)
+		case 3: // pre-index
+			c.ldstSingle(insn, base+offset, true, base+offset)
+		}
+	case insn&0x3B200C00 == 0x38200800: // register offset
+		option := (insn >> 13) & 7
+		if option&2 == 0 {
+			c.undefined()
+			return
+		}
+		var shift uint32
+		if insn&(1<<12) != 0 {
+			shift = ldstScale(insn)
+		}
+		offset := extendReg(c.x((insn>>16)&31), option, shift)
+		c.ldstSingle(insn, c.xsp((insn>>5)&31)+offset, false, 0)
+	default:
+		c.undefined()
+	}
+}
+
+// ldstScale returns log2 of the access size of a single register load/store.
+func ldstScale(insn uint32) uint32 {
+	size := insn >> 30
+	if insn&(1<<26) != 0 { // SIMD&FP: opc<1>:size
+		return (insn>>21)&4 | size
+	}
+	return size
+}
+
+// ldstSingle performs a single register load or store at addr, optionally
+// writing wbAddr back to the base register afterwards.
+func (c *CPU) ldstSingle(insn uint32, addr uint64, writeback bool, wbAddr uint64) {
+	rt := insn & 31
+	rn := (insn >> 5) & 31
+	size := insn >> 30
+	opc := (insn >> 22) & 3
+
+	if insn&(1<<26) != 0 {
+		scale := (opc>>1)<<2 | size
+		if scale > 4 {
+			c.undefined()
+			return
+		}
+		n := 1 << scale
+		if opc&1 != 0 {
+			var buf [16]byte
+			if !c.access(addr, buf[:n], AccessRead, 0) {
+				return
+			}
+			c.V[rt] = buf
+		} else if !c.access(addr, c.V[rt][:n], AccessWrite, 0) {
+			return
+		}
+		if writeback {
+			c.setXSP(rn, wbAddr, true)
+		}
+		return
+	}
+
+	n := 1 << size
+	var signed, sf bool
+	switch opc {
+	case 0, 1:
+		sf = size == 3
+	case 2:
+		if size == 3 { // PRFM
+			return
+		}
+		signed, sf = true, true
+	case 3:
+		if size >= 2 {
+			c.undefined()
+			return
+		}
+		signed = true
+	}
+
+	var iss uint32
+	if !writeback {
+		iss = dataISS(n, signed, rt, sf, false)
+	}
+
+	if opc == 0 {
+		if !c.store(addr, n, c.x(rt), iss) {
+			return
+		}
+	} else {
+		v, ok := c.load(addr, n, iss)
+		if !ok {
+			return
+		}
+		if signed {
+			v = signExtend(v, uint(n*8))
+		}
+		c.setX(rt, v, sf)
+	}
+	if writeback {
+		c.setXSP(rn, wbAddr, true)
+	}
+}
+
+// execLoadLiteral implements LDR (literal), LDRSW (literal) and PRFM.
+func (c *CPU) execLoadLiteral(insn uint32) {
+	rt := insn & 31
+	opc := insn >> 30
+	addr := c.PC + signExtend(uint64((insn>>5)&0x7FFFF)<<2, 21)
+
+	if insn&(1<<26) != 0 {
+		if opc == 3 {
+			c.undefined()
+			return
+		}
+		var buf [16]byte
+		if c.access(addr, buf[:4<<opc], AccessRead, 0) {
+			c.V[rt] = buf
+		}
+		return
+	}
+
+	switch opc {
+	case 0, 1:
+		n := 4 << opc
+		if v, ok := c.load(addr, n, dataISS(n, false, rt, opc == 1, false)); ok {
+			c.setX(rt, v, opc == 1)
+		}
+	case 2: // LDRSW
+		if v, ok := c.load(addr, 4, dataISS(4, true, rt, true, false)); ok {
+			c.setX(rt, signExtend(v, 32), true)
+		}
+	case 3: // PRFM
+	}
+}
+
+// execPair implements LDP, STP, LDPSW and LDNP/STNP for general and SIMD&FP
+// registers.
+func (c *CPU) execPair(insn uint32) {
+	opc := insn >> 30
+	simd := insn&(1<<26) != 0
+	load := insn&(1<<22) != 0
+	rt := insn & 31
+	rn := (insn >> 5) & 31
+	rt2 := (insn >> 10) & 31
+
+	var scale uint32
+	signed := false
+	if simd {
+		if opc == 3 {
+			c.undefined()
+			return
+		}
+		scale = 2 + opc
+	} else {
+		switch opc {
+		case 0:
+			scale = 2
+		case 1: // LDPSW
+			if !load {
+				c.undefined()
+				return
+			}
+			scale, signed = 2, true
+		case 2:
+			scale = 3
+		default:
+			c.undefined()
+			return
+		}
+	}
+
+	n := 1 << scale
+	offset := signExtend(uint64((insn>>15)&0x7F), 7) << scale
+	base := c.xsp(rn)
+	addr := base
+	writeback := false
+	switch (insn >> 23) & 3 {
+	case 0, 2: // no-allocate and signed offset
+		addr = base + offset
+	case 1: // post-index
+		writeback = true
+	case 3: // pre-index
+		addr = base + offset
+		writeback = true
+	}
+
+	var buf [32]byte
+	if load {
+		if !c.access(addr, buf[:2*n], AccessRead, 0) {
+			return
+		}
+		if simd {
+			var v1, v2 [16]byte
+			copy(v1[:], buf[:n])
+			copy(v2[:], buf[n:2*n])
+			c.V[rt], c.V[rt2] = v1, v2
+		} else {
+			v1 := binary.LittleEndian.Uint64(buf[0:8])
+			v2 := binary.LittleEndian.Uint64(buf[n : n+8])
+			if n == 4 {
+				v1 &= 0xFFFFFFFF
+				v2 &= 0xFFFFFFFF
+			}
+			if signed {
+				v1, v2 = signExtend(v1, 32), signExtend(v2, 32)
+			}
+			sf := n == 8 || signed
+			c.setX(rt, v1, sf)
+			c.setX(rt2, v2, sf)
+		}
+	} else {
+		if simd {
+			copy(buf[:n], c.V[rt][:n])
+			copy(buf[n:2*n], c.V[rt2][:n])
+		} else {
+			var tmp [8]byte
+			binary.LittleEndian.PutUint64(tmp[:], c.x(rt))
+			copy(buf[:n], tmp[:n])
+			binary.LittleEndian.PutUint64(tmp[:], c.x(rt2))
+			copy(buf[n:2*n], tmp[:n])
+		}
+		if !c.access(addr, buf[:2*n], AccessWrite, 0) {
+			return
+		}
+	}
+
+	if writeback {
+		c.setXSP(rn, base+offset, true)
+	}
+}
+
+// execExclusive implements LDXR/STXR, LDAXR/STLXR and LDAR/STLR with a
+// single-address exclusive monitor.
+func (c *CPU) execExclusive(insn uint32) {
+	size := insn >> 30
+	o2 := (insn >> 23) & 1
+	load := insn&(1<<22) != 0
+	o1 := (insn >> 21) & 1
+	rs := (insn >> 16) & 31
+	rt := insn & 31
+	rn := (insn >> 5) & 31
+
+	if o1 != 0 {
+		c.undefined() // pair exclusives and compare-and-swap
+		return
+	}
+
+	n := 1 << size
+	sf := size == 3
+	addr := c.xsp(rn)
+
+	if o2 == 1 { // LDAR/STLR and the LORegion variants
+		iss := dataISS(n, false, rt, sf, true)
+		if addr&uint64(n-1) != 0 {
+			c.alignmentFault(addr, !load, iss)
+			return
+		}
+		if load {
+			if v, ok := c.load(addr, n, iss); ok {
+				c.setX(rt, v, sf)
+			}
+		} else {
+			c.store(addr, n, c.x(rt), iss)
+		}
+		return
+	}
+
+	if addr&uint64(n-1) != 0 {
+		c.alignmentFault(addr, !load, 0)
+		return
+	}
+	if load {
+		v, ok := c.load(addr, n, 0)
+		if !ok {
+			return
+		}
+		c.setX(rt, v, sf)
+		c.monitorAddr, c.monitorValid = addr, true
+		return
+	}
+
+	if !c.monitorValid || c.monitorAddr != addr {
+		c.monitorValid = false
+		c.setX(rs, 1, false)
+		return
+	}
+	if !c.store(addr, n, c.x(rt), 0) {
+		return
+	}
+	c.monitorValid = false
+	c.setX(rs, 0, false)
+}
@@ -0,0 +1,104 @@
+package a64
+
+import "encoding/binary"
+
+// access copies between buf and guest memory at addr. Every byte is
+// translated before any is transferred, so a fault leaves memory and
+// registers untouched. On failure the matching abort is pending and false is
+// returned. iss carries the instruction specific syndrome bits (ISV, SAS,
+// SSE, SRT, SF, AR) reported with a data abort.
+func (c *CPU) access(addr uint64, buf []byte, acc Access, iss uint32) bool {
+	for off := 0; off < len(buf); {
+		host, fault := c.Mem.Translate(addr+uint64(off), acc)
+		if fault == FaultNone && len(host) == 0 {
+			fault = FaultTranslation
+		}
+		if fault != FaultNone {
+			c.abort(addr+uint64(off), acc, fault, iss)
+			return false
+		}
+		off += min(len(host), len(buf)-off)
+	}
+
+	for off := 0; off < len(buf); {
+		host, _ := c.Mem.Translate(addr+uint64(off), acc)
+		if acc == AccessWrite {
+			off += copy(host, buf[off:])
+		} else {
+			off += copy(buf[off:], host)
+		}
+	}
+	return true
+}
+
+// abort raises an instruction or data abort for addr.
+func (c *CPU) abort(addr uint64, acc Access, fault Fault, iss uint32) {
+	fsc := uint32(FSCTranslationL3)
+	if fault == FaultPermission {
+		fsc = FSCPermissionL3
+	}
+
+	if acc == AccessFetch {
+		c.exception(ECInstAbortLower, fsc, addr, addr)
+		return
+	}
+	if acc == AccessWrite {
+		iss |= issWnR
+	}
+	c.exception(ECDataAbortLower, iss|fsc, addr, addr)
+}
+
+// alignmentFault raises a data abort for a misaligned access that must be
+// aligned (exclusives and acquire/release).
+func (c *CPU) alignmentFault(addr uint64, write bool, iss uint32) {
+	if write {
+		iss |= issWnR
+	}
+	c.exception(ECDataAbortLower, iss|FSCAlignment, addr, addr)
+}
+
+// fetch reads an instruction word.
+func (c *CPU) fetch(addr uint64, buf []byte) bool {
+	return c.access(addr, buf, AccessFetch, 0)
+}
+
+// load reads a little-endian value of size bytes (1, 2, 4 or 8).
+func (c *CPU) load(addr uint64, size int, iss uint32) (uint64, bool) {
+	var buf [8]byte
+	if !c.access(addr, buf[:size], AccessRead, iss) {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint64(buf[:]), true
+}
+
+// store writes a little-endian value of size bytes (1, 2, 4 or 8).
+func (c *CPU) store(addr uint64, size int, val uint64, iss uint32) bool {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], val)
+	return c.access(addr, buf[:size], AccessWrite, iss)
+}
+
+// dataISS builds the syndrome bits describing a single register load or
+// store so that a hypervisor can emulate it (ISV=1).
+func dataISS(size int, signExtend bool, rt uint32, sf bool, acqRel bool) uint32 {
+	iss := uint32(issISV)
+	switch size {
+	case 2:
+		iss |= 1 << 22
+	case 4:
+		iss |= 2 << 22
+	case 8:
+		iss |= 3 << 22
+	}
+	if signExtend {
+		iss |= 1 << 21
+	}
+	iss |= (rt & 31) << 16
+	if sf {
+		iss |= 1 << 15
+	}
+	if acqRel {
+		iss |= 1 << 14
+	}
+	return iss
+}
@@ -0,0 +1,258 @@
+package a64
+
+import "encoding/binary"
+
+// execSIMD handles the "Data Processing -- Scalar Floating-Point and
+// Advanced SIMD" group (op0 = x111). Only the register moves and bitwise
+// operations compilers emit for copies and zeroing are implemented;
+// arithmetic raises an Unknown-reason exception.
+func (c *CPU) execSIMD(insn uint32) {
+	switch {
+	case insn&0x9FF80400 == 0x0F000400:
+		c.execModifiedImm(insn)
+	case insn&0x9F20FC00 == 0x0E201C00:
+		c.execVectorLogical(insn)
+	case insn&0xBFE0FC00 == 0x0E000C00: // DUP (general)
+		size, _, ok := elemSize((insn >> 16) & 0x1F)
+		if !ok || (size == 3 && insn&(1<<30) == 0) {
+			c.undefined()
+			return
+		}
+		v := c.x((insn >> 5) & 31)
+		var out [16]byte
+		n := 8
+		if insn&(1<<30) != 0 {
+			n = 16
+		}
+		for i := 0; i < n>>size; i++ {
+			setLane(&out, i, size, v)
+		}
+		c.V[insn&31] = out
+	case insn&0xFFE0FC00 == 0x4E001C00: // INS (general)
+		size, idx, ok := elemSize((insn >> 16) & 0x1F)
+		if !ok {
+			c.undefined()
+			return
+		}
+		setLane(&c.V[insn&31], idx, size, c.x((insn>>5)&31))
+	case insn&0xFFE08400 == 0x6E000400: // INS (element)
+		imm5 := (insn >> 16) & 0x1F
+		size, dst, ok := elemSize(imm5)
+		if !ok {
+			c.undefined()
+			return
+		}
+		src := int((insn>>11)&0xF) >> size
+		setLane(&c.V[insn&31], dst, size, lane(&c.V[(insn>>5)&31], src, size))
+	case insn&0xBFE0FC00 == 0x0E003C00: // UMOV
+		size, idx, ok := elemSize((insn >> 16) & 0x1F)
+		q := insn&(1<<30) != 0
+		if !ok || q != (size == 3) {
+			c.undefined()
+			return
+		}
+		c.setX(insn&31, lane(&c.V[(insn>>5)&31], idx, size), q)
+	case insn&0xBFE0FC00 == 0x0E002C00: // SMOV
+		size, idx, ok := elemSize((insn >> 16) & 0x1F)
+		q := insn&(1<<30) != 0
+		if !ok || size >= 2 && !(size == 2 && q) {
+			c.undefined()
+			return
+		}
+		v := signExtend(lane(&c.V[(insn>>5)&31], idx, size), 8<<size)
+		c.setX(insn&31, v, q)
+	case insn&0x7F20FC00 == 0x1E200000:
+		c.execFMovGeneral(insn)
+	case insn&0xFF3FFC00 == 0x1E204000: // FMOV (register)
+		typ := (insn >> 22) & 3
+		if typ > 1 {
+			c.undefined()
+			return
+		}
+		var out [16]byte
+		n := 4 << typ
+		copy(out[:n], c.V[(insn>>5)&31][:n])
+		c.V[insn&31] = out
+	default:
+		c.undefined()
+	}
+}
+
+// execModifiedImm implements MOVI, MVNI and the ORR/BIC (vector, immediate)
+// forms of "Advanced SIMD modified immediate".
+func (c *CPU) execModifiedImm(insn uint32) {
+	q := insn&(1<<30) != 0
+	op := (insn >> 29) & 1
+	cmode := (insn >> 12) & 0xF
+	imm8 := (insn>>11)&0xE0 | (insn>>5)&0x1F
+	if insn&(1<<11) != 0 || cmode == 0xF {
+		c.undefined() // FMOV (vector, immediate)
+		return
+	}
+
+	imm := expandImm(op, cmode, uint64(imm8))
+	rd := insn & 31
+	lo := binary.LittleEndian.Uint64(c.V[rd][0:8])
+	hi := binary.LittleEndian.Uint64(c.V[rd][8:16])
+
+	switch {
+	case cmode < 0xC && cmode&1 == 1: // ORR, BIC
+		if op == 1 {
+			lo, hi = lo&^imm, hi&^imm
+		} else {
+			lo, hi = lo|imm, hi|imm
+		}
+	case op == 1 && cmode != 0xE: // MVNI
+		lo, hi = ^imm, ^imm
+	default: // MOVI
+		lo, hi = imm, imm
+	}
+	if !q {
+		hi = 0
+	}
+
+	var out [16]byte
+	binary.LittleEndian.PutUint64(out[0:8], lo)
+	binary.LittleEndian.PutUint64(out[8:16], hi)
+	c.V[rd] = out
+}
+
+// expandImm is AdvSIMDExpandImm for the integer cmodes.
+func expandImm(op, cmode uint32, imm8 uint64) uint64 {
+	switch cmode >> 1 {
+	case 0:
+		return replicate(imm8, 32, 64)
+	case 1:
+		return replicate(imm8<<8, 32, 64)
+	case 2:
+		return replicate(imm8<<16, 32, 64)
+	case 3:
+		return replicate(imm8<<24, 32, 64)
+	case 4:
+		return replicate(imm8, 16, 64)
+	case 5:
+		return replicate(imm8<<8, 16, 64)
+	case 6:
+		if cmode&1 == 0 {
+			return replicate(imm8<<8|0xFF, 32, 64)
+		}
+		return replicate(imm8<<16|0xFFFF, 32, 64)
+	}
+	if op == 0 {
+		return replicate(imm8, 8, 64)
+	}
+	var imm uint64
+	for i := 0; i < 8; i++ {
+		if imm8>>i&1 != 0 {
+			imm |= 0xFF << (8 * i)
+		}
+	}
+	return imm
+}
+
+// execVectorLogical implements AND, BIC, ORR, ORN, EOR, BSL, BIT and BIF.
+func (c *CPU) execVectorLogical(insn uint32) {
+	n := 8
+	if insn&(1<<30) != 0 {
+		n = 16
+	}
+	rd := insn & 31
+	a := c.V[(insn>>5)&31]
+	b := c.V[(insn>>16)&31]
+	d := c.V[rd]
+	u := (insn >> 29) & 1
+	opc := (insn >> 22) & 3
+
+	var out [16]byte
+	for i := 0; i < n; i++ {
+		switch u<<2 | opc {
+		case 0: // AND
+			out[i] = a[i] & b[i]
+		case 1: // BIC
+			out[i] = a[i] &^ b[i]
+		case 2: // ORR
+			out[i] = a[i] | b[i]
+		case 3: // ORN
+			out[i] = a[i] | ^b[i]
+		case 4: // EOR
+			out[i] = a[i] ^ b[i]
+		case 5: // BSL
+			out[i] = d[i]&a[i] | ^d[i]&b[i]
+		case 6: // BIT
+			out[i] = b[i]&a[i] | ^b[i]&d[i]
+		case 7: // BIF
+			out[i] = ^b[i]&a[i] | b[i]&d[i]
+		}
+	}
+	c.V[rd] = out
+}
+
+// execFMovGeneral implements FMOV between general purpose and SIMD&FP
+// registers.
+func (c *CPU) execFMovGeneral(insn uint32) {
+	sf := insn>>31 != 0
+	typ := (insn >> 22) & 3
+	rmode := (insn >> 19) & 3
+	opcode := (insn >> 16) & 7
+	rd := insn & 31
+	rn := (insn >> 5) & 31
+	if opcode&6 != 6 {
+		c.undefined() // conversions
+		return
+	}
+	toGPR := opcode == 6
+
+	switch {
+	case !sf && typ == 0 && rmode == 0: // Wd <-> Sn
+		if toGPR {
+			c.setX(rd, uint64(binary.LittleEndian.Uint32(c.V[rn][0:4])), false)
+		} else {
+			var out [16]byte
+			binary.LittleEndian.PutUint32(out[0:4], uint32(c.x(rn)))
+			c.V[rd] = out
+		}
+	case sf && typ == 1 && rmode == 0: // Xd <-> Dn
+		if toGPR {
+			c.setX(rd, binary.LittleEndian.Uint64(c.V[rn][0:8]), true)
+		} else {
+			var out [16]byte
+			binary.LittleEndian.PutUint64(out[0:8], c.x(rn))
+			c.V[rd] = out
+		}
+	case sf && typ == 2 && rmode == 1: // Xd <-> Vn.D[1]
+		if toGPR {
+			c.setX(rd, binary.LittleEndian.Uint64(c.V[rn][8:16]), true)
+		} else {
+			binary.LittleEndian.PutUint64(c.V[rd][8:16], c.x(rn))
+		}
+	default:
+		c.undefined()
+	}
+}
+
+// elemSize decodes the imm5 field of the copy instructions into log2 of the
+// element size in bytes and the element index.
+func elemSize(imm5 uint32) (size uint32, idx int, ok bool) {
+	for size = 0; size < 4; size++ {
+		if imm5>>size&1 != 0 {
+			return size, int(imm5 >> (size + 1)), true
+		}
+	}
+	return 0, 0, false
+}
+
+// lane returns element idx of v for elements of 1<<size bytes.
+func lane(v *[16]byte, idx int, size uint32) uint64 {
+	var buf [8]byte
+	n := 1 << size
+	copy(buf[:n], v[idx*n:])
+	return binary.LittleEndian.Uint64(buf[:])
+}
+
+// setLane writes element idx of v for elements of 1<<size bytes.
+func setLane(v *[16]byte, idx int, size uint32, val uint64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], val)
+	n := 1 << size
+	copy(v[idx*n:idx*n+n], buf[:n])
+}
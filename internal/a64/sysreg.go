@@ -0,0 +1,213 @@
+package a64
+
+// System register encodings (op0<<14 | op1<<11 | CRn<<7 | CRm<<3 | op2), the
+// same packing Hypervisor.framework uses for hv_sys_reg_t.
+const (
+	SysMDSCR_EL1        = 0x8012
+	SysMIDR_EL1         = 0xC000
+	SysMPIDR_EL1        = 0xC005
+	SysREVIDR_EL1       = 0xC006
+	SysID_AA64PFR0_EL1  = 0xC020
+	SysID_AA64PFR1_EL1  = 0xC021
+	SysID_AA64DFR0_EL1  = 0xC028
+	SysID_AA64DFR1_EL1  = 0xC029
+	SysID_AA64AFR0_EL1  = 0xC02C
+	SysID_AA64AFR1_EL1  = 0xC02D
+	SysID_AA64ISAR0_EL1 = 0xC030
+	SysID_AA64ISAR1_EL1 = 0xC031
+	SysID_AA64ISAR2_EL1 = 0xC032
+	SysID_AA64MMFR0_EL1 = 0xC038
+	SysID_AA64MMFR1_EL1 = 0xC039
+	SysID_AA64MMFR2_EL1 = 0xC03A
+	SysSCTLR_EL1        = 0xC080
+	SysACTLR_EL1        = 0xC081
+	SysCPACR_EL1        = 0xC082
+	SysTTBR0_EL1        = 0xC100
+	SysTTBR1_EL1        = 0xC101
+	SysTCR_EL1          = 0xC102
+	SysSPSR_EL1         = 0xC200
+	SysELR_EL1          = 0xC201
+	SysSP_EL0           = 0xC208
+	SysSPSel            = 0xC210
+	SysCurrentEL        = 0xC212
+	SysAFSR0_EL1        = 0xC288
+	SysAFSR1_EL1        = 0xC289
+	SysESR_EL1          = 0xC290
+	SysFAR_EL1          = 0xC300
+	SysPAR_EL1          = 0xC3A0
+	SysMAIR_EL1         = 0xC510
+	SysAMAIR_EL1        = 0xC518
+	SysVBAR_EL1         = 0xC600
+	SysCONTEXTIDR_EL1   = 0xC681
+	SysTPIDR_EL1        = 0xC684
+	SysCNTKCTL_EL1      = 0xC708
+	SysCLIDR_EL1        = 0xC801
+	SysCSSELR_EL1       = 0xD000
+	SysCTR_EL0          = 0xD801
+	SysDCZID_EL0        = 0xD807
+	SysNZCV             = 0xDA10
+	SysDAIF             = 0xDA11
+	SysFPCR             = 0xDA20
+	SysFPSR             = 0xDA21
+	SysTPIDR_EL0        = 0xDE82
+	SysTPIDRRO_EL0      = 0xDE83
+	SysCNTFRQ_EL0       = 0xDF00
+	SysCNTPCT_EL0       = 0xDF01
+	SysCNTVCT_EL0       = 0xDF02
+	SysCNTV_TVAL_EL0    = 0xDF18
+	SysCNTV_CTL_EL0     = 0xDF19
+	SysCNTV_CVAL_EL0    = 0xDF1A
+	SysSP_EL1           = 0xE208
+)
+
+// CNTV_CTL_EL0 bits.
+const (
+	cntvEnable  = 1 << 0
+	cntvIMask   = 1 << 1
+	cntvIStatus = 1 << 2
+)
+
+// vtimerAsserted reports whether the virtual timer asserts its interrupt:
+// it is enabled, not masked by the guest, and the counter has reached
+// CNTV_CVAL_EL0.
+func (c *CPU) vtimerAsserted() bool {
+	ctl, _ := c.readSysReg(SysCNTV_CTL_EL0)
+	return ctl&(cntvEnable|cntvIMask|cntvIStatus) == cntvEnable|cntvIStatus
+}
+
+// dczBlockSize is the DC ZVA block size advertised through DCZID_EL0.
+const dczBlockSize = 64
+
+// CounterFrequency is the CNTFRQ_EL0 value. The counter advances once per
+// retired instruction, so this only matters to guests that convert ticks to
+// time.
+const CounterFrequency = 24000000
+
+// idRegs are the read-only identification registers and their values: an
+// ARMv8.0 core with FP/AdvSIMD, 4K/16K granules and a 40-bit PA range.
+var idRegs = map[uint16]uint64{
+	SysMIDR_EL1:         0x000F0000, // implementer 0 ("software use")
+	SysREVIDR_EL1:       0,
+	SysID_AA64PFR0_EL1:  0x11, // EL0 and EL1 AArch64, FP and AdvSIMD present
+	SysID_AA64PFR1_EL1:  0,
+	SysID_AA64DFR0_EL1:  0x6,
+	SysID_AA64DFR1_EL1:  0,
+	SysID_AA64AFR0_EL1:  0,
+	SysID_AA64AFR1_EL1:  0,
+	SysID_AA64ISAR0_EL1: 0,
+	SysID_AA64ISAR1_EL1: 0,
+	SysID_AA64ISAR2_EL1: 0,
+	SysID_AA64MMFR0_EL1: 0x0F100022,
+	SysID_AA64MMFR1_EL1: 0,
+	SysID_AA64MMFR2_EL1: 0,
+	SysCLIDR_EL1:        0,
+	SysCTR_EL0:          0x84448004,
+	SysDCZID_EL0:        4, // 2^4 words = 64 bytes
+	SysCNTFRQ_EL0:       CounterFrequency,
+}
+
+// rwRegs are the writable EL0/EL1 registers that live in CPU.Sys.
+var rwRegs = map[uint16]bool{
+	SysMDSCR_EL1:      true,
+	SysSCTLR_EL1:      true,
+	SysACTLR_EL1:      true,
+	SysCPACR_EL1:      true,
+	SysTTBR0_EL1:      true,
+	SysTTBR1_EL1:      true,
+	SysTCR_EL1:        true,
+	SysSPSR_EL1:       true,
+	SysELR_EL1:        true,
+	SysAFSR0_EL1:      true,
+	SysAFSR1_EL1:      true,
+	SysESR_EL1:        true,
+	SysFAR_EL1:        true,
+	SysPAR_EL1:        true,
+	SysMAIR_EL1:       true,
+	SysAMAIR_EL1:      true,
+	SysVBAR_EL1:       true,
+	SysCONTEXTIDR_EL1: true,
+	SysTPIDR_EL1:      true,
+	SysCNTKCTL_EL1:    true,
+	SysCSSELR_EL1:     true,
+	SysTPIDR_EL0:      true,
+	SysTPIDRRO_EL0:    true,
+	SysCNTV_CTL_EL0:   true,
+	SysCNTV_CVAL_EL0:  true,
+	SysSP_EL1:         true,
+}
+
+// ReadSysReg returns the value of the system register with encoding key and
+// whether the interpreter implements it.
+func (c *CPU) ReadSysReg(key uint16) (uint64, bool) { return c.readSysReg(key) }
+
+// WriteSysReg sets the system register with encoding key. It returns false
+// if the register is unknown or read-only.
+func (c *CPU) WriteSysReg(key uint16, v uint64) bool { return c.writeSysReg(key, v) }
+
+func (c *CPU) readSysReg(key uint16) (uint64, bool) {
+	switch key {
+	case SysNZCV:
+		return c.PSTATE & pstateNZCV, true
+	case SysDAIF:
+		return c.PSTATE & pstateDAIF, true
+	case SysCurrentEL:
+		return c.PSTATE & 0xC, true
+	case SysSPSel:
+		return c.PSTATE & 1, true
+	case SysFPCR:
+		return c.FPCR, true
+	case SysFPSR:
+		return c.FPSR, true
+	case SysSP_EL0:
+		return c.SP, true
+	case SysMPIDR_EL1:
+		return 1<<31 | c.Affinity, true
+	case SysCNTVCT_EL0, SysCNTPCT_EL0:
+		return c.Retired, true
+	case SysCNTV_TVAL_EL0:
+		return uint64(uint32(c.Sys[SysCNTV_CVAL_EL0] - c.Retired)), true
+	case SysCNTV_CTL_EL0:
+		ctl := c.Sys[SysCNTV_CTL_EL0] & (cntvEnable | cntvIMask)
+		if ctl&cntvEnable != 0 && c.Retired >= c.Sys[SysCNTV_CVAL_EL0] {
+			ctl |= cntvIStatus
+		}
+		return ctl, true
+	}
+	if v, ok := idRegs[key]; ok {
+		return v, true
+	}
+	if rwRegs[key] {
+		return c.Sys[key], true
+	}
+	return 0, false
+}
+
+func (c *CPU) writeSysReg(key uint16, v uint64) bool {
+	switch key {
+	case SysNZCV:
+		c.PSTATE = c.PSTATE&^pstateNZCV | v&pstateNZCV
+	case SysDAIF:
+		c.PSTATE = c.PSTATE&^pstateDAIF | v&pstateDAIF
+	case SysSPSel:
+		if c.el() == 0 {
+			return false
+		}
+		c.PSTATE = c.PSTATE&^1 | v&1
+	case SysFPCR:
+		c.FPCR = v
+	case SysFPSR:
+		c.FPSR = v
+	case SysSP_EL0:
+		c.SP = v
+	case SysCNTV_TVAL_EL0:
+		c.Sys[SysCNTV_CVAL_EL0] = c.Retired + signExtend(v&0xFFFFFFFF, 32)
+	case SysCNTV_CTL_EL0:
+		c.Sys[SysCNTV_CTL_EL0] = v & (cntvEnable | cntvIMask) // ISTATUS is read-only
+	default:
+		if !rwRegs[key] {
+			return false
+		}
+		c.Sys[key] = v
+	}
+	return true
+}
@@ -0,0 +1,299 @@
+package hypervisor
+
+import (
+	"sort"
+	"sync"
+	"unsafe"
+
+	"github.com/blacktop/go-hypervisor/internal/a64"
+)
+
+func init() {
+	RegisterBackend("interp", func() (Backend, error) { return NewInterpBackend(), nil })
+}
+
+// interpMapping is one guest physical range backed by host memory.
+type interpMapping struct {
+	gpa   uint64
+	host  []byte
+	perms MemPerm
+}
+
+func (m interpMapping) end() uint64 { return m.gpa + uint64(len(m.host)) }
+
+// joins reports whether n continues m, in guest and host memory alike, with
+// the same permissions, so that the two can be one mapping.
+func (m interpMapping) joins(n interpMapping) bool {
+	return m.end() == n.gpa && m.perms == n.perms &&
+		cap(m.host)-len(m.host) >= len(n.host) &&
+		unsafe.SliceData(m.host[len(m.host):]) == unsafe.SliceData(n.host)
+}
+
+// coalesce merges neighbouring mappings that join, so that splits undone by
+// later calls, such as dirty tracking protecting page by page, do not leave
+// one mapping per page behind.
+func coalesce(ms []interpMapping) []interpMapping {
+	out := ms[:0]
+	for _, m := range ms {
+		if n := len(out); n > 0 && out[n-1].joins(m) {
+			prev := out[n-1]
+			out[n-1].host = prev.host[:len(prev.host)+len(m.host)]
+			continue
+		}
+		out = append(out, m)
+	}
+	clear(ms[len(out):])
+	return out
+}
+
+// InterpBackend is a Backend that executes guest code with a pure-Go AArch64
+// interpreter. It runs on every platform and is the default where
+// Hypervisor.framework is unavailable.
+//
+// The guest runs at EL1 with the MMU off, so guest virtual addresses are
+// guest physical addresses. Exits carry the same ESR_EL2/FAR_EL2 encoding
+// the hardware reports for BRK, HVC, SVC, SMC, WFI/WFE, trapped system
+// register accesses, undefined instructions and stage-2 faults. Pending
+// interrupts are taken through VBAR_EL1, and the virtual timer, which counts
+// retired instructions, exits with ExitTimer. Unlike Hypervisor.framework,
+// any number of interpreter VMs may exist at once.
+type InterpBackend struct {
+	mu       sync.RWMutex
+	mappings []interpMapping // sorted by gpa, non-overlapping
+	nextID   uint64
+}
+
+// NewInterpBackend returns an InterpBackend with no mappings.
+func NewInterpBackend() *InterpBackend { return &InterpBackend{} }
+
+func (b *InterpBackend) Name() string { return "interp" }
+
+func (b *InterpBackend) CreateVM() error { return nil }
+
+func (b *InterpBackend) DestroyVM() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.mappings = nil
+	return nil
+}
+
+func (b *InterpBackend) Map(host []byte, guestPhys uint64, perms MemPerm) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	m := interpMapping{gpa: guestPhys, host: host, perms: perms}
+	i := sort.Search(len(b.mappings), func(i int) bool { return b.mappings[i].gpa >= guestPhys })
+	if i > 0 && b.mappings[i-1].end() > guestPhys {
+		return HVError{Code: HV_BAD_ARGUMENT}
+	}
+	if i < len(b.mappings) && b.mappings[i].gpa < m.end() {
+		return HVError{Code: HV_BAD_ARGUMENT}
+	}
+	b.mappings = append(b.mappings, interpMapping{})
+	copy(b.mappings[i+1:], b.mappings[i:])
+	b.mappings[i] = m
+	b.mappings = coalesce(b.mappings)
+	return nil
+}
+
+// Unmap removes [guestPhys, guestPhys+size), splitting mappings that only
+// partly overlap the range.
+func (b *InterpBackend) Unmap(guestPhys, size uint64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	end := guestPhys + size
+	found := false
+	kept := b.mappings[:0:0]
+	for _, m := range b.mappings {
+		if m.end() <= guestPhys || m.gpa >= end {
+			kept = append(kept, m)
+			continue
+		}
+		found = true
+		if m.gpa < guestPhys {
+			kept = append(kept, interpMapping{gpa: m.gpa, host: m.host[:guestPhys-m.gpa], perms: m.perms})
+		}
+		if m.end() > end {
+			kept = append(kept, interpMapping{gpa: end, host: m.host[end-m.gpa:], perms: m.perms})
+		}
+	}
+	if !found {
+		return HVError{Code: HV_BAD_ARGUMENT}
+	}
+	b.mappings = coalesce(kept)
+	return nil
+}
+
+// Protect sets the permissions of [guestPhys, guestPhys+size), splitting
+// mappings that only partly overlap the range.
+func (b *InterpBackend) Protect(guestPhys, size uint64, perms MemPerm) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	end := guestPhys + size
+	kept := b.mappings[:0:0]
+	for _, m := range b.mappings {
+		if m.end() <= guestPhys || m.gpa >= end {
+			kept = append(kept, m)
+			continue
+		}
+		lo, hi := max(m.gpa, guestPhys), min(m.end(), end)
+		if m.gpa < lo {
+			kept = append(kept, interpMapping{gpa: m.gpa, host: m.host[:lo-m.gpa], perms: m.perms})
+		}
+		kept = append(kept, interpMapping{gpa: lo, host: m.host[lo-m.gpa : hi-m.gpa], perms: perms})
+		if m.end() > hi {
+			kept = append(kept, interpMapping{gpa: hi, host: m.host[hi-m.gpa:], perms: m.perms})
+		}
+	}
+	b.mappings = coalesce(kept)
+	return nil
+}
+
+func (b *InterpBackend) CreateVCPU() (BackendVCPU, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	v := &interpVCPU{id: b.nextID}
+	v.cpu = a64.New(b)
+	v.cpu.Affinity = b.nextID
+	b.nextID++
+	return v, nil
+}
+
+// Translate implements a64.Memory over the backend's mappings.
+func (b *InterpBackend) Translate(addr uint64, acc a64.Access) ([]byte, a64.Fault) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	i := sort.Search(len(b.mappings), func(i int) bool { return b.mappings[i].end() > addr })
+	if i == len(b.mappings) || b.mappings[i].gpa > addr {
+		return nil, a64.FaultTranslation
+	}
+	m := b.mappings[i]
+
+	var need MemPerm
+	switch acc {
+	case a64.AccessRead:
+		need = MemRead
+	case a64.AccessWrite:
+		need = MemWrite
+	case a64.AccessFetch:
+		need = MemExec
+	}
+	if m.perms&need == 0 {
+		return nil, a64.FaultPermission
+	}
+	return m.host[addr-m.gpa:], a64.FaultNone
+}
+
+// interpVCPU adapts an a64.CPU to BackendVCPU.
+type interpVCPU struct {
+	id  uint64
+	cpu *a64.CPU
+}
+
+func (v *interpVCPU) ID() uint64 { return v.id }
+
+func (v *interpVCPU) GetReg(r Reg) (uint64, error) {
+	switch {
+	case r <= RegLR:
+		return v.cpu.X[r], nil
+	case r == RegSP:
+		return v.cpu.SP, nil
+	case r == RegPC:
+		return v.cpu.PC, nil
+	case r == RegCPSR:
+		return v.cpu.PSTATE, nil
+	case r == RegFPCR:
+		return v.cpu.FPCR, nil
+	case r == RegFPSR:
+		return v.cpu.FPSR, nil
+	}
+	return 0, HVError{Code: HV_BAD_ARGUMENT}
+}
+
+func (v *interpVCPU) SetReg(r Reg, val uint64) error {
+	switch {
+	case r <= RegLR:
+		v.cpu.X[r] = val
+	case r == RegSP:
+		v.cpu.SP = val
+	case r == RegPC:
+		v.cpu.PC = val
+	case r == RegCPSR:
+		v.cpu.PSTATE = val
+	case r == RegFPCR:
+		v.cpu.FPCR = val
+	case r == RegFPSR:
+		v.cpu.FPSR = val
+	default:
+		return HVError{Code: HV_BAD_ARGUMENT}
+	}
+	return nil
+}
+
+func (v *interpVCPU) GetSysReg(r SysReg) (uint64, error) {
+	val, ok := v.cpu.ReadSysReg(uint16(r))
+	if !ok {
+		return 0, HVError{Code: HV_BAD_ARGUMENT}
+	}
+	return val, nil
+}
+
+// SetSysReg writes a system register. Identification registers are fixed
+// by the interpreter and reject writes.
+func (v *interpVCPU) SetSysReg(r SysReg, val uint64) error {
+	if !v.cpu.WriteSysReg(uint16(r), val) {
+		return HVError{Code: HV_BAD_ARGUMENT}
+	}
+	return nil
+}
+
+func (v *interpVCPU) GetSIMD(q SIMDReg) ([16]byte, error) { return v.cpu.V[q], nil }
+
+func (v *interpVCPU) SetSIMD(q SIMDReg, val [16]byte) error {
+	v.cpu.V[q] = val
+	return nil
+}
+
+func (v *interpVCPU) SetPendingInterrupt(t InterruptType, pending bool) error {
+	if t == FIQ {
+		v.cpu.FIQ = pending
+	} else {
+		v.cpu.IRQ = pending
+	}
+	return nil
+}
+
+func (v *interpVCPU) GetVTimerMask() (bool, error) { return v.cpu.VTimerMasked, nil }
+
+func (v *interpVCPU) SetVTimerMask(masked bool) error {
+	v.cpu.VTimerMasked = masked
+	return nil
+}
+
+func (v *interpVCPU) Run() (ExitInfo, error) {
+	exit := v.cpu.Run()
+	if exit.Canceled {
+		return ExitInfo{Reason: ExitCanceled}, nil
+	}
+	if exit.VTimer {
+		return ExitInfo{Reason: ExitTimer}, nil
+	}
+	return ExitInfo{
+		Reason: ExitException,
+		ESR:    exit.ESR,
+		FAR:    exit.FAR,
+		IPA:    exit.IPA,
+	}, nil
+}
+
+func (v *interpVCPU) Exit() error {
+	v.cpu.Stop()
+	return nil
+}
+
+func (v *interpVCPU) Destroy() error { return nil }
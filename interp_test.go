@@ -0,0 +1,238 @@
+package hypervisor
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/blacktop/go-hypervisor/internal/a64"
+)
+
+// newInterpVM creates a VM on the interpreter backend with code loaded at
+// interpCodeGPA (read/execute) and a read/write data page at interpDataGPA.
+func newInterpVM(t *testing.T, code ...uint32) (*VM, *VCPU, []byte) {
+	t.Helper()
+	vm, err := NewVMWithBackend("interp")
+	if err != nil {
+		t.Fatalf("NewVMWithBackend(interp) failed: %v", err)
+	}
+	t.Cleanup(func() { vm.Close() })
+
+	page := pageSize()
+	text := alignedBuffer(t, page)
+	for i, insn := range code {
+		binary.LittleEndian.PutUint32(text[4*i:], insn)
+	}
+	data := alignedBuffer(t, page)
+	if err := vm.Map(text, interpCodeGPA, MemRead|MemExec); err != nil {
+		t.Fatalf("Map(code) failed: %v", err)
+	}
+	if err := vm.Map(data, interpDataGPA, MemRead|MemWrite); err != nil {
+		t.Fatalf("Map(data) failed: %v", err)
+	}
+
+	vcpu, err := vm.NewVCPU()
+	if err != nil {
+		t.Fatalf("NewVCPU failed: %v", err)
+	}
+	t.Cleanup(func() { vcpu.Close() })
+	if err := vcpu.SetPC(interpCodeGPA); err != nil {
+		t.Fatalf("SetPC failed: %v", err)
+	}
+	return vm, vcpu, data
+}
+
+const (
+	interpCodeGPA = 0x10000
+	interpDataGPA = 0x100000
+)
+
+func TestInterpRun(t *testing.T) {
+	_, vcpu, data := newInterpVM(t,
+		0xD2800540, // movz x0, #0x2a
+		0xD2A00201, // movz x1, #0x10, lsl #16 (x1 = 0x100000)
+		0xF9000020, // str  x0, [x1]
+		0x91000400, // add  x0, x0, #1
+		0xD4200000, // brk  #0
+	)
+
+	info, err := vcpu.Run()
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if info.Reason != ExitException || info.ESR != 0xF2000000 {
+		t.Errorf("exit = %+v, want BRK #0 exception (ESR 0xf2000000)", info)
+	}
+	if pc, _ := vcpu.GetPC(); pc != interpCodeGPA+16 {
+		t.Errorf("PC = 0x%x, want 0x%x", pc, interpCodeGPA+16)
+	}
+	if x0, _ := vcpu.GetReg(RegX0); x0 != 0x2b {
+		t.Errorf("X0 = 0x%x, want 0x2b", x0)
+	}
+	if got := binary.LittleEndian.Uint64(data); got != 0x2a {
+		t.Errorf("guest store = 0x%x, want 0x2a", got)
+	}
+}
+
+func TestInterpExits(t *testing.T) {
+	tests := []struct {
+		name   string
+		code   []uint32
+		esr    uint64
+		far    uint64
+		wantPC uint64
+	}{
+		{
+			name:   "hvc",
+			code:   []uint32{0xD4000022}, // hvc #1
+			esr:    0x16<<26 | 1<<25 | 1,
+			wantPC: interpCodeGPA + 4,
+		},
+		{
+			name: "load from unmapped memory",
+			// movz x1, #0x20, lsl #16; ldr w2, [x1, #4]
+			code: []uint32{0xD2A00401, 0xB9400422},
+			// EC=0x24 IL ISV SAS=2 SRT=2 DFSC=translation L3
+			esr:    0x24<<26 | 1<<25 | 1<<24 | 2<<22 | 2<<16 | 0x07,
+			far:    0x200004,
+			wantPC: interpCodeGPA + 4,
+		},
+		{
+			name: "store to read-only code",
+			// adr x1, #0; str x0, [x1]
+			code: []uint32{0x10000001, 0xF9000020},
+			// EC=0x24 IL ISV SAS=3 SRT=0 SF WnR DFSC=permission L3
+			esr:    0x24<<26 | 1<<25 | 1<<24 | 3<<22 | 1<<15 | 1<<6 | 0x0F,
+			far:    interpCodeGPA,
+			wantPC: interpCodeGPA + 4,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, vcpu, _ := newInterpVM(t, tt.code...)
+			info, err := vcpu.Run()
+			if err != nil {
+				t.Fatalf("Run failed: %v", err)
+			}
+			if info.ESR != tt.esr {
+				t.Errorf("ESR = 0x%x, want 0x%x", info.ESR, tt.esr)
+			}
+			if info.FAR != tt.far {
+				t.Errorf("FAR = 0x%x, want 0x%x", info.FAR, tt.far)
+			}
+			if pc, _ := vcpu.GetPC(); pc != tt.wantPC {
+				t.Errorf("PC = 0x%x, want 0x%x", pc, tt.wantPC)
+			}
+		})
+	}
+}
+
+func TestInterpMapping(t *testing.T) {
+	vm, err := NewVMWithBackend("interp")
+	if err != nil {
+		t.Fatalf("NewVMWithBackend(interp) failed: %v", err)
+	}
+	defer vm.Close()
+	b := vm.Backend().(*InterpBackend)
+
+	page := uint64(pageSize())
+	buf := alignedBuffer(t, int(3*page))
+	if err := vm.Map(buf, 0x100000, MemRead|MemWrite); err != nil {
+		t.Fatalf("Map failed: %v", err)
+	}
+	if err := vm.Map(alignedBuffer(t, int(page)), 0x100000+page, MemRead); err == nil {
+		t.Error("Expected overlapping Map to fail")
+	}
+
+	// Punch a hole in the middle page.
+	if err := vm.Unmap(0x100000+page, page); err != nil {
+		t.Fatalf("Unmap failed: %v", err)
+	}
+	if _, fault := b.Translate(0x100000+page, a64.AccessRead); fault == a64.FaultNone {
+		t.Error("Expected unmapped middle page to fault")
+	}
+	host, fault := b.Translate(0x100000+2*page, a64.AccessRead)
+	if fault != a64.FaultNone || &host[0] != &buf[2*page] {
+		t.Error("Expected last page to remain mapped to the same host memory")
+	}
+	if err := vm.Unmap(0x100000+page, page); err == nil {
+		t.Error("Expected Unmap of an unmapped range to fail")
+	}
+}
+
+func TestInterpCoalesce(t *testing.T) {
+	vm, err := NewVMWithBackend("interp")
+	if err != nil {
+		t.Fatalf("NewVMWithBackend(interp) failed: %v", err)
+	}
+	defer vm.Close()
+	b := vm.Backend().(*InterpBackend)
+
+	page := uint64(pageSize())
+	const base = 0x100000
+	const pages = 16
+	buf := alignedBuffer(t, int(pages*page))
+	if err := vm.Map(buf, base, MemRead|MemWrite); err != nil {
+		t.Fatalf("Map failed: %v", err)
+	}
+	mappings := func(name string, want int) {
+		t.Helper()
+		b.mu.RLock()
+		defer b.mu.RUnlock()
+		if got := len(b.mappings); got != want {
+			t.Errorf("%s: %d mappings, want %d", name, got, want)
+		}
+	}
+
+	// Write-protecting page by page and lifting it again, as dirty tracking
+	// does, leaves a single mapping.
+	for i := uint64(0); i < pages; i++ {
+		if err := vm.Protect(base+i*page, page, MemRead); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mappings("read-only", 1)
+	for i := uint64(0); i < pages; i += 2 {
+		if err := vm.Protect(base+i*page, page, MemRead|MemWrite); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mappings("alternating", pages)
+	for i := uint64(1); i < pages; i += 2 {
+		if err := vm.Protect(base+i*page, page, MemRead|MemWrite); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mappings("read-write", 1)
+
+	// Mapping a hole again with the memory it had rejoins its neighbours;
+	// other memory stays separate.
+	if err := vm.Unmap(base+page, 2*page); err != nil {
+		t.Fatal(err)
+	}
+	mappings("hole", 2)
+	if err := vm.Map(buf[page:2*page], base+page, MemRead|MemWrite); err != nil {
+		t.Fatal(err)
+	}
+	mappings("half refilled", 2)
+	if err := vm.Map(alignedBuffer(t, int(page)), base+2*page, MemRead|MemWrite); err != nil {
+		t.Fatal(err)
+	}
+	mappings("refilled", 3)
+	host, fault := b.Translate(base+page, a64.AccessWrite)
+	if fault != a64.FaultNone || &host[0] != &buf[page] || len(host) != int(page) {
+		t.Errorf("Translate(0x%x) = %d bytes, %v; want the page of buf", base+page, len(host), fault)
+	}
+}
+
+func TestInterpMultipleVMs(t *testing.T) {
+	vm1, err := NewVMWithBackend("interp")
+	if err != nil {
+		t.Fatalf("first VM failed: %v", err)
+	}
+	defer vm1.Close()
+	vm2, err := NewVMWithBackend("interp")
+	if err != nil {
+		t.Fatalf("second VM failed: %v", err)
+	}
+	defer vm2.Close()
+}
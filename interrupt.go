@@ -0,0 +1,267 @@
+package hypervisor
+
+import "fmt"
+
+// InterruptType selects one of a vCPU's interrupt lines.
+type InterruptType int
+
+const (
+	IRQ InterruptType = iota
+	FIQ
+)
+
+func (t InterruptType) String() string {
+	switch t {
+	case IRQ:
+		return "irq"
+	case FIQ:
+		return "fiq"
+	}
+	return fmt.Sprintf("InterruptType(%d)", int(t))
+}
+
+// CNTV_CTL_EL0 bits.
+const (
+	vtimerEnable  = 1 << 0
+	vtimerIMask   = 1 << 1
+	vtimerIStatus = 1 << 2
+)
+
+// VTimerState is the state of a vCPU's virtual timer.
+type VTimerState struct {
+	// Ctl is CNTV_CTL_EL0: bit 0 enables the timer, bit 1 (IMASK) lets the
+	// guest mask its interrupt and bit 2 (ISTATUS) is set once it fired.
+	Ctl uint64 `json:"ctl"`
+	// CVal is CNTV_CVAL_EL0, the virtual count at which the timer fires.
+	CVal uint64 `json:"cval"`
+	// Masked is set while the host masks the timer, as it is after an
+	// ExitTimer exit, so that it cannot exit again.
+	Masked bool `json:"masked"`
+}
+
+// Enabled reports whether the guest has enabled the timer.
+func (s VTimerState) Enabled() bool { return s.Ctl&vtimerEnable != 0 }
+
+// Asserted reports whether the timer asserts its interrupt: it is enabled,
+// has fired, and the guest has not masked it.
+func (s VTimerState) Asserted() bool {
+	return s.Ctl&(vtimerEnable|vtimerIMask|vtimerIStatus) == vtimerEnable|vtimerIStatus
+}
+
+// SetPendingInterrupt raises or lowers the vCPU's IRQ or FIQ line. A raised
+// line is level-triggered: the guest takes the interrupt through its
+// VBAR_EL1 vector table whenever PSTATE does not mask it, on every Run,
+// until the line is lowered, typically once the guest has acknowledged the
+// interrupt to whatever raised it. Guest code that cannot exit, such as an
+// interrupt handler returning straight to a busy loop, keeps taking a line
+// that stays raised.
+//
+// Unlike the register accessors, SetPendingInterrupt may be called from
+// any goroutine while the vCPU runs: the guest is interrupted briefly so
+// that the change takes effect at once.
+func (c *VCPU) SetPendingInterrupt(t InterruptType, pending bool) error {
+	if err := c.setPendingInterrupt(t, pending); err != nil {
+		return &OpError{Op: "set pending interrupt", Reg: t.String(), Err: err}
+	}
+	return nil
+}
+
+func (c *VCPU) setPendingInterrupt(t InterruptType, pending bool) error {
+	if c == nil {
+		return errVCPUNil
+	}
+	if t != IRQ && t != FIQ {
+		return fmt.Errorf("hv: invalid interrupt type %d", int(t))
+	}
+
+	// Security: Lock to prevent use-after-free
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+
+	if c.closed {
+		return ErrVCPUClosed
+	}
+	if c.lines[t] == pending {
+		return nil
+	}
+	c.lines[t] = pending
+	if c.running {
+		// The run passes the new level on when it re-enters the guest
+		if err := c.impl.Exit(); err != nil {
+			c.metrics.recordResourceError()
+			return err
+		}
+	}
+	return nil
+}
+
+// PendingInterrupt reports whether SetPendingInterrupt has raised the IRQ
+// or FIQ line. It does not include the IRQ raised by SyncVTimer.
+func (c *VCPU) PendingInterrupt(t InterruptType) (bool, error) {
+	pending, err := c.pendingInterrupt(t)
+	if err != nil {
+		return false, &OpError{Op: "get pending interrupt", Reg: t.String(), Err: err}
+	}
+	return pending, nil
+}
+
+func (c *VCPU) pendingInterrupt(t InterruptType) (bool, error) {
+	if c == nil {
+		return false, errVCPUNil
+	}
+	if t != IRQ && t != FIQ {
+		return false, fmt.Errorf("hv: invalid interrupt type %d", int(t))
+	}
+
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+
+	if c.closed {
+		return false, ErrVCPUClosed
+	}
+	return c.lines[t], nil
+}
+
+// syncInterrupts passes the interrupt lines to the backend before it
+// enters the guest. It is only called from the goroutine running the vCPU.
+func (c *VCPU) syncInterrupts() error {
+	c.closeMu.Lock()
+	lines := c.lines
+	lines[IRQ] = lines[IRQ] || c.vtimerIRQ
+	c.closeMu.Unlock()
+
+	for t, pending := range lines {
+		if pending == c.applied[t] {
+			continue
+		}
+		if err := c.impl.SetPendingInterrupt(InterruptType(t), pending); err != nil {
+			c.metrics.recordResourceError()
+			return err
+		}
+		c.applied[t] = pending
+	}
+	return nil
+}
+
+// VTimer returns the state of the virtual timer.
+func (c *VCPU) VTimer() (VTimerState, error) {
+	s, err := c.vtimer()
+	if err != nil {
+		return VTimerState{}, &OpError{Op: "get vtimer", Err: err}
+	}
+	return s, nil
+}
+
+func (c *VCPU) vtimer() (VTimerState, error) {
+	if c == nil {
+		return VTimerState{}, errVCPUNil
+	}
+
+	// Security: Lock to prevent use-after-free
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+
+	if c.closed {
+		return VTimerState{}, ErrVCPUClosed
+	}
+	if c.running {
+		return VTimerState{}, ErrVCPURunning
+	}
+	return c.vtimerLocked()
+}
+
+func (c *VCPU) vtimerLocked() (VTimerState, error) {
+	var s VTimerState
+	var err error
+	if s.Ctl, err = c.impl.GetSysReg(SysCNTV_CTL_EL0); err == nil {
+		if s.CVal, err = c.impl.GetSysReg(SysCNTV_CVAL_EL0); err == nil {
+			s.Masked, err = c.impl.GetVTimerMask()
+		}
+	}
+	if err != nil {
+		c.metrics.recordResourceError()
+		return VTimerState{}, err
+	}
+	c.metrics.recordRegisterOp()
+	return s, nil
+}
+
+// SetVTimerMask masks or unmasks the virtual timer. A masked timer cannot
+// exit with ExitTimer; the timer is masked whenever it does, until the host
+// unmasks it, usually through SyncVTimer.
+func (c *VCPU) SetVTimerMask(masked bool) error {
+	if err := c.setVTimerMask(masked); err != nil {
+		return &OpError{Op: "set vtimer mask", Err: err}
+	}
+	return nil
+}
+
+func (c *VCPU) setVTimerMask(masked bool) error {
+	if c == nil {
+		return errVCPUNil
+	}
+
+	// Security: Lock to prevent use-after-free
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+
+	if c.closed {
+		return ErrVCPUClosed
+	}
+	if c.running {
+		return ErrVCPURunning
+	}
+	if err := c.impl.SetVTimerMask(masked); err != nil {
+		c.metrics.recordResourceError()
+		return err
+	}
+	c.metrics.recordRegisterOp()
+	return nil
+}
+
+// SyncVTimer connects the virtual timer to the IRQ line, as an interrupt
+// controller would. While the timer asserts its interrupt, as it does after
+// an ExitTimer exit, the line is raised. Once the guest has handled the
+// interrupt by disabling, masking or reprogramming the timer, the line is
+// lowered and the timer unmasked, re-arming it for its next ExitTimer.
+// Calling it after every exit lets timer-driven guests make progress under
+// Run. It reports whether the timer's interrupt is pending.
+//
+// The timer's IRQ is independent of the one SetPendingInterrupt raises; the
+// guest sees the line raised if either is.
+func (c *VCPU) SyncVTimer() (bool, error) {
+	asserted, err := c.syncVTimer()
+	if err != nil {
+		return false, &OpError{Op: "sync vtimer", Err: err}
+	}
+	return asserted, nil
+}
+
+func (c *VCPU) syncVTimer() (bool, error) {
+	if c == nil {
+		return false, errVCPUNil
+	}
+
+	// Security: Lock to prevent use-after-free
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+
+	if c.closed {
+		return false, ErrVCPUClosed
+	}
+	if c.running {
+		return false, ErrVCPURunning
+	}
+	s, err := c.vtimerLocked()
+	if err != nil {
+		return false, err
+	}
+	c.vtimerIRQ = s.Asserted()
+	if !c.vtimerIRQ && s.Masked {
+		if err := c.impl.SetVTimerMask(false); err != nil {
+			c.metrics.recordResourceError()
+			return false, err
+		}
+	}
+	return c.vtimerIRQ, nil
+}
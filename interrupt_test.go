@@ -0,0 +1,197 @@
+package hypervisor
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// newInterruptVM loads code at interpCodeGPA followed by a vector table
+// whose IRQ and FIQ entries for EL1h take BRK #1 and BRK #2, and points
+// VBAR_EL1 at it.
+func newInterruptVM(t *testing.T, code ...uint32) *VCPU {
+	t.Helper()
+	text := make([]uint32, 0x300/4+1)
+	copy(text, code)
+	text[0x280/4] = 0xD4200020 // brk #1
+	text[0x300/4] = 0xD4200040 // brk #2
+	_, vcpu, _ := newInterpVM(t, text...)
+	if err := vcpu.SetSysReg(SysVBAR_EL1, interpCodeGPA); err != nil {
+		t.Fatalf("SetSysReg(VBAR_EL1) failed: %v", err)
+	}
+	return vcpu
+}
+
+const (
+	insnDAIFClr = 0xD50343FF // msr daifclr, #3
+	insnLoop    = 0x14000000 // b .
+)
+
+func TestSetPendingInterrupt(t *testing.T) {
+	tests := []struct {
+		name    string
+		code    []uint32
+		typ     InterruptType
+		wantBRK uint16 // immediate of the BRK the run stops at
+	}{
+		{"irq", []uint32{insnDAIFClr, 0xD4200060}, IRQ, 1},
+		{"fiq", []uint32{insnDAIFClr, 0xD4200060}, FIQ, 2},
+		{"masked", []uint32{0xD4200060}, IRQ, 3}, // brk #3 runs instead
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vcpu := newInterruptVM(t, tt.code...)
+			if err := vcpu.SetPendingInterrupt(tt.typ, true); err != nil {
+				t.Fatalf("SetPendingInterrupt failed: %v", err)
+			}
+			if got, err := vcpu.PendingInterrupt(tt.typ); err != nil || !got {
+				t.Errorf("PendingInterrupt = %v, %v, want true", got, err)
+			}
+			info, err := vcpu.Run()
+			if err != nil {
+				t.Fatalf("Run failed: %v", err)
+			}
+			if got := uint16(info.ESR); info.Class() != ECBRK || got != tt.wantBRK {
+				t.Errorf("exit = %v, want brk #%d", info, tt.wantBRK)
+			}
+		})
+	}
+}
+
+func TestSetPendingInterruptRunning(t *testing.T) {
+	vcpu := newInterruptVM(t, insnDAIFClr, insnLoop)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	type result struct {
+		info ExitInfo
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		info, err := vcpu.RunContext(ctx)
+		done <- result{info, err}
+	}()
+	for {
+		if _, err := vcpu.GetPC(); errors.Is(err, ErrVCPURunning) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := vcpu.SetPendingInterrupt(IRQ, true); err != nil {
+		t.Fatalf("SetPendingInterrupt failed: %v", err)
+	}
+	res := <-done
+	if res.err != nil {
+		t.Fatalf("RunContext failed: %v", res.err)
+	}
+	if res.info.Class() != ECBRK || uint16(res.info.ESR) != 1 {
+		t.Errorf("exit = %v, want brk #1 from the IRQ vector", res.info)
+	}
+}
+
+func TestVTimer(t *testing.T) {
+	// The IRQ handler disables the timer before trapping.
+	code := make([]uint32, 0x280/4+2)
+	code[0], code[1] = insnDAIFClr, insnLoop
+	code[0x280/4] = 0xD51BE33F   // msr cntv_ctl_el0, xzr
+	code[0x280/4+1] = 0xD4200020 // brk #1
+	_, vcpu, _ := newInterpVM(t, code...)
+	for _, r := range []struct {
+		reg SysReg
+		val uint64
+	}{{SysVBAR_EL1, interpCodeGPA}, {SysCNTV_CVAL_EL0, 5}, {SysCNTV_CTL_EL0, 1}} {
+		if err := vcpu.SetSysReg(r.reg, r.val); err != nil {
+			t.Fatalf("SetSysReg(%v) failed: %v", r.reg, err)
+		}
+	}
+
+	info, err := vcpu.Run()
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if info.Reason != ExitTimer {
+		t.Fatalf("exit = %v, want ExitTimer", info)
+	}
+	s, err := vcpu.VTimer()
+	if err != nil {
+		t.Fatalf("VTimer failed: %v", err)
+	}
+	if !s.Masked || !s.Enabled() || !s.Asserted() || s.CVal != 5 {
+		t.Errorf("VTimer = %+v, want masked, enabled and asserted with CVal 5", s)
+	}
+
+	if asserted, err := vcpu.SyncVTimer(); err != nil || !asserted {
+		t.Fatalf("SyncVTimer = %v, %v, want true", asserted, err)
+	}
+	if info, err = vcpu.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if info.Class() != ECBRK || uint16(info.ESR) != 1 {
+		t.Fatalf("exit = %v, want brk #1 from the IRQ handler", info)
+	}
+
+	if asserted, err := vcpu.SyncVTimer(); err != nil || asserted {
+		t.Errorf("SyncVTimer after handler = %v, %v, want false", asserted, err)
+	}
+	if s, err = vcpu.VTimer(); err != nil || s.Masked || s.Enabled() {
+		t.Errorf("VTimer after handler = %+v, %v, want disabled and unmasked", s, err)
+	}
+}
+
+func TestVTimerFake(t *testing.T) {
+	vm, fake := newFakeVM(t)
+	vcpu, err := vm.NewVCPU()
+	if err != nil {
+		t.Fatalf("NewVCPU failed: %v", err)
+	}
+	defer vcpu.Close()
+
+	fake.QueueExit(ExitInfo{Reason: ExitTimer})
+	if info, err := vcpu.Run(); err != nil || info.Reason != ExitTimer {
+		t.Fatalf("Run = %v, %v, want ExitTimer", info, err)
+	}
+	if s, err := vcpu.VTimer(); err != nil || !s.Masked {
+		t.Errorf("VTimer = %+v, %v, want masked", s, err)
+	}
+	if err := vcpu.SetVTimerMask(false); err != nil {
+		t.Fatalf("SetVTimerMask failed: %v", err)
+	}
+	if s, err := vcpu.VTimer(); err != nil || s.Masked {
+		t.Errorf("VTimer = %+v, %v, want unmasked", s, err)
+	}
+}
+
+func TestInterruptErrors(t *testing.T) {
+	vm, _ := newFakeVM(t)
+	vcpu, err := vm.NewVCPU()
+	if err != nil {
+		t.Fatalf("NewVCPU failed: %v", err)
+	}
+	if err := vcpu.SetPendingInterrupt(InterruptType(7), true); err == nil {
+		t.Error("SetPendingInterrupt(7) succeeded, want error")
+	}
+	if _, err := vcpu.PendingInterrupt(InterruptType(-1)); err == nil {
+		t.Error("PendingInterrupt(-1) succeeded, want error")
+	}
+	vcpu.Close()
+
+	tests := []struct {
+		name string
+		fn   func() error
+	}{
+		{"set pending", func() error { return vcpu.SetPendingInterrupt(IRQ, true) }},
+		{"get pending", func() error { _, err := vcpu.PendingInterrupt(FIQ); return err }},
+		{"vtimer", func() error { _, err := vcpu.VTimer(); return err }},
+		{"mask", func() error { return vcpu.SetVTimerMask(true) }},
+		{"sync", func() error { _, err := vcpu.SyncVTimer(); return err }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.fn(); !errors.Is(err, ErrVCPUClosed) {
+				t.Errorf("got %v, want ErrVCPUClosed", err)
+			}
+		})
+	}
+}
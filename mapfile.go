@@ -0,0 +1,89 @@
+package hypervisor
+
+import (
+	"fmt"
+	"math"
+	"os"
+)
+
+// MapFile maps size bytes of f, starting at offset, at guestPhys without
+// copying them, and returns the region. By default the mapping is private:
+// the guest, within perms, and WriteAt change copy-on-write pages and the
+// file is never modified. With shared set, writes land in the file, which
+// must be open for writing if perms include MemWrite; shared mappings need
+// mmap, and fail with errors.ErrUnsupported where the host has none. A
+// shared mapping without MemWrite is read-only in the host too: WriteAt
+// and Protect cannot make it writable, and the slices Slice returns for it
+// must not be written.
+//
+// offset, guestPhys and size must be page-aligned, and the range must not
+// extend past the page holding the end of the file; the host faults on
+// pages beyond it, so the file must not be truncated while mapped. Regions
+// reports the file's name in Region.File. The mapping is released once
+// Unmap has removed all of it, or when the VM is closed; f may be closed as
+// soon as MapFile returns. Snapshot saves the mapped contents, not the file.
+func (vm *VM) MapFile(f *os.File, offset int64, guestPhys, size uint64, perms MemPerm, shared bool) (Region, error) {
+	r, err := vm.mapFile(f, offset, guestPhys, size, perms, shared)
+	if err != nil {
+		return Region{}, &OpError{Op: "map file", GPA: guestPhys, Size: size, Err: err}
+	}
+	vm.notify(func(o Observer) { o.Mapped(vm, r) })
+	return r, nil
+}
+
+func (vm *VM) mapFile(f *os.File, offset int64, guestPhys, size uint64, perms MemPerm, shared bool) (Region, error) {
+	if vm == nil {
+		return Region{}, errVMNil
+	}
+
+	// Security: Lock so that Close frees the mapping only after it is owned
+	vm.closeMu.Lock()
+	defer vm.closeMu.Unlock()
+
+	if vm.closed {
+		return Region{}, ErrVMClosed
+	}
+	if f == nil {
+		return Region{}, fmt.Errorf("hv: file is nil")
+	}
+	if size == 0 {
+		return Region{}, fmt.Errorf("hv: zero size")
+	}
+	if offset < 0 {
+		return Region{}, fmt.Errorf("hv: negative file offset %d", offset)
+	}
+
+	// Performance: Fast alignment checks using cached masks
+	if !isPageAligned(uint64(offset)) {
+		return Region{}, fmt.Errorf("%w: file offset 0x%x (page size: %d)", ErrInvalidAlignment, offset, pageSize())
+	}
+	if !isPageAligned(size) {
+		return Region{}, fmt.Errorf("%w: size %d (page size: %d)", ErrInvalidAlignment, size, pageSize())
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return Region{}, fmt.Errorf("hv: %w", err)
+	}
+	// Security: Pages past the end of the file would fault in the host
+	page := uint64(pageSize())
+	end := (uint64(fi.Size()) + page - 1) &^ (page - 1)
+	if size > math.MaxInt || uint64(offset) > end || size > end-uint64(offset) {
+		vm.metrics.recordSecurityError()
+		return Region{}, fmt.Errorf("hv: range 0x%x+%d extends past the end of %s (%d bytes)", offset, size, f.Name(), fi.Size())
+	}
+
+	writable := perms&MemWrite != 0
+	mem, err := mapHostFile(f, offset, int(size), shared, writable)
+	if err != nil {
+		vm.metrics.recordResourceError()
+		return Region{}, fmt.Errorf("hv: failed to map %s: %w", f.Name(), err)
+	}
+	r, err := vm.mapRegion(Region{GPA: guestPhys, Perms: perms, File: f.Name(), Host: mem, readOnly: shared && !writable}, nil)
+	if err != nil {
+		freeHost(mem)
+		return Region{}, err
+	}
+	vm.own(hostAlloc{mem: mem})
+	return r, nil
+}
@@ -0,0 +1,191 @@
+package hypervisor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// tempFile returns an open file holding data.
+func tempFile(t *testing.T, data []byte) *os.File {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "image.bin")
+	if err := os.WriteFile(name, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestMapFile(t *testing.T) {
+	page := uint64(pageSize())
+	const base = 0x200000
+	// Two and a half pages; the mapping starts at the second.
+	data := make([]byte, 2*page+page/2)
+	for i := range data {
+		data[i] = byte(i/int(page) + 1)
+	}
+
+	for _, shared := range []bool{false, true} {
+		t.Run(fmt.Sprintf("shared=%v", shared), func(t *testing.T) {
+			vm, _ := newFakeVM(t)
+			rec := &recorder{}
+			vm.AddObserver(rec)
+			f := tempFile(t, data)
+
+			r, err := vm.MapFile(f, int64(page), base, 2*page, MemRead|MemWrite, shared)
+			if errors.Is(err, errors.ErrUnsupported) {
+				t.Skip(err)
+			}
+			if err != nil {
+				t.Fatalf("MapFile failed: %v", err)
+			}
+			if r.File != f.Name() || r.GPA != base || r.Size != 2*page {
+				t.Errorf("MapFile = %v, want 0x%x-0x%x from %s", r, base, base+2*page, f.Name())
+			}
+			if got := vm.Regions(); len(got) != 1 || got[0].File != f.Name() {
+				t.Errorf("Regions = %v, want one region of %s", got, f.Name())
+			}
+
+			// The guest sees the file, zero-filled past its end.
+			got := make([]byte, 2*page)
+			if _, err := vm.ReadAt(got, base); err != nil {
+				t.Fatal(err)
+			}
+			want := append(bytes.Clone(data[page:]), make([]byte, page/2)...)
+			if !bytes.Equal(got, want) {
+				t.Errorf("guest memory does not match the file")
+			}
+
+			// Writes reach the file only if the mapping is shared.
+			if _, err := vm.WriteAt([]byte{0xff}, base); err != nil {
+				t.Fatal(err)
+			}
+			file, err := os.ReadFile(f.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantByte := data[page]
+			if shared {
+				wantByte = 0xff
+			}
+			if file[page] != wantByte {
+				t.Errorf("file byte after WriteAt = 0x%x, want 0x%x", file[page], wantByte)
+			}
+
+			if err := vm.Unmap(base, 2*page); err != nil {
+				t.Fatal(err)
+			}
+			if len(vm.owned) != 0 {
+				t.Errorf("%d allocations after Unmap, want 0", len(vm.owned))
+			}
+			wantEvents := []string{
+				fmt.Sprintf("map 0x%x+%d rw-", base, 2*page),
+				fmt.Sprintf("unmap 0x%x+%d", base, 2*page),
+			}
+			if !reflect.DeepEqual(rec.events, wantEvents) {
+				t.Errorf("events = %q, want %q", rec.events, wantEvents)
+			}
+		})
+	}
+}
+
+func TestMapFileErrors(t *testing.T) {
+	page := uint64(pageSize())
+	const base = 0x200000
+	f := tempFile(t, make([]byte, 2*page))
+
+	tests := []struct {
+		name    string
+		file    *os.File
+		offset  int64
+		gpa     uint64
+		size    uint64
+		wantErr error
+	}{
+		{"nil file", nil, 0, base, page, errAny},
+		{"zero size", f, 0, base, 0, errAny},
+		{"negative offset", f, -int64(page), base, page, errAny},
+		{"unaligned offset", f, 1, base, page, ErrInvalidAlignment},
+		{"unaligned gpa", f, 0, base + 1, page, ErrInvalidAlignment},
+		{"past end of file", f, int64(page), base, 2 * page, errAny},
+		{"offset past end", f, int64(4 * page), base, page, errAny},
+		{"overlaps", f, 0, base - page, 2 * page, errAny},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm, _ := newFakeVM(t)
+			if err := vm.Map(alignedBuffer(t, int(page)), base, MemRead); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := vm.MapFile(tt.file, tt.offset, tt.gpa, tt.size, MemRead, false)
+			if err == nil {
+				t.Fatal("MapFile succeeded, want an error")
+			}
+			if tt.wantErr != errAny && !errors.Is(err, tt.wantErr) {
+				t.Errorf("MapFile error = %v, want %v", err, tt.wantErr)
+			}
+			if len(vm.owned) != 0 || len(vm.Regions()) != 1 {
+				t.Errorf("failed MapFile left %d allocations and regions %v", len(vm.owned), vm.Regions())
+			}
+		})
+	}
+}
+
+func TestMapFileReadOnly(t *testing.T) {
+	page := uint64(pageSize())
+	const base = 0x200000
+	data := bytes.Repeat([]byte{0x5a}, int(2*page))
+	name := tempFile(t, data).Name()
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	vm, _ := newFakeVM(t)
+	if _, err := vm.MapFile(f, 0, base, 2*page, MemRead|MemWrite, true); err == nil {
+		t.Error("writable shared MapFile of a read-only file succeeded, want an error")
+	}
+	_, err = vm.MapFile(f, 0, base, 2*page, MemRead|MemExec, true)
+	if errors.Is(err, errors.ErrUnsupported) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatalf("MapFile failed: %v", err)
+	}
+	cp, err := vm.Checkpoint()
+	if err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+
+	got := make([]byte, 2*page)
+	if _, err := vm.ReadAt(got, base); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("ReadAt = %v, want the file's contents", err)
+	}
+	if _, err := vm.WriteAt([]byte{1}, int64(base+page)); err == nil {
+		t.Error("WriteAt succeeded, want an error")
+	}
+	if err := vm.Protect(base, page, MemRead|MemWrite); err == nil {
+		t.Error("Protect(rw-) succeeded, want an error")
+	}
+	// Resetting to an older checkpoint restores all memory but this.
+	if _, err := vm.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+	if err := vm.Reset(cp); err != nil {
+		t.Errorf("Reset failed: %v", err)
+	}
+	if file, err := os.ReadFile(name); err != nil || !bytes.Equal(file, data) {
+		t.Errorf("file changed: %v", err)
+	}
+}
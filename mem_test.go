@@ -78,7 +78,7 @@ func TestMemoryMapValidation(t *testing.T) {
 		if err == nil {
 			t.Error("Expected error for empty host buffer, got nil")
 		}
-		if err != nil && err.Error() != "hv: map requires non-empty host buffer" {
+		if err != nil && err.Error() != "hv: map: empty host buffer" {
 			t.Errorf("Wrong error message: %v", err)
 		}
 	})
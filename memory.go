@@ -1,47 +1,13 @@
-//go:build darwin && arm64
-
 package hypervisor
 
-/*
-#include <Hypervisor/hv.h>
-#include <Hypervisor/hv_error.h>
-
-#ifndef HV_MEMORY_READ
-#define HV_MEMORY_READ (1<<0)
-#endif
-#ifndef HV_MEMORY_WRITE
-#define HV_MEMORY_WRITE (1<<1)
-#endif
-#ifndef HV_MEMORY_EXEC
-#define HV_MEMORY_EXEC (1<<2)
-#endif
-
-extern int hv_vm_map(void* uva, unsigned long long gpa, size_t size, int flags);
-extern int hv_vm_unmap(unsigned long long gpa, size_t size);
-
-// Wrapper to construct flags using framework macros without exposing values to Go.
-static int go_hv_vm_map(void* addr, unsigned long long gpa, unsigned long long size, int r, int w, int x) {
-	int flags = 0;
-	if (r) flags |= HV_MEMORY_READ;
-	if (w) flags |= HV_MEMORY_WRITE;
-	if (x) flags |= HV_MEMORY_EXEC;
-	return hv_vm_map(addr, gpa, (size_t)size, flags);
-}
-
-static int go_hv_vm_unmap(unsigned long long gpa, unsigned long long size) {
-	return hv_vm_unmap(gpa, (size_t)size);
-}
-*/
-import "C"
-
 import (
 	"fmt"
 	"math"
+	"os"
 	"runtime"
 	"sync"
+	"time"
 	"unsafe"
-
-	"golang.org/x/sys/unix"
 )
 
 var (
@@ -53,7 +19,7 @@ var (
 // pageSize returns the system page size, cached for performance
 func pageSize() int {
 	pageSizeOnce.Do(func() {
-		cachedPageSize = unix.Getpagesize()
+		cachedPageSize = os.Getpagesize()
 		cachedPageMask = uint64(cachedPageSize - 1)
 	})
 	return cachedPageSize
@@ -62,114 +28,180 @@ func pageSize() int {
 // isPageAligned returns true if addr is page-aligned (fast path)
 func isPageAligned(addr uint64) bool {
 	pageSizeOnce.Do(func() {
-		cachedPageSize = unix.Getpagesize()
+		cachedPageSize = os.Getpagesize()
 		cachedPageMask = uint64(cachedPageSize - 1)
 	})
 	return addr&cachedPageMask == 0
 }
 
 // Map maps a host memory slice into the guest physical address space.
-// The host slice base address, length, and guestPhys must be page-aligned.
+// The host slice base address, length, and guestPhys must be page-aligned,
+// and the range must not overlap an existing region.
 func (vm *VM) Map(host []byte, guestPhys uint64, perms MemPerm) error {
+	return vm.MapLabeled(host, guestPhys, perms, "")
+}
+
+// MapLabeled is like Map but records label with the region so that it is
+// reported by Regions.
+func (vm *VM) MapLabeled(host []byte, guestPhys uint64, perms MemPerm, label string) error {
+	r, err := vm.mapLabeled(host, guestPhys, perms, label)
+	if err != nil {
+		return &OpError{Op: "map", GPA: guestPhys, Size: uint64(len(host)), Err: err}
+	}
+	vm.notify(func(o Observer) { o.Mapped(vm, r) })
+	return nil
+}
+
+func (vm *VM) mapLabeled(host []byte, guestPhys uint64, perms MemPerm, label string) (Region, error) {
 	if vm == nil {
-		return fmt.Errorf("hv: VM is nil")
+		return Region{}, errVMNil
+	}
+
+	// Security: Lock to keep Close from tearing the VM down meanwhile
+	vm.closeMu.Lock()
+	defer vm.closeMu.Unlock()
+
+	return vm.mapRegion(Region{GPA: guestPhys, Perms: perms, Label: label, Host: host}, nil)
+}
+
+// mapRegion maps r.Host at r.GPA. The backend maps a sparse region's pages
+// as they are touched rather than up front, filled by p if it is not nil.
+// The caller holds vm.closeMu.
+func (vm *VM) mapRegion(r Region, p PageProvider) (Region, error) {
+	host, guestPhys, perms := r.Host, r.GPA, r.Perms
+	if vm == nil {
+		return Region{}, errVMNil
 	}
 	if vm.closed {
-		return fmt.Errorf("hv: VM is closed")
+		return Region{}, ErrVMClosed
 	}
 	if len(host) == 0 {
-		return fmt.Errorf("hv: map requires non-empty host buffer")
+		return Region{}, errEmptyHost
 	}
+	start := time.Now()
 
 	// Security: Prevent integer overflow vulnerabilities
-	if len(host) > math.MaxInt32 {
-		return fmt.Errorf("hv: host buffer too large (max %d bytes)", math.MaxInt32)
-	}
 	if guestPhys > math.MaxUint64-uint64(len(host)) {
-		return fmt.Errorf("hv: guest address range would overflow")
+		vm.metrics.recordSecurityError()
+		return Region{}, errRangeOverflow
 	}
 
 	// Validate permissions - must have at least one permission set
 	if perms == 0 {
-		return fmt.Errorf("hv: map requires at least one permission (read, write, or exec)")
+		return Region{}, fmt.Errorf("hv: at least one permission (read, write, or exec) is required")
 	}
 	// Check for invalid permission bits
 	validPerms := MemRead | MemWrite | MemExec
 	if perms&^validPerms != 0 {
-		return fmt.Errorf("hv: invalid permission bits 0x%x (valid: 0x%x)", perms, validPerms)
+		return Region{}, fmt.Errorf("hv: invalid permission bits 0x%x (valid: 0x%x)", perms, validPerms)
 	}
 
 	// Performance: Fast alignment checks using cached masks
 	if !isPageAligned(guestPhys) {
-		return fmt.Errorf("hv: guestPhys not page-aligned: 0x%x (page size: %d)", guestPhys, pageSize())
+		return Region{}, fmt.Errorf("%w: guestPhys 0x%x (page size: %d)", ErrInvalidAlignment, guestPhys, pageSize())
 	}
 	if !isPageAligned(uint64(len(host))) {
-		return fmt.Errorf("hv: host length not page multiple: %d (page size: %d)", len(host), pageSize())
+		return Region{}, fmt.Errorf("%w: host length %d (page size: %d)", ErrInvalidAlignment, len(host), pageSize())
 	}
-	// Pin the memory before passing to C to prevent GC from moving it
+	// Pin the memory while the backend uses it
 	runtime.KeepAlive(host)
 	defer runtime.KeepAlive(host)
 
 	ptr := unsafe.Pointer(&host[0])
 	if !isPageAligned(uint64(uintptr(ptr))) {
-		return fmt.Errorf("hv: host base not page-aligned: %p (page size: %d)", ptr, pageSize())
+		return Region{}, fmt.Errorf("%w: host base %p (page size: %d)", ErrInvalidAlignment, ptr, pageSize())
 	}
-	read := 0
-	write := 0
-	exec := 0
-	if perms&MemRead != 0 {
-		read = 1
-	}
-	if perms&MemWrite != 0 {
-		write = 1
-	}
-	if perms&MemExec != 0 {
-		exec = 1
+
+	vm.regions.mu.Lock()
+	defer vm.regions.mu.Unlock()
+
+	if r, ok := vm.regions.overlapLocked(guestPhys, uint64(len(host))); ok {
+		return Region{}, fmt.Errorf("hv: overlaps mapped region %v", r)
 	}
-	ret := C.go_hv_vm_map(ptr, C.ulonglong(guestPhys), C.ulonglong(uint64(len(host))), C.int(read), C.int(write), C.int(exec))
-	if err := hvErr(ret); err != nil {
-		recordResourceError()
-		return fmt.Errorf("failed to map %d bytes at 0x%x with perms 0x%x: %w", len(host), guestPhys, perms, err)
+	r.Size = uint64(len(host))
+	if r.Sparse {
+		vm.regions.sparse = append(vm.regions.sparse, newSparseRange(r.GPA, r.Size, p))
+	} else {
+		if err := vm.backend.Map(host, guestPhys, perms); err != nil {
+			vm.metrics.recordResourceError()
+			return Region{}, err
+		}
+		r.Committed = r.Size
 	}
+	vm.regions.insertLocked(r)
 
-	recordMapOperation()
-	return nil
+	vm.metrics.recordMap(time.Since(start), r.Size, r.Committed)
+	return r, nil
 }
 
-// Unmap removes a region from the guest physical address space.
+// Unmap removes a range from the guest physical address space. Regions that
+// only partly overlap the range are split. It returns ErrMemoryNotMapped if
+// nothing in the range is mapped. Memory from AllocRegion and MapFile is
+// released once none of it is mapped.
 func (vm *VM) Unmap(guestPhys, size uint64) error {
+	guards, err := vm.unmap(guestPhys, size)
+	if err != nil {
+		return &OpError{Op: "unmap", GPA: guestPhys, Size: size, Err: err}
+	}
+	vm.notify(func(o Observer) {
+		o.Unmapped(vm, guestPhys, size)
+		for _, g := range guards {
+			o.Unmapped(vm, g.GPA, g.Size)
+		}
+	})
+	return nil
+}
+
+// unmap also returns the guard regions of allocations it released.
+func (vm *VM) unmap(guestPhys, size uint64) ([]Region, error) {
 	if vm == nil {
-		return fmt.Errorf("hv: VM is nil")
+		return nil, errVMNil
 	}
+
+	// Security: Lock to keep Close from tearing the VM down meanwhile
+	vm.closeMu.Lock()
+	defer vm.closeMu.Unlock()
+
+	return vm.unmapRange(guestPhys, size)
+}
+
+// unmapRange does the work of Unmap. The caller holds vm.closeMu.
+func (vm *VM) unmapRange(guestPhys, size uint64) ([]Region, error) {
 	if vm.closed {
-		return fmt.Errorf("hv: VM is closed")
+		return nil, ErrVMClosed
 	}
 	if size == 0 {
-		return fmt.Errorf("hv: unmap requires non-zero size")
+		return nil, fmt.Errorf("hv: zero size")
 	}
 
 	// Security: Prevent integer overflow vulnerabilities
-	if size > math.MaxInt32 {
-		return fmt.Errorf("hv: unmap size too large (max %d bytes)", math.MaxInt32)
-	}
 	if guestPhys > math.MaxUint64-size {
-		return fmt.Errorf("hv: guest address range would overflow")
+		vm.metrics.recordSecurityError()
+		return nil, errRangeOverflow
 	}
 
 	// Performance: Fast alignment checks using cached masks
 	if !isPageAligned(guestPhys) {
-		return fmt.Errorf("hv: guestPhys not page-aligned: 0x%x (page size: %d)", guestPhys, pageSize())
+		return nil, fmt.Errorf("%w: guestPhys 0x%x (page size: %d)", ErrInvalidAlignment, guestPhys, pageSize())
 	}
 	if !isPageAligned(size) {
-		return fmt.Errorf("hv: size not page multiple: %d (page size: %d)", size, pageSize())
+		return nil, fmt.Errorf("%w: size %d (page size: %d)", ErrInvalidAlignment, size, pageSize())
 	}
 
-	ret := C.go_hv_vm_unmap(C.ulonglong(guestPhys), C.ulonglong(size))
-	if err := hvErr(ret); err != nil {
-		recordResourceError()
-		return fmt.Errorf("failed to unmap region 0x%x+%d: %w", guestPhys, size, err)
-	}
+	vm.regions.mu.Lock()
+	defer vm.regions.mu.Unlock()
 
-	recordUnmapOperation()
-	return nil
+	if _, ok := vm.regions.overlapLocked(guestPhys, size); !ok {
+		return nil, ErrMemoryNotMapped
+	}
+	err := vm.eachBackedLocked(guestPhys, size, func(_ Region, gpa, size uint64) error {
+		return vm.backend.Unmap(gpa, size)
+	})
+	if err != nil {
+		vm.metrics.recordResourceError()
+		return nil, err
+	}
+	vm.metrics.recordUnmap(vm.regions.removeLocked(guestPhys, size))
+	vm.untrackLocked(guestPhys, size)
+	return vm.releaseLocked(), nil
 }
@@ -1,34 +1,127 @@
-//go:build darwin && arm64
-
 package hypervisor
 
 import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
-// Performance metrics for monitoring hypervisor operations
-var (
-	// Operation counters
-	vmCreateCount    uint64
-	vmDestroyCount   uint64
-	vcpuCreateCount  uint64
-	vcpuDestroyCount uint64
-	mapOperations    uint64
-	unmapOperations  uint64
-	registerOps      uint64
-	runOperations    uint64
-
-	// Timing metrics (nanoseconds)
-	totalVMCreateTime uint64
-	totalRunTime      uint64
-
-	// Error counters
-	securityErrors uint64
-	resourceErrors uint64
-)
+// Performance metrics for monitoring hypervisor operations.
+//
+// Every VM and VCPU owns a metricSet whose parent is the set of the scope
+// enclosing it (vCPU -> VM -> process), and each event is recorded into
+// the whole chain, so a VM's metrics include its vCPUs' and the global
+// metrics include everything.
+var globalMetrics metricSet
+
+// latencyBounds are the upper bounds of the latency histogram buckets.
+var latencyBounds = [...]time.Duration{
+	time.Microsecond, 5 * time.Microsecond,
+	10 * time.Microsecond, 50 * time.Microsecond,
+	100 * time.Microsecond, 500 * time.Microsecond,
+	time.Millisecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 5 * time.Second, 10 * time.Second,
+}
+
+// numExceptionClasses covers every 6-bit ESR_EL2.EC value.
+const numExceptionClasses = 64
+
+type latencyHistogram struct {
+	count   atomic.Uint64
+	sum     atomic.Uint64                         // nanoseconds
+	buckets [len(latencyBounds) + 1]atomic.Uint64 // last bucket is +Inf
+}
 
-// Metrics provides access to performance metrics
+func (h *latencyHistogram) observe(d time.Duration) {
+	i := sort.Search(len(latencyBounds), func(i int) bool { return d <= latencyBounds[i] })
+	h.buckets[i].Add(1)
+	h.count.Add(1)
+	h.sum.Add(uint64(d.Nanoseconds()))
+}
+
+func (h *latencyHistogram) snapshot() Histogram {
+	s := Histogram{Buckets: make([]HistogramBucket, len(latencyBounds))}
+	var cum uint64
+	for i, le := range latencyBounds {
+		cum += h.buckets[i].Load()
+		s.Buckets[i] = HistogramBucket{LeNs: uint64(le.Nanoseconds()), Count: cum}
+	}
+	// count is updated separately from the buckets; never report fewer
+	// observations than they hold.
+	s.Count = max(h.count.Load(), cum+h.buckets[len(latencyBounds)].Load())
+	s.SumNs = h.sum.Load()
+	return s
+}
+
+func (h *latencyHistogram) reset() {
+	h.count.Store(0)
+	h.sum.Store(0)
+	for i := range h.buckets {
+		h.buckets[i].Store(0)
+	}
+}
+
+// metricSet holds the counters of one scope.
+type metricSet struct {
+	parent *metricSet
+	labels string // Prometheus labels identifying the scope, e.g. `vm="1"`
+
+	vmCreate, vmDestroy     atomic.Uint64
+	vcpuCreate, vcpuDestroy atomic.Uint64
+	mapOps, unmapOps        atomic.Uint64
+	registerOps, runOps     atomic.Uint64
+	securityErrors          atomic.Uint64
+	resourceErrors          atomic.Uint64
+	mappedBytes             atomic.Int64
+	committedBytes          atomic.Int64
+
+	runLatency, mapLatency, vmCreateLatency latencyHistogram
+
+	exitReasons [len(exitReasonNames)]atomic.Uint64
+	exitClasses [numExceptionClasses]atomic.Uint64
+}
+
+// VM and vCPU scopes are numbered for their Prometheus labels.
+var vmSeq atomic.Uint64
+
+// liveMetrics tracks the sets of open VMs and vCPUs for WritePrometheus.
+var liveMetrics = struct {
+	sync.Mutex
+	sets map[*metricSet]struct{}
+}{sets: make(map[*metricSet]struct{})}
+
+func newVMMetrics() *metricSet {
+	return &metricSet{parent: &globalMetrics, labels: fmt.Sprintf(`vm="%d"`, vmSeq.Add(1))}
+}
+
+func newVCPUMetrics(vm *metricSet, id uint64) *metricSet {
+	return &metricSet{parent: vm, labels: fmt.Sprintf(`%s,vcpu="%d"`, vm.labels, id)}
+}
+
+// register makes the set visible to WritePrometheus until unregister.
+func (m *metricSet) register() {
+	liveMetrics.Lock()
+	defer liveMetrics.Unlock()
+	liveMetrics.sets[m] = struct{}{}
+}
+
+func (m *metricSet) unregister() {
+	liveMetrics.Lock()
+	defer liveMetrics.Unlock()
+	delete(liveMetrics.sets, m)
+}
+
+// Metrics is a snapshot of the performance metrics of one scope: the whole
+// process (GetMetrics), a VM including its vCPUs (VM.Metrics) or a single
+// vCPU (VCPU.Metrics).
 type Metrics struct {
 	VMCreated         uint64 `json:"vm_created"`
 	VMDestroyed       uint64 `json:"vm_destroyed"`
@@ -42,92 +135,368 @@ type Metrics struct {
 	AvgRunTimeNs      uint64 `json:"avg_run_time_ns"`
 	SecurityErrors    uint64 `json:"security_errors"`
 	ResourceErrors    uint64 `json:"resource_errors"`
+
+	// MappedBytes is the guest memory currently mapped, including the
+	// reserved but untouched pages of sparse regions.
+	MappedBytes int64 `json:"mapped_bytes"`
+	// CommittedBytes is the part of MappedBytes backed by memory.
+	CommittedBytes int64 `json:"committed_bytes"`
+
+	RunLatency      Histogram `json:"run_latency"`
+	MapLatency      Histogram `json:"map_latency"`
+	VMCreateLatency Histogram `json:"vm_create_latency"`
+
+	// ExitsByReason counts every exit taken by the guest, including ones
+	// serviced internally such as MMIO, keyed by ExitReason.String.
+	ExitsByReason map[string]uint64 `json:"exits_by_reason,omitempty"`
+	// ExitsByClass breaks down exception exits by ExceptionClass.String.
+	ExitsByClass map[string]uint64 `json:"exits_by_class,omitempty"`
+}
+
+// Histogram is a snapshot of a latency distribution.
+type Histogram struct {
+	Count uint64 `json:"count"`
+	SumNs uint64 `json:"sum_ns"`
+	// Buckets are cumulative, in increasing order of LeNs. Observations
+	// above the last bound are only included in Count.
+	Buckets []HistogramBucket `json:"buckets"`
+}
+
+// HistogramBucket counts the observations no greater than LeNs nanoseconds.
+type HistogramBucket struct {
+	LeNs  uint64 `json:"le_ns"`
+	Count uint64 `json:"count"`
+}
+
+// Mean returns the average observation, or 0 if there are none.
+func (h Histogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return time.Duration(h.SumNs / h.Count)
 }
 
-// GetMetrics returns current performance metrics
+// GetMetrics returns the performance metrics aggregated over every VM the
+// process has created.
 func GetMetrics() Metrics {
-	vmCreated := atomic.LoadUint64(&vmCreateCount)
-	runOps := atomic.LoadUint64(&runOperations)
+	return globalMetrics.snapshot()
+}
+
+// ResetMetrics clears the process-wide metrics. Per-VM and per-vCPU
+// metrics are not affected.
+func ResetMetrics() {
+	globalMetrics.reset()
+}
 
-	var avgVMCreate, avgRun uint64
-	if vmCreated > 0 {
-		avgVMCreate = atomic.LoadUint64(&totalVMCreateTime) / vmCreated
+// Metrics returns the performance metrics of this VM and its vCPUs.
+func (vm *VM) Metrics() Metrics {
+	if vm == nil {
+		return Metrics{}
 	}
-	if runOps > 0 {
-		avgRun = atomic.LoadUint64(&totalRunTime) / runOps
+	return vm.metrics.snapshot()
+}
+
+// Metrics returns the performance metrics of this vCPU.
+func (c *VCPU) Metrics() Metrics {
+	if c == nil {
+		return Metrics{}
 	}
+	return c.metrics.snapshot()
+}
 
-	return Metrics{
-		VMCreated:         vmCreated,
-		VMDestroyed:       atomic.LoadUint64(&vmDestroyCount),
-		VCPUCreated:       atomic.LoadUint64(&vcpuCreateCount),
-		VCPUDestroyed:     atomic.LoadUint64(&vcpuDestroyCount),
-		MapOperations:     atomic.LoadUint64(&mapOperations),
-		UnmapOperations:   atomic.LoadUint64(&unmapOperations),
-		RegisterOps:       atomic.LoadUint64(&registerOps),
-		RunOperations:     runOps,
-		AvgVMCreateTimeNs: avgVMCreate,
-		AvgRunTimeNs:      avgRun,
-		SecurityErrors:    atomic.LoadUint64(&securityErrors),
-		ResourceErrors:    atomic.LoadUint64(&resourceErrors),
+func (m *metricSet) snapshot() Metrics {
+	s := Metrics{
+		VMCreated:       m.vmCreate.Load(),
+		VMDestroyed:     m.vmDestroy.Load(),
+		VCPUCreated:     m.vcpuCreate.Load(),
+		VCPUDestroyed:   m.vcpuDestroy.Load(),
+		MapOperations:   m.mapOps.Load(),
+		UnmapOperations: m.unmapOps.Load(),
+		RegisterOps:     m.registerOps.Load(),
+		RunOperations:   m.runOps.Load(),
+		SecurityErrors:  m.securityErrors.Load(),
+		ResourceErrors:  m.resourceErrors.Load(),
+		MappedBytes:     m.mappedBytes.Load(),
+		CommittedBytes:  m.committedBytes.Load(),
+		RunLatency:      m.runLatency.snapshot(),
+		MapLatency:      m.mapLatency.snapshot(),
+		VMCreateLatency: m.vmCreateLatency.snapshot(),
 	}
+	s.AvgVMCreateTimeNs = uint64(s.VMCreateLatency.Mean())
+	s.AvgRunTimeNs = uint64(s.RunLatency.Mean())
+
+	for r := range m.exitReasons {
+		if n := m.exitReasons[r].Load(); n != 0 {
+			if s.ExitsByReason == nil {
+				s.ExitsByReason = make(map[string]uint64)
+			}
+			s.ExitsByReason[ExitReason(r).String()] = n
+		}
+	}
+	for ec := range m.exitClasses {
+		if n := m.exitClasses[ec].Load(); n != 0 {
+			if s.ExitsByClass == nil {
+				s.ExitsByClass = make(map[string]uint64)
+			}
+			s.ExitsByClass[ExceptionClass(ec).String()] = n
+		}
+	}
+	return s
 }
 
-// ResetMetrics clears all performance metrics
-func ResetMetrics() {
-	atomic.StoreUint64(&vmCreateCount, 0)
-	atomic.StoreUint64(&vmDestroyCount, 0)
-	atomic.StoreUint64(&vcpuCreateCount, 0)
-	atomic.StoreUint64(&vcpuDestroyCount, 0)
-	atomic.StoreUint64(&mapOperations, 0)
-	atomic.StoreUint64(&unmapOperations, 0)
-	atomic.StoreUint64(&registerOps, 0)
-	atomic.StoreUint64(&runOperations, 0)
-	atomic.StoreUint64(&totalVMCreateTime, 0)
-	atomic.StoreUint64(&totalRunTime, 0)
-	atomic.StoreUint64(&securityErrors, 0)
-	atomic.StoreUint64(&resourceErrors, 0)
+func (m *metricSet) reset() {
+	for _, c := range []*atomic.Uint64{
+		&m.vmCreate, &m.vmDestroy, &m.vcpuCreate, &m.vcpuDestroy,
+		&m.mapOps, &m.unmapOps, &m.registerOps, &m.runOps,
+		&m.securityErrors, &m.resourceErrors,
+	} {
+		c.Store(0)
+	}
+	m.mappedBytes.Store(0)
+	m.committedBytes.Store(0)
+	m.runLatency.reset()
+	m.mapLatency.reset()
+	m.vmCreateLatency.reset()
+	for i := range m.exitReasons {
+		m.exitReasons[i].Store(0)
+	}
+	for i := range m.exitClasses {
+		m.exitClasses[i].Store(0)
+	}
 }
 
-// Internal metric recording functions
-func recordVMCreate(duration time.Duration) {
-	atomic.AddUint64(&vmCreateCount, 1)
-	atomic.AddUint64(&totalVMCreateTime, uint64(duration.Nanoseconds()))
+// Internal metric recording functions. Each records into m and every
+// enclosing scope.
+
+func (m *metricSet) recordVMCreate(duration time.Duration) {
+	for ; m != nil; m = m.parent {
+		m.vmCreate.Add(1)
+		m.vmCreateLatency.observe(duration)
+	}
 }
 
-func recordVMDestroy() {
-	atomic.AddUint64(&vmDestroyCount, 1)
+func (m *metricSet) recordVMDestroy() {
+	for ; m != nil; m = m.parent {
+		m.vmDestroy.Add(1)
+	}
+}
+
+func (m *metricSet) recordVCPUCreate() {
+	for ; m != nil; m = m.parent {
+		m.vcpuCreate.Add(1)
+	}
 }
 
-func recordVCPUCreate() {
-	atomic.AddUint64(&vcpuCreateCount, 1)
+func (m *metricSet) recordVCPUDestroy() {
+	for ; m != nil; m = m.parent {
+		m.vcpuDestroy.Add(1)
+	}
 }
 
-func recordVCPUDestroy() {
-	atomic.AddUint64(&vcpuDestroyCount, 1)
+func (m *metricSet) recordMap(duration time.Duration, size, committed uint64) {
+	for ; m != nil; m = m.parent {
+		m.mapOps.Add(1)
+		m.mapLatency.observe(duration)
+		m.mappedBytes.Add(int64(size))
+		m.committedBytes.Add(int64(committed))
+	}
 }
 
-func recordMapOperation() {
-	atomic.AddUint64(&mapOperations, 1)
+func (m *metricSet) recordUnmap(size, committed uint64) {
+	for ; m != nil; m = m.parent {
+		m.unmapOps.Add(1)
+		m.mappedBytes.Add(-int64(size))
+		m.committedBytes.Add(-int64(committed))
+	}
 }
 
-func recordUnmapOperation() {
-	atomic.AddUint64(&unmapOperations, 1)
+// recordUnmapped accounts for memory released without an Unmap call, such
+// as by VM.Close.
+func (m *metricSet) recordUnmapped(size, committed uint64) {
+	for ; m != nil; m = m.parent {
+		m.mappedBytes.Add(-int64(size))
+		m.committedBytes.Add(-int64(committed))
+	}
 }
 
-func recordRegisterOp() {
-	atomic.AddUint64(&registerOps, 1)
+// recordCommit accounts for sparse pages backed on first touch, or
+// released again by Reset.
+func (m *metricSet) recordCommit(delta int64) {
+	for ; m != nil; m = m.parent {
+		m.committedBytes.Add(delta)
+	}
 }
 
-func recordRun(duration time.Duration) {
-	atomic.AddUint64(&runOperations, 1)
-	atomic.AddUint64(&totalRunTime, uint64(duration.Nanoseconds()))
+func (m *metricSet) recordRegisterOp() {
+	for ; m != nil; m = m.parent {
+		m.registerOps.Add(1)
+	}
 }
 
-func recordSecurityError() {
-	atomic.AddUint64(&securityErrors, 1)
+func (m *metricSet) recordRun(duration time.Duration) {
+	for ; m != nil; m = m.parent {
+		m.runOps.Add(1)
+		m.runLatency.observe(duration)
+	}
 }
 
-func recordResourceError() {
-	atomic.AddUint64(&resourceErrors, 1)
+func (m *metricSet) recordExit(info ExitInfo) {
+	for ; m != nil; m = m.parent {
+		if info.Reason >= 0 && int(info.Reason) < len(m.exitReasons) {
+			m.exitReasons[info.Reason].Add(1)
+		}
+		if info.Reason == ExitException {
+			m.exitClasses[info.Class()%numExceptionClasses].Add(1)
+		}
+	}
+}
+
+func (m *metricSet) recordSecurityError() {
+	for ; m != nil; m = m.parent {
+		m.securityErrors.Add(1)
+	}
+}
+
+func (m *metricSet) recordResourceError() {
+	for ; m != nil; m = m.parent {
+		m.resourceErrors.Add(1)
+	}
+}
+
+// PublishExpvar publishes the process-wide metrics as the expvar variable
+// name, served as JSON by the expvar handler at /debug/vars. Like
+// expvar.Publish it panics if name is already in use.
+func PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() any { return GetMetrics() }))
+}
+
+// WritePrometheus writes the process-wide metrics, followed by those of
+// every open VM and vCPU labeled with vm and vcpu, to w in the Prometheus
+// text exposition format.
+func WritePrometheus(w io.Writer) error {
+	scopes := []scopedMetrics{{Metrics: GetMetrics()}}
+
+	liveMetrics.Lock()
+	var live []*metricSet
+	for m := range liveMetrics.sets {
+		live = append(live, m)
+	}
+	liveMetrics.Unlock()
+	sort.Slice(live, func(i, j int) bool { return live[i].labels < live[j].labels })
+	for _, m := range live {
+		scopes = append(scopes, scopedMetrics{Metrics: m.snapshot(), labels: m.labels})
+	}
+	return writePrometheus(w, scopes)
+}
+
+// WritePrometheus writes m to w in the Prometheus text exposition format,
+// without any scope labels.
+func (m Metrics) WritePrometheus(w io.Writer) error {
+	return writePrometheus(w, []scopedMetrics{{Metrics: m}})
+}
+
+type scopedMetrics struct {
+	Metrics
+	labels string
+}
+
+// promCounters lists the plain counters and gauges in exposition order.
+var promCounters = []struct {
+	name, typ, help string
+	value           func(*Metrics) float64
+}{
+	{"hv_vm_created_total", "counter", "VMs created.", func(m *Metrics) float64 { return float64(m.VMCreated) }},
+	{"hv_vm_destroyed_total", "counter", "VMs destroyed.", func(m *Metrics) float64 { return float64(m.VMDestroyed) }},
+	{"hv_vcpu_created_total", "counter", "vCPUs created.", func(m *Metrics) float64 { return float64(m.VCPUCreated) }},
+	{"hv_vcpu_destroyed_total", "counter", "vCPUs destroyed.", func(m *Metrics) float64 { return float64(m.VCPUDestroyed) }},
+	{"hv_map_operations_total", "counter", "Guest memory map operations.", func(m *Metrics) float64 { return float64(m.MapOperations) }},
+	{"hv_unmap_operations_total", "counter", "Guest memory unmap operations.", func(m *Metrics) float64 { return float64(m.UnmapOperations) }},
+	{"hv_register_operations_total", "counter", "vCPU register accesses.", func(m *Metrics) float64 { return float64(m.RegisterOps) }},
+	{"hv_run_operations_total", "counter", "vCPU runs.", func(m *Metrics) float64 { return float64(m.RunOperations) }},
+	{"hv_security_errors_total", "counter", "Requests rejected by bounds and overflow checks.", func(m *Metrics) float64 { return float64(m.SecurityErrors) }},
+	{"hv_resource_errors_total", "counter", "Backend failures.", func(m *Metrics) float64 { return float64(m.ResourceErrors) }},
+	{"hv_mapped_bytes", "gauge", "Guest memory currently mapped.", func(m *Metrics) float64 { return float64(m.MappedBytes) }},
+	{"hv_committed_bytes", "gauge", "Mapped guest memory backed by host memory.", func(m *Metrics) float64 { return float64(m.CommittedBytes) }},
+}
+
+var promHistograms = []struct {
+	name, help string
+	value      func(*Metrics) Histogram
+}{
+	{"hv_run_duration_seconds", "Latency of vCPU runs.", func(m *Metrics) Histogram { return m.RunLatency }},
+	{"hv_map_duration_seconds", "Latency of guest memory map operations.", func(m *Metrics) Histogram { return m.MapLatency }},
+	{"hv_vm_create_duration_seconds", "Latency of VM creation.", func(m *Metrics) Histogram { return m.VMCreateLatency }},
+}
+
+func writePrometheus(w io.Writer, scopes []scopedMetrics) error {
+	bw := bufio.NewWriter(w)
+
+	for _, c := range promCounters {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", c.name, c.help, c.name, c.typ)
+		for i := range scopes {
+			writeSample(bw, c.name, joinLabels(scopes[i].labels), c.value(&scopes[i].Metrics))
+		}
+	}
+
+	fmt.Fprintf(bw, "# HELP hv_exits_total Guest exits by reason and exception class.\n# TYPE hv_exits_total counter\n")
+	for i := range scopes {
+		s := &scopes[i]
+		for _, reason := range sortedKeys(s.ExitsByReason) {
+			if reason == ExitException.String() {
+				continue // broken down by class below
+			}
+			labels := joinLabels(s.labels, `reason="`+reason+`"`)
+			writeSample(bw, "hv_exits_total", labels, float64(s.ExitsByReason[reason]))
+		}
+		for _, class := range sortedKeys(s.ExitsByClass) {
+			labels := joinLabels(s.labels, `reason="exception"`, `class="`+class+`"`)
+			writeSample(bw, "hv_exits_total", labels, float64(s.ExitsByClass[class]))
+		}
+	}
+
+	for _, h := range promHistograms {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+		for i := range scopes {
+			hist := h.value(&scopes[i].Metrics)
+			for _, b := range hist.Buckets {
+				le := strconv.FormatFloat(time.Duration(b.LeNs).Seconds(), 'g', -1, 64)
+				writeSample(bw, h.name+"_bucket", joinLabels(scopes[i].labels, `le="`+le+`"`), float64(b.Count))
+			}
+			writeSample(bw, h.name+"_bucket", joinLabels(scopes[i].labels, `le="+Inf"`), float64(hist.Count))
+			writeSample(bw, h.name+"_sum", joinLabels(scopes[i].labels), time.Duration(hist.SumNs).Seconds())
+			writeSample(bw, h.name+"_count", joinLabels(scopes[i].labels), float64(hist.Count))
+		}
+	}
+	return bw.Flush()
+}
+
+func writeSample(w io.Writer, name, labels string, v float64) {
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s%s %s\n", name, labels, strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+// joinLabels joins the non-empty label lists.
+func joinLabels(lists ...string) string {
+	var out string
+	for _, l := range lists {
+		if l == "" {
+			continue
+		}
+		if out != "" {
+			out += ","
+		}
+		out += l
+	}
+	return out
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
 }
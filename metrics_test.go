@@ -1,67 +1,174 @@
-//go:build darwin && arm64 && hypervisor
-
 package hypervisor
 
 import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 )
 
-func TestMetrics(t *testing.T) {
-	// Skip hypervisor tests in CI environments (no nested virtualization support)
-	if isCI() {
-		t.Skip("Skipping hypervisor tests in CI environment")
+func TestLatencyHistogram(t *testing.T) {
+	tests := []struct {
+		name    string
+		observe []time.Duration
+		le      time.Duration // bucket to check
+		want    uint64        // cumulative count at le
+		count   uint64
+	}{
+		{"empty", nil, time.Millisecond, 0, 0},
+		{"exact bound", []time.Duration{time.Millisecond}, time.Millisecond, 1, 1},
+		{"below and above", []time.Duration{time.Microsecond, 2 * time.Millisecond}, time.Millisecond, 1, 2},
+		{"overflow", []time.Duration{time.Minute}, 10 * time.Second, 0, 1},
 	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h latencyHistogram
+			for _, d := range tt.observe {
+				h.observe(d)
+			}
+			s := h.snapshot()
+			if s.Count != tt.count {
+				t.Errorf("Count = %d, want %d", s.Count, tt.count)
+			}
+			var got uint64
+			found := false
+			for _, b := range s.Buckets {
+				if time.Duration(b.LeNs) == tt.le {
+					got, found = b.Count, true
+				}
+			}
+			if !found || got != tt.want {
+				t.Errorf("bucket le=%v = %d (found %v), want %d", tt.le, got, found, tt.want)
+			}
+		})
+	}
+}
 
-	// Reset metrics for clean test
+func TestMetrics(t *testing.T) {
 	ResetMetrics()
 
-	// Verify initial state
-	metrics := GetMetrics()
-	if metrics.VMCreated != 0 {
-		t.Errorf("Expected VMCreated=0, got %d", metrics.VMCreated)
+	vm, vcpu, _ := newInterpVM(t, 0xD4200000) // brk #0
+	page := int64(pageSize())
+
+	m := GetMetrics()
+	if m.VMCreated != 1 || m.VCPUCreated != 1 {
+		t.Errorf("VMCreated, VCPUCreated = %d, %d, want 1, 1", m.VMCreated, m.VCPUCreated)
+	}
+	if m.VMCreateLatency.Count != 1 || m.AvgVMCreateTimeNs == 0 {
+		t.Errorf("VM create latency = %+v, want one observation", m.VMCreateLatency)
+	}
+	if m.MapOperations != 2 || m.MapLatency.Count != 2 || m.MappedBytes != 2*page || m.CommittedBytes != 2*page {
+		t.Errorf("map metrics = %d ops, %d timed, %d bytes, %d committed, want 2, 2, %d, %d",
+			m.MapOperations, m.MapLatency.Count, m.MappedBytes, m.CommittedBytes, 2*page, 2*page)
 	}
 
-	// Create and test VM (if entitled)
-	vm, err := NewVM()
-	if err != nil {
-		if err.Error() == "hv: access denied (HV_DENIED) - missing entitlement 'com.apple.security.hypervisor' or insufficient privileges" {
-			t.Skip("Skipping metrics test: missing hypervisor entitlements")
-		}
-		t.Fatalf("Failed to create VM: %v", err)
+	if _, err := vcpu.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if _, err := vcpu.GetReg(regCount); err == nil {
+		t.Fatal("Expected error for invalid register")
 	}
-	defer vm.Close()
 
-	// Check VM creation was recorded
-	metrics = GetMetrics()
-	if metrics.VMCreated != 1 {
-		t.Errorf("Expected VMCreated=1, got %d", metrics.VMCreated)
+	// Every event is visible in the vCPU, its VM and the process.
+	scopes := map[string]Metrics{"vcpu": vcpu.Metrics(), "vm": vm.Metrics(), "global": GetMetrics()}
+	for name, m := range scopes {
+		if m.RunOperations != 1 || m.RunLatency.Count != 1 {
+			t.Errorf("%s: runs = %d, timed %d, want 1", name, m.RunOperations, m.RunLatency.Count)
+		}
+		if m.ExitsByReason["exception"] != 1 || m.ExitsByClass["brk"] != 1 {
+			t.Errorf("%s: exits = %v / %v, want one brk", name, m.ExitsByReason, m.ExitsByClass)
+		}
+		if m.SecurityErrors != 1 {
+			t.Errorf("%s: SecurityErrors = %d, want 1", name, m.SecurityErrors)
+		}
 	}
-	if metrics.AvgVMCreateTimeNs == 0 {
-		t.Errorf("Expected non-zero VM create time")
+	if m := vcpu.Metrics(); m.MapOperations != 0 || m.VCPUCreated != 1 {
+		t.Errorf("vcpu: MapOperations, VCPUCreated = %d, %d, want 0, 1", m.MapOperations, m.VCPUCreated)
 	}
 
-	// Test VCPU metrics
-	vcpu, err := vm.NewVCPU()
-	if err != nil {
-		t.Fatalf("Failed to create VCPU: %v", err)
+	if err := vm.Unmap(interpDataGPA, uint64(page)); err != nil {
+		t.Fatalf("Unmap failed: %v", err)
+	}
+	if m := vm.Metrics(); m.UnmapOperations != 1 || m.MappedBytes != page {
+		t.Errorf("after Unmap: %d ops, %d bytes, want 1, %d", m.UnmapOperations, m.MappedBytes, page)
 	}
-	defer vcpu.Close()
+	vcpu.Close()
+	vm.Close()
+	if m := GetMetrics(); m.MappedBytes != 0 || m.VMDestroyed != 1 || m.VCPUDestroyed != 1 {
+		t.Errorf("after Close: %d bytes, %d VMs and %d vCPUs destroyed, want 0, 1, 1",
+			m.MappedBytes, m.VMDestroyed, m.VCPUDestroyed)
+	}
+}
 
-	metrics = GetMetrics()
-	if metrics.VCPUCreated != 1 {
-		t.Errorf("Expected VCPUCreated=1, got %d", metrics.VCPUCreated)
+func TestMetricsFinalize(t *testing.T) {
+	page := uint64(pageSize())
+	// A VM that is never closed, of which only its metrics are kept.
+	m := func() *metricSet {
+		vm, err := NewVMWithBackend("fake")
+		if err != nil {
+			t.Fatalf("NewVMWithBackend(fake) failed: %v", err)
+		}
+		if _, err := vm.AllocRegion(0x200000, 4*page, MemRead|MemWrite, AllocOptions{}); err != nil {
+			t.Fatalf("AllocRegion failed: %v", err)
+		}
+		return vm.metrics
+	}()
+
+	for i := 0; i < 100 && m.vmDestroy.Load() == 0; i++ {
+		runtime.GC()
+		time.Sleep(time.Millisecond)
+	}
+	got := m.snapshot()
+	if got.VMDestroyed != 1 || got.MappedBytes != 0 || got.CommittedBytes != 0 {
+		t.Errorf("after finalize: %d VMs destroyed, %d bytes mapped, %d committed; want 1, 0, 0",
+			got.VMDestroyed, got.MappedBytes, got.CommittedBytes)
+	}
+	liveMetrics.Lock()
+	_, live := liveMetrics.sets[m]
+	liveMetrics.Unlock()
+	if live {
+		t.Error("finalized VM's metrics are still live")
 	}
+}
 
-	// Test register operation metrics
-	_, err = vcpu.GetReg(RegX0)
-	if err != nil {
-		t.Fatalf("Failed to get register: %v", err)
+func TestMetricsExport(t *testing.T) {
+	ResetMetrics()
+	_, vcpu, _ := newInterpVM(t, 0xD4200000) // brk #0
+	if _, err := vcpu.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
 	}
 
-	metrics = GetMetrics()
-	if metrics.RegisterOps != 1 {
-		t.Errorf("Expected RegisterOps=1, got %d", metrics.RegisterOps)
+	var buf bytes.Buffer
+	if err := WritePrometheus(&buf); err != nil {
+		t.Fatalf("WritePrometheus failed: %v", err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"# TYPE hv_run_operations_total counter\n",
+		"hv_run_operations_total 1\n",
+		"# TYPE hv_run_duration_seconds histogram\n",
+		`hv_run_duration_seconds_bucket{le="+Inf"} 1` + "\n",
+		`hv_exits_total{reason="exception",class="brk"} 1` + "\n",
+		`hv_exits_total{` + vcpu.metrics.labels + `,reason="exception",class="brk"} 1` + "\n",
+		`hv_map_duration_seconds_bucket{` + vcpu.vm.metrics.labels + `,le="0.001"} `,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Prometheus output missing %q", want)
+		}
+	}
+	if n := strings.Count(out, "# TYPE hv_exits_total "); n != 1 {
+		t.Errorf("hv_exits_total declared %d times, want 1", n)
 	}
 
-	t.Logf("Final metrics: %+v", metrics)
+	PublishExpvar("hypervisor_test")
+	var got Metrics
+	if err := json.Unmarshal([]byte(expvar.Get("hypervisor_test").String()), &got); err != nil {
+		t.Fatalf("expvar output is not Metrics JSON: %v", err)
+	}
+	if got.RunOperations != 1 || got.ExitsByClass["brk"] != 1 {
+		t.Errorf("expvar metrics = %+v, want one brk run", got)
+	}
 }
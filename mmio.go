@@ -0,0 +1,382 @@
+package hypervisor
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/blacktop/go-hypervisor/internal/a64"
+)
+
+// Device emulates a memory-mapped I/O range. addr is the guest physical
+// address of the access and size is 1, 2, 4 or 8 bytes. Devices are called
+// from the goroutine running the vCPU that faulted and must be safe for
+// concurrent use when the VM has more than one vCPU.
+type Device interface {
+	Read(addr uint64, size int) (uint64, error)
+	Write(addr uint64, size int, val uint64) error
+}
+
+// mmioRange is one registered device window.
+type mmioRange struct {
+	base, size uint64
+	dev        Device
+}
+
+// mmioBus maps guest physical ranges to devices.
+type mmioBus struct {
+	mu     sync.RWMutex
+	ranges []mmioRange // sorted by base, non-overlapping
+}
+
+func (b *mmioBus) lookup(addr uint64) (Device, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	i := sort.Search(len(b.ranges), func(i int) bool { return b.ranges[i].base+b.ranges[i].size > addr })
+	if i == len(b.ranges) || b.ranges[i].base > addr {
+		return nil, false
+	}
+	return b.ranges[i].dev, true
+}
+
+// RegisterMMIO routes guest accesses to [gpa, gpa+size) to dev. The range
+// must not be mapped with Map: devices are reached through the data aborts
+// the guest takes on unmapped addresses. Loads and stores that report a
+// valid syndrome are completed transparently inside Run.
+func (vm *VM) RegisterMMIO(gpa, size uint64, dev Device) error {
+	if err := vm.registerMMIO(gpa, size, dev); err != nil {
+		return &OpError{Op: "register MMIO", GPA: gpa, Size: size, Err: err}
+	}
+	return nil
+}
+
+func (vm *VM) registerMMIO(gpa, size uint64, dev Device) error {
+	if vm == nil {
+		return errVMNil
+	}
+
+	// Security: Lock to keep Close from tearing the VM down meanwhile
+	vm.closeMu.Lock()
+	defer vm.closeMu.Unlock()
+
+	if vm.closed {
+		return ErrVMClosed
+	}
+	if dev == nil {
+		return fmt.Errorf("hv: MMIO device is nil")
+	}
+	if size == 0 {
+		return fmt.Errorf("hv: zero size")
+	}
+	if gpa > math.MaxUint64-size {
+		return errRangeOverflow
+	}
+
+	b := &vm.mmio
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	i := sort.Search(len(b.ranges), func(i int) bool { return b.ranges[i].base >= gpa })
+	if (i > 0 && b.ranges[i-1].base+b.ranges[i-1].size > gpa) ||
+		(i < len(b.ranges) && b.ranges[i].base < gpa+size) {
+		return fmt.Errorf("hv: overlaps an existing MMIO device")
+	}
+	b.ranges = append(b.ranges, mmioRange{})
+	copy(b.ranges[i+1:], b.ranges[i:])
+	b.ranges[i] = mmioRange{base: gpa, size: size, dev: dev}
+	return nil
+}
+
+// UnregisterMMIO removes the device registered at gpa.
+func (vm *VM) UnregisterMMIO(gpa uint64) error {
+	if vm == nil {
+		return &OpError{Op: "unregister MMIO", Err: errVMNil}
+	}
+
+	b := &vm.mmio
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for i, r := range b.ranges {
+		if r.base == gpa {
+			b.ranges = append(b.ranges[:i], b.ranges[i+1:]...)
+			return nil
+		}
+	}
+	return &OpError{Op: "unregister MMIO", Err: fmt.Errorf("hv: no MMIO device registered at 0x%x", gpa)}
+}
+
+// handleMMIO completes a data abort that targets a registered device. It
+// reports false if the exit is not an MMIO access it can emulate. It is only
+// called from the goroutine running the vCPU.
+func (c *VCPU) handleMMIO(info ExitInfo) (bool, error) {
+	da, ok := info.DataAbort()
+	if !ok || !da.DFSC.IsTranslation() {
+		return false, nil
+	}
+	dev, ok := c.vm.mmio.lookup(info.IPA)
+	if !ok {
+		return false, nil
+	}
+	if !da.ISV {
+		return c.emulateMMIO(info, da)
+	}
+
+	size := da.Size()
+	if da.WnR {
+		val, err := c.dataReg(uint32(da.SRT))
+		if err != nil {
+			return false, err
+		}
+		if err := dev.Write(info.IPA, size, val&sizeMask(size)); err != nil {
+			return false, fmt.Errorf("hv: MMIO write of %d bytes at 0x%x failed: %w", size, info.IPA, err)
+		}
+	} else {
+		val, err := dev.Read(info.IPA, size)
+		if err != nil {
+			return false, fmt.Errorf("hv: MMIO read of %d bytes at 0x%x failed: %w", size, info.IPA, err)
+		}
+		val &= sizeMask(size)
+		if da.SSE && val&(1<<(8*size-1)) != 0 {
+			val |= ^sizeMask(size)
+		}
+		if !da.SF {
+			val &= 0xFFFFFFFF
+		}
+		if err := c.setDataReg(uint32(da.SRT), val); err != nil {
+			return false, err
+		}
+	}
+
+	return true, c.advancePC(uint64(info.InstructionLength()))
+}
+
+// mmioTarget is where one element of an emulated access goes: a device or
+// mapped guest RAM.
+type mmioTarget struct {
+	ipa uint64
+	dev Device
+	ram []byte
+}
+
+// emulateMMIO completes an access whose syndrome does not describe it
+// (ISV=0), such as LDP/STP or a pre/post-indexed load or store. The
+// instruction is fetched at PC through the region table, which assumes the
+// guest runs with stage 1 translation off or identity mapped code. It
+// reports false if the instruction cannot be fetched or is not a general
+// purpose register load or store.
+func (c *VCPU) emulateMMIO(info ExitInfo, da DataAbort) (bool, error) {
+	pc, err := c.impl.GetReg(RegPC)
+	if err != nil {
+		return false, fmt.Errorf("failed to get register %d: %w", RegPC, err)
+	}
+	code, ok := c.vm.regions.slice(pc, 4, MemRead)
+	if !ok {
+		return false, nil
+	}
+	ls, ok := a64.DecodeLoadStore(binary.LittleEndian.Uint32(code))
+	if !ok || ls.Load == da.WnR {
+		return false, nil
+	}
+
+	base := pc
+	if !ls.Literal {
+		if base, err = c.baseReg(ls.Rn); err != nil {
+			return false, err
+		}
+	}
+	var index uint64
+	if ls.RegOffset {
+		if index, err = c.dataReg(ls.Rm); err != nil {
+			return false, err
+		}
+	}
+	addr, wb := ls.Address(base, index)
+
+	// Resolve every element before touching any so that an access that is
+	// partly unmapped is returned to the caller with no side effects.
+	// Security: Only the page of the fault is known to be translated, so
+	// element addresses are rebased on the reported IPA.
+	targets := make([]mmioTarget, 1, 2)
+	if ls.Pair {
+		targets = targets[:2]
+	}
+	perm := MemRead
+	if !ls.Load {
+		perm = MemWrite
+	}
+	for i := range targets {
+		va := addr + uint64(i*ls.Size)
+		ipa := va
+		if !da.FnV {
+			ipa = info.IPA + (va - info.FAR)
+		}
+		t := mmioTarget{ipa: ipa}
+		if t.dev, ok = c.vm.mmio.lookup(ipa); !ok {
+			if t.ram, ok = c.vm.regions.slice(ipa, ls.Size, perm); !ok {
+				return false, nil
+			}
+		}
+		targets[i] = t
+	}
+
+	regs := [2]uint32{ls.Rt, ls.Rt2}
+	if ls.Load {
+		var vals [2]uint64
+		for i, t := range targets {
+			if vals[i], err = t.read(ls.Size); err != nil {
+				return false, err
+			}
+		}
+		for i := range targets {
+			if err := c.setDataReg(regs[i], ls.Extend(vals[i])); err != nil {
+				return false, err
+			}
+		}
+	} else {
+		for i, t := range targets {
+			val, err := c.dataReg(regs[i])
+			if err != nil {
+				return false, err
+			}
+			if err := t.write(ls.Size, val&sizeMask(ls.Size)); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	if ls.Writeback {
+		if err := c.setBaseReg(ls.Rn, wb); err != nil {
+			return false, err
+		}
+	}
+	return true, c.advancePC(4)
+}
+
+func (t mmioTarget) read(size int) (uint64, error) {
+	if t.dev == nil {
+		var buf [8]byte
+		copy(buf[:], t.ram)
+		return binary.LittleEndian.Uint64(buf[:]), nil
+	}
+	val, err := t.dev.Read(t.ipa, size)
+	if err != nil {
+		return 0, fmt.Errorf("hv: MMIO read of %d bytes at 0x%x failed: %w", size, t.ipa, err)
+	}
+	return val, nil
+}
+
+func (t mmioTarget) write(size int, val uint64) error {
+	if t.dev == nil {
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], val)
+		copy(t.ram, buf[:size])
+		return nil
+	}
+	if err := t.dev.Write(t.ipa, size, val); err != nil {
+		return fmt.Errorf("hv: MMIO write of %d bytes at 0x%x failed: %w", size, t.ipa, err)
+	}
+	return nil
+}
+
+// spEL1 reports whether the stack pointer is SP_EL1: the guest runs above
+// EL0 with PSTATE.SPSel set, as in EL1h. Otherwise it is SP_EL0, RegSP.
+func (c *VCPU) spEL1() (bool, error) {
+	cpsr, err := c.impl.GetReg(RegCPSR)
+	if err != nil {
+		return false, fmt.Errorf("failed to get register %d: %w", RegCPSR, err)
+	}
+	return (cpsr>>2)&3 != 0 && cpsr&1 != 0, nil
+}
+
+// baseReg reads base register n; 31 is the current stack pointer.
+func (c *VCPU) baseReg(n uint32) (uint64, error) {
+	r := Reg(n)
+	if n == 31 {
+		el1, err := c.spEL1()
+		if err != nil {
+			return 0, err
+		}
+		if el1 {
+			v, err := c.impl.GetSysReg(SysSP_EL1)
+			if err != nil {
+				return 0, fmt.Errorf("failed to get register %v: %w", SysSP_EL1, err)
+			}
+			return v, nil
+		}
+		r = RegSP
+	}
+	v, err := c.impl.GetReg(r)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get register %d: %w", r, err)
+	}
+	return v, nil
+}
+
+// setBaseReg writes base register n back; 31 is the current stack pointer.
+func (c *VCPU) setBaseReg(n uint32, v uint64) error {
+	r := Reg(n)
+	if n == 31 {
+		el1, err := c.spEL1()
+		if err != nil {
+			return err
+		}
+		if el1 {
+			if err := c.impl.SetSysReg(SysSP_EL1, v); err != nil {
+				return fmt.Errorf("failed to set register %v: %w", SysSP_EL1, err)
+			}
+			return nil
+		}
+		r = RegSP
+	}
+	if err := c.impl.SetReg(r, v); err != nil {
+		return fmt.Errorf("failed to set register %d: %w", r, err)
+	}
+	return nil
+}
+
+// dataReg reads data register n; 31 reads as zero (XZR).
+func (c *VCPU) dataReg(n uint32) (uint64, error) {
+	if n == 31 {
+		return 0, nil
+	}
+	v, err := c.impl.GetReg(Reg(n))
+	if err != nil {
+		return 0, fmt.Errorf("failed to get register %d: %w", n, err)
+	}
+	return v, nil
+}
+
+// setDataReg writes data register n; writes to 31 (XZR) are discarded.
+func (c *VCPU) setDataReg(n uint32, v uint64) error {
+	if n == 31 {
+		return nil
+	}
+	if err := c.impl.SetReg(Reg(n), v); err != nil {
+		return fmt.Errorf("failed to set register %d: %w", n, err)
+	}
+	return nil
+}
+
+// advancePC moves PC forward by n bytes.
+func (c *VCPU) advancePC(n uint64) error {
+	pc, err := c.impl.GetReg(RegPC)
+	if err != nil {
+		return fmt.Errorf("failed to get register %d: %w", RegPC, err)
+	}
+	if err := c.impl.SetReg(RegPC, pc+n); err != nil {
+		return fmt.Errorf("failed to set register %d: %w", RegPC, err)
+	}
+	return nil
+}
+
+// sizeMask returns a mask covering size bytes.
+func sizeMask(size int) uint64 {
+	if size >= 8 {
+		return math.MaxUint64
+	}
+	return 1<<(8*size) - 1
+}
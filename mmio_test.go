@@ -0,0 +1,291 @@
+package hypervisor
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+// mmioAccess records one device access.
+type mmioAccess struct {
+	addr  uint64
+	size  int
+	val   uint64
+	write bool
+}
+
+// testDevice is a register file backed device that logs every access.
+type testDevice struct {
+	mu   sync.Mutex
+	regs map[uint64]uint64
+	log  []mmioAccess
+	err  error
+}
+
+func (d *testDevice) Read(addr uint64, size int) (uint64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.log = append(d.log, mmioAccess{addr: addr, size: size})
+	return d.regs[addr], d.err
+}
+
+func (d *testDevice) Write(addr uint64, size int, val uint64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.log = append(d.log, mmioAccess{addr: addr, size: size, val: val, write: true})
+	return d.err
+}
+
+const testDeviceGPA = 0x900000
+
+func TestMMIO(t *testing.T) {
+	vm, vcpu, _ := newInterpVM(t,
+		0xD2A01201, // movz  x1, #0x90, lsl #16
+		0xD2800820, // movz  x0, #0x41
+		0x39000020, // strb  w0, [x1]
+		0xB9400422, // ldr   w2, [x1, #4]
+		0x79801023, // ldrsh x3, [x1, #8]
+		0xF900083F, // str   xzr, [x1, #16]
+		0xD4200000, // brk   #0
+	)
+	dev := &testDevice{regs: map[uint64]uint64{
+		testDeviceGPA + 4: 0xAAAA12345678, // truncated to 32 bits by the load
+		testDeviceGPA + 8: 0x8001,
+	}}
+	if err := vm.RegisterMMIO(testDeviceGPA, 0x1000, dev); err != nil {
+		t.Fatalf("RegisterMMIO failed: %v", err)
+	}
+
+	info, err := vcpu.Run()
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if info.Class() != ECBRK {
+		t.Fatalf("Run stopped with %v, want brk", info)
+	}
+
+	want := []mmioAccess{
+		{addr: testDeviceGPA, size: 1, val: 0x41, write: true},
+		{addr: testDeviceGPA + 4, size: 4},
+		{addr: testDeviceGPA + 8, size: 2},
+		{addr: testDeviceGPA + 16, size: 8, val: 0, write: true},
+	}
+	if len(dev.log) != len(want) {
+		t.Fatalf("device saw %d accesses, want %d: %+v", len(dev.log), len(want), dev.log)
+	}
+	for i := range want {
+		if dev.log[i] != want[i] {
+			t.Errorf("access %d = %+v, want %+v", i, dev.log[i], want[i])
+		}
+	}
+
+	regs := []struct {
+		reg  Reg
+		want uint64
+	}{
+		{RegX2, 0x12345678},
+		{RegX3, 0xFFFFFFFFFFFF8001},
+		{RegPC, interpCodeGPA + 24},
+	}
+	for _, r := range regs {
+		if got, _ := vcpu.GetReg(r.reg); got != r.want {
+			t.Errorf("reg %d = 0x%x, want 0x%x", r.reg, got, r.want)
+		}
+	}
+}
+
+func TestMMIOEmulated(t *testing.T) {
+	// None of these report a valid syndrome, so Run has to decode them.
+	vm, vcpu, _ := newInterpVM(t,
+		0xD2A01201, // movz  x1, #0x90, lsl #16
+		0xD2800820, // movz  x0, #0x41
+		0xD2800842, // movz  x2, #0x42
+		0xA9000820, // stp   x0, x2, [x1]
+		0x29C11023, // ldp   w3, w4, [x1, #8]!
+		0xB8004420, // str   w0, [x1], #4
+		0x69401825, // ldpsw x5, x6, [x1]
+		0xD4200000, // brk   #0
+	)
+	dev := &testDevice{regs: map[uint64]uint64{
+		testDeviceGPA + 8:  0x11111111,
+		testDeviceGPA + 12: 0xFFFFFFFE,
+		testDeviceGPA + 16: 7,
+	}}
+	if err := vm.RegisterMMIO(testDeviceGPA, 0x1000, dev); err != nil {
+		t.Fatalf("RegisterMMIO failed: %v", err)
+	}
+
+	info, err := vcpu.Run()
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if info.Class() != ECBRK {
+		t.Fatalf("Run stopped with %v, want brk", info)
+	}
+
+	want := []mmioAccess{
+		{addr: testDeviceGPA, size: 8, val: 0x41, write: true},
+		{addr: testDeviceGPA + 8, size: 8, val: 0x42, write: true},
+		{addr: testDeviceGPA + 8, size: 4},
+		{addr: testDeviceGPA + 12, size: 4},
+		{addr: testDeviceGPA + 8, size: 4, val: 0x41, write: true},
+		{addr: testDeviceGPA + 12, size: 4},
+		{addr: testDeviceGPA + 16, size: 4},
+	}
+	if len(dev.log) != len(want) {
+		t.Fatalf("device saw %d accesses, want %d: %+v", len(dev.log), len(want), dev.log)
+	}
+	for i := range want {
+		if dev.log[i] != want[i] {
+			t.Errorf("access %d = %+v, want %+v", i, dev.log[i], want[i])
+		}
+	}
+
+	regs := []struct {
+		reg  Reg
+		want uint64
+	}{
+		{RegX1, testDeviceGPA + 12}, // pre-index then post-index writeback
+		{RegX3, 0x11111111},
+		{RegX4, 0xFFFFFFFE},
+		{RegX5, 0xFFFFFFFFFFFFFFFE},
+		{RegX6, 7},
+		{RegPC, interpCodeGPA + 28},
+	}
+	for _, r := range regs {
+		if got, _ := vcpu.GetReg(r.reg); got != r.want {
+			t.Errorf("reg %d = 0x%x, want 0x%x", r.reg, got, r.want)
+		}
+	}
+}
+
+func TestMMIOStackPointer(t *testing.T) {
+	tests := []struct {
+		name      string
+		cpsr      uint64
+		sp, other SysReg // the stack pointer in use, and the one left alone
+	}{
+		{"el1h", 0x3c5, SysSP_EL1, SysSP_EL0},
+		{"el1t", 0x3c4, SysSP_EL0, SysSP_EL1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm, vcpu, _ := newInterpVM(t,
+				0xD2800820, // movz x0, #0x41
+				0xF81F0FE0, // str  x0, [sp, #-16]!
+				0xD4200000, // brk  #0
+			)
+			dev := &testDevice{}
+			if err := vm.RegisterMMIO(testDeviceGPA, 0x1000, dev); err != nil {
+				t.Fatalf("RegisterMMIO failed: %v", err)
+			}
+			if err := vcpu.SetReg(RegCPSR, tt.cpsr); err != nil {
+				t.Fatal(err)
+			}
+			if err := vcpu.SetSysReg(tt.sp, testDeviceGPA+0x20); err != nil {
+				t.Fatal(err)
+			}
+			if err := vcpu.SetSysReg(tt.other, 0x1234); err != nil {
+				t.Fatal(err)
+			}
+
+			info, err := vcpu.Run()
+			if err != nil {
+				t.Fatalf("Run failed: %v", err)
+			}
+			if info.Class() != ECBRK {
+				t.Fatalf("Run stopped with %v, want brk", info)
+			}
+			want := mmioAccess{addr: testDeviceGPA + 0x10, size: 8, val: 0x41, write: true}
+			if len(dev.log) != 1 || dev.log[0] != want {
+				t.Errorf("device saw %+v, want [%+v]", dev.log, want)
+			}
+			if got, _ := vcpu.GetSysReg(tt.sp); got != testDeviceGPA+0x10 {
+				t.Errorf("%v = 0x%x, want 0x%x", tt.sp, got, testDeviceGPA+0x10)
+			}
+			if got, _ := vcpu.GetSysReg(tt.other); got != 0x1234 {
+				t.Errorf("%v = 0x%x, want 0x1234", tt.other, got)
+			}
+		})
+	}
+}
+
+func TestMMIOErrors(t *testing.T) {
+	t.Run("undecodable access exits to caller", func(t *testing.T) {
+		vm, vcpu, _ := newInterpVM(t,
+			0xD2A01201, // movz x1, #0x90, lsl #16
+			0x3D800020, // str  q0, [x1]
+		)
+		dev := &testDevice{}
+		if err := vm.RegisterMMIO(testDeviceGPA, 0x1000, dev); err != nil {
+			t.Fatalf("RegisterMMIO failed: %v", err)
+		}
+		info, err := vcpu.Run()
+		if err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		if da, ok := info.DataAbort(); !ok || da.ISV || len(dev.log) != 0 {
+			t.Errorf("Run = %v with %d device accesses, want ISV=0 data abort", info, len(dev.log))
+		}
+	})
+
+	t.Run("device error stops Run", func(t *testing.T) {
+		vm, vcpu, _ := newInterpVM(t,
+			0xD2A01201, // movz x1, #0x90, lsl #16
+			0xB9400022, // ldr  w2, [x1]
+		)
+		boom := errors.New("boom")
+		if err := vm.RegisterMMIO(testDeviceGPA, 0x1000, &testDevice{err: boom}); err != nil {
+			t.Fatalf("RegisterMMIO failed: %v", err)
+		}
+		if _, err := vcpu.Run(); !errors.Is(err, boom) {
+			t.Errorf("Run error = %v, want it to wrap boom", err)
+		}
+	})
+
+	t.Run("unregistered device exits to caller", func(t *testing.T) {
+		vm, vcpu, _ := newInterpVM(t,
+			0xD2A01201, // movz x1, #0x90, lsl #16
+			0xB9400022, // ldr  w2, [x1]
+		)
+		if err := vm.RegisterMMIO(testDeviceGPA, 0x1000, &testDevice{}); err != nil {
+			t.Fatalf("RegisterMMIO failed: %v", err)
+		}
+		if err := vm.UnregisterMMIO(testDeviceGPA); err != nil {
+			t.Fatalf("UnregisterMMIO failed: %v", err)
+		}
+		info, err := vcpu.Run()
+		if err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		if _, ok := info.DataAbort(); !ok || info.IPA != testDeviceGPA {
+			t.Errorf("Run = %v, want data abort at 0x%x", info, testDeviceGPA)
+		}
+	})
+
+	t.Run("registration validation", func(t *testing.T) {
+		vm, _ := newFakeVM(t)
+		dev := &testDevice{}
+		if err := vm.RegisterMMIO(0x1000, 0x100, dev); err != nil {
+			t.Fatalf("RegisterMMIO failed: %v", err)
+		}
+		bad := []struct {
+			name      string
+			gpa, size uint64
+			dev       Device
+		}{
+			{"overlap", 0x10F0, 0x20, dev},
+			{"nil device", 0x2000, 0x100, nil},
+			{"zero size", 0x2000, 0, dev},
+			{"overflow", ^uint64(0), 2, dev},
+		}
+		for _, tt := range bad {
+			if err := vm.RegisterMMIO(tt.gpa, tt.size, tt.dev); err == nil {
+				t.Errorf("%s: expected error", tt.name)
+			}
+		}
+		if err := vm.UnregisterMMIO(0x5000); err == nil {
+			t.Error("Expected error unregistering unknown device")
+		}
+	})
+}
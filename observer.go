@@ -0,0 +1,138 @@
+package hypervisor
+
+import "sync"
+
+// Observer is notified of VM and vCPU events, for audit trails, tracing and
+// test assertions. Callbacks run synchronously on the goroutine that caused
+// the event, after it has succeeded and without any library locks held, so
+// they may inspect the VM or vCPU but should return quickly. Embed
+// NopObserver to implement only the callbacks of interest.
+type Observer interface {
+	// VMCreated is called when a VM has been created. Only observers
+	// registered with RegisterObserver see it.
+	VMCreated(vm *VM)
+	// VMClosed is called when a VM has been destroyed. Its regions are
+	// gone without individual Unmapped calls.
+	VMClosed(vm *VM)
+	// VCPUCreated is called when a vCPU has been created.
+	VCPUCreated(vcpu *VCPU)
+	// VCPUClosed is called when a vCPU has been destroyed.
+	VCPUClosed(vcpu *VCPU)
+	// Mapped is called when a region has been mapped into the guest.
+	Mapped(vm *VM, r Region)
+	// Unmapped is called when [gpa, gpa+size) has been unmapped.
+	Unmapped(vm *VM, gpa, size uint64)
+	// RegisterWritten is called for every register written through the
+	// VCPU API, including each register loaded by RestoreState. Writes the
+	// library makes while completing exits, such as MMIO loads, are not
+	// reported.
+	RegisterWritten(vcpu *VCPU, w RegWrite)
+	// RunStarted is called when Run or RunContext is about to enter the
+	// guest.
+	RunStarted(vcpu *VCPU)
+	// RunExited is called when Run or RunContext returns, with its results.
+	// The vCPU is no longer running, so its registers can be read.
+	RunExited(vcpu *VCPU, info ExitInfo, err error)
+}
+
+// NopObserver implements Observer with callbacks that do nothing.
+type NopObserver struct{}
+
+func (NopObserver) VMCreated(*VM)                    {}
+func (NopObserver) VMClosed(*VM)                     {}
+func (NopObserver) VCPUCreated(*VCPU)                {}
+func (NopObserver) VCPUClosed(*VCPU)                 {}
+func (NopObserver) Mapped(*VM, Region)               {}
+func (NopObserver) Unmapped(*VM, uint64, uint64)     {}
+func (NopObserver) RegisterWritten(*VCPU, RegWrite)  {}
+func (NopObserver) RunStarted(*VCPU)                 {}
+func (NopObserver) RunExited(*VCPU, ExitInfo, error) {}
+
+// RegKind tells which register file a RegWrite refers to.
+type RegKind int
+
+const (
+	RegKindGeneral RegKind = iota // Reg: general purpose and special registers
+	RegKindSystem                 // SysReg
+	RegKindSIMD                   // SIMDReg
+)
+
+// RegWrite describes a register write reported to RegisterWritten.
+type RegWrite struct {
+	Kind   RegKind
+	Reg    Reg      // RegKindGeneral
+	Sys    SysReg   // RegKindSystem
+	SIMD   SIMDReg  // RegKindSIMD
+	Value  uint64   // RegKindGeneral and RegKindSystem
+	Vector [16]byte // RegKindSIMD
+}
+
+// Name returns the name of the register written.
+func (w RegWrite) Name() string {
+	switch w.Kind {
+	case RegKindSystem:
+		return w.Sys.String()
+	case RegKindSIMD:
+		return w.SIMD.String()
+	}
+	return w.Reg.String()
+}
+
+// observerList is a copy-on-write list of observers, so notifying takes no
+// lock that a callback could be holding.
+type observerList struct {
+	mu   sync.Mutex
+	list []*Observer
+}
+
+// add appends o and returns a function that removes it again.
+func (l *observerList) add(o Observer) func() {
+	p := &o
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.list = append(l.list[:len(l.list):len(l.list)], p)
+	return func() { l.remove(p) }
+}
+
+func (l *observerList) remove(p *Observer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, q := range l.list {
+		if q == p {
+			l.list = append(l.list[:i:i], l.list[i+1:]...)
+			return
+		}
+	}
+}
+
+func (l *observerList) snapshot() []*Observer {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.list
+}
+
+// globalObservers are attached to every VM when it is created.
+var globalObservers observerList
+
+// RegisterObserver attaches o to every VM created from now on, including
+// its VMCreated event. It returns a function that stops attaching o to new
+// VMs; VMs that already have it keep it.
+func RegisterObserver(o Observer) (unregister func()) {
+	return globalObservers.add(o)
+}
+
+// AddObserver attaches o to this VM and its vCPUs. Observers are called in
+// the order they were added. It returns a function that detaches o.
+func (vm *VM) AddObserver(o Observer) (remove func()) {
+	if vm == nil {
+		return func() {}
+	}
+	return vm.observers.add(o)
+}
+
+// notify calls f for each of the VM's observers.
+func (vm *VM) notify(f func(Observer)) {
+	for _, o := range vm.observers.snapshot() {
+		f(*o)
+	}
+}
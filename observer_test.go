@@ -0,0 +1,155 @@
+package hypervisor
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// recorder logs every event as a string. It reads PC when a run exits to
+// check that callbacks may use the vCPU.
+type recorder struct {
+	events []string
+}
+
+func (r *recorder) add(format string, args ...any) {
+	r.events = append(r.events, fmt.Sprintf(format, args...))
+}
+
+func (r *recorder) VMCreated(*VM)          { r.add("vm create") }
+func (r *recorder) VMClosed(*VM)           { r.add("vm close") }
+func (r *recorder) VCPUCreated(*VCPU)      { r.add("vcpu create") }
+func (r *recorder) VCPUClosed(*VCPU)       { r.add("vcpu close") }
+func (r *recorder) Mapped(_ *VM, g Region) { r.add("map 0x%x+%d %v", g.GPA, g.Size, g.Perms) }
+func (r *recorder) Unmapped(_ *VM, gpa, size uint64) {
+	r.add("unmap 0x%x+%d", gpa, size)
+}
+func (r *recorder) RegisterWritten(_ *VCPU, w RegWrite) {
+	r.add("write %s", w.Name())
+}
+func (r *recorder) RunStarted(*VCPU) { r.add("run") }
+func (r *recorder) RunExited(c *VCPU, info ExitInfo, err error) {
+	pc, perr := c.GetPC()
+	r.add("exit %v pc=0x%x %v %v", info.Class(), pc, err, perr)
+}
+
+// execMapDetector records every executable mapping.
+type execMapDetector struct {
+	NopObserver
+	mapped []Region
+}
+
+func (d *execMapDetector) Mapped(_ *VM, r Region) {
+	if r.Perms&MemExec != 0 {
+		d.mapped = append(d.mapped, r)
+	}
+}
+
+func TestObserver(t *testing.T) {
+	rec := &recorder{}
+	unregister := RegisterObserver(rec)
+	vm, vcpu, _ := newInterpVM(t, 0xD4200000) // brk #0
+	unregister()
+
+	other, err := NewVMWithBackend("interp")
+	if err != nil {
+		t.Fatalf("NewVMWithBackend failed: %v", err)
+	}
+	other.Close()
+
+	page := uint64(pageSize())
+	rec.add("--")
+	if _, err := vcpu.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if err := vcpu.SetSysReg(SysTPIDR_EL0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := vcpu.SetSIMD(RegQ3, [16]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vcpu.SetReg(RegX0, 9); err != nil {
+		t.Fatal(err)
+	}
+	// Failed writes are not reported.
+	if err := vcpu.SetReg(regCount, 9); err == nil {
+		t.Fatal("Expected error for invalid register")
+	}
+	if err := vm.Unmap(interpDataGPA, page); err != nil {
+		t.Fatal(err)
+	}
+	vcpu.Close()
+	vm.Close()
+	vm.Close()
+
+	want := []string{
+		"vm create",
+		fmt.Sprintf("map 0x%x+%d %v", interpCodeGPA, page, MemRead|MemExec),
+		fmt.Sprintf("map 0x%x+%d %v", interpDataGPA, page, MemRead|MemWrite),
+		"vcpu create",
+		"write PC",
+		"--",
+		"run",
+		fmt.Sprintf("exit brk pc=0x%x <nil> <nil>", interpCodeGPA),
+		"write TPIDR_EL0",
+		"write Q3",
+		"write X0",
+		fmt.Sprintf("unmap 0x%x+%d", interpDataGPA, page),
+		"vcpu close",
+		"vm close",
+	}
+	if !reflect.DeepEqual(rec.events, want) {
+		t.Errorf("events:\n%q\nwant:\n%q", rec.events, want)
+	}
+}
+
+func TestAddObserver(t *testing.T) {
+	vm, vcpu, _ := newInterpVM(t, 0xD4200000) // brk #0
+
+	detector := &execMapDetector{}
+	rec := &recorder{}
+	removeDetector := vm.AddObserver(detector)
+	removeRec := vm.AddObserver(rec)
+
+	page := pageSize()
+	if err := vm.Map(alignedBuffer(t, page), 0x200000, MemRead|MemWrite); err != nil {
+		t.Fatal(err)
+	}
+	if len(detector.mapped) != 0 {
+		t.Errorf("detector flagged %v", detector.mapped)
+	}
+	if err := vm.Map(alignedBuffer(t, page), 0x300000, MemRead|MemExec); err != nil {
+		t.Fatal(err)
+	}
+	if len(detector.mapped) != 1 || detector.mapped[0].GPA != 0x300000 {
+		t.Errorf("detector mapped = %v, want the region at 0x300000", detector.mapped)
+	}
+
+	state, err := vcpu.SaveState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.events = nil
+	if err := vcpu.RestoreState(state); err != nil {
+		t.Fatal(err)
+	}
+	want := int(regCount) + int(RegQ31) + 1
+	for r := range state.Sys {
+		if !r.IsID() {
+			want++
+		}
+	}
+	if len(rec.events) != want {
+		t.Errorf("RestoreState reported %d writes, want %d", len(rec.events), want)
+	}
+
+	removeDetector()
+	removeRec()
+	rec.events = nil
+	if err := vm.Map(alignedBuffer(t, page), 0x400000, MemRead|MemExec); err != nil {
+		t.Fatal(err)
+	}
+	if len(detector.mapped) != 1 || len(rec.events) != 0 {
+		t.Errorf("removed observers saw %d and %d events", len(detector.mapped)-1, len(rec.events))
+	}
+}
@@ -0,0 +1,275 @@
+package pagetable
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Config describes the translation regime a Builder produces.
+type Config struct {
+	// Granule is the translation granule for both TTBR0 and TTBR1.
+	Granule Granule
+	// VABits is the width of each half of the virtual address space. TTBR0
+	// covers [0, 1<<VABits) and TTBR1 the top 1<<VABits bytes. Zero means
+	// 48.
+	VABits uint
+	// IPABits is the intermediate physical address width programmed into
+	// TCR_EL1.IPS: 32, 36, 40, 42, 44 or 48. Zero means 40.
+	IPABits uint
+	// TableBase and TableSize give the granule aligned guest physical area
+	// tables are allocated from. The builder owns the whole area.
+	TableBase uint64
+	TableSize uint64
+}
+
+// Builder writes translation tables into guest memory.
+type Builder struct {
+	mem   Memory
+	cfg   Config
+	next  uint64    // next free table in the pool
+	roots [2]uint64 // TTBR0 and TTBR1 root tables, 0 if not allocated
+}
+
+// New returns a Builder that allocates tables from cfg's table area in mem.
+// The TTBR0 root table is allocated immediately; the TTBR1 root is
+// allocated by the first mapping in the upper half.
+func New(mem Memory, cfg Config) (*Builder, error) {
+	if mem == nil {
+		return nil, fmt.Errorf("pagetable: memory is nil")
+	}
+	if cfg.Granule != Granule4K && cfg.Granule != Granule16K {
+		return nil, fmt.Errorf("pagetable: unsupported granule %v", cfg.Granule)
+	}
+	if cfg.VABits == 0 {
+		cfg.VABits = 48
+	}
+	if cfg.VABits < 25 || cfg.VABits > 48 {
+		return nil, fmt.Errorf("pagetable: VA width %d out of range [25, 48]", cfg.VABits)
+	}
+	if cfg.IPABits == 0 {
+		cfg.IPABits = 40
+	}
+	if _, ok := ipsEncoding(cfg.IPABits); !ok || cfg.IPABits > 48 {
+		return nil, fmt.Errorf("pagetable: unsupported IPA width %d", cfg.IPABits)
+	}
+	gran := cfg.Granule.Size()
+	if cfg.TableBase%gran != 0 || cfg.TableSize%gran != 0 || cfg.TableSize == 0 {
+		return nil, fmt.Errorf("pagetable: table area 0x%x+%d not %v aligned", cfg.TableBase, cfg.TableSize, cfg.Granule)
+	}
+	if cfg.TableBase > math.MaxUint64-cfg.TableSize || cfg.TableBase+cfg.TableSize > 1<<cfg.IPABits {
+		return nil, fmt.Errorf("pagetable: table area 0x%x+%d outside the %d-bit IPA space", cfg.TableBase, cfg.TableSize, cfg.IPABits)
+	}
+
+	b := &Builder{mem: mem, cfg: cfg, next: cfg.TableBase}
+	root, err := b.allocTable()
+	if err != nil {
+		return nil, err
+	}
+	b.roots[0] = root
+	return b, nil
+}
+
+// allocTable takes one zeroed granule from the table pool.
+func (b *Builder) allocTable() (uint64, error) {
+	gran := b.cfg.Granule.Size()
+	if b.next+gran > b.cfg.TableBase+b.cfg.TableSize {
+		return 0, fmt.Errorf("pagetable: table area 0x%x+%d exhausted", b.cfg.TableBase, b.cfg.TableSize)
+	}
+	addr := b.next
+	if _, err := b.mem.WriteAt(make([]byte, gran), int64(addr)); err != nil {
+		return 0, fmt.Errorf("failed to clear table at 0x%x: %w", addr, err)
+	}
+	b.next += gran
+	return addr, nil
+}
+
+// TablesUsed returns the number of bytes of the table area in use.
+func (b *Builder) TablesUsed() uint64 { return b.next - b.cfg.TableBase }
+
+// Map maps [va, va+size) to [ipa, ipa+size) with the given permissions and
+// memory attributes. va, ipa and size must be granule aligned, and the range
+// must lie entirely in the TTBR0 or the TTBR1 half and not overlap an
+// existing mapping. Block descriptors are used wherever alignment permits.
+func (b *Builder) Map(va, ipa, size uint64, prot Prot, attr Attr) error {
+	gran := b.cfg.Granule.Size()
+	if size == 0 {
+		return fmt.Errorf("pagetable: map requires non-zero size")
+	}
+	if va%gran != 0 || ipa%gran != 0 || size%gran != 0 {
+		return fmt.Errorf("pagetable: 0x%x->0x%x+%d not %v aligned", va, ipa, size, b.cfg.Granule)
+	}
+	if ipa > math.MaxUint64-size || ipa+size > 1<<b.cfg.IPABits {
+		return fmt.Errorf("pagetable: IPA 0x%x+%d outside the %d-bit IPA space", ipa, size, b.cfg.IPABits)
+	}
+	if attr > 7 {
+		return fmt.Errorf("pagetable: invalid attribute index %d", attr)
+	}
+	half, ok := b.half(va, size)
+	if !ok {
+		return fmt.Errorf("pagetable: VA range 0x%x+%d is not inside one %d-bit half", va, size, b.cfg.VABits)
+	}
+	if b.roots[half] == 0 {
+		root, err := b.allocTable()
+		if err != nil {
+			return err
+		}
+		b.roots[half] = root
+	}
+
+	// Check for overlaps first so a rejected Map leaves the tables alone.
+	leaf := leafBits(prot, attr)
+	for _, dry := range []bool{true, false} {
+		for off := uint64(0); off < size; {
+			n, err := b.mapOne(half, va+off, ipa+off, size-off, leaf, dry)
+			if err != nil {
+				return err
+			}
+			off += n
+		}
+	}
+	return nil
+}
+
+// half returns 0 for a range in the TTBR0 half and 1 for the TTBR1 half.
+func (b *Builder) half(va, size uint64) (int, bool) {
+	last := va + size - 1
+	if last < va {
+		return 0, false
+	}
+	top := uint64(1) << b.cfg.VABits
+	switch {
+	case last < top:
+		return 0, true
+	case va >= -top:
+		return 1, true
+	}
+	return 0, false
+}
+
+// leafBits returns the attribute bits of a block or page descriptor.
+func leafBits(prot Prot, attr Attr) uint64 {
+	d := uint64(descAF) | uint64(attr)<<descAttrIdx
+	if attr != AttrDevice {
+		d |= descSHInner
+	}
+	if prot&ProtWrite == 0 {
+		d |= descAPRO
+	}
+	if prot&ProtUser != 0 {
+		d |= descAPUser
+	}
+	if prot&ProtExec == 0 {
+		d |= descPXN
+	}
+	if prot&ProtUserExec == 0 {
+		d |= descUXN
+	}
+	return d
+}
+
+// mapOne installs the largest descriptor that fits at va and returns the
+// number of bytes it maps. With dry set it only checks that the range is
+// free and returns how much of it was checked.
+func (b *Builder) mapOne(half int, va, ipa, remaining, leaf uint64, dry bool) (uint64, error) {
+	g := b.cfg.Granule
+	level := g.startLevel(b.cfg.VABits)
+	table := b.roots[half]
+	for {
+		shift := g.levelShift(level)
+		span := uint64(1) << shift
+		entry := table + 8*b.index(va, level)
+
+		desc, err := b.read(entry)
+		if err != nil {
+			return 0, err
+		}
+
+		if level == 3 || (g.blockAllowed(level) && va%span == 0 && ipa%span == 0 && remaining >= span) {
+			if desc&descValid != 0 {
+				return 0, fmt.Errorf("pagetable: VA 0x%x is already mapped", va)
+			}
+			if dry {
+				return span, nil
+			}
+			kind := uint64(descValid)
+			if level == 3 {
+				kind |= descTable
+			}
+			return span, b.write(entry, kind|leaf|ipa&descAddrMask)
+		}
+
+		switch {
+		case desc&descValid == 0 && dry:
+			return min(span-va%span, remaining), nil
+		case desc&descValid == 0:
+			next, err := b.allocTable()
+			if err != nil {
+				return 0, err
+			}
+			if err := b.write(entry, next|descValid|descTable); err != nil {
+				return 0, err
+			}
+			table = next
+		case desc&descTable == 0:
+			return 0, fmt.Errorf("pagetable: VA 0x%x is already mapped by a level %d block", va, level)
+		default:
+			table = desc & descAddrMask
+		}
+		level++
+	}
+}
+
+// index returns the table index for va at level.
+func (b *Builder) index(va uint64, level int) uint64 {
+	g := b.cfg.Granule
+	bits := g.bitsPerLevel()
+	if level == g.startLevel(b.cfg.VABits) {
+		bits = b.cfg.VABits - g.levelShift(level)
+	}
+	return (va >> g.levelShift(level)) & (1<<bits - 1)
+}
+
+func (b *Builder) read(addr uint64) (uint64, error) {
+	var buf [8]byte
+	if _, err := b.mem.ReadAt(buf[:], int64(addr)); err != nil {
+		return 0, fmt.Errorf("failed to read descriptor at 0x%x: %w", addr, err)
+	}
+	return binary.LittleEndian.Uint64(buf[:]), nil
+}
+
+func (b *Builder) write(addr, desc uint64) error {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], desc)
+	if _, err := b.mem.WriteAt(buf[:], int64(addr)); err != nil {
+		return fmt.Errorf("failed to write descriptor at 0x%x: %w", addr, err)
+	}
+	return nil
+}
+
+// Registers returns the system register values that enable the tables
+// built so far. A TTBR1 half with no mappings is disabled with EPD1.
+func (b *Builder) Registers() Registers {
+	tsz := uint64(64 - b.cfg.VABits)
+	ips, _ := ipsEncoding(b.cfg.IPABits)
+
+	tcr := tsz | tsz<<16 | ips<<tcrIPSPos |
+		tcrIRGN0 | tcrORGN0 | tcrSH0 | tcrIRGN1 | tcrORGN1 | tcrSH1
+	switch b.cfg.Granule {
+	case Granule4K:
+		tcr |= 0<<14 | 2<<30
+	case Granule16K:
+		tcr |= 2<<14 | 1<<30
+	}
+	if b.roots[1] == 0 {
+		tcr |= tcrEPD1
+	}
+
+	return Registers{
+		SCTLR: sctlrRES1 | sctlrM | sctlrC | sctlrI,
+		TCR:   tcr,
+		MAIR:  MAIR,
+		TTBR0: b.roots[0],
+		TTBR1: b.roots[1],
+	}
+}
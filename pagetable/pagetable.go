@@ -0,0 +1,178 @@
+// Package pagetable builds AArch64 stage-1 translation tables in guest
+// memory and walks them in software.
+//
+// A Builder lays out tables for the 4K or 16K translation granule in a
+// caller supplied guest physical area, using the largest block descriptors
+// the alignment allows, and reports the TTBR0/TTBR1, TCR, MAIR and SCTLR
+// values that enable them. Walk resolves a guest virtual address to an
+// intermediate physical address from those same register values, so it can
+// translate fault addresses reported by a guest that programs its own
+// tables.
+package pagetable
+
+import (
+	"fmt"
+	"io"
+)
+
+// Memory is guest physical memory addressed by offset, such as a
+// *hypervisor.VM.
+type Memory interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// Granule is a translation granule size.
+type Granule uint8
+
+const (
+	Granule4K Granule = iota
+	Granule16K
+)
+
+// Size returns the granule size in bytes.
+func (g Granule) Size() uint64 { return 1 << g.shift() }
+
+func (g Granule) shift() uint {
+	if g == Granule16K {
+		return 14
+	}
+	return 12
+}
+
+// bitsPerLevel is the number of VA bits resolved by each table level.
+func (g Granule) bitsPerLevel() uint { return g.shift() - 3 }
+
+// levelShift returns the VA bit position resolved at level.
+func (g Granule) levelShift(level int) uint {
+	return g.shift() + uint(3-level)*g.bitsPerLevel()
+}
+
+// blockAllowed reports whether a block descriptor may appear at level.
+func (g Granule) blockAllowed(level int) bool {
+	if g == Granule16K {
+		return level == 2
+	}
+	return level == 1 || level == 2
+}
+
+// startLevel returns the first lookup level for a vaBits wide address space.
+func (g Granule) startLevel(vaBits uint) int {
+	levels := (vaBits - g.shift() + g.bitsPerLevel() - 1) / g.bitsPerLevel()
+	return 4 - int(levels)
+}
+
+func (g Granule) String() string {
+	switch g {
+	case Granule4K:
+		return "4K"
+	case Granule16K:
+		return "16K"
+	}
+	return fmt.Sprintf("Granule(%d)", uint8(g))
+}
+
+// Prot is the access permissions of a mapping.
+type Prot uint8
+
+const (
+	// ProtRead allows EL1 reads. Every valid mapping is readable at EL1.
+	ProtRead Prot = 1 << iota
+	// ProtWrite allows writes, from EL0 too when combined with ProtUser.
+	ProtWrite
+	// ProtExec allows EL1 instruction fetches. It is ignored for mappings
+	// writable from EL0, which the architecture never lets EL1 execute.
+	ProtExec
+	// ProtUser grants EL0 the same read/write access as EL1.
+	ProtUser
+	// ProtUserExec allows EL0 instruction fetches.
+	ProtUserExec
+)
+
+func (p Prot) String() string {
+	b := []byte("-----")
+	for i, c := range "rwxuX" {
+		if p&(1<<i) != 0 {
+			b[i] = byte(c)
+		}
+	}
+	return string(b)
+}
+
+// Attr is a MAIR_EL1 attribute index.
+type Attr uint8
+
+const (
+	// AttrDevice is Device-nGnRnE memory.
+	AttrDevice Attr = 0
+	// AttrNormal is Normal write-back cacheable memory.
+	AttrNormal Attr = 1
+	// AttrNormalNC is Normal non-cacheable memory.
+	AttrNormalNC Attr = 2
+)
+
+// MAIR is the MAIR_EL1 value that defines the Attr indexes.
+const MAIR = 0x44<<(8*AttrNormalNC) | 0xFF<<(8*AttrNormal) | 0x00<<(8*AttrDevice)
+
+// Descriptor bits shared by table, block and page entries.
+const (
+	descValid    = 1 << 0
+	descTable    = 1 << 1 // table at levels 0-2, page at level 3
+	descAttrIdx  = 2
+	descAPUser   = 1 << 6
+	descAPRO     = 1 << 7
+	descSHInner  = 3 << 8
+	descAF       = 1 << 10
+	descPXN      = 1 << 53
+	descUXN      = 1 << 54
+	tablePXN     = 1 << 59
+	tableUXN     = 1 << 60
+	tableAPUser  = 1 << 61 // set: EL0 access denied
+	tableAPRO    = 1 << 62
+	descAddrMask = 0x0000FFFFFFFFF000
+	ttbrBADDR    = 0x0000FFFFFFFFFFFE
+)
+
+// SCTLR_EL1 bits.
+const (
+	sctlrM    = 1 << 0
+	sctlrC    = 1 << 2
+	sctlrI    = 1 << 12
+	sctlrRES1 = 0x30d00800
+)
+
+// TCR_EL1 fields.
+const (
+	tcrEPD0   = 1 << 7
+	tcrEPD1   = 1 << 23
+	tcrIRGN0  = 1 << 8  // write-back write-allocate
+	tcrORGN0  = 1 << 10 // write-back write-allocate
+	tcrSH0    = 3 << 12 // inner shareable
+	tcrIRGN1  = 1 << 24
+	tcrORGN1  = 1 << 26
+	tcrSH1    = 3 << 28
+	tcrIPSPos = 32
+)
+
+// Registers holds the system register values that control stage-1
+// translation at EL1.
+type Registers struct {
+	SCTLR uint64 `json:"sctlr"`
+	TCR   uint64 `json:"tcr"`
+	MAIR  uint64 `json:"mair"`
+	TTBR0 uint64 `json:"ttbr0"`
+	TTBR1 uint64 `json:"ttbr1"`
+}
+
+// ipsBits maps TCR_EL1.IPS to a physical address width.
+var ipsBits = [...]uint{32, 36, 40, 42, 44, 48, 52}
+
+// ipsEncoding returns the TCR_EL1.IPS value for an IPA width.
+func ipsEncoding(bits uint) (uint64, bool) {
+	for i, b := range ipsBits {
+		if b == bits {
+			return uint64(i), true
+		}
+	}
+	return 0, false
+}
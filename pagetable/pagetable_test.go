@@ -0,0 +1,248 @@
+package pagetable
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// testMem is a flat guest physical memory starting at base.
+type testMem struct {
+	base uint64
+	buf  []byte
+}
+
+func newTestMem(base, size uint64) *testMem { return &testMem{base: base, buf: make([]byte, size)} }
+
+func (m *testMem) span(p []byte, off int64) ([]byte, error) {
+	addr := uint64(off)
+	if addr < m.base || addr+uint64(len(p)) > m.base+uint64(len(m.buf)) {
+		return nil, fmt.Errorf("unmapped 0x%x", addr)
+	}
+	return m.buf[addr-m.base:], nil
+}
+
+func (m *testMem) ReadAt(p []byte, off int64) (int, error) {
+	s, err := m.span(p, off)
+	if err != nil {
+		return 0, err
+	}
+	return copy(p, s), nil
+}
+
+func (m *testMem) WriteAt(p []byte, off int64) (int, error) {
+	s, err := m.span(p, off)
+	if err != nil {
+		return 0, err
+	}
+	return copy(s, p), nil
+}
+
+const (
+	tableBase = 0x80000000
+	tableSize = 0x100000
+	kernelVA  = 0xFFFF000000000000
+)
+
+func TestBuildAndWalk(t *testing.T) {
+	for _, g := range []Granule{Granule4K, Granule16K} {
+		t.Run(g.String(), func(t *testing.T) {
+			mem := newTestMem(tableBase, tableSize)
+			b, err := New(mem, Config{Granule: g, TableBase: tableBase, TableSize: tableSize})
+			if err != nil {
+				t.Fatalf("New failed: %v", err)
+			}
+
+			gran := g.Size()
+			block := uint64(1) << g.levelShift(2)
+			maps := []struct {
+				va, ipa, size uint64
+				prot          Prot
+				attr          Attr
+			}{
+				{0x40000000, 0x40000000, gran, ProtRead | ProtExec, AttrNormal},              // code page
+				{0x40000000 + gran, 0x40000000 + gran, gran, ProtWrite, AttrNormal},          // data page
+				{0x60000000, 0x60000000, 2 * block, ProtWrite | ProtUser, AttrNormal},        // two blocks
+				{0x9000000, 0x9000000, gran, ProtWrite, AttrDevice},                          // device
+				{kernelVA, 0x40000000, gran, ProtExec | ProtUser | ProtUserExec, AttrNormal}, // TTBR1 alias
+			}
+			for _, m := range maps {
+				if err := b.Map(m.va, m.ipa, m.size, m.prot, m.attr); err != nil {
+					t.Fatalf("Map(0x%x) failed: %v", m.va, err)
+				}
+			}
+			regs := b.Registers()
+
+			tests := []struct {
+				va    uint64
+				ipa   uint64
+				level int
+				prot  Prot
+				attr  Attr
+			}{
+				{0x40000010, 0x40000010, 3, ProtRead | ProtExec, AttrNormal},
+				{0x40000000 + gran + 8, 0x40000000 + gran + 8, 3, ProtRead | ProtWrite, AttrNormal},
+				{0x60000000 + block + 0x123, 0x60000000 + block + 0x123, 2, ProtRead | ProtWrite | ProtUser, AttrNormal},
+				{0x9000004, 0x9000004, 3, ProtRead | ProtWrite, AttrDevice},
+				{kernelVA + 0x40, 0x40000040, 3, ProtRead | ProtExec | ProtUser | ProtUserExec, AttrNormal},
+			}
+			for _, tt := range tests {
+				tr, err := Walk(mem, regs, tt.va)
+				if err != nil {
+					t.Errorf("Walk(0x%x) failed: %v", tt.va, err)
+					continue
+				}
+				if tr.IPA != tt.ipa || tr.Level != tt.level || tr.Prot != tt.prot || tr.Attr != tt.attr {
+					t.Errorf("Walk(0x%x) = ipa 0x%x level %d prot %v attr %d, want 0x%x %d %v %d",
+						tt.va, tr.IPA, tr.Level, tr.Prot, tr.Attr, tt.ipa, tt.level, tt.prot, tt.attr)
+				}
+			}
+
+			for _, va := range []uint64{0, 0x40000000 + 2*gran, kernelVA + gran, 0x0001000000000000} {
+				_, err := Walk(mem, regs, va)
+				var f *Fault
+				if !errors.As(err, &f) || f.Kind != FaultTranslation {
+					t.Errorf("Walk(0x%x) = %v, want translation fault", va, err)
+				}
+			}
+
+			used := b.TablesUsed()
+			if err := b.Map(0x60000000+block-gran, 0x1000000, 2*gran, ProtWrite, AttrNormal); err == nil {
+				t.Error("Expected error mapping over an existing block")
+			}
+			if b.TablesUsed() != used {
+				t.Error("rejected Map allocated tables")
+			}
+			if _, err := Walk(mem, regs, 0x60000000-gran); err == nil {
+				t.Error("rejected Map left a partial mapping")
+			}
+		})
+	}
+}
+
+func TestRegisters(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		tcr  uint64
+	}{
+		{"4K 48-bit", Config{Granule: Granule4K}, 16 | 16<<16 | 2<<32 | 2<<30 | tcrEPD1},
+		{"16K 39-bit", Config{Granule: Granule16K, VABits: 39, IPABits: 36}, 25 | 25<<16 | 1<<32 | 2<<14 | 1<<30 | tcrEPD1},
+	}
+	const cache = tcrIRGN0 | tcrORGN0 | tcrSH0 | tcrIRGN1 | tcrORGN1 | tcrSH1
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.TableBase, tt.cfg.TableSize = tableBase, tableSize
+			b, err := New(newTestMem(tableBase, tableSize), tt.cfg)
+			if err != nil {
+				t.Fatalf("New failed: %v", err)
+			}
+			regs := b.Registers()
+			if regs.TCR != tt.tcr|cache {
+				t.Errorf("TCR = 0x%x, want 0x%x", regs.TCR, tt.tcr|cache)
+			}
+			if regs.TTBR0 != tableBase || regs.TTBR1 != 0 {
+				t.Errorf("TTBR0/1 = 0x%x/0x%x, want 0x%x/0", regs.TTBR0, regs.TTBR1, tableBase)
+			}
+			if regs.SCTLR&(sctlrM|sctlrC|sctlrI) != sctlrM|sctlrC|sctlrI || regs.MAIR != 0x44FF00 {
+				t.Errorf("SCTLR/MAIR = 0x%x/0x%x", regs.SCTLR, regs.MAIR)
+			}
+		})
+	}
+}
+
+func TestWalkDescriptorBits(t *testing.T) {
+	mem := newTestMem(tableBase, tableSize)
+	b, err := New(mem, Config{Granule: Granule4K, TableBase: tableBase, TableSize: tableSize})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if err := b.Map(0x1000, 0x1000, 0x1000, ProtWrite|ProtUser|ProtExec|ProtUserExec, AttrNormal); err != nil {
+		t.Fatalf("Map failed: %v", err)
+	}
+	regs := b.Registers()
+
+	t.Run("EL0 writable is never EL1 executable", func(t *testing.T) {
+		tr, err := Walk(mem, regs, 0x1000)
+		if err != nil {
+			t.Fatalf("Walk failed: %v", err)
+		}
+		if tr.Prot != ProtRead|ProtWrite|ProtUser|ProtUserExec {
+			t.Errorf("Prot = %v", tr.Prot)
+		}
+	})
+
+	t.Run("access flag", func(t *testing.T) {
+		tr, _ := Walk(mem, regs, 0x1000)
+		leaf := findDescriptor(t, mem, tr.Descriptor)
+		if err := b.write(leaf, tr.Descriptor&^descAF); err != nil {
+			t.Fatal(err)
+		}
+		var f *Fault
+		if _, err := Walk(mem, regs, 0x1000); !errors.As(err, &f) || f.Kind != FaultAccessFlag || f.Level != 3 {
+			t.Errorf("Walk = %v, want level 3 access flag fault", err)
+		}
+	})
+
+	t.Run("MMU off", func(t *testing.T) {
+		off := regs
+		off.SCTLR &^= sctlrM
+		tr, err := Walk(mem, off, 0xDEAD000)
+		if err != nil || tr.IPA != 0xDEAD000 || tr.Level != -1 {
+			t.Errorf("Walk = %+v, %v, want identity", tr, err)
+		}
+	})
+
+	t.Run("disabled TTBR1", func(t *testing.T) {
+		var f *Fault
+		if _, err := Walk(mem, regs, kernelVA); !errors.As(err, &f) || f.Kind != FaultTranslation {
+			t.Errorf("Walk = %v, want translation fault", err)
+		}
+	})
+}
+
+func TestBuilderErrors(t *testing.T) {
+	mem := newTestMem(tableBase, 0x2000)
+	if _, err := New(mem, Config{Granule: Granule16K, TableBase: tableBase, TableSize: 0x2000}); err == nil {
+		t.Error("Expected error for table area not 16K aligned")
+	}
+	if _, err := New(mem, Config{Granule: Granule4K, VABits: 52, TableBase: tableBase, TableSize: 0x2000}); err == nil {
+		t.Error("Expected error for 52-bit VA")
+	}
+
+	b, err := New(mem, Config{Granule: Granule4K, TableBase: tableBase, TableSize: 0x2000})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	bad := []struct {
+		name          string
+		va, ipa, size uint64
+	}{
+		{"unaligned", 0x1001, 0x1000, 0x1000},
+		{"zero size", 0x1000, 0x1000, 0},
+		{"non-canonical", 0x0001000000000000, 0x1000, 0x1000},
+		{"IPA too wide", 0x1000, 1 << 40, 0x1000},
+		{"tables exhausted", 0x1000, 0x1000, 0x1000}, // needs three more tables
+	}
+	for _, tt := range bad {
+		if err := b.Map(tt.va, tt.ipa, tt.size, ProtWrite, AttrNormal); err == nil {
+			t.Errorf("%s: expected error", tt.name)
+		}
+	}
+}
+
+// findDescriptor returns the address of the descriptor with value desc.
+func findDescriptor(t *testing.T, mem *testMem, desc uint64) uint64 {
+	t.Helper()
+	for off := 0; off+8 <= len(mem.buf); off += 8 {
+		var v uint64
+		for i := 7; i >= 0; i-- {
+			v = v<<8 | uint64(mem.buf[off+i])
+		}
+		if v == desc {
+			return mem.base + uint64(off)
+		}
+	}
+	t.Fatalf("descriptor 0x%x not found", desc)
+	return 0
+}
@@ -0,0 +1,190 @@
+package pagetable
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// FaultKind classifies a failed translation.
+type FaultKind int
+
+const (
+	// FaultTranslation means a descriptor was invalid or the VA is outside
+	// the configured ranges.
+	FaultTranslation FaultKind = iota
+	// FaultAccessFlag means the descriptor has AF clear.
+	FaultAccessFlag
+	// FaultAddressSize means a table or output address exceeds the
+	// configured IPA width.
+	FaultAddressSize
+)
+
+func (k FaultKind) String() string {
+	switch k {
+	case FaultTranslation:
+		return "translation"
+	case FaultAccessFlag:
+		return "access flag"
+	case FaultAddressSize:
+		return "address size"
+	}
+	return fmt.Sprintf("FaultKind(%d)", int(k))
+}
+
+// Fault is the error Walk returns when the tables do not map a VA.
+type Fault struct {
+	VA    uint64
+	Level int
+	Kind  FaultKind
+}
+
+func (f *Fault) Error() string {
+	return fmt.Sprintf("pagetable: %v fault at level %d for VA 0x%x", f.Kind, f.Level, f.VA)
+}
+
+// Translation is the result of a successful walk.
+type Translation struct {
+	// VA is the translated virtual address.
+	VA uint64 `json:"va"`
+	// IPA is the intermediate physical address VA maps to.
+	IPA uint64 `json:"ipa"`
+	// Level is the lookup level of the block or page descriptor, or -1 when
+	// the MMU is off.
+	Level int `json:"level"`
+	// Size is the size of the block or page containing VA.
+	Size uint64 `json:"size"`
+	// Prot is the effective access permissions, including restrictions
+	// inherited from table descriptors.
+	Prot Prot `json:"prot"`
+	// Attr is the MAIR attribute index.
+	Attr Attr `json:"attr"`
+	// Descriptor is the raw block or page descriptor.
+	Descriptor uint64 `json:"descriptor"`
+}
+
+// Walk translates va using the stage-1 EL1&0 regime described by regs,
+// reading descriptors from mem. With SCTLR_EL1.M clear the address is
+// returned unchanged with every permission. Only the 4K and 16K granules
+// are supported. A VA the tables do not map yields a *Fault.
+func Walk(mem io.ReaderAt, regs Registers, va uint64) (Translation, error) {
+	if regs.SCTLR&sctlrM == 0 {
+		return Translation{VA: va, IPA: va, Level: -1, Prot: ProtRead | ProtWrite | ProtExec | ProtUser | ProtUserExec}, nil
+	}
+
+	upper := va>>55&1 != 0
+	var tsz, tg, ttbr uint64
+	var disabled bool
+	if upper {
+		tsz, tg, ttbr = regs.TCR>>16&0x3F, regs.TCR>>30&3, regs.TTBR1
+		disabled = regs.TCR&tcrEPD1 != 0
+	} else {
+		tsz, tg, ttbr = regs.TCR&0x3F, regs.TCR>>14&3, regs.TTBR0
+		disabled = regs.TCR&tcrEPD0 != 0
+	}
+
+	var g Granule
+	switch {
+	case !upper && tg == 0, upper && tg == 2:
+		g = Granule4K
+	case !upper && tg == 2, upper && tg == 1:
+		g = Granule16K
+	default:
+		return Translation{}, fmt.Errorf("pagetable: unsupported granule in TCR_EL1 0x%x", regs.TCR)
+	}
+	if tsz < 16 || tsz > 39 {
+		return Translation{}, fmt.Errorf("pagetable: unsupported TxSZ %d in TCR_EL1 0x%x", tsz, regs.TCR)
+	}
+	vaBits := uint(64 - tsz)
+	ips := regs.TCR >> tcrIPSPos & 7
+	if ips >= uint64(len(ipsBits)) {
+		ips = uint64(len(ipsBits)) - 1
+	}
+	paBits := min(ipsBits[ips], 48)
+
+	level := g.startLevel(vaBits)
+	fault := func(kind FaultKind) (Translation, error) {
+		return Translation{}, &Fault{VA: va, Level: level, Kind: kind}
+	}
+
+	// The bits above the range must all match bit 55.
+	high := va >> vaBits
+	if disabled || (!upper && high != 0) || (upper && high != 1<<(64-vaBits)-1) {
+		return fault(FaultTranslation)
+	}
+
+	table := ttbr & ttbrBADDR
+	prot := ProtRead | ProtWrite | ProtExec | ProtUser | ProtUserExec
+	for {
+		shift := g.levelShift(level)
+		bits := g.bitsPerLevel()
+		if level == g.startLevel(vaBits) {
+			bits = vaBits - shift
+		}
+		if table>>paBits != 0 {
+			return fault(FaultAddressSize)
+		}
+		entry := table + 8*(va>>shift&(1<<bits-1))
+
+		var buf [8]byte
+		if _, err := mem.ReadAt(buf[:], int64(entry)); err != nil {
+			return Translation{}, fmt.Errorf("failed to read level %d descriptor at 0x%x: %w", level, entry, err)
+		}
+		desc := binary.LittleEndian.Uint64(buf[:])
+
+		if desc&descValid == 0 {
+			return fault(FaultTranslation)
+		}
+		if level < 3 && desc&descTable != 0 {
+			if desc&tablePXN != 0 {
+				prot &^= ProtExec
+			}
+			if desc&tableUXN != 0 {
+				prot &^= ProtUserExec
+			}
+			if desc&tableAPUser != 0 {
+				prot &^= ProtUser
+			}
+			if desc&tableAPRO != 0 {
+				prot &^= ProtWrite
+			}
+			table = desc & descAddrMask
+			level++
+			continue
+		}
+		if level == 3 && desc&descTable == 0 || level < 3 && !g.blockAllowed(level) {
+			return fault(FaultTranslation) // reserved encoding
+		}
+		if desc&descAF == 0 {
+			return fault(FaultAccessFlag)
+		}
+
+		size := uint64(1) << shift
+		out := desc & descAddrMask &^ (size - 1)
+		if out>>paBits != 0 {
+			return fault(FaultAddressSize)
+		}
+
+		if desc&descAPRO != 0 {
+			prot &^= ProtWrite
+		}
+		if desc&descAPUser == 0 {
+			prot &^= ProtUser
+		}
+		if desc&descPXN != 0 || prot&(ProtUser|ProtWrite) == ProtUser|ProtWrite {
+			prot &^= ProtExec
+		}
+		if desc&descUXN != 0 {
+			prot &^= ProtUserExec
+		}
+		return Translation{
+			VA:         va,
+			IPA:        out | va&(size-1),
+			Level:      level,
+			Size:       size,
+			Prot:       prot,
+			Attr:       Attr(desc >> descAttrIdx & 7),
+			Descriptor: desc,
+		}, nil
+	}
+}
@@ -0,0 +1,161 @@
+package hypervisor
+
+import (
+	"fmt"
+	"math"
+)
+
+// Protect changes the guest permissions of [guestPhys, guestPhys+size),
+// which must be page-aligned and entirely mapped. Regions that only partly
+// overlap the range are split, keeping their labels. perms may be zero to
+// make the range inaccessible, as for a guard page.
+//
+// Guest accesses the new permissions deny exit with a permission fault,
+// which is passed to the handler set with SetPermissionFaultHandler.
+func (vm *VM) Protect(guestPhys, size uint64, perms MemPerm) error {
+	if err := vm.protect(guestPhys, size, perms); err != nil {
+		return &OpError{Op: "protect", GPA: guestPhys, Size: size, Err: err}
+	}
+	return nil
+}
+
+func (vm *VM) protect(guestPhys, size uint64, perms MemPerm) error {
+	if vm == nil {
+		return errVMNil
+	}
+
+	// Security: Lock to keep Close from tearing the VM down meanwhile
+	vm.closeMu.Lock()
+	defer vm.closeMu.Unlock()
+
+	return vm.protectRange(guestPhys, size, perms)
+}
+
+// protectRange does the work of Protect. The caller holds vm.closeMu.
+func (vm *VM) protectRange(guestPhys, size uint64, perms MemPerm) error {
+	if vm.closed {
+		return ErrVMClosed
+	}
+	if size == 0 {
+		return fmt.Errorf("hv: zero size")
+	}
+
+	// Security: Prevent integer overflow vulnerabilities
+	if guestPhys > math.MaxUint64-size {
+		vm.metrics.recordSecurityError()
+		return errRangeOverflow
+	}
+
+	validPerms := MemRead | MemWrite | MemExec
+	if perms&^validPerms != 0 {
+		return fmt.Errorf("hv: invalid permission bits 0x%x (valid: 0x%x)", perms, validPerms)
+	}
+
+	// Performance: Fast alignment checks using cached masks
+	if !isPageAligned(guestPhys) {
+		return fmt.Errorf("%w: guestPhys 0x%x (page size: %d)", ErrInvalidAlignment, guestPhys, pageSize())
+	}
+	if !isPageAligned(size) {
+		return fmt.Errorf("%w: size %d (page size: %d)", ErrInvalidAlignment, size, pageSize())
+	}
+
+	vm.regions.mu.Lock()
+	defer vm.regions.mu.Unlock()
+
+	if !vm.regions.coveredLocked(guestPhys, size) {
+		return ErrMemoryNotMapped
+	}
+	if perms&MemWrite != 0 {
+		// Security: The host could not back guest writes to a read-only mapping
+		for i := vm.regions.find(guestPhys); i < len(vm.regions.regions) && vm.regions.regions[i].GPA < guestPhys+size; i++ {
+			if r := vm.regions.regions[i]; r.readOnly {
+				return fmt.Errorf("hv: 0x%x is mapped read-only from %s", r.GPA, r.File)
+			}
+		}
+	}
+	err := vm.eachBackedLocked(guestPhys, size, func(_ Region, gpa, size uint64) error {
+		return vm.backend.Protect(gpa, size, perms)
+	})
+	if err != nil {
+		vm.metrics.recordResourceError()
+		return err
+	}
+	vm.regions.protectLocked(guestPhys, size, perms)
+	if perms&MemWrite != 0 {
+		return vm.protectTrackedLocked(guestPhys, size)
+	}
+	return nil
+}
+
+// PermissionFault describes a guest access that the permissions of a mapped
+// region denied.
+type PermissionFault struct {
+	// GPA is the guest physical address accessed.
+	GPA uint64
+	// Access is the kind of access denied: MemRead, MemWrite or MemExec.
+	Access MemPerm
+	// Region is the region containing GPA, with its current permissions.
+	Region Region
+	// Exit is the abort the guest took.
+	Exit ExitInfo
+}
+
+// PermissionFaultHandler decides what happens after a permission fault. It
+// returns true to resume the guest, which retries the faulting instruction,
+// typically after Protect has granted the access; otherwise Run returns
+// the abort. A handler that resumes without granting the access makes the
+// guest fault again.
+//
+// The handler runs on the goroutine running vcpu, so vcpu's register
+// accessors return ErrVCPURunning; the VM's methods may be used.
+type PermissionFaultHandler func(vcpu *VCPU, f PermissionFault) bool
+
+// SetPermissionFaultHandler sets the handler called when a guest access
+// faults on the permissions of a mapped region. A nil handler, the
+// default, returns every such fault from Run.
+func (vm *VM) SetPermissionFaultHandler(h PermissionFaultHandler) {
+	if vm == nil {
+		return
+	}
+	if h == nil {
+		vm.permFault.Store(nil)
+		return
+	}
+	vm.permFault.Store(&h)
+}
+
+// permissionFault decodes info as a permission fault on a mapped region.
+func (vm *VM) permissionFault(info ExitInfo) (PermissionFault, bool) {
+	var access MemPerm
+	if da, ok := info.DataAbort(); ok && da.DFSC.IsPermission() {
+		access = MemRead
+		if da.WnR && !da.CM {
+			access = MemWrite
+		}
+	} else if ia, ok := info.InstructionAbort(); ok && ia.IFSC.IsPermission() {
+		access = MemExec
+	} else {
+		return PermissionFault{}, false
+	}
+
+	r, ok := vm.regions.lookup(info.IPA)
+	if !ok {
+		return PermissionFault{}, false
+	}
+	return PermissionFault{GPA: info.IPA, Access: access, Region: r, Exit: info}, true
+}
+
+// handlePermissionFault passes a permission fault to the VM's handler,
+// reporting whether the guest should resume. It is only called from the
+// goroutine running the vCPU.
+func (c *VCPU) handlePermissionFault(info ExitInfo) bool {
+	h := c.vm.permFault.Load()
+	if h == nil {
+		return false
+	}
+	f, ok := c.vm.permissionFault(info)
+	if !ok {
+		return false
+	}
+	return (*h)(c, f)
+}
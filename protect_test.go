@@ -0,0 +1,188 @@
+package hypervisor
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// errAny stands for an error test cases do not identify further.
+var errAny = errors.New("any error")
+
+func TestProtect(t *testing.T) {
+	page := uint64(pageSize())
+	const base = 0x200000
+
+	tests := []struct {
+		name    string
+		gpa     uint64
+		size    uint64
+		perms   MemPerm
+		wantErr error // nil if Protect succeeds; errAny matches any error
+		want    []Region
+	}{
+		{
+			name:  "whole region",
+			gpa:   base,
+			size:  4 * page,
+			perms: MemRead,
+			want:  []Region{{GPA: base, Size: 4 * page, Perms: MemRead, Label: "heap", Committed: 4 * page}},
+		},
+		{
+			name:  "middle splits",
+			gpa:   base + page,
+			size:  2 * page,
+			perms: 0,
+			want: []Region{
+				{GPA: base, Size: page, Perms: MemRead | MemWrite, Label: "heap", Committed: page},
+				{GPA: base + page, Size: 2 * page, Perms: 0, Label: "heap", Committed: 2 * page},
+				{GPA: base + 3*page, Size: page, Perms: MemRead | MemWrite, Label: "heap", Committed: page},
+			},
+		},
+		{
+			name:  "tail",
+			gpa:   base + 3*page,
+			size:  page,
+			perms: MemRead | MemExec,
+			want: []Region{
+				{GPA: base, Size: 3 * page, Perms: MemRead | MemWrite, Label: "heap", Committed: 3 * page},
+				{GPA: base + 3*page, Size: page, Perms: MemRead | MemExec, Label: "heap", Committed: page},
+			},
+		},
+		{
+			name:    "partly unmapped",
+			gpa:     base + 3*page,
+			size:    2 * page,
+			perms:   MemRead,
+			wantErr: ErrMemoryNotMapped,
+		},
+		{
+			name:    "unaligned",
+			gpa:     base + 1,
+			size:    page,
+			perms:   MemRead,
+			wantErr: ErrInvalidAlignment,
+		},
+		{
+			name:    "invalid permissions",
+			gpa:     base,
+			size:    page,
+			perms:   0x10,
+			wantErr: errAny,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm, backend := newFakeVM(t)
+			if err := vm.MapLabeled(alignedBuffer(t, int(4*page)), base, MemRead|MemWrite, "heap"); err != nil {
+				t.Fatal(err)
+			}
+
+			err := vm.Protect(tt.gpa, tt.size, tt.perms)
+			if tt.wantErr != nil {
+				if err == nil {
+					t.Fatal("Protect succeeded, want an error")
+				}
+				if tt.wantErr != errAny && !errors.Is(err, tt.wantErr) {
+					t.Errorf("Protect error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Protect failed: %v", err)
+			}
+
+			got := vm.Regions()
+			for i := range got {
+				got[i].Host = nil
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Regions = %v, want %v", got, tt.want)
+			}
+			for _, m := range backend.Mappings() {
+				inside := m.GuestPhys >= tt.gpa && m.GuestPhys < tt.gpa+tt.size
+				if inside && m.Perms != tt.perms {
+					t.Errorf("backend page 0x%x perms = %v, want %v", m.GuestPhys, m.Perms, tt.perms)
+				}
+			}
+		})
+	}
+}
+
+func TestPermissionFaultHandler(t *testing.T) {
+	vm, vcpu, data := newInterpVM(t,
+		0xD2800540, // movz x0, #0x2a
+		0xD2A00201, // movz x1, #0x10, lsl #16 (x1 = interpDataGPA)
+		0xF9000020, // str  x0, [x1]
+		0xD4200000, // brk  #0
+	)
+	page := uint64(pageSize())
+	if err := vm.Protect(interpDataGPA, page, MemRead); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a handler the fault is returned.
+	info, err := vcpu.Run()
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	da, ok := info.DataAbort()
+	if !ok || !da.DFSC.IsPermission() || !da.WnR || info.IPA != interpDataGPA {
+		t.Fatalf("exit = %v, want a write permission fault at 0x%x", info, interpDataGPA)
+	}
+
+	// A handler that grants the access lets the store complete.
+	var faults []PermissionFault
+	vm.SetPermissionFaultHandler(func(c *VCPU, f PermissionFault) bool {
+		faults = append(faults, f)
+		return c == vcpu && vm.Protect(f.Region.GPA, f.Region.Size, f.Region.Perms|f.Access) == nil
+	})
+	info, err = vcpu.Run()
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if info.Class() != ECBRK {
+		t.Fatalf("exit = %v, want BRK", info)
+	}
+	if data[0] != 0x2a {
+		t.Errorf("data[0] = 0x%x, want 0x2a", data[0])
+	}
+	if len(faults) != 1 {
+		t.Fatalf("handler called %d times, want 1", len(faults))
+	}
+	f := faults[0]
+	if f.GPA != interpDataGPA || f.Access != MemWrite || f.Region.Perms != MemRead {
+		t.Errorf("fault = %+v, want a write at 0x%x to a read-only region", f, interpDataGPA)
+	}
+
+	// Execute permission is enforced too; declining returns the abort.
+	if err := vm.Protect(interpCodeGPA, page, MemRead); err != nil {
+		t.Fatal(err)
+	}
+	if err := vcpu.SetPC(interpCodeGPA); err != nil {
+		t.Fatal(err)
+	}
+	faults = nil
+	vm.SetPermissionFaultHandler(func(_ *VCPU, f PermissionFault) bool {
+		faults = append(faults, f)
+		return false
+	})
+	info, err = vcpu.Run()
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if ia, ok := info.InstructionAbort(); !ok || !ia.IFSC.IsPermission() {
+		t.Errorf("exit = %v, want an instruction permission fault", info)
+	}
+	if len(faults) != 1 || faults[0].Access != MemExec {
+		t.Errorf("faults = %+v, want one exec fault", faults)
+	}
+
+	vm.SetPermissionFaultHandler(nil)
+	if _, err := vcpu.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if len(faults) != 1 {
+		t.Errorf("removed handler was called")
+	}
+}
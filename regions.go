@@ -0,0 +1,358 @@
+package hypervisor
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+)
+
+// Region describes one guest physical range mapped with VM.Map.
+type Region struct {
+	// GPA is the guest physical base address.
+	GPA uint64 `json:"gpa"`
+	// Size is the length of the range in bytes.
+	Size uint64 `json:"size"`
+	// Perms are the guest access permissions.
+	Perms MemPerm `json:"perms"`
+	// Label is the caller supplied name given to MapLabeled, if any.
+	Label string `json:"label,omitempty"`
+	// Sparse is set for regions allocated with AllocOptions.Sparse, whose
+	// pages are only backed once touched.
+	Sparse bool `json:"sparse,omitempty"`
+	// File is the name of the file mapped with MapFile, if any.
+	File string `json:"file,omitempty"`
+	// Committed is the number of bytes backed by memory: Size, or for a
+	// sparse region the pages touched so far, as of the call to Regions.
+	Committed uint64 `json:"committed"`
+	// Host is the host memory backing the range.
+	Host []byte `json:"-"`
+
+	readOnly bool // Host may not be written, as for a read-only MapFile
+}
+
+// End returns the first guest physical address after the region.
+func (r Region) End() uint64 { return r.GPA + r.Size }
+
+// Contains reports whether gpa lies inside the region.
+func (r Region) Contains(gpa uint64) bool { return gpa >= r.GPA && gpa < r.End() }
+
+// sub returns the part of the region in [lo, hi), which must lie inside it.
+func (r Region) sub(lo, hi uint64) Region {
+	s := r
+	s.GPA = lo
+	s.Size = hi - lo
+	s.Host = r.Host[lo-r.GPA : hi-r.GPA : hi-r.GPA]
+	s.Committed = 0
+	if !r.Sparse {
+		s.Committed = s.Size
+	}
+	return s
+}
+
+func (r Region) String() string {
+	s := fmt.Sprintf("0x%x-0x%x %v", r.GPA, r.End(), r.Perms)
+	if r.Label != "" {
+		s += " " + r.Label
+	}
+	if r.File != "" {
+		s += " (file " + r.File + ")"
+	}
+	if r.Sparse {
+		s += fmt.Sprintf(" (sparse, 0x%x committed)", r.Committed)
+	}
+	return s
+}
+
+func (p MemPerm) String() string {
+	b := []byte("---")
+	if p&MemRead != 0 {
+		b[0] = 'r'
+	}
+	if p&MemWrite != 0 {
+		b[1] = 'w'
+	}
+	if p&MemExec != 0 {
+		b[2] = 'x'
+	}
+	return string(b)
+}
+
+// regionTable tracks the host memory behind each mapped guest physical
+// range, independently of the backend, so the library can read guest memory
+// itself.
+type regionTable struct {
+	mu      sync.RWMutex
+	regions []Region       // sorted by GPA, non-overlapping
+	dirty   []*dirtyRange  // ranges with dirty tracking enabled
+	sparse  []*sparseRange // commitment of sparse regions
+}
+
+// find returns the index of the first region ending after gpa.
+func (t *regionTable) find(gpa uint64) int {
+	return sort.Search(len(t.regions), func(i int) bool { return t.regions[i].End() > gpa })
+}
+
+// overlapLocked returns a region intersecting [gpa, gpa+size).
+func (t *regionTable) overlapLocked(gpa, size uint64) (Region, bool) {
+	i := t.find(gpa)
+	if i < len(t.regions) && t.regions[i].GPA < gpa+size {
+		return t.regions[i], true
+	}
+	return Region{}, false
+}
+
+// insertLocked records a mapping the backend has accepted.
+func (t *regionTable) insertLocked(r Region) {
+	i := sort.Search(len(t.regions), func(i int) bool { return t.regions[i].GPA >= r.GPA })
+	t.regions = append(t.regions, Region{})
+	copy(t.regions[i+1:], t.regions[i:])
+	t.regions[i] = r
+}
+
+// removeLocked drops [gpa, gpa+size), splitting regions that only partly
+// overlap the range. It returns the number of mapped and committed bytes
+// dropped.
+func (t *regionTable) removeLocked(gpa, size uint64) (reserved, committed uint64) {
+	end := gpa + size
+	kept := t.regions[:0:0]
+	for _, r := range t.regions {
+		if r.End() <= gpa || r.GPA >= end {
+			kept = append(kept, r)
+			continue
+		}
+		part := r.sub(max(r.GPA, gpa), min(r.End(), end))
+		reserved += part.Size
+		committed += t.committedLocked(part)
+		if r.GPA < gpa {
+			kept = append(kept, r.sub(r.GPA, gpa))
+		}
+		if r.End() > end {
+			kept = append(kept, r.sub(end, r.End()))
+		}
+	}
+	t.regions = kept
+	t.dropSparseLocked(gpa, size)
+	return reserved, committed
+}
+
+// coveredLocked reports whether every byte of [gpa, gpa+size) is mapped.
+func (t *regionTable) coveredLocked(gpa, size uint64) bool {
+	end := gpa + size
+	for i := t.find(gpa); gpa < end; i++ {
+		if i == len(t.regions) || !t.regions[i].Contains(gpa) {
+			return false
+		}
+		gpa = t.regions[i].End()
+	}
+	return true
+}
+
+// protectLocked sets the permissions of [gpa, gpa+size), splitting regions
+// that only partly overlap the range.
+func (t *regionTable) protectLocked(gpa, size uint64, perms MemPerm) {
+	end := gpa + size
+	kept := t.regions[:0:0]
+	for _, r := range t.regions {
+		if r.End() <= gpa || r.GPA >= end {
+			kept = append(kept, r)
+			continue
+		}
+		lo, hi := max(r.GPA, gpa), min(r.End(), end)
+		if r.GPA < lo {
+			kept = append(kept, r.sub(r.GPA, lo))
+		}
+		mid := r.sub(lo, hi)
+		mid.Perms = perms
+		kept = append(kept, mid)
+		if r.End() > hi {
+			kept = append(kept, r.sub(hi, r.End()))
+		}
+	}
+	t.regions = kept
+}
+
+// lookup returns the region containing gpa.
+func (t *regionTable) lookup(gpa uint64) (Region, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	r, ok := t.lookupLocked(gpa)
+	r.Committed = t.committedLocked(r)
+	return r, ok
+}
+
+func (t *regionTable) lookupLocked(gpa uint64) (Region, bool) {
+	i := t.find(gpa)
+	if i == len(t.regions) || !t.regions[i].Contains(gpa) {
+		return Region{}, false
+	}
+	return t.regions[i], true
+}
+
+// clear forgets every region and returns the number of bytes they mapped
+// and committed.
+func (t *regionTable) clear() (reserved, committed uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, r := range t.regions {
+		reserved += r.Size
+		committed += t.committedLocked(r)
+	}
+	t.regions = nil
+	t.dirty = nil
+	t.sparse = nil
+	return reserved, committed
+}
+
+// list returns a copy of the regions in address order.
+func (t *regionTable) list() []Region {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	regions := append([]Region(nil), t.regions...)
+	for i := range regions {
+		regions[i].Committed = t.committedLocked(regions[i])
+	}
+	return regions
+}
+
+// slice returns the n host bytes backing gpa if they lie in a single region
+// whose permissions include perms.
+func (t *regionTable) slice(gpa uint64, n int, perms MemPerm) ([]byte, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	i := t.find(gpa)
+	if i == len(t.regions) || !t.regions[i].Contains(gpa) {
+		return nil, false
+	}
+	r := t.regions[i]
+	off := gpa - r.GPA
+	if r.Perms&perms != perms || uint64(n) > r.Size-off {
+		return nil, false
+	}
+	return r.Host[off : off+uint64(n)], true
+}
+
+// copyAt copies between p and guest memory starting at gpa, crossing region
+// boundaries as long as the regions are contiguous. It returns the number of
+// bytes copied before a hole or, for a write, a read-only region.
+func (t *regionTable) copyAt(p []byte, gpa uint64, write bool) (int, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	n := 0
+	for i := t.find(gpa); n < len(p); i++ {
+		addr := gpa + uint64(n)
+		if i == len(t.regions) || !t.regions[i].Contains(addr) {
+			return n, fmt.Errorf("%w at 0x%x", ErrMemoryNotMapped, addr)
+		}
+		host := t.regions[i].Host[addr-t.regions[i].GPA:]
+		if write {
+			// Security: Writing to a read-only host mapping would fault
+			if t.regions[i].readOnly {
+				return n, fmt.Errorf("hv: 0x%x is mapped read-only from %s", addr, t.regions[i].File)
+			}
+			c := copy(host, p[n:])
+			t.markDirtyLocked(addr, uint64(c))
+			n += c
+		} else {
+			n += copy(p[n:], host)
+		}
+	}
+	return n, nil
+}
+
+// Regions returns the current guest physical memory map in address order.
+func (vm *VM) Regions() []Region {
+	if vm == nil {
+		return nil
+	}
+	return vm.regions.list()
+}
+
+// ReadAt reads len(p) bytes of guest physical memory starting at off. It
+// implements io.ReaderAt; reads may span adjacent regions. If part of the
+// range is not mapped, ReadAt returns the bytes read before the hole and an
+// error wrapping ErrMemoryNotMapped.
+func (vm *VM) ReadAt(p []byte, off int64) (int, error) {
+	return vm.copyAt(p, off, false)
+}
+
+// WriteAt writes p to guest physical memory starting at off. It implements
+// io.WriterAt; writes may span adjacent regions and ignore guest
+// permissions. If part of the range is not mapped, WriteAt stops at the hole
+// and returns an error wrapping ErrMemoryNotMapped; it also stops at a file
+// MapFile mapped read-only.
+func (vm *VM) WriteAt(p []byte, off int64) (int, error) {
+	return vm.copyAt(p, off, true)
+}
+
+func (vm *VM) copyAt(p []byte, off int64, write bool) (int, error) {
+	op := "read"
+	if write {
+		op = "write"
+	}
+	if vm == nil {
+		return 0, &OpError{Op: op, Err: errVMNil}
+	}
+	if off < 0 {
+		return 0, &OpError{Op: op, Err: fmt.Errorf("hv: negative guest address %d", off)}
+	}
+	gpa := uint64(off)
+	// Security: Prevent integer overflow vulnerabilities
+	if gpa > math.MaxUint64-uint64(len(p)) {
+		vm.metrics.recordSecurityError()
+		return 0, &OpError{Op: op, GPA: gpa, Size: uint64(len(p)), Err: errRangeOverflow}
+	}
+
+	if err := vm.commitRange(gpa, uint64(len(p)), write); err != nil {
+		return 0, &OpError{Op: op, GPA: gpa, Size: uint64(len(p)), Err: err}
+	}
+	n, err := vm.regions.copyAt(p, gpa, write)
+	if err != nil {
+		return n, &OpError{Op: op, GPA: gpa, Size: uint64(len(p)), Err: err}
+	}
+	return n, nil
+}
+
+// Slice returns the host memory backing [gpa, gpa+size). The range must lie
+// within a single region. The slice aliases guest memory and is only valid
+// until the range is unmapped.
+func (vm *VM) Slice(gpa, size uint64) ([]byte, error) {
+	b, err := vm.slice(gpa, size)
+	if err != nil {
+		return nil, &OpError{Op: "slice", GPA: gpa, Size: size, Err: err}
+	}
+	return b, nil
+}
+
+func (vm *VM) slice(gpa, size uint64) ([]byte, error) {
+	if vm == nil {
+		return nil, errVMNil
+	}
+	if size == 0 {
+		return nil, fmt.Errorf("hv: zero size")
+	}
+	// Security: Prevent integer overflow vulnerabilities
+	if gpa > math.MaxUint64-size {
+		vm.metrics.recordSecurityError()
+		return nil, errRangeOverflow
+	}
+
+	vm.regions.mu.RLock()
+	defer vm.regions.mu.RUnlock()
+
+	i := vm.regions.find(gpa)
+	if i == len(vm.regions.regions) || !vm.regions.regions[i].Contains(gpa) {
+		return nil, ErrMemoryNotMapped
+	}
+	r := vm.regions.regions[i]
+	if gpa+size > r.End() {
+		return nil, fmt.Errorf("hv: range extends past region %v", r)
+	}
+	off := gpa - r.GPA
+	return r.Host[off : off+size : off+size], nil
+}
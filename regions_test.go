@@ -0,0 +1,127 @@
+package hypervisor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+)
+
+var (
+	_ io.ReaderAt = (*VM)(nil)
+	_ io.WriterAt = (*VM)(nil)
+)
+
+func TestRegions(t *testing.T) {
+	vm, _ := newFakeVM(t)
+	page := uint64(os.Getpagesize())
+
+	code := alignedBuffer(t, int(page))
+	data := alignedBuffer(t, int(2*page))
+	if err := vm.MapLabeled(code, 0x10000, MemRead|MemExec, "code"); err != nil {
+		t.Fatalf("MapLabeled failed: %v", err)
+	}
+	if err := vm.MapLabeled(data, 0x10000+page, MemRead|MemWrite, "data"); err != nil {
+		t.Fatalf("MapLabeled failed: %v", err)
+	}
+
+	t.Run("overlap rejected", func(t *testing.T) {
+		if err := vm.Map(alignedBuffer(t, int(page)), 0x10000+page, MemRead); err == nil {
+			t.Error("Expected error mapping over an existing region")
+		}
+		if got := len(vm.Regions()); got != 2 {
+			t.Errorf("len(Regions()) = %d, want 2", got)
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		want := []Region{
+			{GPA: 0x10000, Size: page, Perms: MemRead | MemExec, Label: "code"},
+			{GPA: 0x10000 + page, Size: 2 * page, Perms: MemRead | MemWrite, Label: "data"},
+		}
+		got := vm.Regions()
+		if len(got) != len(want) {
+			t.Fatalf("Regions() = %v, want %v", got, want)
+		}
+		for i := range want {
+			g := got[i]
+			if g.GPA != want[i].GPA || g.Size != want[i].Size || g.Perms != want[i].Perms || g.Label != want[i].Label {
+				t.Errorf("region %d = %v, want %v", i, g, want[i])
+			}
+		}
+		if s, want := got[0].String(), fmt.Sprintf("0x10000-0x%x r-x code", 0x10000+page); s != want {
+			t.Errorf("String() = %q, want %q", s, want)
+		}
+	})
+
+	t.Run("read and write across regions", func(t *testing.T) {
+		msg := []byte("spans two regions")
+		gpa := int64(0x10000 + page - 5)
+		if n, err := vm.WriteAt(msg, gpa); err != nil || n != len(msg) {
+			t.Fatalf("WriteAt = %d, %v", n, err)
+		}
+		if !bytes.Equal(code[page-5:], msg[:5]) || !bytes.Equal(data[:len(msg)-5], msg[5:]) {
+			t.Error("WriteAt did not update both host buffers")
+		}
+		got := make([]byte, len(msg))
+		if n, err := vm.ReadAt(got, gpa); err != nil || n != len(msg) || !bytes.Equal(got, msg) {
+			t.Errorf("ReadAt = %d, %q, %v, want %q", n, got, err, msg)
+		}
+	})
+
+	t.Run("holes", func(t *testing.T) {
+		end := int64(0x10000 + 3*page)
+		buf := make([]byte, 8)
+		n, err := vm.ReadAt(buf, end-4)
+		if n != 4 || !errors.Is(err, ErrMemoryNotMapped) {
+			t.Errorf("ReadAt past end = %d, %v, want 4 and ErrMemoryNotMapped", n, err)
+		}
+		if _, err := vm.WriteAt(buf, 0x1000); !errors.Is(err, ErrMemoryNotMapped) {
+			t.Errorf("WriteAt unmapped = %v, want ErrMemoryNotMapped", err)
+		}
+		if _, err := vm.ReadAt(buf, -1); err == nil {
+			t.Error("Expected error for negative offset")
+		}
+	})
+
+	t.Run("slice", func(t *testing.T) {
+		s, err := vm.Slice(0x10000+page+8, 8)
+		if err != nil {
+			t.Fatalf("Slice failed: %v", err)
+		}
+		s[0] = 0xAA
+		if data[8] != 0xAA {
+			t.Error("Slice does not alias host memory")
+		}
+		if _, err := vm.Slice(0x10000+page-4, 8); err == nil {
+			t.Error("Expected error for slice spanning regions")
+		}
+		if _, err := vm.Slice(0x1000, 8); !errors.Is(err, ErrMemoryNotMapped) {
+			t.Errorf("Slice unmapped = %v, want ErrMemoryNotMapped", err)
+		}
+	})
+
+	t.Run("unmap splits regions", func(t *testing.T) {
+		if err := vm.Unmap(0x10000+page, page); err != nil {
+			t.Fatalf("Unmap failed: %v", err)
+		}
+		got := vm.Regions()
+		if len(got) != 2 || got[1].GPA != 0x10000+2*page || got[1].Size != page || got[1].Label != "data" {
+			t.Errorf("Regions() after Unmap = %v", got)
+		}
+		if err := vm.Unmap(0x10000+page, page); !errors.Is(err, ErrMemoryNotMapped) {
+			t.Errorf("second Unmap = %v, want ErrMemoryNotMapped", err)
+		}
+	})
+
+	t.Run("close forgets regions", func(t *testing.T) {
+		if err := vm.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+		if got := vm.Regions(); len(got) != 0 {
+			t.Errorf("Regions() after Close = %v", got)
+		}
+	})
+}
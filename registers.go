@@ -1,19 +1,22 @@
-//go:build darwin && arm64
-
 package hypervisor
 
-/*
-#cgo darwin LDFLAGS: -framework Hypervisor
-#include <Hypervisor/hv_vcpu.h>
-#include <Hypervisor/hv_vcpu_types.h>
-*/
-import "C"
-
-import "fmt"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
 
 func (c *VCPU) GetReg(r Reg) (uint64, error) {
+	v, err := c.getReg(r)
+	if err != nil {
+		return 0, &OpError{Op: "get register", Reg: r.String(), Err: err}
+	}
+	return v, nil
+}
+
+func (c *VCPU) getReg(r Reg) (uint64, error) {
 	if c == nil {
-		return 0, fmt.Errorf("hv: VCPU is nil")
+		return 0, errVCPUNil
 	}
 
 	// Security: Lock to prevent use-after-free
@@ -21,41 +24,82 @@ func (c *VCPU) GetReg(r Reg) (uint64, error) {
 	defer c.closeMu.Unlock()
 
 	if c.closed {
-		return 0, fmt.Errorf("hv: VCPU is closed")
+		return 0, ErrVCPUClosed
+	}
+	if c.running {
+		return 0, ErrVCPURunning
 	}
 
 	// Security: Enhanced register bounds validation
-	if r < RegX0 || r > RegCPSR {
-		return 0, fmt.Errorf("hv: invalid register %d (must be %d-%d)", r, RegX0, RegCPSR)
+	if r < RegX0 || r >= regCount {
+		c.metrics.recordSecurityError()
+		return 0, fmt.Errorf("%w (must be %d-%d)", ErrInvalidRegister, RegX0, regCount-1)
 	}
 
-	var val C.ulonglong
-	var ret C.hv_return_t
+	val, err := c.impl.GetReg(r)
+	if err != nil {
+		c.metrics.recordResourceError()
+		return 0, err
+	}
 
-	// Use system register API for SP
-	if r == RegSP {
-		ret = C.hv_vcpu_get_sys_reg(C.hv_vcpu_t(c.id), C.HV_SYS_REG_SP_EL0, &val)
-	} else {
-		// Security: Additional validation for register mapping
-		hvReg := regToHV(r)
-		if hvReg == C.HV_REG_X0 && r != RegX0 {
-			return 0, fmt.Errorf("hv: register mapping failed for %d", r)
-		}
-		ret = C.hv_vcpu_get_reg(C.hv_vcpu_t(c.id), hvReg, &val)
+	c.metrics.recordRegisterOp()
+	return val, nil
+}
+
+func (c *VCPU) SetReg(r Reg, v uint64) error {
+	if err := c.setReg(r, v); err != nil {
+		return &OpError{Op: "set register", Reg: r.String(), Err: err}
 	}
+	c.vm.notify(func(o Observer) { o.RegisterWritten(c, RegWrite{Kind: RegKindGeneral, Reg: r, Value: v}) })
+	return nil
+}
 
-	if err := hvErr(ret); err != nil {
-		recordResourceError()
-		return 0, fmt.Errorf("failed to get register %d: %w", r, err)
+func (c *VCPU) setReg(r Reg, v uint64) error {
+	if c == nil {
+		return errVCPUNil
 	}
 
-	recordRegisterOp()
-	return uint64(val), nil
+	// Security: Lock to prevent use-after-free
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+
+	if c.closed {
+		return ErrVCPUClosed
+	}
+	if c.running {
+		return ErrVCPURunning
+	}
+
+	// Security: Enhanced register bounds validation
+	if r < RegX0 || r >= regCount {
+		c.metrics.recordSecurityError()
+		return fmt.Errorf("%w (must be %d-%d)", ErrInvalidRegister, RegX0, regCount-1)
+	}
+
+	if err := c.impl.SetReg(r, v); err != nil {
+		c.metrics.recordResourceError()
+		return err
+	}
+
+	c.metrics.recordRegisterOp()
+	return nil
 }
 
-func (c *VCPU) SetReg(r Reg, v uint64) error {
+func (c *VCPU) GetPC() (uint64, error) { return c.GetReg(RegPC) }
+func (c *VCPU) SetPC(v uint64) error   { return c.SetReg(RegPC, v) }
+
+// GetSysReg reads one of the system registers listed by SysRegs.
+func (c *VCPU) GetSysReg(r SysReg) (uint64, error) {
+	v, err := c.getSysReg(r)
+	if err != nil {
+		return 0, &OpError{Op: "get register", Reg: r.String(), Err: err}
+	}
+	return v, nil
+}
+
+func (c *VCPU) getSysReg(r SysReg) (uint64, error) {
 	if c == nil {
-		return fmt.Errorf("hv: VCPU is nil")
+		return 0, errVCPUNil
 	}
 
 	// Security: Lock to prevent use-after-free
@@ -63,39 +107,140 @@ func (c *VCPU) SetReg(r Reg, v uint64) error {
 	defer c.closeMu.Unlock()
 
 	if c.closed {
-		return fmt.Errorf("hv: VCPU is closed")
+		return 0, ErrVCPUClosed
+	}
+	if c.running {
+		return 0, ErrVCPURunning
+	}
+	if !r.Valid() {
+		return 0, ErrInvalidRegister
 	}
 
-	// Security: Enhanced register bounds validation
-	if r < RegX0 || r > RegCPSR {
-		return fmt.Errorf("hv: invalid register %d (must be %d-%d)", r, RegX0, RegCPSR)
+	val, err := c.impl.GetSysReg(r)
+	if err != nil {
+		c.metrics.recordResourceError()
+		return 0, err
 	}
 
-	var ret C.hv_return_t
+	c.metrics.recordRegisterOp()
+	return val, nil
+}
 
-	// Use system register API for SP
-	if r == RegSP {
-		ret = C.hv_vcpu_set_sys_reg(C.hv_vcpu_t(c.id), C.HV_SYS_REG_SP_EL0, C.ulonglong(v))
-	} else {
-		// Security: Additional validation for register mapping
-		hvReg := regToHV(r)
-		if hvReg == C.HV_REG_X0 && r != RegX0 {
-			return fmt.Errorf("hv: register mapping failed for %d", r)
-		}
-		ret = C.hv_vcpu_set_reg(C.hv_vcpu_t(c.id), hvReg, C.ulonglong(v))
+// SetSysReg writes one of the system registers listed by SysRegs. Whether
+// identification registers can be changed depends on the backend.
+func (c *VCPU) SetSysReg(r SysReg, v uint64) error {
+	if err := c.setSysReg(r, v); err != nil {
+		return &OpError{Op: "set register", Reg: r.String(), Err: err}
+	}
+	c.vm.notify(func(o Observer) { o.RegisterWritten(c, RegWrite{Kind: RegKindSystem, Sys: r, Value: v}) })
+	return nil
+}
+
+func (c *VCPU) setSysReg(r SysReg, v uint64) error {
+	if c == nil {
+		return errVCPUNil
+	}
+
+	// Security: Lock to prevent use-after-free
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+
+	if c.closed {
+		return ErrVCPUClosed
+	}
+	if c.running {
+		return ErrVCPURunning
+	}
+	if !r.Valid() {
+		return ErrInvalidRegister
 	}
 
-	if err := hvErr(ret); err != nil {
-		recordResourceError()
-		return fmt.Errorf("failed to set register %d: %w", r, err)
+	if err := c.impl.SetSysReg(r, v); err != nil {
+		c.metrics.recordResourceError()
+		return err
 	}
 
-	recordRegisterOp()
+	c.metrics.recordRegisterOp()
 	return nil
 }
 
-func (c *VCPU) GetPC() (uint64, error) { return c.GetReg(RegPC) }
-func (c *VCPU) SetPC(v uint64) error   { return c.SetReg(RegPC, v) }
+// GetSIMD reads a 128-bit SIMD&FP register. The bytes are in memory
+// order, so byte 0 is the least significant byte of the register.
+func (c *VCPU) GetSIMD(q SIMDReg) ([16]byte, error) {
+	v, err := c.getSIMD(q)
+	if err != nil {
+		return v, &OpError{Op: "get register", Reg: q.String(), Err: err}
+	}
+	return v, nil
+}
+
+func (c *VCPU) getSIMD(q SIMDReg) ([16]byte, error) {
+	if c == nil {
+		return [16]byte{}, errVCPUNil
+	}
+
+	// Security: Lock to prevent use-after-free
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+
+	if c.closed {
+		return [16]byte{}, ErrVCPUClosed
+	}
+	if c.running {
+		return [16]byte{}, ErrVCPURunning
+	}
+	if q < RegQ0 || q > RegQ31 {
+		c.metrics.recordSecurityError()
+		return [16]byte{}, fmt.Errorf("%w (must be %d-%d)", ErrInvalidRegister, RegQ0, RegQ31)
+	}
+
+	val, err := c.impl.GetSIMD(q)
+	if err != nil {
+		c.metrics.recordResourceError()
+		return [16]byte{}, err
+	}
+
+	c.metrics.recordRegisterOp()
+	return val, nil
+}
+
+// SetSIMD writes a 128-bit SIMD&FP register.
+func (c *VCPU) SetSIMD(q SIMDReg, v [16]byte) error {
+	if err := c.setSIMD(q, v); err != nil {
+		return &OpError{Op: "set register", Reg: q.String(), Err: err}
+	}
+	c.vm.notify(func(o Observer) { o.RegisterWritten(c, RegWrite{Kind: RegKindSIMD, SIMD: q, Vector: v}) })
+	return nil
+}
+
+func (c *VCPU) setSIMD(q SIMDReg, v [16]byte) error {
+	if c == nil {
+		return errVCPUNil
+	}
+
+	// Security: Lock to prevent use-after-free
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+
+	if c.closed {
+		return ErrVCPUClosed
+	}
+	if c.running {
+		return ErrVCPURunning
+	}
+	if q < RegQ0 || q > RegQ31 {
+		c.metrics.recordSecurityError()
+		return fmt.Errorf("%w (must be %d-%d)", ErrInvalidRegister, RegQ0, RegQ31)
+	}
+
+	if err := c.impl.SetSIMD(q, v); err != nil {
+		c.metrics.recordResourceError()
+		return err
+	}
+
+	c.metrics.recordRegisterOp()
+	return nil
+}
 
 // RegBatch represents a batch of register operations for performance
 type RegBatch map[Reg]uint64
@@ -104,7 +249,7 @@ type RegBatch map[Reg]uint64
 // Note: Currently implemented as individual calls, but foundation for batching
 func (c *VCPU) GetRegs(regs []Reg) (RegBatch, error) {
 	if c == nil {
-		return nil, fmt.Errorf("hv: VCPU is nil")
+		return nil, &OpError{Op: "get registers", Err: errVCPUNil}
 	}
 
 	batch := make(RegBatch, len(regs))
@@ -122,7 +267,7 @@ func (c *VCPU) GetRegs(regs []Reg) (RegBatch, error) {
 // Note: Currently implemented as individual calls, but foundation for batching
 func (c *VCPU) SetRegs(batch RegBatch) error {
 	if c == nil {
-		return fmt.Errorf("hv: VCPU is nil")
+		return &OpError{Op: "set registers", Err: errVCPUNil}
 	}
 
 	for reg, val := range batch {
@@ -133,77 +278,71 @@ func (c *VCPU) SetRegs(batch RegBatch) error {
 	return nil
 }
 
-// regToHV maps our Reg enum to the Hypervisor framework hv_reg_t constants.
-func regToHV(r Reg) C.hv_reg_t {
-	switch r {
-	case RegX0:
-		return C.HV_REG_X0
-	case RegX1:
-		return C.HV_REG_X1
-	case RegX2:
-		return C.HV_REG_X2
-	case RegX3:
-		return C.HV_REG_X3
-	case RegX4:
-		return C.HV_REG_X4
-	case RegX5:
-		return C.HV_REG_X5
-	case RegX6:
-		return C.HV_REG_X6
-	case RegX7:
-		return C.HV_REG_X7
-	case RegX8:
-		return C.HV_REG_X8
-	case RegX9:
-		return C.HV_REG_X9
-	case RegX10:
-		return C.HV_REG_X10
-	case RegX11:
-		return C.HV_REG_X11
-	case RegX12:
-		return C.HV_REG_X12
-	case RegX13:
-		return C.HV_REG_X13
-	case RegX14:
-		return C.HV_REG_X14
-	case RegX15:
-		return C.HV_REG_X15
-	case RegX16:
-		return C.HV_REG_X16
-	case RegX17:
-		return C.HV_REG_X17
-	case RegX18:
-		return C.HV_REG_X18
-	case RegX19:
-		return C.HV_REG_X19
-	case RegX20:
-		return C.HV_REG_X20
-	case RegX21:
-		return C.HV_REG_X21
-	case RegX22:
-		return C.HV_REG_X22
-	case RegX23:
-		return C.HV_REG_X23
-	case RegX24:
-		return C.HV_REG_X24
-	case RegX25:
-		return C.HV_REG_X25
-	case RegX26:
-		return C.HV_REG_X26
-	case RegX27:
-		return C.HV_REG_X27
-	case RegX28:
-		return C.HV_REG_X28
-	case RegFP:
-		return C.HV_REG_FP
-	case RegLR:
-		return C.HV_REG_LR
-	case RegPC:
-		return C.HV_REG_PC
-	case RegCPSR:
-		return C.HV_REG_CPSR
-	default:
-		// This should not happen due to validation in GetReg/SetReg
-		return C.HV_REG_X0
+// regNames are the names Reg.String returns and ParseReg accepts besides
+// X0-X30.
+var regNames = map[Reg]string{
+	RegFP:   "FP",
+	RegLR:   "LR",
+	RegSP:   "SP",
+	RegPC:   "PC",
+	RegCPSR: "CPSR",
+	RegFPCR: "FPCR",
+	RegFPSR: "FPSR",
+}
+
+func (r Reg) String() string {
+	if name, ok := regNames[r]; ok {
+		return name
+	}
+	if r >= RegX0 && r <= RegX28 {
+		return "X" + strconv.Itoa(int(r))
+	}
+	return fmt.Sprintf("Reg(%d)", int(r))
+}
+
+// ParseReg parses a register name such as "x0", "x29", "fp", "sp" or
+// "cpsr". Names are case-insensitive.
+func ParseReg(s string) (Reg, error) {
+	upper := strings.ToUpper(strings.TrimSpace(s))
+	for r, name := range regNames {
+		if name == upper {
+			return r, nil
+		}
+	}
+	if n, ok := parseIndexed(upper, "X", 30); ok {
+		return Reg(n), nil
+	}
+	return 0, fmt.Errorf("hv: unknown register %q", s)
+}
+
+func (q SIMDReg) String() string {
+	if q >= RegQ0 && q <= RegQ31 {
+		return "Q" + strconv.Itoa(int(q))
+	}
+	return fmt.Sprintf("SIMDReg(%d)", int(q))
+}
+
+// ParseSIMDReg parses a SIMD&FP register name from "q0" to "q31". The
+// "v" prefix is accepted as well.
+func ParseSIMDReg(s string) (SIMDReg, error) {
+	upper := strings.ToUpper(strings.TrimSpace(s))
+	for _, prefix := range []string{"Q", "V"} {
+		if n, ok := parseIndexed(upper, prefix, 31); ok {
+			return SIMDReg(n), nil
+		}
+	}
+	return 0, fmt.Errorf("hv: unknown SIMD register %q", s)
+}
+
+// parseIndexed parses prefix followed by a decimal number no larger than max.
+func parseIndexed(s, prefix string, max int) (int, bool) {
+	digits, ok := strings.CutPrefix(s, prefix)
+	if !ok || digits == "" || (len(digits) > 1 && digits[0] == '0') {
+		return 0, false
+	}
+	n, err := strconv.Atoi(digits)
+	if err != nil || n < 0 || n > max {
+		return 0, false
 	}
+	return n, true
 }
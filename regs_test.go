@@ -130,77 +130,3 @@ func TestPCHelpers(t *testing.T) {
 		t.Errorf("PC helpers: got 0x%x, want approximately 0x%x", pc, testPC)
 	}
 }
-
-// Add String() method for better test output
-func (r Reg) String() string {
-	switch r {
-	case RegX0:
-		return "X0"
-	case RegX1:
-		return "X1"
-	case RegX2:
-		return "X2"
-	case RegX3:
-		return "X3"
-	case RegX4:
-		return "X4"
-	case RegX5:
-		return "X5"
-	case RegX6:
-		return "X6"
-	case RegX7:
-		return "X7"
-	case RegX8:
-		return "X8"
-	case RegX9:
-		return "X9"
-	case RegX10:
-		return "X10"
-	case RegX11:
-		return "X11"
-	case RegX12:
-		return "X12"
-	case RegX13:
-		return "X13"
-	case RegX14:
-		return "X14"
-	case RegX15:
-		return "X15"
-	case RegX16:
-		return "X16"
-	case RegX17:
-		return "X17"
-	case RegX18:
-		return "X18"
-	case RegX19:
-		return "X19"
-	case RegX20:
-		return "X20"
-	case RegX21:
-		return "X21"
-	case RegX22:
-		return "X22"
-	case RegX23:
-		return "X23"
-	case RegX24:
-		return "X24"
-	case RegX25:
-		return "X25"
-	case RegX26:
-		return "X26"
-	case RegX27:
-		return "X27"
-	case RegX28:
-		return "X28"
-	case RegFP:
-		return "FP"
-	case RegLR:
-		return "LR"
-	case RegPC:
-		return "PC"
-	case RegCPSR:
-		return "CPSR"
-	default:
-		return "Unknown"
-	}
-}
@@ -0,0 +1,189 @@
+package hypervisor
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// newSpinVM returns an interp vCPU counting X0 up to X1, which is set so
+// high that the guest never reaches the brk on its own.
+func newSpinVM(t *testing.T) *VCPU {
+	t.Helper()
+	_, vcpu, _ := newInterpVM(t,
+		0x91000400, // add  x0, x0, #1
+		0xEB01001F, // cmp  x0, x1
+		0x54FFFFC1, // b.ne -8
+		0xD4200000, // brk  #0
+	)
+	if err := vcpu.SetReg(RegX1, 1<<62); err != nil {
+		t.Fatalf("SetReg failed: %v", err)
+	}
+	return vcpu
+}
+
+func TestRunContextDeadline(t *testing.T) {
+	vcpu := newSpinVM(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	info, err := vcpu.RunContext(ctx)
+	if err != nil {
+		t.Fatalf("RunContext failed: %v", err)
+	}
+	if info.Reason != ExitCanceled {
+		t.Fatalf("exit = %v, want %v", info, ExitCanceled)
+	}
+
+	pc, _ := vcpu.GetPC()
+	if pc < interpCodeGPA || pc > interpCodeGPA+8 {
+		t.Errorf("PC = 0x%x, want inside the loop at 0x%x", pc, interpCodeGPA)
+	}
+	x0, _ := vcpu.GetReg(RegX0)
+	if x0 == 0 {
+		t.Error("X0 = 0, want the guest to have made progress")
+	}
+
+	// Resuming continues the same loop from where it was stopped.
+	if err := vcpu.SetReg(RegX1, x0+1000); err != nil {
+		t.Fatalf("SetReg failed: %v", err)
+	}
+	info, err = vcpu.Run()
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if _, ok := info.Breakpoint(); !ok {
+		t.Errorf("exit = %v, want brk", info)
+	}
+	if got, _ := vcpu.GetReg(RegX0); got != x0+1000 {
+		t.Errorf("X0 = %d, want %d", got, x0+1000)
+	}
+}
+
+func TestRunContextCanceled(t *testing.T) {
+	vcpu := newSpinVM(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	info, err := vcpu.RunContext(ctx)
+	if err != nil || info.Reason != ExitCanceled {
+		t.Fatalf("RunContext = %v, %v, want %v", info, err, ExitCanceled)
+	}
+	if pc, _ := vcpu.GetPC(); pc != interpCodeGPA {
+		t.Errorf("PC = 0x%x, want 0x%x", pc, uint64(interpCodeGPA))
+	}
+
+	// A canceled run must not leave an exit pending for the next one.
+	if err := vcpu.SetReg(RegX1, 3); err != nil {
+		t.Fatalf("SetReg failed: %v", err)
+	}
+	if info, err := vcpu.Run(); err != nil || info.Reason != ExitException {
+		t.Errorf("Run = %v, %v, want brk", info, err)
+	}
+}
+
+func TestRunContextBusy(t *testing.T) {
+	vcpu := newSpinVM(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := vcpu.RunContext(ctx)
+		done <- err
+	}()
+
+	// Wait for the guest to start, then check that it is left alone.
+	for {
+		if _, err := vcpu.GetReg(RegX0); errors.Is(err, ErrVCPURunning) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := vcpu.Run(); !errors.Is(err, ErrVCPURunning) {
+		t.Errorf("concurrent Run error = %v, want ErrVCPURunning", err)
+	}
+	if _, err := vcpu.SaveState(); !errors.Is(err, ErrVCPURunning) {
+		t.Errorf("SaveState error = %v, want ErrVCPURunning", err)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("RunContext failed: %v", err)
+	}
+	if _, err := vcpu.GetReg(RegX0); err != nil {
+		t.Errorf("GetReg after run = %v", err)
+	}
+}
+
+func TestCloseWhileRunning(t *testing.T) {
+	vcpu := newSpinVM(t)
+
+	done := make(chan ExitInfo, 1)
+	go func() {
+		info, _ := vcpu.Run()
+		done <- info
+	}()
+	for {
+		if _, err := vcpu.GetReg(RegX0); errors.Is(err, ErrVCPURunning) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	closed := make(chan error, 1)
+	go func() { closed <- vcpu.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Errorf("Close failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not interrupt the running guest")
+	}
+	if info := <-done; info.Reason != ExitCanceled {
+		t.Errorf("Run exit = %v, want %v", info, ExitCanceled)
+	}
+	if _, err := vcpu.GetReg(RegX0); err == nil {
+		t.Error("Expected error using a closed vCPU")
+	}
+}
+
+func TestRunLoopDeadline(t *testing.T) {
+	vcpu := newSpinVM(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	res, err := vcpu.RunLoop(ctx, Handlers{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("RunLoop error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if res.Reason != StopCanceled || res.Exit.Reason != ExitCanceled {
+		t.Errorf("result = %+v, want StopCanceled with a canceled exit", res)
+	}
+}
+
+func TestRunContextFake(t *testing.T) {
+	vm, err := NewVMWithBackend("fake")
+	if err != nil {
+		t.Fatalf("NewVMWithBackend failed: %v", err)
+	}
+	defer vm.Close()
+	vcpu, err := vm.NewVCPU()
+	if err != nil {
+		t.Fatalf("NewVCPU failed: %v", err)
+	}
+	defer vcpu.Close()
+
+	// An exit forced on an idle vCPU is stale and must be ignored.
+	if err := vcpu.impl.Exit(); err != nil {
+		t.Fatalf("Exit failed: %v", err)
+	}
+	info, err := vcpu.Run()
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if info.Reason != ExitException {
+		t.Errorf("exit = %v, want the queued brk", info)
+	}
+}
@@ -0,0 +1,157 @@
+package hypervisor
+
+import (
+	"context"
+	"fmt"
+)
+
+// Action tells RunLoop what to do after an ExitHandler returns.
+type Action int
+
+const (
+	// ActionResume re-enters the guest at the current PC. Handlers that
+	// change PC themselves should return ActionResume.
+	ActionResume Action = iota
+	// ActionSkip advances PC past the trapping instruction and re-enters
+	// the guest. HVC and SVC already report the following instruction as
+	// their return address, so for them it behaves like ActionResume.
+	ActionSkip
+	// ActionStop returns from RunLoop with StopHandler.
+	ActionStop
+)
+
+func (a Action) String() string {
+	switch a {
+	case ActionResume:
+		return "resume"
+	case ActionSkip:
+		return "skip"
+	case ActionStop:
+		return "stop"
+	}
+	return fmt.Sprintf("Action(%d)", int(a))
+}
+
+// ExitHandler handles one exception exit. It may read and modify vCPU
+// state before telling the loop how to continue. A non-nil error stops the
+// loop with StopError.
+type ExitHandler func(vcpu *VCPU, info ExitInfo) (Action, error)
+
+// Handlers maps exception classes to the handler RunLoop calls for them.
+type Handlers map[ExceptionClass]ExitHandler
+
+// StopReason describes why RunLoop returned.
+type StopReason int
+
+const (
+	// StopHandler means a handler returned ActionStop.
+	StopHandler StopReason = iota
+	// StopUnhandled means the vCPU exited with a class that has no handler,
+	// or for a reason other than an exception.
+	StopUnhandled
+	// StopError means Run or a handler failed.
+	StopError
+	// StopCanceled means the context was done.
+	StopCanceled
+)
+
+func (r StopReason) String() string {
+	switch r {
+	case StopHandler:
+		return "handler"
+	case StopUnhandled:
+		return "unhandled"
+	case StopError:
+		return "error"
+	case StopCanceled:
+		return "canceled"
+	}
+	return fmt.Sprintf("StopReason(%d)", int(r))
+}
+
+func (r StopReason) MarshalText() ([]byte, error) { return []byte(r.String()), nil }
+
+// RunResult reports how RunLoop ended.
+type RunResult struct {
+	// Reason is why the loop stopped.
+	Reason StopReason `json:"reason"`
+	// Exit is the last exit taken. For StopCanceled it may be the zero value
+	// if the guest never ran.
+	Exit ExitInfo `json:"exit"`
+	// Exits counts the exits taken, including the last one.
+	Exits uint64 `json:"exits"`
+}
+
+// RunLoop runs the vCPU and dispatches each exception exit to the handler
+// registered for its class until a handler stops the loop, an exit has no
+// handler, or ctx is done. Each run uses RunContext, so a guest that never
+// exits is forced out when ctx is done; the result then has StopCanceled and
+// an ExitCanceled exit, and the error wraps ctx.Err(). Errors are
+// *OpError values with Op "run loop", except those from RunContext itself.
+func (c *VCPU) RunLoop(ctx context.Context, handlers Handlers) (RunResult, error) {
+	var res RunResult
+	for {
+		if err := ctx.Err(); err != nil {
+			res.Reason = StopCanceled
+			return res, &OpError{Op: "run loop", Err: err}
+		}
+
+		info, err := c.RunContext(ctx)
+		if err != nil {
+			res.Reason = StopError
+			return res, err
+		}
+		res.Exit = info
+		res.Exits++
+
+		if info.Reason == ExitCanceled {
+			if err := ctx.Err(); err != nil {
+				res.Reason = StopCanceled
+				return res, &OpError{Op: "run loop", Err: err}
+			}
+		}
+
+		if info.Reason != ExitException {
+			res.Reason = StopUnhandled
+			return res, nil
+		}
+		handler := handlers[info.Class()]
+		if handler == nil {
+			res.Reason = StopUnhandled
+			return res, nil
+		}
+
+		action, err := handler(c, info)
+		if err != nil {
+			res.Reason = StopError
+			return res, &OpError{Op: "run loop", Err: fmt.Errorf("hv: %v handler failed: %w", info.Class(), err)}
+		}
+		switch action {
+		case ActionResume:
+		case ActionSkip:
+			if err := c.skipInstruction(info); err != nil {
+				res.Reason = StopError
+				return res, &OpError{Op: "run loop", Err: err}
+			}
+		case ActionStop:
+			res.Reason = StopHandler
+			return res, nil
+		default:
+			res.Reason = StopError
+			return res, &OpError{Op: "run loop", Err: fmt.Errorf("hv: %v handler returned invalid action %v", info.Class(), action)}
+		}
+	}
+}
+
+// skipInstruction moves PC past the instruction that caused info.
+func (c *VCPU) skipInstruction(info ExitInfo) error {
+	switch info.Class() {
+	case ECSVC, ECHVC:
+		return nil // PC already points past the call
+	}
+	pc, err := c.GetPC()
+	if err != nil {
+		return err
+	}
+	return c.SetPC(pc + uint64(info.InstructionLength()))
+}
@@ -0,0 +1,148 @@
+package hypervisor
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestRunLoop(t *testing.T) {
+	_, vcpu, _ := newInterpVM(t,
+		0xD4000022, // hvc  #1
+		0xD538FFE3, // mrs  x3, s3_0_c15_c15_7
+		0xD503207F, // wfi
+		0xD4000021, // svc  #1
+		0xD4200040, // brk  #2
+	)
+
+	var hvcs, svcs, waits int
+	handlers := Handlers{
+		ECHVC: func(v *VCPU, info ExitInfo) (Action, error) {
+			hvcs++
+			return ActionSkip, v.SetReg(RegX0, 0x1000)
+		},
+		ECSysReg: func(v *VCPU, info ExitInfo) (Action, error) {
+			trap, _ := info.SysRegTrap()
+			if !trap.Read || trap.Encoding() != 0xC7FF {
+				t.Errorf("unexpected trap %+v", trap)
+			}
+			return ActionSkip, v.SetReg(Reg(trap.Rt), 0xfeed)
+		},
+		ECWFx: func(v *VCPU, info ExitInfo) (Action, error) {
+			waits++
+			return ActionSkip, nil
+		},
+		ECSVC: func(v *VCPU, info ExitInfo) (Action, error) {
+			svcs++
+			return ActionResume, nil
+		},
+		ECBRK: func(v *VCPU, info ExitInfo) (Action, error) {
+			return ActionStop, nil
+		},
+	}
+
+	res, err := vcpu.RunLoop(context.Background(), handlers)
+	if err != nil {
+		t.Fatalf("RunLoop failed: %v", err)
+	}
+	if res.Reason != StopHandler || res.Exits != 5 {
+		t.Errorf("result = %+v, want StopHandler after 5 exits", res)
+	}
+	if brk, ok := res.Exit.Breakpoint(); !ok || brk.Comment != 2 {
+		t.Errorf("last exit = %v, want brk #2", res.Exit)
+	}
+	if hvcs != 1 || svcs != 1 || waits != 1 {
+		t.Errorf("hvc/svc/wfi handled %d/%d/%d times, want 1 each", hvcs, svcs, waits)
+	}
+	if pc, _ := vcpu.GetPC(); pc != interpCodeGPA+16 {
+		t.Errorf("PC = 0x%x, want 0x%x", pc, interpCodeGPA+16)
+	}
+	if x3, _ := vcpu.GetReg(RegX3); x3 != 0xfeed {
+		t.Errorf("X3 = 0x%x, want 0xfeed", x3)
+	}
+}
+
+func TestRunLoopStops(t *testing.T) {
+	t.Run("unhandled class", func(t *testing.T) {
+		_, vcpu, _ := newInterpVM(t, 0xD4200000) // brk #0
+		res, err := vcpu.RunLoop(context.Background(), nil)
+		if err != nil || res.Reason != StopUnhandled || res.Exit.Class() != ECBRK {
+			t.Errorf("RunLoop = %+v, %v, want unhandled brk", res, err)
+		}
+	})
+
+	t.Run("handler error", func(t *testing.T) {
+		_, vcpu, _ := newInterpVM(t, 0xD4200000)
+		boom := errors.New("boom")
+		res, err := vcpu.RunLoop(context.Background(), Handlers{
+			ECBRK: func(*VCPU, ExitInfo) (Action, error) { return ActionStop, boom },
+		})
+		if !errors.Is(err, boom) || res.Reason != StopError {
+			t.Errorf("RunLoop = %+v, %v, want StopError wrapping boom", res, err)
+		}
+	})
+
+	t.Run("invalid action", func(t *testing.T) {
+		_, vcpu, _ := newInterpVM(t, 0xD4200000)
+		res, err := vcpu.RunLoop(context.Background(), Handlers{
+			ECBRK: func(*VCPU, ExitInfo) (Action, error) { return Action(42), nil },
+		})
+		if err == nil || res.Reason != StopError {
+			t.Errorf("RunLoop = %+v, %v, want StopError", res, err)
+		}
+	})
+
+	t.Run("canceled context", func(t *testing.T) {
+		_, vcpu, _ := newInterpVM(t, 0xD4200000)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		res, err := vcpu.RunLoop(ctx, nil)
+		if !errors.Is(err, context.Canceled) || res.Reason != StopCanceled || res.Exits != 0 {
+			t.Errorf("RunLoop = %+v, %v, want StopCanceled before running", res, err)
+		}
+	})
+
+	t.Run("non-exception exit", func(t *testing.T) {
+		vm, fake := newFakeVM(t)
+		vcpu, err := vm.NewVCPU()
+		if err != nil {
+			t.Fatalf("NewVCPU failed: %v", err)
+		}
+		defer vcpu.Close()
+		fake.QueueExit(ExitInfo{Reason: ExitTimer})
+		res, err := vcpu.RunLoop(context.Background(), Handlers{})
+		if err != nil || res.Reason != StopUnhandled || res.Exit.Reason != ExitTimer {
+			t.Errorf("RunLoop = %+v, %v, want unhandled vtimer exit", res, err)
+		}
+	})
+}
+
+func TestRunLoopSkip(t *testing.T) {
+	vm, fake := newFakeVM(t)
+	vcpu, err := vm.NewVCPU()
+	if err != nil {
+		t.Fatalf("NewVCPU failed: %v", err)
+	}
+	defer vcpu.Close()
+	if err := vcpu.SetPC(0x4000); err != nil {
+		t.Fatalf("SetPC failed: %v", err)
+	}
+
+	// SMC reports the trapping instruction and must be skipped; HVC already
+	// points past itself and must not be.
+	fake.QueueExit(
+		ExitInfo{Reason: ExitException, ESR: uint64(ECSMC)<<26 | 1<<25},
+		ExitInfo{Reason: ExitException, ESR: uint64(ECHVC)<<26 | 1<<25},
+	)
+	skip := func(*VCPU, ExitInfo) (Action, error) { return ActionSkip, nil }
+	res, err := vcpu.RunLoop(context.Background(), Handlers{ECSMC: skip, ECHVC: skip})
+	if err != nil {
+		t.Fatalf("RunLoop failed: %v", err)
+	}
+	if res.Exits != 3 || res.Exit.Class() != ECBRK {
+		t.Errorf("result = %+v, want BRK after 3 exits", res)
+	}
+	if pc, _ := vcpu.GetPC(); pc != 0x4004 {
+		t.Errorf("PC = 0x%x, want 0x4004", pc)
+	}
+}
@@ -0,0 +1,427 @@
+package hypervisor
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math"
+)
+
+// Snapshot container constants. See VM.Snapshot for the layout.
+const (
+	snapshotVersion   = 1
+	snapshotChunk     = 4096    // granularity of sparse page storage
+	snapshotMaxRegion = 1 << 16 // sanity limits applied when restoring
+	snapshotMaxSize   = 1 << 40 // memory across all regions
+	snapshotMaxVCPUs  = 1 << 10
+	snapshotMaxLabel  = 1 << 12
+	snapshotMaxState  = 1 << 16
+)
+
+var snapshotMagic = [8]byte{'H', 'V', 'S', 'N', 'A', 'P', '\r', '\n'}
+
+// Snapshot writes the VM's mapped memory and the state of every open vCPU
+// to w. vCPUs must not be running; Snapshot fails with ErrVCPURunning if
+// one is. MMIO devices are not saved and must be registered again after
+// RestoreVM.
+//
+// The container is little-endian:
+//
+//	header   magic "HVSNAP\r\n" | version u32 | regions u32 | vcpus u32
+//	regions  per region: gpa u64 | size u64 | perms u32 | label len u16 | label
+//	memory   per region: bitmap of ceil(size/4096/8) bytes, bit i set if
+//	         4 KiB page i is stored, then each stored page in order
+//	vcpus    per vCPU: state len u32 | CPUState.MarshalBinary
+//	trailer  crc32 (IEEE) of every preceding byte, u32
+//
+// All-zero pages are left out of the memory section, and sparse regions
+// are restored as ordinary regions, so their uncommitted pages cost
+// nothing to write and are backed lazily by the host after RestoreVM.
+// Pages a PageProvider has not supplied yet are fetched and committed
+// first, except those the guest may not access, such as guard pages, which
+// are saved as zero.
+func (vm *VM) Snapshot(w io.Writer) error {
+	if err := vm.snapshot(w); err != nil {
+		return &OpError{Op: "snapshot", Err: err}
+	}
+	return nil
+}
+
+func (vm *VM) snapshot(w io.Writer) error {
+	if vm == nil {
+		return errVMNil
+	}
+
+	// Security: Lock to keep Close from tearing the VM down meanwhile
+	vm.closeMu.Lock()
+	defer vm.closeMu.Unlock()
+
+	if vm.closed {
+		return ErrVMClosed
+	}
+
+	// Capture registers first: SaveState fails for running vCPUs.
+	var states [][]byte
+	for _, c := range vm.VCPUs() {
+		s, err := c.SaveState()
+		if err != nil {
+			return err
+		}
+		b, err := s.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		states = append(states, b)
+	}
+
+	// Fetch the pages providers have not supplied yet, so that their
+	// contents are saved rather than zero.
+	type span struct{ gpa, size uint64 }
+	var fetch []span
+	vm.regions.mu.RLock()
+	for _, s := range vm.regions.sparse {
+		if s.provider != nil {
+			fetch = append(fetch, span{s.gpa, s.size})
+		}
+	}
+	vm.regions.mu.RUnlock()
+	for _, f := range fetch {
+		if err := vm.commitRange(f.gpa, f.size, false); err != nil {
+			return err
+		}
+	}
+
+	vm.regions.mu.RLock()
+	defer vm.regions.mu.RUnlock()
+
+	sw := newSnapshotWriter(w)
+	sw.write(snapshotMagic[:])
+	sw.u32(snapshotVersion)
+	sw.u32(uint32(len(vm.regions.regions)))
+	sw.u32(uint32(len(states)))
+
+	for _, r := range vm.regions.regions {
+		if r.Size%snapshotChunk != 0 {
+			return fmt.Errorf("hv: region %v is not a multiple of %d bytes", r, snapshotChunk)
+		}
+		if len(r.Label) > snapshotMaxLabel {
+			return fmt.Errorf("hv: region %v label too long (max %d bytes)", r, snapshotMaxLabel)
+		}
+		sw.u64(r.GPA)
+		sw.u64(r.Size)
+		sw.u32(uint32(r.Perms))
+		sw.u16(uint16(len(r.Label)))
+		sw.write([]byte(r.Label))
+	}
+
+	var zero [snapshotChunk]byte
+	for _, r := range vm.regions.regions {
+		pages := int(r.Size / snapshotChunk)
+		bitmap := make([]byte, (pages+7)/8)
+		sparse := vm.regions.sparseLocked(r.GPA)
+		for i := 0; i < pages; i++ {
+			// Performance: Pages a sparse region never committed are zero
+			if r.Sparse && (sparse == nil || !sparse.isCommitted(r.GPA+uint64(i)*snapshotChunk)) {
+				continue
+			}
+			if !bytes.Equal(r.Host[i*snapshotChunk:(i+1)*snapshotChunk], zero[:]) {
+				bitmap[i/8] |= 1 << (i % 8)
+			}
+		}
+		sw.write(bitmap)
+		for i := 0; i < pages; i++ {
+			if bitmap[i/8]&(1<<(i%8)) != 0 {
+				sw.write(r.Host[i*snapshotChunk : (i+1)*snapshotChunk])
+			}
+		}
+	}
+
+	for _, b := range states {
+		sw.u32(uint32(len(b)))
+		sw.write(b)
+	}
+	if err := sw.finish(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// RestoreVM creates a VM on the default backend from a snapshot written by
+// VM.Snapshot. Memory is restored into host buffers the VM owns, freed as
+// for AllocRegion; vCPUs are recreated in their original order, available from
+// VM.VCPUs, with their registers reloaded. The whole snapshot is read and
+// its checksum verified before any VM is created.
+func RestoreVM(r io.Reader) (*VM, error) {
+	return RestoreVMWithBackend(DefaultBackend(), r)
+}
+
+// RestoreVMWithBackend is like RestoreVM but uses the named backend.
+func RestoreVMWithBackend(name string, r io.Reader) (*VM, error) {
+	vm, err := restoreVM(name, r)
+	if err != nil {
+		return nil, &OpError{Op: "restore snapshot", Err: err}
+	}
+	return vm, nil
+}
+
+func restoreVM(name string, r io.Reader) (*VM, error) {
+	regions, states, err := readSnapshot(r)
+	if err != nil {
+		for _, reg := range regions {
+			freeHost(reg.Host)
+		}
+		return nil, err
+	}
+
+	vm, err := NewVMWithBackend(name)
+	if err != nil {
+		for _, reg := range regions {
+			freeHost(reg.Host)
+		}
+		return nil, err
+	}
+	for _, reg := range regions {
+		vm.own(hostAlloc{mem: reg.Host})
+	}
+
+	for _, reg := range regions {
+		// Map needs some access, so guard pages and other regions without
+		// any are mapped readable and then protected.
+		perms := reg.Perms
+		if perms == 0 {
+			perms = MemRead
+		}
+		err := vm.MapLabeled(reg.Host, reg.GPA, perms, reg.Label)
+		if err == nil && reg.Perms == 0 {
+			err = vm.Protect(reg.GPA, reg.Size, 0)
+		}
+		if err != nil {
+			vm.Close()
+			return nil, err
+		}
+	}
+	for _, s := range states {
+		c, err := vm.NewVCPU()
+		if err == nil {
+			err = c.RestoreState(s)
+		}
+		if err != nil {
+			for _, c := range vm.VCPUs() {
+				c.Close()
+			}
+			vm.Close()
+			return nil, err
+		}
+	}
+	return vm, nil
+}
+
+// readSnapshot parses and checks a snapshot. Regions it returns own host
+// memory from reserveHost, even on error.
+func readSnapshot(r io.Reader) ([]Region, []*CPUState, error) {
+	sr := newSnapshotReader(r)
+
+	var magic [8]byte
+	sr.read(magic[:])
+	if sr.err != nil {
+		return nil, nil, sr.err
+	}
+	if magic != snapshotMagic {
+		return nil, nil, fmt.Errorf("hv: not a VM snapshot (bad magic)")
+	}
+	if v := sr.u32(); sr.err == nil && (v < 1 || v > snapshotVersion) {
+		return nil, nil, fmt.Errorf("hv: unsupported snapshot version %d (max %d)", v, snapshotVersion)
+	}
+	nregions, nvcpus := sr.u32(), sr.u32()
+	if sr.err != nil {
+		return nil, nil, sr.err
+	}
+
+	// Security: Bound counts and sizes before allocating anything
+	if nregions > snapshotMaxRegion || nvcpus > snapshotMaxVCPUs {
+		globalMetrics.recordSecurityError()
+		return nil, nil, fmt.Errorf("hv: snapshot has %d regions and %d vCPUs (max %d and %d)",
+			nregions, nvcpus, snapshotMaxRegion, snapshotMaxVCPUs)
+	}
+
+	// Security: Check every descriptor, and the memory they add up to,
+	// before reserving any of it
+	descs := make([]Region, 0, nregions)
+	var total, end uint64
+	for i := uint32(0); i < nregions; i++ {
+		reg := Region{GPA: sr.u64(), Size: sr.u64(), Perms: MemPerm(sr.u32())}
+		n := sr.u16()
+		if sr.err != nil {
+			return nil, nil, sr.err
+		}
+		if n > snapshotMaxLabel {
+			globalMetrics.recordSecurityError()
+			return nil, nil, fmt.Errorf("hv: region label too long (%d bytes)", n)
+		}
+		label := make([]byte, n)
+		sr.read(label)
+		reg.Label = string(label)
+		if sr.err != nil {
+			return nil, nil, sr.err
+		}
+		if reg.Size == 0 || reg.Size%snapshotChunk != 0 || reg.Size > snapshotMaxSize-total {
+			globalMetrics.recordSecurityError()
+			return nil, nil, fmt.Errorf("hv: invalid region size %d (max %d bytes in total)", reg.Size, snapshotMaxSize)
+		}
+		if reg.GPA%snapshotChunk != 0 || reg.GPA < end || reg.GPA > math.MaxUint64-reg.Size {
+			globalMetrics.recordSecurityError()
+			return nil, nil, fmt.Errorf("hv: invalid region %v: regions must be aligned, in order and not overlap", reg)
+		}
+		if reg.Perms&^(MemRead|MemWrite|MemExec) != 0 {
+			return nil, nil, fmt.Errorf("hv: invalid permission bits 0x%x in region %v", reg.Perms, reg)
+		}
+		total += reg.Size
+		end = reg.End()
+		descs = append(descs, reg)
+	}
+
+	var regions []Region
+	for _, reg := range descs {
+		// Performance: Reserve the memory, so pages left out cost nothing
+		// until touched
+		host, err := reserveHost(int(reg.Size))
+		if err != nil {
+			return regions, nil, fmt.Errorf("failed to allocate %d bytes for region %v: %w", reg.Size, reg, err)
+		}
+		reg.Host = host
+		regions = append(regions, reg)
+
+		pages := int(reg.Size / snapshotChunk)
+		bitmap := make([]byte, (pages+7)/8)
+		sr.read(bitmap)
+		for i := 0; i < pages && sr.err == nil; i++ {
+			if bitmap[i/8]&(1<<(i%8)) != 0 {
+				sr.read(host[i*snapshotChunk : (i+1)*snapshotChunk])
+			}
+		}
+		if sr.err != nil {
+			return regions, nil, sr.err
+		}
+	}
+
+	states := make([]*CPUState, 0, nvcpus)
+	for i := uint32(0); i < nvcpus; i++ {
+		n := sr.u32()
+		if sr.err == nil && n > snapshotMaxState {
+			globalMetrics.recordSecurityError()
+			return regions, nil, fmt.Errorf("hv: vCPU %d state too large (%d bytes)", i, n)
+		}
+		b := make([]byte, n)
+		sr.read(b)
+		if sr.err != nil {
+			return regions, nil, sr.err
+		}
+		s := new(CPUState)
+		if err := s.UnmarshalBinary(b); err != nil {
+			return regions, nil, fmt.Errorf("vCPU %d: %w", i, err)
+		}
+		states = append(states, s)
+	}
+
+	if err := sr.verify(); err != nil {
+		return regions, nil, err
+	}
+	return regions, states, nil
+}
+
+// snapshotWriter buffers and checksums little-endian output, keeping the
+// first error.
+type snapshotWriter struct {
+	w   *bufio.Writer
+	crc hash.Hash32
+	err error
+}
+
+func newSnapshotWriter(w io.Writer) *snapshotWriter {
+	return &snapshotWriter{w: bufio.NewWriter(w), crc: crc32.NewIEEE()}
+}
+
+func (s *snapshotWriter) write(p []byte) {
+	if s.err != nil {
+		return
+	}
+	s.crc.Write(p)
+	_, s.err = s.w.Write(p)
+}
+
+func (s *snapshotWriter) u16(v uint16) { s.write(binary.LittleEndian.AppendUint16(nil, v)) }
+func (s *snapshotWriter) u32(v uint32) { s.write(binary.LittleEndian.AppendUint32(nil, v)) }
+func (s *snapshotWriter) u64(v uint64) { s.write(binary.LittleEndian.AppendUint64(nil, v)) }
+
+// finish writes the checksum trailer and flushes.
+func (s *snapshotWriter) finish() error {
+	if s.err != nil {
+		return s.err
+	}
+	sum := s.crc.Sum32()
+	s.u32(sum)
+	if s.err != nil {
+		return s.err
+	}
+	return s.w.Flush()
+}
+
+// snapshotReader is the reading counterpart of snapshotWriter.
+type snapshotReader struct {
+	r   io.Reader
+	crc hash.Hash32
+	err error
+	buf [8]byte
+}
+
+func newSnapshotReader(r io.Reader) *snapshotReader {
+	return &snapshotReader{r: bufio.NewReader(r), crc: crc32.NewIEEE()}
+}
+
+// read fills p, or zeroes it once an error has occurred.
+func (s *snapshotReader) read(p []byte) {
+	if s.err == nil {
+		if _, err := io.ReadFull(s.r, p); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			s.err = fmt.Errorf("hv: truncated snapshot: %w", err)
+		} else {
+			s.crc.Write(p)
+			return
+		}
+	}
+	clear(p)
+}
+
+func (s *snapshotReader) u16() uint16 {
+	s.read(s.buf[:2])
+	return binary.LittleEndian.Uint16(s.buf[:2])
+}
+
+func (s *snapshotReader) u32() uint32 {
+	s.read(s.buf[:4])
+	return binary.LittleEndian.Uint32(s.buf[:4])
+}
+
+func (s *snapshotReader) u64() uint64 {
+	s.read(s.buf[:8])
+	return binary.LittleEndian.Uint64(s.buf[:8])
+}
+
+// verify reads the trailer and compares it with the checksum so far.
+func (s *snapshotReader) verify() error {
+	want := s.crc.Sum32()
+	got := s.u32()
+	if s.err != nil {
+		return s.err
+	}
+	if got != want {
+		return fmt.Errorf("hv: snapshot checksum mismatch (0x%08x, want 0x%08x)", got, want)
+	}
+	return nil
+}
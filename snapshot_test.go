@@ -0,0 +1,266 @@
+package hypervisor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	vm, vcpu, _ := newInterpVM(t,
+		0xF9400020, // ldr x0, [x1]
+		0x91000400, // add x0, x0, #1
+		0xF9000020, // str x0, [x1]
+		0xD4200000, // brk #0
+	)
+	second, err := vm.NewVCPU()
+	if err != nil {
+		t.Fatalf("NewVCPU failed: %v", err)
+	}
+	defer second.Close()
+
+	page := pageSize()
+	const heapGPA = 0x200000
+	heap := alignedBuffer(t, 8*page)
+	if err := vm.MapLabeled(heap, heapGPA, MemRead|MemWrite, "heap"); err != nil {
+		t.Fatalf("MapLabeled failed: %v", err)
+	}
+	counter := uint64(heapGPA + 5*page)
+	binary.LittleEndian.PutUint64(heap[5*page:], 41)
+
+	if err := vcpu.SetReg(RegX1, counter); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.SetSysReg(SysVBAR_EL1, 0x800); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := vm.Snapshot(&buf); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	if total := 10 * page; buf.Len() >= total/2 {
+		t.Errorf("snapshot is %d bytes for %d bytes of mostly zero memory", buf.Len(), total)
+	}
+	snap := buf.Bytes()
+
+	restored, err := RestoreVMWithBackend("interp", bytes.NewReader(snap))
+	if err != nil {
+		t.Fatalf("RestoreVM failed: %v", err)
+	}
+	defer restored.Close()
+
+	strip := func(regions []Region) []Region {
+		for i := range regions {
+			regions[i].Host = nil
+		}
+		return regions
+	}
+	if got, want := strip(restored.Regions()), strip(vm.Regions()); !reflect.DeepEqual(got, want) {
+		t.Errorf("Regions() = %v, want %v", got, want)
+	}
+
+	vcpus := restored.VCPUs()
+	if len(vcpus) != 2 {
+		t.Fatalf("len(VCPUs()) = %d, want 2", len(vcpus))
+	}
+	for i, orig := range []*VCPU{vcpu, second} {
+		want, _ := orig.SaveState()
+		got, err := vcpus[i].SaveState()
+		if err != nil {
+			t.Fatalf("SaveState failed: %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("vCPU %d state = %+v, want %+v", i, got, want)
+		}
+	}
+
+	if _, err := vcpus[0].Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if x0, _ := vcpus[0].GetReg(RegX0); x0 != 42 {
+		t.Errorf("X0 = %d, want 42", x0)
+	}
+	var word [8]byte
+	if _, err := restored.ReadAt(word[:], int64(counter)); err != nil || binary.LittleEndian.Uint64(word[:]) != 42 {
+		t.Errorf("restored counter = %d, %v, want 42", binary.LittleEndian.Uint64(word[:]), err)
+	}
+	if v := binary.LittleEndian.Uint64(heap[5*page:]); v != 41 {
+		t.Errorf("original counter = %d, want 41", v)
+	}
+
+	second.Close()
+	if got := vm.VCPUs(); len(got) != 1 || got[0] != vcpu {
+		t.Errorf("VCPUs() after Close = %v, want only the first vCPU", got)
+	}
+}
+
+func TestSnapshotGuardPages(t *testing.T) {
+	vm, _, _ := newInterpVM(t)
+	page := uint64(pageSize())
+	const heapGPA = 0x200000
+	if _, err := vm.AllocRegion(heapGPA, 4*page, MemRead|MemWrite, AllocOptions{Label: "heap", GuardPages: 1}); err != nil {
+		t.Fatalf("AllocRegion failed: %v", err)
+	}
+	if err := vm.Protect(heapGPA+page, page, 0); err != nil {
+		t.Fatalf("Protect failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := vm.Snapshot(&buf); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	restored, err := RestoreVMWithBackend("interp", &buf)
+	if err != nil {
+		t.Fatalf("RestoreVM failed: %v", err)
+	}
+	defer restored.Close()
+
+	type desc struct {
+		GPA, Size uint64
+		Perms     MemPerm
+		Label     string
+	}
+	describe := func(regions []Region) []desc {
+		var ds []desc
+		for _, r := range regions {
+			ds = append(ds, desc{r.GPA, r.Size, r.Perms, r.Label})
+		}
+		return ds
+	}
+	if got, want := describe(restored.Regions()), describe(vm.Regions()); !reflect.DeepEqual(got, want) {
+		t.Errorf("Regions() = %+v, want %+v", got, want)
+	}
+	for _, gpa := range []uint64{heapGPA - page, heapGPA + page, heapGPA + 4*page} {
+		r, ok := restored.regions.lookup(gpa)
+		if !ok || r.Perms != 0 {
+			t.Errorf("region at 0x%x = %v, %v; want no access", gpa, r, ok)
+		}
+	}
+}
+
+func TestSnapshotPageProvider(t *testing.T) {
+	vm, _, _ := newInterpVM(t)
+	page := uint64(pageSize())
+	const heapGPA = 0x200000
+	src := &pageSource{}
+	opts := AllocOptions{Provider: src, GuardPages: 1}
+	if _, err := vm.AllocRegion(heapGPA, 4*page, MemRead|MemWrite, opts); err != nil {
+		t.Fatalf("AllocRegion failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := vm.Snapshot(&buf); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	// Every page the guest may access is fetched, and no guard page.
+	want := []uint64{heapGPA, heapGPA + page, heapGPA + 2*page, heapGPA + 3*page}
+	if !reflect.DeepEqual(src.fetched, want) {
+		t.Errorf("fetched %#x, want %#x", src.fetched, want)
+	}
+
+	restored, err := RestoreVMWithBackend("interp", &buf)
+	if err != nil {
+		t.Fatalf("RestoreVM failed: %v", err)
+	}
+	defer restored.Close()
+	for _, gpa := range want {
+		got := make([]byte, 1)
+		if _, err := restored.ReadAt(got, int64(gpa)); err != nil {
+			t.Fatal(err)
+		}
+		if got[0] != byte(gpa/page) {
+			t.Errorf("restored page 0x%x = 0x%x, want 0x%x", gpa, got[0], byte(gpa/page))
+		}
+	}
+
+	// Provider errors fail the snapshot.
+	src.err = errors.New("backing store unavailable")
+	if _, err := vm.AllocRegion(0x400000, page, MemRead, AllocOptions{Provider: src}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Snapshot(io.Discard); !errors.Is(err, src.err) {
+		t.Errorf("Snapshot error = %v, want %v", err, src.err)
+	}
+}
+
+func TestRestoreVMErrors(t *testing.T) {
+	vm, _, data := newInterpVM(t, 0xD4200000)
+	data[100] = 1
+
+	var buf bytes.Buffer
+	if err := vm.Snapshot(&buf); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	snap := buf.Bytes()
+
+	corrupt := func(off int) []byte {
+		b := append([]byte(nil), snap...)
+		b[off] ^= 0xff
+		return b
+	}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"bad magic", corrupt(0)},
+		{"future version", corrupt(8)},
+		{"too many regions", corrupt(15)},
+		{"flipped memory byte", corrupt(len(snap) / 2)},
+		{"bad checksum", corrupt(len(snap) - 1)},
+		{"truncated", snap[:len(snap)-5]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if restored, err := RestoreVMWithBackend("interp", bytes.NewReader(tt.data)); err == nil {
+				restored.Close()
+				t.Error("Expected error, got nil")
+			}
+		})
+	}
+}
+
+// snapshotHeader returns the header and region descriptors of a snapshot
+// of the given regions, without their memory.
+func snapshotHeader(regions ...Region) []byte {
+	b := append([]byte(nil), snapshotMagic[:]...)
+	b = binary.LittleEndian.AppendUint32(b, snapshotVersion)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(regions)))
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	for _, r := range regions {
+		b = binary.LittleEndian.AppendUint64(b, r.GPA)
+		b = binary.LittleEndian.AppendUint64(b, r.Size)
+		b = binary.LittleEndian.AppendUint32(b, uint32(r.Perms))
+		b = binary.LittleEndian.AppendUint16(b, 0)
+	}
+	return b
+}
+
+func TestRestoreVMDescriptors(t *testing.T) {
+	const tib = 1 << 40
+	tests := []struct {
+		name    string
+		regions []Region
+		want    string
+	}{
+		{"too large in total", []Region{{GPA: 0, Size: tib, Perms: MemRead}, {GPA: tib, Size: tib, Perms: MemRead}}, "in total"},
+		{"overlapping", []Region{{GPA: 0x10000, Size: 0x2000, Perms: MemRead}, {GPA: 0x11000, Size: 0x1000, Perms: MemRead}}, "overlap"},
+		{"unaligned", []Region{{GPA: 0x10001, Size: 0x1000, Perms: MemRead}}, "aligned"},
+		{"overflowing", []Region{{GPA: 1<<64 - 0x1000, Size: 0x2000, Perms: MemRead}}, "overlap"},
+		{"bad permissions", []Region{{GPA: 0x10000, Size: 0x1000, Perms: 0x80}}, "permission"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Descriptors are rejected before any memory is read or reserved.
+			_, err := RestoreVMWithBackend("interp", bytes.NewReader(snapshotHeader(tt.regions...)))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("RestoreVM error = %v, want one mentioning %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,295 @@
+package hypervisor
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// PageProvider supplies the contents of demand-paged memory, allocated
+// with AllocOptions.Provider. Fetch returns the contents of the page at
+// gpa, which is page-aligned; a short result is zero-filled to a page. It
+// is called the first time the guest, ReadAt, WriteAt or Snapshot touches
+// the page, from the goroutine doing so, and again if Reset returns the
+// page to a checkpoint taken before it was fetched. Fetch must be safe for
+// concurrent use when the VM has more than one vCPU, and an error it
+// returns is returned by Run, ReadAt, WriteAt or Snapshot.
+type PageProvider interface {
+	Fetch(gpa uint64) ([]byte, error)
+}
+
+// sparseRange records which pages of a sparse region the backend maps. A
+// sparse region reserves its guest physical range and host memory up
+// front, but a page is only mapped, and so committed, once the guest or
+// WriteAt first touches it. Until then it reads as zero, or as the page
+// its provider returns.
+type sparseRange struct {
+	gpa, size uint64
+	committed []uint64 // one bit per page
+	provider  PageProvider
+}
+
+func newSparseRange(gpa, size uint64, p PageProvider) *sparseRange {
+	pages := size / uint64(pageSize())
+	return &sparseRange{gpa: gpa, size: size, committed: make([]uint64, (pages+63)/64), provider: p}
+}
+
+func (s *sparseRange) end() uint64 { return s.gpa + s.size }
+
+func (s *sparseRange) index(gpa uint64) uint64 { return (gpa - s.gpa) / uint64(pageSize()) }
+
+func (s *sparseRange) isCommitted(gpa uint64) bool {
+	i := s.index(gpa)
+	return s.committed[i/64]&(1<<(i%64)) != 0
+}
+
+func (s *sparseRange) setCommitted(gpa uint64) {
+	i := s.index(gpa)
+	s.committed[i/64] |= 1 << (i % 64)
+}
+
+// bitmap returns the committed pages as a DirtyBitmap, to walk them.
+func (s *sparseRange) bitmap() DirtyBitmap {
+	return DirtyBitmap{GPA: s.gpa, Size: s.size, PageSize: uint64(pageSize()), Bits: s.committed}
+}
+
+// runs calls fn for each run of committed pages in [lo, hi).
+func (s *sparseRange) runs(lo, hi uint64, fn func(gpa, size uint64) error) error {
+	lo, hi = max(lo, s.gpa), min(hi, s.end())
+	return s.bitmap().runs(func(gpa, size uint64) error {
+		from, to := max(gpa, lo), min(gpa+size, hi)
+		if from >= to {
+			return nil
+		}
+		return fn(from, to-from)
+	})
+}
+
+// count returns the committed bytes in [lo, hi).
+func (s *sparseRange) count(lo, hi uint64) uint64 {
+	lo, hi = max(lo, s.gpa), min(hi, s.end())
+	if lo >= hi {
+		return 0
+	}
+	page := uint64(pageSize())
+	first, last := s.index(lo), s.index(hi-1)
+	var n int
+	for i := first; i <= last; {
+		w := s.committed[i/64] >> (i % 64)
+		if span := last - i + 1; span < 64-i%64 {
+			w &= 1<<span - 1
+		}
+		n += bits.OnesCount64(w)
+		i += 64 - i%64
+	}
+	return uint64(n) * page
+}
+
+// uncommit clears the pages in [lo, hi).
+func (s *sparseRange) uncommit(lo, hi uint64) {
+	lo, hi = max(lo, s.gpa), min(hi, s.end())
+	page := uint64(pageSize())
+	for gpa := lo; gpa < hi; gpa += page {
+		i := s.index(gpa)
+		s.committed[i/64] &^= 1 << (i % 64)
+	}
+}
+
+// sparseLocked returns the sparse range containing gpa, or nil.
+func (t *regionTable) sparseLocked(gpa uint64) *sparseRange {
+	for _, s := range t.sparse {
+		if gpa >= s.gpa && gpa < s.end() {
+			return s
+		}
+	}
+	return nil
+}
+
+// committedLocked returns the bytes of r the backend maps.
+func (t *regionTable) committedLocked(r Region) uint64 {
+	if !r.Sparse {
+		return r.Size
+	}
+	if s := t.sparseLocked(r.GPA); s != nil {
+		return s.count(r.GPA, r.End())
+	}
+	return 0
+}
+
+// dropSparseLocked forgets the commitment of [gpa, gpa+size), which has
+// just been unmapped, and the sparse ranges no region uses any more.
+func (t *regionTable) dropSparseLocked(gpa, size uint64) {
+	kept := t.sparse[:0]
+	for _, s := range t.sparse {
+		s.uncommit(gpa, gpa+size)
+		if _, ok := t.overlapLocked(s.gpa, s.size); ok {
+			kept = append(kept, s)
+		}
+	}
+	clear(t.sparse[len(kept):])
+	t.sparse = kept
+}
+
+// eachBackedLocked calls fn for every part of [gpa, gpa+size) the backend
+// maps, with the region it belongs to: all of a region, or the committed
+// runs of a sparse one.
+func (vm *VM) eachBackedLocked(gpa, size uint64, fn func(r Region, gpa, size uint64) error) error {
+	end := gpa + size
+	for i := vm.regions.find(gpa); i < len(vm.regions.regions); i++ {
+		r := vm.regions.regions[i]
+		if r.GPA >= end {
+			break
+		}
+		lo, hi := max(r.GPA, gpa), min(r.End(), end)
+		if !r.Sparse {
+			if err := fn(r, lo, hi-lo); err != nil {
+				return err
+			}
+			continue
+		}
+		s := vm.regions.sparseLocked(lo)
+		if s == nil {
+			continue
+		}
+		if err := s.runs(lo, hi, func(gpa, size uint64) error { return fn(r, gpa, size) }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uncommittedLocked returns the sparse range and region of the page at
+// gpa if it can be committed: it is mapped with some access and not
+// committed yet.
+func (vm *VM) uncommittedLocked(gpa uint64) (*sparseRange, Region, bool) {
+	s := vm.regions.sparseLocked(gpa)
+	if s == nil || s.isCommitted(gpa) {
+		return nil, Region{}, false
+	}
+	r, ok := vm.regions.lookupLocked(gpa)
+	if !ok || !r.Sparse || r.Perms == 0 {
+		return nil, Region{}, false
+	}
+	return s, r, true
+}
+
+// commit commits the page at gpa, reporting whether it is committed now.
+// A page being written is marked dirty in tracked ranges; any other access
+// maps it without write access there, so the first write is still seen.
+// The provider is called without the lock held, so it may be called
+// twice for a page two vCPUs touch at once; the first result wins.
+func (vm *VM) commit(gpa uint64, write bool) (bool, error) {
+	page := uint64(pageSize())
+	vm.regions.mu.Lock()
+	s, _, ok := vm.uncommittedLocked(gpa)
+	var p PageProvider
+	if ok {
+		p = s.provider
+	}
+	vm.regions.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+
+	var data []byte
+	if p != nil {
+		var err error
+		if data, err = p.Fetch(gpa); err != nil {
+			return false, fmt.Errorf("hv: failed to fetch page 0x%x: %w", gpa, err)
+		}
+		if uint64(len(data)) > page {
+			return false, fmt.Errorf("hv: provider returned %d bytes for page 0x%x (page size: %d)", len(data), gpa, page)
+		}
+	}
+
+	vm.regions.mu.Lock()
+	defer vm.regions.mu.Unlock()
+	s, r, ok := vm.uncommittedLocked(gpa)
+	if !ok || s.provider != p {
+		// Committed meanwhile by another vCPU, or unmapped
+		cur := vm.regions.sparseLocked(gpa)
+		return cur != nil && cur.isCommitted(gpa), nil
+	}
+	perms := r.Perms
+	if d := vm.regions.trackedLocked(gpa); d != nil {
+		if write {
+			d.mark(gpa, gpa+page)
+		} else {
+			perms &^= MemWrite
+		}
+	}
+	host := r.Host[gpa-r.GPA : gpa-r.GPA+page : gpa-r.GPA+page]
+	if p != nil {
+		clear(host[copy(host, data):])
+	}
+	if err := vm.backend.Map(host, gpa, perms); err != nil {
+		vm.metrics.recordResourceError()
+		return false, fmt.Errorf("hv: failed to commit sparse page 0x%x: %w", gpa, err)
+	}
+	s.setCommitted(gpa)
+	vm.metrics.recordCommit(int64(page))
+	return true, nil
+}
+
+// uncommitLocked returns the committed pages of sparse range s in
+// [gpa, gpa+size) to their initial state: unmapped, zero, and fetched
+// again when next touched.
+func (vm *VM) uncommitLocked(s *sparseRange, r Region, gpa, size uint64) error {
+	type run struct{ gpa, size uint64 }
+	var runs []run
+	s.runs(gpa, gpa+size, func(gpa, size uint64) error {
+		runs = append(runs, run{gpa, size})
+		return nil
+	})
+	for _, u := range runs {
+		if err := vm.backend.Unmap(u.gpa, u.size); err != nil {
+			vm.metrics.recordResourceError()
+			return err
+		}
+		clear(r.Host[u.gpa-r.GPA : u.gpa+u.size-r.GPA])
+		s.uncommit(u.gpa, u.gpa+u.size)
+		vm.metrics.recordCommit(-int64(u.size))
+	}
+	return nil
+}
+
+// handleSparseFault commits the page of a sparse region the guest touched
+// for the first time, reporting whether it did. Pages the guest may not
+// access at all, such as guard pages, are left to fault. It is only called
+// from the goroutine running the vCPU.
+func (c *VCPU) handleSparseFault(info ExitInfo) (bool, error) {
+	write := false
+	if da, ok := info.DataAbort(); ok && da.DFSC.IsTranslation() {
+		write = da.WnR && !da.CM
+	} else if ia, ok := info.InstructionAbort(); !ok || !ia.IFSC.IsTranslation() {
+		return false, nil
+	}
+	return c.vm.commit(info.IPA&^uint64(pageSize()-1), write)
+}
+
+// commitRange commits the pages of sparse regions in [gpa, gpa+size)
+// before a host access: all of them for a write, so that the guest sees
+// the data, and those with a provider for a read.
+func (vm *VM) commitRange(gpa, size uint64, write bool) error {
+	vm.regions.mu.RLock()
+	sparse := len(vm.regions.sparse) != 0
+	vm.regions.mu.RUnlock()
+	if !sparse {
+		return nil
+	}
+
+	page := uint64(pageSize())
+	end := gpa + size
+	for addr := gpa &^ (page - 1); addr < end; addr += page {
+		vm.regions.mu.RLock()
+		s := vm.regions.sparseLocked(addr)
+		need := s != nil && (write || s.provider != nil) && !s.isCommitted(addr)
+		vm.regions.mu.RUnlock()
+		if !need {
+			continue
+		}
+		if _, err := vm.commit(addr, write); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+package hypervisor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestSparseRegion(t *testing.T) {
+	page := uint64(pageSize())
+	const base = 0x200000
+	const size = 1 << 32 // beyond the old 2 GiB limit
+	vm, vcpu, _ := newInterpVM(t,
+		0xD2800540,                    // movz x0, #0x2a
+		0xD2A00401,                    // movz x1, #0x20, lsl #16 (x1 = 0x200000)
+		0xF9000020,                    // str  x0, [x1]
+		0xF9400022|uint32(page/8)<<10, // ldr  x2, [x1, #page]
+		0xD4200000,                    // brk  #0
+	)
+
+	r, err := vm.AllocRegion(base, size, MemRead|MemWrite, AllocOptions{Label: "heap", Sparse: true})
+	if err != nil {
+		t.Fatalf("AllocRegion failed: %v", err)
+	}
+	if !r.Sparse || r.Size != size || r.Committed != 0 {
+		t.Errorf("AllocRegion = %+v, want a sparse region of %d bytes with none committed", r, size)
+	}
+
+	committed := func(name string, want uint64) {
+		t.Helper()
+		var got, mapped uint64
+		for _, r := range vm.Regions() {
+			if r.Sparse {
+				got += r.Committed
+			}
+			mapped += r.Size
+		}
+		if got != want {
+			t.Errorf("%s: Regions committed = %d bytes, want %d", name, got, want)
+		}
+		// The code and data pages are always committed.
+		m := vm.Metrics()
+		if m.CommittedBytes != int64(want+2*page) || m.MappedBytes != int64(mapped) {
+			t.Errorf("%s: CommittedBytes, MappedBytes = %d, %d; want %d, %d",
+				name, m.CommittedBytes, m.MappedBytes, want+2*page, mapped)
+		}
+	}
+	committed("AllocRegion", 0)
+
+	// The guest's store and load each commit the page they touch.
+	if info, err := vcpu.Run(); err != nil || info.Class() != ECBRK {
+		t.Fatalf("Run = %v, %v; want BRK", info, err)
+	}
+	if x2, _ := vcpu.GetReg(RegX2); x2 != 0 || r.Host[0] != 0x2a {
+		t.Errorf("X2, host[0] = 0x%x, 0x%x; want 0, 0x2a", x2, r.Host[0])
+	}
+	committed("Run", 2*page)
+
+	// WriteAt commits what it writes; ReadAt does not.
+	if _, err := vm.WriteAt([]byte{1}, base+size-1); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 8)
+	if _, err := vm.ReadAt(buf, base+size/2); err != nil {
+		t.Fatal(err)
+	}
+	committed("WriteAt", 3*page)
+
+	// Unmapping part of the region releases what it committed there.
+	if err := vm.Unmap(base, page); err != nil {
+		t.Fatal(err)
+	}
+	committed("Unmap", 2*page)
+	if err := vm.Unmap(base+page, size-page); err != nil {
+		t.Fatal(err)
+	}
+	if m := vm.Metrics(); m.CommittedBytes != int64(2*page) || m.MappedBytes != int64(2*page) {
+		t.Errorf("after Unmap: CommittedBytes, MappedBytes = %d, %d; want %d, %d",
+			m.CommittedBytes, m.MappedBytes, 2*page, 2*page)
+	}
+	if len(vm.owned) != 0 {
+		t.Errorf("%d allocations after Unmap, want 0", len(vm.owned))
+	}
+}
+
+func TestSparseCheckpoint(t *testing.T) {
+	page := uint64(pageSize())
+	const base = 0x200000
+	vm, vcpu, _ := newInterpVM(t,
+		0xD2800540, // movz x0, #0x2a
+		0xD2A00401, // movz x1, #0x20, lsl #16 (x1 = 0x200000)
+		0xF9000020, // str  x0, [x1]
+		0xD4200000, // brk  #0
+	)
+	r, err := vm.AllocRegion(base, 1<<30, MemRead|MemWrite, AllocOptions{Sparse: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vm.WriteAt([]byte{7}, int64(base+page)); err != nil {
+		t.Fatal(err)
+	}
+
+	cp, err := vm.Checkpoint()
+	if err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+	for i := range 2 {
+		if _, err := vm.WriteAt([]byte{9}, int64(base+page)); err != nil {
+			t.Fatal(err)
+		}
+		if info, err := vcpu.Run(); err != nil || info.Class() != ECBRK {
+			t.Fatalf("run %d: Run = %v, %v; want BRK", i, info, err)
+		}
+		if err := vm.Reset(cp); err != nil {
+			t.Fatalf("run %d: Reset failed: %v", i, err)
+		}
+		// The page committed after the checkpoint reads as zero again.
+		if r.Host[0] != 0 || r.Host[page] != 7 {
+			t.Errorf("run %d: memory = 0x%x, 0x%x; want 0, 7", i, r.Host[0], r.Host[page])
+		}
+	}
+	dirty, err := vm.CollectDirty()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, d := range dirty {
+		if d.GPA >= base && d.GPA < base+1<<30 {
+			n += d.Count()
+		}
+	}
+	if n != 2 {
+		t.Errorf("%d sparse pages dirty, want 2", n)
+	}
+}
+
+// pageSource is a PageProvider filling the first 16 bytes of each page
+// with its page number, recording the pages it was asked for.
+type pageSource struct {
+	mu      sync.Mutex
+	fetched []uint64
+	err     error
+}
+
+func (p *pageSource) Fetch(gpa uint64) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.fetched = append(p.fetched, gpa)
+	if p.err != nil {
+		return nil, p.err
+	}
+	// A short page: the rest is zero-filled.
+	return bytes.Repeat([]byte{byte(gpa / uint64(pageSize()))}, 16), nil
+}
+
+func TestPageProvider(t *testing.T) {
+	page := uint64(pageSize())
+	const base = 0x200000
+	vm, vcpu, _ := newInterpVM(t,
+		0xD2A00401,                    // movz x1, #0x20, lsl #16 (x1 = 0x200000)
+		0xF9400020,                    // ldr  x0, [x1]
+		0xF9400022|uint32(page/8)<<10, // ldr  x2, [x1, #page]
+		0xF9400023|uint32(page/8)<<10, // ldr  x3, [x1, #page]
+		0xD4200000,                    // brk  #0
+	)
+	src := &pageSource{}
+	r, err := vm.AllocRegion(base, 1<<32, MemRead|MemWrite, AllocOptions{Provider: src})
+	if err != nil {
+		t.Fatalf("AllocRegion failed: %v", err)
+	}
+	if !r.Sparse {
+		t.Errorf("region with a provider is not sparse")
+	}
+	fill := func(gpa uint64) uint64 { return bytes8(byte(gpa / page)) }
+
+	// Each page the guest touches is fetched once.
+	if info, err := vcpu.Run(); err != nil || info.Class() != ECBRK {
+		t.Fatalf("Run = %v, %v; want BRK", info, err)
+	}
+	x0, _ := vcpu.GetReg(RegX0)
+	x2, _ := vcpu.GetReg(RegX2)
+	x3, _ := vcpu.GetReg(RegX3)
+	if x0 != fill(base) || x2 != fill(base+page) || x3 != x2 {
+		t.Errorf("X0, X2, X3 = 0x%x, 0x%x, 0x%x; want 0x%x, 0x%x, 0x%x",
+			x0, x2, x3, fill(base), fill(base+page), fill(base+page))
+	}
+	if want := []uint64{base, base + page}; !reflect.DeepEqual(src.fetched, want) {
+		t.Errorf("fetched %#x, want %#x", src.fetched, want)
+	}
+
+	// ReadAt fetches too, and sees the zero-filled tail of the page.
+	far := uint64(base + 1<<31)
+	buf := make([]byte, 32)
+	if _, err := vm.ReadAt(buf, int64(far)); err != nil {
+		t.Fatal(err)
+	}
+	want := append(bytes.Repeat([]byte{byte(far / page)}, 16), make([]byte, 16)...)
+	if !bytes.Equal(buf, want) {
+		t.Errorf("ReadAt = %x, want %x", buf, want)
+	}
+
+	// WriteAt fetches the page before writing into it.
+	if _, err := vm.WriteAt([]byte{0xee}, int64(base+2*page+1)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := r.Host[2*page:2*page+3], []byte{2, 0xee, 2}; !bytes.Equal(got, want) {
+		t.Errorf("page after WriteAt = %x, want %x", got, want)
+	}
+	if m := vm.Metrics(); m.CommittedBytes != int64(6*page) {
+		t.Errorf("CommittedBytes = %d, want %d", m.CommittedBytes, 6*page)
+	}
+
+	// Provider errors are returned from the access.
+	src.err = errors.New("backing store unavailable")
+	if _, err := vm.ReadAt(buf, int64(base+3*page)); !errors.Is(err, src.err) {
+		t.Errorf("ReadAt error = %v, want %v", err, src.err)
+	}
+}
+
+func TestPageProviderReset(t *testing.T) {
+	page := uint64(pageSize())
+	const base = 0x200000
+	vm, vcpu, _ := newInterpVM(t,
+		0xD2A00401, // movz x1, #0x20, lsl #16 (x1 = 0x200000)
+		0xF9000020, // str  x0, [x1]
+		0xD4200000, // brk  #0
+	)
+	src := &pageSource{}
+	r, err := vm.AllocRegion(base, 1<<30, MemRead|MemWrite, AllocOptions{Provider: src})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp, err := vm.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	committed := vm.Metrics().CommittedBytes
+	for i := range 2 {
+		if info, err := vcpu.Run(); err != nil || info.Class() != ECBRK {
+			t.Fatalf("run %d: Run = %v, %v; want BRK", i, info, err)
+		}
+		if err := vm.Reset(cp); err != nil {
+			t.Fatalf("run %d: Reset failed: %v", i, err)
+		}
+		// The page the guest wrote is released, and fetched again.
+		if m := vm.Metrics(); m.CommittedBytes != committed || r.Host[0] != 0 {
+			t.Errorf("run %d: CommittedBytes = %d, host[0] = 0x%x; want %d, 0", i, m.CommittedBytes, r.Host[0], committed)
+		}
+	}
+	buf := make([]byte, 1)
+	if _, err := vm.ReadAt(buf, base); err != nil {
+		t.Fatal(err)
+	}
+	if buf[0] != byte(base/page) || len(src.fetched) != 3 {
+		t.Errorf("after Reset: byte 0x%x, %d fetches; want 0x%x, 3", buf[0], len(src.fetched), byte(base/page))
+	}
+}
+
+// bytes8 returns the little-endian uint64 of eight b bytes.
+func bytes8(b byte) uint64 {
+	return binary.LittleEndian.Uint64(bytes.Repeat([]byte{b}, 8))
+}
@@ -0,0 +1,444 @@
+package hypervisor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// CPUStateVersion is the version written by CPUState's JSON and binary
+// encodings. Decoders accept this and every earlier version.
+const CPUStateVersion = 1
+
+// cpuStateMagic starts the binary encoding of a CPUState.
+var cpuStateMagic = [4]byte{'H', 'V', 'C', 'S'}
+
+// CPUState is a snapshot of a vCPU's architectural state: general purpose
+// registers, PSTATE, SIMD/FP registers and EL1 system registers.
+//
+// It encodes to JSON as an object keyed by lower-case register name
+// ("x0", "fp", "pc", "cpsr", ...), with nonzero SIMD registers under
+// "simd" as 128-bit hex values and system registers under "sys". As with
+// other structs, decoding JSON leaves registers the input omits unchanged,
+// so a partial state file can be layered over SaveState's result.
+// MarshalBinary produces a compact little-endian encoding of the same data.
+type CPUState struct {
+	// X holds X0-X30; X[29] is FP and X[30] is LR.
+	X    [31]uint64
+	SP   uint64
+	PC   uint64
+	CPSR uint64
+	FPCR uint64
+	FPSR uint64
+	// Q holds the 128-bit SIMD/FP registers, each in little-endian byte
+	// order.
+	Q [32][16]byte
+	// Sys holds system register values. Registers the backend could not
+	// read are absent.
+	Sys map[SysReg]uint64
+}
+
+// regPtr returns the field that holds r, or nil for an invalid register.
+func (s *CPUState) regPtr(r Reg) *uint64 {
+	switch {
+	case r >= RegX0 && r <= RegLR:
+		return &s.X[r]
+	case r == RegSP:
+		return &s.SP
+	case r == RegPC:
+		return &s.PC
+	case r == RegCPSR:
+		return &s.CPSR
+	case r == RegFPCR:
+		return &s.FPCR
+	case r == RegFPSR:
+		return &s.FPSR
+	}
+	return nil
+}
+
+// Reg returns the value of r, or 0 for an invalid register.
+func (s *CPUState) Reg(r Reg) uint64 {
+	if p := s.regPtr(r); p != nil {
+		return *p
+	}
+	return 0
+}
+
+// SetReg sets the value of r. Invalid registers are ignored.
+func (s *CPUState) SetReg(r Reg, v uint64) {
+	if p := s.regPtr(r); p != nil {
+		*p = v
+	}
+}
+
+// Clone returns a deep copy of s.
+func (s *CPUState) Clone() *CPUState {
+	c := *s
+	if s.Sys != nil {
+		c.Sys = make(map[SysReg]uint64, len(s.Sys))
+		for r, v := range s.Sys {
+			c.Sys[r] = v
+		}
+	}
+	return &c
+}
+
+// unsupportedSysReg reports whether err is a backend rejecting a system
+// register it does not implement.
+func unsupportedSysReg(err error) bool {
+	var hvErr HVError
+	return errors.As(err, &hvErr) && (hvErr.Code == HV_BAD_ARGUMENT || hvErr.Code == HV_UNSUPPORTED)
+}
+
+// SaveState captures the vCPU's registers. System registers the backend
+// does not implement are left out of CPUState.Sys.
+func (c *VCPU) SaveState() (*CPUState, error) {
+	if c == nil {
+		return nil, &OpError{Op: "save state", Err: errVCPUNil}
+	}
+
+	// Security: Lock to prevent use-after-free
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+
+	if c.closed {
+		return nil, &OpError{Op: "save state", Err: ErrVCPUClosed}
+	}
+	if c.running {
+		return nil, &OpError{Op: "save state", Err: ErrVCPURunning}
+	}
+
+	s := &CPUState{Sys: make(map[SysReg]uint64)}
+	for r := RegX0; r < regCount; r++ {
+		v, err := c.impl.GetReg(r)
+		if err != nil {
+			c.metrics.recordResourceError()
+			return nil, &OpError{Op: "save state", Reg: r.String(), Err: err}
+		}
+		s.SetReg(r, v)
+	}
+	for q := RegQ0; q <= RegQ31; q++ {
+		v, err := c.impl.GetSIMD(q)
+		if err != nil {
+			c.metrics.recordResourceError()
+			return nil, &OpError{Op: "save state", Reg: q.String(), Err: err}
+		}
+		s.Q[q] = v
+	}
+	for _, r := range SysRegs() {
+		v, err := c.impl.GetSysReg(r)
+		if err != nil {
+			if unsupportedSysReg(err) {
+				continue
+			}
+			c.metrics.recordResourceError()
+			return nil, &OpError{Op: "save state", Reg: r.String(), Err: err}
+		}
+		s.Sys[r] = v
+	}
+
+	c.metrics.recordRegisterOp()
+	return s, nil
+}
+
+// RestoreState loads a state captured by SaveState, possibly from another
+// vCPU. Identification registers (see SysReg.IsID) are not restored, so
+// each vCPU keeps its own MPIDR_EL1; nor are system registers missing from
+// s.Sys. Every other register is written, including zero values.
+func (c *VCPU) RestoreState(s *CPUState) error {
+	written, reg, err := c.restoreState(s)
+	if err != nil {
+		return &OpError{Op: "restore state", Reg: reg, Err: err}
+	}
+	c.vm.notify(func(o Observer) {
+		for _, w := range written {
+			o.RegisterWritten(c, w)
+		}
+	})
+	return nil
+}
+
+// restoreState does the work of RestoreState and returns the writes made,
+// or the name of the register that could not be restored.
+func (c *VCPU) restoreState(s *CPUState) ([]RegWrite, string, error) {
+	if c == nil {
+		return nil, "", errVCPUNil
+	}
+	if s == nil {
+		return nil, "", fmt.Errorf("hv: CPU state is nil")
+	}
+
+	// Security: Lock to prevent use-after-free
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+
+	if c.closed {
+		return nil, "", ErrVCPUClosed
+	}
+	if c.running {
+		return nil, "", ErrVCPURunning
+	}
+
+	// Validate before writing anything so a bad state does not leave the
+	// vCPU half restored.
+	regs := make([]SysReg, 0, len(s.Sys))
+	for r := range s.Sys {
+		if !r.Valid() {
+			return nil, r.String(), ErrInvalidRegister
+		}
+		if !r.IsID() {
+			regs = append(regs, r)
+		}
+	}
+	sort.Slice(regs, func(i, j int) bool { return regs[i] < regs[j] })
+
+	// System registers first: on backends where SP_EL0 aliases SP, the
+	// general purpose value written last wins.
+	written := make([]RegWrite, 0, len(regs)+int(RegQ31)+1+int(regCount))
+	for _, r := range regs {
+		if err := c.impl.SetSysReg(r, s.Sys[r]); err != nil {
+			c.metrics.recordResourceError()
+			return nil, r.String(), err
+		}
+		written = append(written, RegWrite{Kind: RegKindSystem, Sys: r, Value: s.Sys[r]})
+	}
+	for q := RegQ0; q <= RegQ31; q++ {
+		if err := c.impl.SetSIMD(q, s.Q[q]); err != nil {
+			c.metrics.recordResourceError()
+			return nil, q.String(), err
+		}
+		written = append(written, RegWrite{Kind: RegKindSIMD, SIMD: q, Vector: s.Q[q]})
+	}
+	for r := RegX0; r < regCount; r++ {
+		if err := c.impl.SetReg(r, s.Reg(r)); err != nil {
+			c.metrics.recordResourceError()
+			return nil, r.String(), err
+		}
+		written = append(written, RegWrite{Kind: RegKindGeneral, Reg: r, Value: s.Reg(r)})
+	}
+
+	c.metrics.recordRegisterOp()
+	return written, "", nil
+}
+
+// jsonName is the JSON key for r.
+func (r Reg) jsonName() string { return strings.ToLower(r.String()) }
+
+// MarshalJSON encodes s with registers in architectural order.
+func (s CPUState) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `{"version":%d`, CPUStateVersion)
+	for r := RegX0; r < regCount; r++ {
+		fmt.Fprintf(&buf, `,%q:%d`, r.jsonName(), s.Reg(r))
+	}
+
+	simd := make(map[string]string)
+	for q := RegQ0; q <= RegQ31; q++ {
+		if s.Q[q] != ([16]byte{}) {
+			simd[strings.ToLower(q.String())] = formatQ(s.Q[q])
+		}
+	}
+	if len(simd) > 0 {
+		b, err := json.Marshal(simd)
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteString(`,"simd":`)
+		buf.Write(b)
+	}
+	if len(s.Sys) > 0 {
+		b, err := json.Marshal(s.Sys)
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteString(`,"sys":`)
+		buf.Write(b)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// UnmarshalJSON decodes the format written by MarshalJSON into s. A
+// missing "version" is accepted for state files written before it existed.
+func (s *CPUState) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	// Check the version before applying anything else.
+	if raw, ok := fields["version"]; ok {
+		var v int
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return fmt.Errorf("hv: invalid CPU state version: %w", err)
+		}
+		if v < 1 || v > CPUStateVersion {
+			return fmt.Errorf("hv: unsupported CPU state version %d (max %d)", v, CPUStateVersion)
+		}
+	}
+
+	for key, raw := range fields {
+		switch key {
+		case "version":
+		case "simd":
+			var simd map[string]string
+			if err := json.Unmarshal(raw, &simd); err != nil {
+				return fmt.Errorf("hv: invalid SIMD registers in CPU state: %w", err)
+			}
+			for name, val := range simd {
+				q, err := ParseSIMDReg(name)
+				if err != nil {
+					return err
+				}
+				if s.Q[q], err = parseQ(val); err != nil {
+					return fmt.Errorf("hv: invalid value for %v: %w", q, err)
+				}
+			}
+		case "sys":
+			if err := json.Unmarshal(raw, &s.Sys); err != nil {
+				return fmt.Errorf("hv: invalid system registers in CPU state: %w", err)
+			}
+		default:
+			r, err := ParseReg(key)
+			if err != nil {
+				return fmt.Errorf("hv: unknown CPU state field %q", key)
+			}
+			var v uint64
+			if err := json.Unmarshal(raw, &v); err != nil {
+				return fmt.Errorf("hv: invalid value for %v: %w", r, err)
+			}
+			s.SetReg(r, v)
+		}
+	}
+	return nil
+}
+
+// formatQ renders a SIMD register as a 128-bit hex number.
+func formatQ(q [16]byte) string {
+	var be [16]byte
+	for i := range q {
+		be[15-i] = q[i]
+	}
+	return "0x" + hex.EncodeToString(be[:])
+}
+
+// parseQ parses a value written by formatQ. Leading zeros may be omitted.
+func parseQ(s string) ([16]byte, error) {
+	var q [16]byte
+	digits := strings.TrimPrefix(strings.ToLower(s), "0x")
+	if len(digits) == 0 || len(digits) > 32 {
+		return q, fmt.Errorf("hv: %q is not a 128-bit hex value", s)
+	}
+	be, err := hex.DecodeString(strings.Repeat("0", 32-len(digits)) + digits)
+	if err != nil {
+		return q, fmt.Errorf("hv: %q is not a 128-bit hex value", s)
+	}
+	for i := range be {
+		q[15-i] = be[i]
+	}
+	return q, nil
+}
+
+// MarshalBinary encodes s as:
+//
+//	magic "HVCS" | version u16 | nregs u16 | nregs × u64 (Reg order)
+//	| nsimd u16 | nsimd × [16]byte | nsys u16 | nsys × (SysReg u16, u64)
+//
+// All integers are little-endian and system registers are sorted by
+// encoding. The counts let newer decoders read older, shorter states.
+func (s CPUState) MarshalBinary() ([]byte, error) {
+	regs := make([]SysReg, 0, len(s.Sys))
+	for r := range s.Sys {
+		regs = append(regs, r)
+	}
+	sort.Slice(regs, func(i, j int) bool { return regs[i] < regs[j] })
+
+	b := make([]byte, 0, 4+2+2+8*int(regCount)+2+16*len(s.Q)+2+10*len(regs))
+	b = append(b, cpuStateMagic[:]...)
+	b = binary.LittleEndian.AppendUint16(b, CPUStateVersion)
+	b = binary.LittleEndian.AppendUint16(b, uint16(regCount))
+	for r := RegX0; r < regCount; r++ {
+		b = binary.LittleEndian.AppendUint64(b, s.Reg(r))
+	}
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(s.Q)))
+	for _, q := range s.Q {
+		b = append(b, q[:]...)
+	}
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(regs)))
+	for _, r := range regs {
+		b = binary.LittleEndian.AppendUint16(b, uint16(r))
+		b = binary.LittleEndian.AppendUint64(b, s.Sys[r])
+	}
+	return b, nil
+}
+
+// UnmarshalBinary decodes the format written by MarshalBinary.
+func (s *CPUState) UnmarshalBinary(data []byte) error {
+	d := stateDecoder{b: data}
+	if magic := d.next(4); d.err == nil && !bytes.Equal(magic, cpuStateMagic[:]) {
+		return fmt.Errorf("hv: not a CPU state (bad magic)")
+	}
+	if v := d.u16(); d.err == nil && (v < 1 || v > CPUStateVersion) {
+		return fmt.Errorf("hv: unsupported CPU state version %d (max %d)", v, CPUStateVersion)
+	}
+
+	var out CPUState
+	n := d.u16()
+	if d.err == nil && n > uint16(regCount) {
+		return fmt.Errorf("hv: CPU state has %d registers (max %d)", n, regCount)
+	}
+	for r := Reg(0); r < Reg(n); r++ {
+		out.SetReg(r, d.u64())
+	}
+	n = d.u16()
+	if d.err == nil && int(n) > len(out.Q) {
+		return fmt.Errorf("hv: CPU state has %d SIMD registers (max %d)", n, len(out.Q))
+	}
+	for q := 0; q < int(n); q++ {
+		copy(out.Q[q][:], d.next(16))
+	}
+	n = d.u16()
+	if n > 0 {
+		out.Sys = make(map[SysReg]uint64, n)
+	}
+	for i := 0; i < int(n); i++ {
+		r := SysReg(d.u16())
+		out.Sys[r] = d.u64()
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if len(d.b) != 0 {
+		return fmt.Errorf("hv: %d trailing bytes after CPU state", len(d.b))
+	}
+	*s = out
+	return nil
+}
+
+// stateDecoder reads little-endian fields, remembering the first short read.
+type stateDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *stateDecoder) next(n int) []byte {
+	if d.err != nil {
+		return make([]byte, n)
+	}
+	if len(d.b) < n {
+		d.err = fmt.Errorf("hv: truncated CPU state")
+		return make([]byte, n)
+	}
+	p := d.b[:n]
+	d.b = d.b[n:]
+	return p
+}
+
+func (d *stateDecoder) u16() uint16 { return binary.LittleEndian.Uint16(d.next(2)) }
+func (d *stateDecoder) u64() uint64 { return binary.LittleEndian.Uint64(d.next(8)) }
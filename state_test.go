@@ -0,0 +1,197 @@
+package hypervisor
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestSaveRestoreState(t *testing.T) {
+	vm, src, _ := newInterpVM(t, 0xD4200000) // brk #0
+	dst, err := vm.NewVCPU()
+	if err != nil {
+		t.Fatalf("NewVCPU failed: %v", err)
+	}
+	defer dst.Close()
+
+	writes := []struct {
+		reg Reg
+		val uint64
+	}{
+		{RegX0, 0x1111},
+		{RegX28, 0x2828},
+		{RegLR, 0x3030},
+		{RegSP, 0x8000},
+		{RegFPCR, 0x3000000},
+		{RegFPSR, 0x10},
+	}
+	for _, w := range writes {
+		if err := src.SetReg(w.reg, w.val); err != nil {
+			t.Fatalf("SetReg(%v) failed: %v", w.reg, err)
+		}
+	}
+	if err := src.SetSIMD(RegQ5, [16]byte{0: 1, 15: 0xff}); err != nil {
+		t.Fatalf("SetSIMD failed: %v", err)
+	}
+	for r, v := range map[SysReg]uint64{SysVBAR_EL1: 0x40000800, SysTTBR0_EL1: 0x80000000, SysTPIDR_EL0: 7} {
+		if err := src.SetSysReg(r, v); err != nil {
+			t.Fatalf("SetSysReg(%v) failed: %v", r, err)
+		}
+	}
+
+	saved, err := src.SaveState()
+	if err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+	for _, w := range writes {
+		if got := saved.Reg(w.reg); got != w.val {
+			t.Errorf("saved %v = 0x%x, want 0x%x", w.reg, got, w.val)
+		}
+	}
+	if saved.Q[5] != ([16]byte{0: 1, 15: 0xff}) || saved.Sys[SysVBAR_EL1] != 0x40000800 {
+		t.Errorf("saved Q5/VBAR = %x/0x%x", saved.Q[5], saved.Sys[SysVBAR_EL1])
+	}
+
+	if err := dst.RestoreState(saved); err != nil {
+		t.Fatalf("RestoreState failed: %v", err)
+	}
+	cloned, err := dst.SaveState()
+	if err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+	if cloned.Sys[SysMPIDR_EL1] == saved.Sys[SysMPIDR_EL1] {
+		t.Error("RestoreState copied MPIDR_EL1 between vCPUs")
+	}
+	cloned.Sys[SysMPIDR_EL1] = saved.Sys[SysMPIDR_EL1]
+	if !reflect.DeepEqual(cloned, saved) {
+		t.Errorf("restored state differs:\n got %+v\nwant %+v", cloned, saved)
+	}
+
+	t.Run("restore overwrites", func(t *testing.T) {
+		if err := dst.SetReg(RegX0, 0xdead); err != nil {
+			t.Fatal(err)
+		}
+		if err := dst.RestoreState(&CPUState{}); err != nil {
+			t.Fatalf("RestoreState failed: %v", err)
+		}
+		if got, _ := dst.GetReg(RegX0); got != 0 {
+			t.Errorf("X0 = 0x%x, want 0", got)
+		}
+		if got, _ := dst.GetSysReg(SysVBAR_EL1); got != 0x40000800 {
+			t.Errorf("VBAR_EL1 = 0x%x, want it untouched", got)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		if err := dst.RestoreState(nil); err == nil {
+			t.Error("Expected error for nil state")
+		}
+		bad := &CPUState{Sys: map[SysReg]uint64{SysReg(0xC7FF): 1}}
+		if err := dst.RestoreState(bad); err == nil {
+			t.Error("Expected error for unknown system register")
+		}
+	})
+}
+
+func TestCPUStateEncoding(t *testing.T) {
+	s := &CPUState{SP: 0x8000, PC: 0x4000, CPSR: 0x3c5, FPCR: 0x3000000}
+	s.X[0], s.X[29], s.X[30] = 42, 0xf0, 0x1e
+	s.Q[0] = [16]byte{0: 0x01, 8: 0x02}
+	s.Q[31] = [16]byte{15: 0x80}
+	s.Sys = map[SysReg]uint64{SysSCTLR_EL1: 0x30d00801, SysCNTV_CVAL_EL0: 1 << 40}
+
+	t.Run("JSON", func(t *testing.T) {
+		data, err := json.Marshal(s)
+		if err != nil {
+			t.Fatalf("Marshal failed: %v", err)
+		}
+		var fields map[string]any
+		if err := json.Unmarshal(data, &fields); err != nil {
+			t.Fatal(err)
+		}
+		for key, want := range map[string]any{
+			"version": float64(CPUStateVersion),
+			"x0":      float64(42),
+			"fp":      float64(0xf0),
+			"lr":      float64(0x1e),
+			"pc":      float64(0x4000),
+			"fpsr":    float64(0),
+		} {
+			if fields[key] != want {
+				t.Errorf("%s = %v, want %v", key, fields[key], want)
+			}
+		}
+		simd, _ := fields["simd"].(map[string]any)
+		if simd["q0"] != "0x00000000000000020000000000000001" || len(simd) != 2 {
+			t.Errorf("simd = %v", simd)
+		}
+		sys, _ := fields["sys"].(map[string]any)
+		if sys["SCTLR_EL1"] != float64(0x30d00801) {
+			t.Errorf("sys = %v", sys)
+		}
+
+		var got CPUState
+		if err := json.Unmarshal(data, &got); err != nil {
+			t.Fatalf("Unmarshal failed: %v", err)
+		}
+		if !reflect.DeepEqual(&got, s) {
+			t.Errorf("round trip = %+v, want %+v", got, *s)
+		}
+	})
+
+	t.Run("binary", func(t *testing.T) {
+		data, err := s.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary failed: %v", err)
+		}
+		var got CPUState
+		if err := got.UnmarshalBinary(data); err != nil {
+			t.Fatalf("UnmarshalBinary failed: %v", err)
+		}
+		if !reflect.DeepEqual(&got, s) {
+			t.Errorf("round trip = %+v, want %+v", got, *s)
+		}
+		for _, n := range []int{0, 3, 8, len(data) - 1} {
+			if err := got.UnmarshalBinary(data[:n]); err == nil {
+				t.Errorf("UnmarshalBinary(%d of %d bytes) succeeded", n, len(data))
+			}
+		}
+		if err := got.UnmarshalBinary(append(data, 0)); err == nil {
+			t.Error("Expected error for trailing bytes")
+		}
+		future := append([]byte(nil), data...)
+		future[4] = CPUStateVersion + 1
+		if err := got.UnmarshalBinary(future); err == nil {
+			t.Error("Expected error for a future version")
+		}
+	})
+
+	t.Run("legacy JSON", func(t *testing.T) {
+		got := CPUState{CPSR: 0x3c5}
+		if err := json.Unmarshal([]byte(`{"x1":15,"x2":25,"pc":16384,"q3":"0x1"}`), &got); err == nil {
+			t.Error("Expected error for a SIMD register outside \"simd\"")
+		}
+		if err := json.Unmarshal([]byte(`{"x1":15,"x2":25,"pc":16384,"simd":{"v3":"0x1"}}`), &got); err != nil {
+			t.Fatalf("Unmarshal failed: %v", err)
+		}
+		if got.X[1] != 15 || got.X[2] != 25 || got.PC != 0x4000 || got.Q[3] != ([16]byte{0: 1}) || got.CPSR != 0x3c5 {
+			t.Errorf("got %+v", got)
+		}
+	})
+
+	t.Run("invalid JSON", func(t *testing.T) {
+		bad := []string{
+			`{"version":2}`,
+			`{"x31":1}`,
+			`{"x0":-1}`,
+			`{"simd":{"q0":"0x` + "123456789012345678901234567890123" + `"}}`,
+			`{"sys":{"NOT_A_REG":1}}`,
+		}
+		for _, in := range bad {
+			var got CPUState
+			if err := json.Unmarshal([]byte(in), &got); err == nil {
+				t.Errorf("Unmarshal(%s) succeeded", in)
+			}
+		}
+	})
+}
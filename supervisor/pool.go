@@ -0,0 +1,379 @@
+// Package supervisor runs VMs in worker processes.
+//
+// Hypervisor.framework allows a single VM per process, so a program that
+// needs many VMs at once has to spread them over processes. A Pool starts
+// up to Config.Workers copies of the hv command's hidden "worker"
+// subcommand (or any program that calls Serve) and hands out a VM handle
+// per worker. Requests travel over the worker's stdin and stdout as
+// length-prefixed frames.
+//
+// A worker that crashes, or that does not stop a canceled run in time and
+// is killed, takes only its own VM with it: that handle's methods return
+// ErrWorkerExited, and the pool starts a fresh worker the next time the
+// slot is needed.
+//
+//	pool, err := supervisor.NewPool(supervisor.Config{Workers: 8})
+//	defer pool.Close()
+//
+//	vm, err := pool.NewVM(ctx)
+//	defer vm.Close()
+//	err = vm.Map(0x4000, 0x4000, hypervisor.MemRead|hypervisor.MemExec)
+//	_, err = vm.WriteAt(code, 0x4000)
+//	err = vm.SetReg(hypervisor.RegPC, 0x4000)
+//	exit, err := vm.Run(ctx)
+package supervisor
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrWorkerExited is returned by every method of a VM whose worker
+	// process has exited.
+	ErrWorkerExited = errors.New("supervisor: worker exited")
+	// ErrPoolClosed is returned by Pool.NewVM after Close.
+	ErrPoolClosed = errors.New("supervisor: pool is closed")
+)
+
+// Config configures a Pool.
+type Config struct {
+	// Path is the worker executable. The default is "hv" found in PATH.
+	Path string
+	// Args are the arguments that make Path serve as a worker. The
+	// default is []string{"worker"}.
+	Args []string
+	// Env is the workers' environment. Nil means the current process's.
+	Env []string
+	// Stderr receives the workers' standard error. Nil discards it.
+	Stderr io.Writer
+	// Backend names the backend workers create VMs on. Empty selects the
+	// worker's default, which honors HV_BACKEND.
+	Backend string
+	// Workers is the most worker processes, and so VMs, alive at once. The
+	// default is runtime.NumCPU().
+	Workers int
+	// KillTimeout is how long a worker may take to stop a canceled run or
+	// to exit when asked before it is killed. The default is 5 seconds.
+	KillTimeout time.Duration
+}
+
+// Stats reports a pool's workers.
+type Stats struct {
+	Workers int    // worker processes alive
+	InUse   int    // VMs handed out and not yet closed
+	Started uint64 // worker processes started, including restarts
+	Crashed uint64 // workers that exited without being asked to
+}
+
+// Pool hands out VMs backed by worker processes. Its methods are safe for
+// concurrent use.
+type Pool struct {
+	cfg Config
+
+	// slots holds one entry per worker the pool may run: an idle worker,
+	// or nil where no process is running yet or its worker has exited.
+	slots chan *worker
+
+	done chan struct{} // closed by Close
+
+	mu   sync.Mutex
+	live map[*worker]struct{}
+
+	inUse   atomic.Int64
+	started atomic.Uint64
+	crashed atomic.Uint64
+}
+
+// NewPool returns a pool for cfg. Workers are started on demand.
+func NewPool(cfg Config) (*Pool, error) {
+	if cfg.Path == "" {
+		path, err := exec.LookPath("hv")
+		if err != nil {
+			return nil, fmt.Errorf("supervisor: no worker executable: %w", err)
+		}
+		cfg.Path = path
+	}
+	if cfg.Args == nil {
+		cfg.Args = []string{"worker"}
+	}
+	if cfg.Workers < 0 {
+		return nil, fmt.Errorf("supervisor: invalid worker count %d", cfg.Workers)
+	}
+	if cfg.Workers == 0 {
+		cfg.Workers = runtime.NumCPU()
+	}
+	if cfg.KillTimeout <= 0 {
+		cfg.KillTimeout = 5 * time.Second
+	}
+
+	p := &Pool{
+		cfg:   cfg,
+		slots: make(chan *worker, cfg.Workers),
+		done:  make(chan struct{}),
+		live:  make(map[*worker]struct{}),
+	}
+	for range cfg.Workers {
+		p.slots <- nil
+	}
+	return p, nil
+}
+
+// NewVM returns a VM with one vCPU in a worker process. It waits until a
+// worker is free or ctx is done, starting a worker if the slot it gets has
+// none, or if the previous one crashed.
+func (p *Pool) NewVM(ctx context.Context) (*VM, error) {
+	var w *worker
+	select {
+	case w = <-p.slots:
+	case <-p.done:
+		return nil, ErrPoolClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if p.isClosed() {
+		p.release(w)
+		return nil, ErrPoolClosed
+	}
+
+	if w == nil || w.exited() {
+		var err error
+		if w, err = p.start(); err != nil {
+			p.slots <- nil
+			return nil, err
+		}
+	}
+	resp, err := w.call(ctx, request{Op: opOpen, Backend: p.cfg.Backend}, p.cfg.KillTimeout)
+	if err == nil {
+		err = resp.Error.err()
+	}
+	if err != nil {
+		p.release(w)
+		return nil, err
+	}
+	p.inUse.Add(1)
+	return &VM{pool: p, w: w}, nil
+}
+
+// release returns w's slot to the pool, discarding w if it has exited or
+// the pool is closed.
+func (p *Pool) release(w *worker) {
+	if w != nil && (w.exited() || p.isClosed()) {
+		p.stop(w)
+		w = nil
+	}
+	p.slots <- w
+}
+
+// Stats reports the pool's current workers and totals since NewPool.
+func (p *Pool) Stats() Stats {
+	p.mu.Lock()
+	workers := len(p.live)
+	p.mu.Unlock()
+	return Stats{
+		Workers: workers,
+		InUse:   int(p.inUse.Load()),
+		Started: p.started.Load(),
+		Crashed: p.crashed.Load(),
+	}
+}
+
+// Close stops every worker, including those backing open VMs, whose
+// methods then return ErrWorkerExited. Idempotent.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	if p.isClosed() {
+		p.mu.Unlock()
+		return nil
+	}
+	close(p.done)
+	workers := make([]*worker, 0, len(p.live))
+	for w := range p.live {
+		workers = append(workers, w)
+	}
+	p.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.stop(w)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+func (p *Pool) isClosed() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// start launches a worker process.
+func (p *Pool) start() (*worker, error) {
+	cmd := exec.Command(p.cfg.Path, p.cfg.Args...)
+	cmd.Env = p.cfg.Env
+	cmd.Stderr = p.cfg.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("supervisor: %w", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("supervisor: %w", err)
+	}
+
+	// Start under the lock, so Close either sees the worker or has
+	// already refused it.
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.isClosed() {
+		return nil, ErrPoolClosed
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("supervisor: failed to start worker: %w", err)
+	}
+	w := &worker{
+		cmd:   cmd,
+		stdin: stdin,
+		resps: make(chan response, 1),
+		done:  make(chan struct{}),
+	}
+	p.live[w] = struct{}{}
+	p.started.Add(1)
+	go w.read(stdout, func() {
+		p.mu.Lock()
+		delete(p.live, w)
+		p.mu.Unlock()
+		if !w.stopping.Load() {
+			p.crashed.Add(1)
+		}
+	})
+	return w, nil
+}
+
+// stop asks w to exit by closing its stdin, and kills it if it has not
+// exited within KillTimeout.
+func (p *Pool) stop(w *worker) {
+	w.stopping.Store(true)
+	w.stdin.Close()
+	select {
+	case <-w.done:
+	case <-time.After(p.cfg.KillTimeout):
+		w.kill()
+		<-w.done
+	}
+}
+
+// worker is the supervisor's end of one worker process.
+type worker struct {
+	cmd      *exec.Cmd
+	stdin    io.WriteCloser
+	stopping atomic.Bool // set when the pool stops the worker on purpose
+
+	callMu sync.Mutex // one request in flight at a time
+	sendMu sync.Mutex // serializes frames, since a cancel may overlap a call
+	nextID uint64
+
+	resps chan response
+	done  chan struct{} // closed once the process has exited
+	err   error         // why it exited, valid after done is closed
+}
+
+// read delivers responses until the worker's stdout fails, then reaps the
+// process and calls exited.
+func (w *worker) read(stdout io.Reader, exited func()) {
+	r := bufio.NewReader(stdout)
+	for {
+		var resp response
+		if err := readFrame(r, &resp); err != nil {
+			break
+		}
+		w.resps <- resp
+	}
+	// Security: A worker that breaks the protocol is not trusted to exit
+	// on its own
+	w.kill()
+	err := w.cmd.Wait()
+	if err == nil {
+		err = errors.New("exit status 0")
+	}
+	w.err = fmt.Errorf("%w (pid %d): %v", ErrWorkerExited, w.cmd.Process.Pid, err)
+	exited()
+	close(w.done)
+}
+
+func (w *worker) exited() bool {
+	select {
+	case <-w.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (w *worker) kill() {
+	w.cmd.Process.Kill()
+}
+
+func (w *worker) send(req request) error {
+	w.sendMu.Lock()
+	defer w.sendMu.Unlock()
+	return writeFrame(w.stdin, req)
+}
+
+// call sends req and waits for its response. If ctx is done first, the
+// worker is asked to cancel the request, and killed if it has not answered
+// within grace.
+func (w *worker) call(ctx context.Context, req request, grace time.Duration) (response, error) {
+	w.callMu.Lock()
+	defer w.callMu.Unlock()
+
+	if w.exited() {
+		return response{}, w.err
+	}
+	w.nextID++
+	req.ID = w.nextID
+	if err := w.send(req); err != nil {
+		w.kill()
+		<-w.done
+		return response{}, w.err
+	}
+
+	cancel := ctx.Done()
+	var deadline <-chan time.Time
+	for {
+		select {
+		case resp := <-w.resps:
+			if resp.ID == req.ID {
+				return resp, nil
+			}
+		case <-w.done:
+			return response{}, w.err
+		case <-cancel:
+			cancel = nil
+			if w.send(request{Op: opCancel, Target: req.ID}) != nil {
+				w.kill()
+			}
+			timer := time.NewTimer(grace)
+			defer timer.Stop()
+			deadline = timer.C
+		case <-deadline:
+			w.kill()
+			deadline = nil
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package supervisor
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/blacktop/go-hypervisor"
+)
+
+// The supervisor and a worker exchange frames over the worker's stdin and
+// stdout. A frame is a little-endian u32 payload length followed by a JSON
+// encoded request or response. The supervisor sends one request at a time
+// and waits for its response, except that a cancel request may be sent
+// while a run is in progress; cancel has no response of its own.
+const (
+	// maxFrame bounds a frame's payload, so a corrupt length cannot make
+	// either side allocate without limit.
+	maxFrame = 16 << 20
+	// maxTransfer is the most guest memory moved by one read or write
+	// request; larger accesses are split.
+	maxTransfer = 1 << 20
+)
+
+// Request operations.
+const (
+	opOpen         = "open"
+	opClose        = "close"
+	opMap          = "map"
+	opUnmap        = "unmap"
+	opRead         = "read"
+	opWrite        = "write"
+	opGetReg       = "get_reg"
+	opSetReg       = "set_reg"
+	opGetSysReg    = "get_sysreg"
+	opSetSysReg    = "set_sysreg"
+	opSaveState    = "save_state"
+	opRestoreState = "restore_state"
+	opRun          = "run"
+	opCancel       = "cancel"
+)
+
+type request struct {
+	ID      uint64               `json:"id"`
+	Op      string               `json:"op"`
+	Backend string               `json:"backend,omitempty"`
+	GPA     uint64               `json:"gpa,omitempty"`
+	Size    uint64               `json:"size,omitempty"`
+	Perms   hypervisor.MemPerm   `json:"perms,omitempty"`
+	Label   string               `json:"label,omitempty"`
+	Reg     int                  `json:"reg,omitempty"`
+	Value   uint64               `json:"value,omitempty"`
+	Data    []byte               `json:"data,omitempty"`
+	State   *hypervisor.CPUState `json:"state,omitempty"`
+	Target  uint64               `json:"target,omitempty"` // request a cancel applies to
+}
+
+type response struct {
+	ID    uint64               `json:"id"`
+	Error *wireError           `json:"error,omitempty"`
+	Value uint64               `json:"value,omitempty"`
+	Data  []byte               `json:"data,omitempty"`
+	State *hypervisor.CPUState `json:"state,omitempty"`
+	Exit  hypervisor.ExitInfo  `json:"exit"`
+}
+
+// wireError carries an error from a worker. Sentinel indexes sentinels,
+// plus one, so that errors.Is keeps working across the process boundary.
+type wireError struct {
+	Message  string `json:"message"`
+	Code     uint32 `json:"code,omitempty"`
+	Sentinel int    `json:"sentinel,omitempty"`
+}
+
+// sentinels are the hypervisor errors a RemoteError can match. Append
+// only: the index is part of the protocol.
+var sentinels = []error{
+	hypervisor.ErrVMClosed,
+	hypervisor.ErrVCPUClosed,
+	hypervisor.ErrInvalidAlignment,
+	hypervisor.ErrInvalidRegister,
+	hypervisor.ErrMemoryNotMapped,
+	hypervisor.ErrVMAlreadyActive,
+	hypervisor.ErrVCPURunning,
+}
+
+func newWireError(err error) *wireError {
+	if err == nil {
+		return nil
+	}
+	e := &wireError{Message: err.Error()}
+	for i, s := range sentinels {
+		if errors.Is(err, s) {
+			e.Sentinel = i + 1
+			break
+		}
+	}
+	var hvErr hypervisor.HVError
+	var hvErrPtr *hypervisor.HVError
+	switch {
+	case errors.As(err, &hvErrPtr):
+		e.Code = hvErrPtr.Code
+	case errors.As(err, &hvErr):
+		e.Code = hvErr.Code
+	}
+	return e
+}
+
+// RemoteError is an error returned by the VM in a worker process. It
+// unwraps to the matching hypervisor sentinel, such as
+// hypervisor.ErrMemoryNotMapped, or else to a hypervisor.HVError with the
+// original code, so errors.Is works as it does in process.
+type RemoteError struct {
+	Message string // the worker's error text
+	Code    uint32 // hv_return_t code, or 0 if the error had none
+
+	sentinel int
+}
+
+func (e *RemoteError) Error() string { return e.Message }
+
+func (e *RemoteError) Unwrap() error {
+	if e.sentinel > 0 && e.sentinel <= len(sentinels) {
+		return sentinels[e.sentinel-1]
+	}
+	if e.Code != 0 {
+		return hypervisor.HVError{Code: e.Code}
+	}
+	return nil
+}
+
+func (e *wireError) err() error {
+	if e == nil {
+		return nil
+	}
+	return &RemoteError{Message: e.Message, Code: e.Code, sentinel: e.Sentinel}
+}
+
+// writeFrame writes v as one frame.
+func writeFrame(w io.Writer, v any) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(payload) > maxFrame {
+		return fmt.Errorf("supervisor: frame too large (%d bytes, max %d)", len(payload), maxFrame)
+	}
+	buf := make([]byte, 4+len(payload))
+	binary.LittleEndian.PutUint32(buf, uint32(len(payload)))
+	copy(buf[4:], payload)
+	_, err = w.Write(buf)
+	return err
+}
+
+// readFrame reads one frame into v. It returns io.EOF only if r ends
+// cleanly between frames.
+func readFrame(r io.Reader, v any) error {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return err
+	}
+	n := binary.LittleEndian.Uint32(hdr[:])
+	if n > maxFrame {
+		return fmt.Errorf("supervisor: frame too large (%d bytes, max %d)", n, maxFrame)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if err := json.Unmarshal(payload, v); err != nil {
+		return fmt.Errorf("supervisor: invalid frame: %w", err)
+	}
+	return nil
+}
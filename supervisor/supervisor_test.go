@@ -0,0 +1,342 @@
+package supervisor
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blacktop/go-hypervisor"
+)
+
+// The test binary doubles as the worker executable.
+const workerEnv = "HV_SUPERVISOR_TEST_WORKER"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(workerEnv) == "1" {
+		if err := Serve(os.Stdin, os.Stdout); err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+const codeGPA = 0x10000
+
+// newPool returns a pool of test workers on the interpreter backend.
+func newPool(t *testing.T, workers int) *Pool {
+	t.Helper()
+	pool, err := NewPool(Config{
+		Path:        os.Args[0],
+		Args:        []string{},
+		Env:         append(os.Environ(), workerEnv+"=1"),
+		Stderr:      os.Stderr,
+		Backend:     "interp",
+		Workers:     workers,
+		KillTimeout: 2 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("NewPool failed: %v", err)
+	}
+	t.Cleanup(func() { pool.Close() })
+	return pool
+}
+
+// newGuest returns a VM with code loaded at codeGPA and PC pointing at it.
+func newGuest(t *testing.T, pool *Pool, code ...uint32) *VM {
+	t.Helper()
+	vm, err := pool.NewVM(context.Background())
+	if err != nil {
+		t.Fatalf("NewVM failed: %v", err)
+	}
+	t.Cleanup(func() { vm.Close() })
+
+	page := uint64(os.Getpagesize())
+	if err := vm.Map(codeGPA, page, hypervisor.MemRead|hypervisor.MemWrite|hypervisor.MemExec); err != nil {
+		t.Fatalf("Map failed: %v", err)
+	}
+	text := make([]byte, 4*len(code))
+	for i, insn := range code {
+		binary.LittleEndian.PutUint32(text[4*i:], insn)
+	}
+	if _, err := vm.WriteAt(text, codeGPA); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if err := vm.SetReg(hypervisor.RegPC, codeGPA); err != nil {
+		t.Fatalf("SetReg(PC) failed: %v", err)
+	}
+	return vm
+}
+
+func TestVM(t *testing.T) {
+	pool := newPool(t, 1)
+	vm := newGuest(t, pool,
+		0xD2800540, // movz x0, #0x2a
+		0xF9000420, // str  x0, [x1, #8]
+		0xD4200000, // brk  #0
+	)
+	if err := vm.SetReg(hypervisor.RegX1, codeGPA+0x100); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := vm.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if info.Class() != hypervisor.ECBRK {
+		t.Errorf("exit = %v, want a BRK", info)
+	}
+	if x0, err := vm.GetReg(hypervisor.RegX0); err != nil || x0 != 0x2a {
+		t.Errorf("X0 = 0x%x, %v; want 0x2a", x0, err)
+	}
+	got := make([]byte, 8)
+	if _, err := vm.ReadAt(got, codeGPA+0x108); err != nil {
+		t.Fatal(err)
+	}
+	if binary.LittleEndian.Uint64(got) != 0x2a {
+		t.Errorf("memory = %x, want 0x2a", got)
+	}
+
+	state, err := vm.SaveState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.PC != codeGPA+8 {
+		t.Errorf("saved PC = 0x%x, want 0x%x", state.PC, codeGPA+8)
+	}
+	if err := vm.SetSysReg(hypervisor.SysTPIDR_EL0, 7); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := vm.GetSysReg(hypervisor.SysTPIDR_EL0); err != nil || v != 7 {
+		t.Errorf("TPIDR_EL0 = %d, %v; want 7", v, err)
+	}
+	if err := vm.RestoreState(state); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemoteErrors(t *testing.T) {
+	pool := newPool(t, 1)
+	vm := newGuest(t, pool, 0xD4200000) // brk #0
+
+	tests := []struct {
+		name   string
+		call   func() error
+		target error  // error the remote error matches, if any
+		msg    string // text the error contains, if any
+	}{
+		{
+			name: "read hole",
+			call: func() error {
+				_, err := vm.ReadAt(make([]byte, 8), 0x800000)
+				return err
+			},
+			target: hypervisor.ErrMemoryNotMapped,
+		},
+		{
+			name:   "unaligned map",
+			call:   func() error { return vm.Map(0x20001, 0x1000, hypervisor.MemRead) },
+			target: hypervisor.ErrInvalidAlignment,
+		},
+		{
+			name:   "invalid register",
+			call:   func() error { return vm.SetReg(hypervisor.Reg(1000), 0) },
+			target: hypervisor.HVError{Code: hypervisor.HV_BAD_ARGUMENT},
+		},
+		{
+			name: "oversized read",
+			call: func() error {
+				_, err := vm.call(context.Background(), request{Op: opRead, GPA: codeGPA, Size: maxTransfer + 1})
+				return err
+			},
+			msg: "invalid read",
+		},
+		{
+			name: "oversized write",
+			call: func() error {
+				_, err := vm.call(context.Background(), request{Op: opWrite, GPA: codeGPA, Data: make([]byte, maxTransfer+1)})
+				return err
+			},
+			msg: "invalid write",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.call()
+			var remote *RemoteError
+			if !errors.As(err, &remote) {
+				t.Fatalf("error %v is not a *RemoteError", err)
+			}
+			if tt.target != nil && !errors.Is(err, tt.target) {
+				t.Errorf("error %v does not match %v", err, tt.target)
+			}
+			if !strings.Contains(err.Error(), tt.msg) {
+				t.Errorf("error %v does not contain %q", err, tt.msg)
+			}
+		})
+	}
+}
+
+func TestRunCancel(t *testing.T) {
+	pool := newPool(t, 1)
+	vm := newGuest(t, pool, 0x14000000) // b .
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	info, err := vm.Run(ctx)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if info.Reason != hypervisor.ExitCanceled {
+		t.Errorf("exit = %v, want %v", info.Reason, hypervisor.ExitCanceled)
+	}
+	if pc, err := vm.GetReg(hypervisor.RegPC); err != nil || pc != codeGPA {
+		t.Errorf("PC = 0x%x, %v; want 0x%x", pc, err, codeGPA)
+	}
+}
+
+func TestRunNoVM(t *testing.T) {
+	s := &server{}
+	s.prepareRun(1)
+	resp := s.handle(request{ID: 1, Op: opRun})
+	if resp.Error == nil {
+		t.Errorf("run without a VM succeeded")
+	}
+	if s.runCtx != nil || s.runCancel != nil {
+		t.Errorf("run context left behind after a rejected run")
+	}
+}
+
+func TestWorkerCrash(t *testing.T) {
+	pool := newPool(t, 1)
+	vm := newGuest(t, pool, 0xD4200000) // brk #0
+	pid := vm.Pid()
+
+	vm.w.kill()
+	if _, err := vm.GetReg(hypervisor.RegX0); !errors.Is(err, ErrWorkerExited) {
+		t.Fatalf("GetReg after crash = %v, want %v", err, ErrWorkerExited)
+	}
+	if _, err := vm.Run(context.Background()); !errors.Is(err, ErrWorkerExited) {
+		t.Errorf("Run after crash = %v, want %v", err, ErrWorkerExited)
+	}
+	if err := vm.Close(); err != nil {
+		t.Errorf("Close after crash = %v", err)
+	}
+
+	// The slot is reused with a new worker.
+	vm2 := newGuest(t, pool, 0xD4200000)
+	if vm2.Pid() == pid {
+		t.Errorf("restarted worker has the crashed worker's pid %d", pid)
+	}
+	if _, err := vm2.Run(context.Background()); err != nil {
+		t.Fatalf("Run on restarted worker failed: %v", err)
+	}
+	stats := pool.Stats()
+	if stats.Started != 2 || stats.Crashed != 1 || stats.Workers != 1 || stats.InUse != 1 {
+		t.Errorf("Stats = %+v, want 2 started, 1 crashed, 1 worker in use", stats)
+	}
+}
+
+func TestPoolSize(t *testing.T) {
+	pool := newPool(t, 2)
+	a := newGuest(t, pool, 0xD2800020, 0xD4200000) // movz x0, #1; brk #0
+	b := newGuest(t, pool, 0xD2800040, 0xD4200000) // movz x0, #2; brk #0
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := pool.NewVM(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("NewVM on a full pool = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// Both VMs run at once, in separate processes.
+	var wg sync.WaitGroup
+	for i, vm := range []*VM{a, b} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := vm.Run(context.Background()); err != nil {
+				t.Errorf("Run %d failed: %v", i, err)
+			}
+			if x0, err := vm.GetReg(hypervisor.RegX0); err != nil || x0 != uint64(i+1) {
+				t.Errorf("VM %d: X0 = %d, %v; want %d", i, x0, err, i+1)
+			}
+		}()
+	}
+	wg.Wait()
+	if a.Pid() == b.Pid() {
+		t.Errorf("both VMs run in pid %d", a.Pid())
+	}
+
+	// Closing a VM frees its worker for the next one, which starts clean.
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c := newGuest(t, pool, 0xD4200000)
+	if c.Pid() != a.Pid() {
+		t.Errorf("new VM runs in pid %d, want the idle worker %d", c.Pid(), a.Pid())
+	}
+	if x0, err := c.GetReg(hypervisor.RegX0); err != nil || x0 != 0 {
+		t.Errorf("X0 of a new VM = %d, %v; want 0", x0, err)
+	}
+	if stats := pool.Stats(); stats.Started != 2 || stats.InUse != 2 {
+		t.Errorf("Stats = %+v, want 2 started and 2 in use", stats)
+	}
+
+	if err := pool.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.NewVM(context.Background()); !errors.Is(err, ErrPoolClosed) {
+		t.Errorf("NewVM after Close = %v, want %v", err, ErrPoolClosed)
+	}
+	if _, err := b.GetReg(hypervisor.RegX0); !errors.Is(err, ErrWorkerExited) {
+		t.Errorf("GetReg after pool Close = %v, want %v", err, ErrWorkerExited)
+	}
+	if stats := pool.Stats(); stats.Workers != 0 || stats.Crashed != 0 {
+		t.Errorf("Stats after Close = %+v, want no workers and no crashes", stats)
+	}
+}
+
+func TestFrames(t *testing.T) {
+	var buf bytes.Buffer
+	in := request{ID: 3, Op: opWrite, GPA: 0x4000, Data: []byte{1, 2, 3}}
+	if err := writeFrame(&buf, in); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{"complete", buf.Bytes(), ""},
+		{"empty", nil, io.EOF.Error()},
+		{"truncated", buf.Bytes()[:buf.Len()-1], io.ErrUnexpectedEOF.Error()},
+		{"oversized", []byte{0xff, 0xff, 0xff, 0xff}, "frame too large"},
+		{"not JSON", []byte{1, 0, 0, 0, '{'}, "invalid frame"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got request
+			err := readFrame(bytes.NewReader(tt.data), &got)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("readFrame error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readFrame failed: %v", err)
+			}
+			if got.ID != in.ID || got.Op != in.Op || got.GPA != in.GPA || !bytes.Equal(got.Data, in.Data) {
+				t.Errorf("readFrame = %+v, want %+v", got, in)
+			}
+		})
+	}
+}
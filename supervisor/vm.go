@@ -0,0 +1,165 @@
+package supervisor
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/blacktop/go-hypervisor"
+)
+
+// VM is a VM with a single vCPU running in a worker process. Its methods
+// mirror those of hypervisor.VM and hypervisor.VCPU, except that guest
+// memory lives in the worker: Map allocates it there, and ReadAt and
+// WriteAt copy to and from it. Errors from the worker's VM are
+// *RemoteError values. Methods are safe for concurrent use but run one at
+// a time.
+type VM struct {
+	pool *Pool
+	w    *worker
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// Pid returns the worker's process ID.
+func (vm *VM) Pid() int { return vm.w.cmd.Process.Pid }
+
+// call runs req in the worker and returns its response.
+func (vm *VM) call(ctx context.Context, req request) (response, error) {
+	vm.mu.Lock()
+	closed := vm.closed
+	vm.mu.Unlock()
+	if closed {
+		return response{}, fmt.Errorf("supervisor: %w", hypervisor.ErrVMClosed)
+	}
+	resp, err := vm.w.call(ctx, req, vm.pool.cfg.KillTimeout)
+	if err != nil {
+		return resp, err
+	}
+	return resp, resp.Error.err()
+}
+
+// Map maps size bytes of zeroed worker memory at gpa.
+func (vm *VM) Map(gpa, size uint64, perms hypervisor.MemPerm) error {
+	return vm.MapLabeled(gpa, size, perms, "")
+}
+
+// MapLabeled is like Map but labels the region.
+func (vm *VM) MapLabeled(gpa, size uint64, perms hypervisor.MemPerm, label string) error {
+	_, err := vm.call(context.Background(), request{Op: opMap, GPA: gpa, Size: size, Perms: perms, Label: label})
+	return err
+}
+
+// Unmap removes [gpa, gpa+size) from the guest physical address space.
+func (vm *VM) Unmap(gpa, size uint64) error {
+	_, err := vm.call(context.Background(), request{Op: opUnmap, GPA: gpa, Size: size})
+	return err
+}
+
+// ReadAt reads guest memory at guest physical address off.
+func (vm *VM) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("supervisor: negative address %d", off)
+	}
+	n := 0
+	for n < len(p) {
+		chunk := min(len(p)-n, maxTransfer)
+		resp, err := vm.call(context.Background(), request{Op: opRead, GPA: uint64(off) + uint64(n), Size: uint64(chunk)})
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:n+chunk], resp.Data)
+	}
+	return n, nil
+}
+
+// WriteAt writes guest memory at guest physical address off.
+func (vm *VM) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("supervisor: negative address %d", off)
+	}
+	n := 0
+	for n < len(p) {
+		chunk := min(len(p)-n, maxTransfer)
+		if _, err := vm.call(context.Background(), request{Op: opWrite, GPA: uint64(off) + uint64(n), Data: p[n : n+chunk]}); err != nil {
+			return n, err
+		}
+		n += chunk
+	}
+	return n, nil
+}
+
+// GetReg reads a general purpose or special register.
+func (vm *VM) GetReg(r hypervisor.Reg) (uint64, error) {
+	resp, err := vm.call(context.Background(), request{Op: opGetReg, Reg: int(r)})
+	return resp.Value, err
+}
+
+// SetReg writes a general purpose or special register.
+func (vm *VM) SetReg(r hypervisor.Reg, v uint64) error {
+	_, err := vm.call(context.Background(), request{Op: opSetReg, Reg: int(r), Value: v})
+	return err
+}
+
+// GetSysReg reads a system register.
+func (vm *VM) GetSysReg(r hypervisor.SysReg) (uint64, error) {
+	resp, err := vm.call(context.Background(), request{Op: opGetSysReg, Reg: int(r)})
+	return resp.Value, err
+}
+
+// SetSysReg writes a system register.
+func (vm *VM) SetSysReg(r hypervisor.SysReg, v uint64) error {
+	_, err := vm.call(context.Background(), request{Op: opSetSysReg, Reg: int(r), Value: v})
+	return err
+}
+
+// SaveState captures the vCPU's registers.
+func (vm *VM) SaveState() (*hypervisor.CPUState, error) {
+	resp, err := vm.call(context.Background(), request{Op: opSaveState})
+	if err != nil {
+		return nil, err
+	}
+	return resp.State, nil
+}
+
+// RestoreState loads registers captured by SaveState.
+func (vm *VM) RestoreState(s *hypervisor.CPUState) error {
+	if s == nil {
+		return fmt.Errorf("supervisor: CPU state is nil")
+	}
+	_, err := vm.call(context.Background(), request{Op: opRestoreState, State: s})
+	return err
+}
+
+// Run runs the vCPU until an exit, like hypervisor.VCPU.RunContext. When
+// ctx is done the worker forces the guest out and Run returns an
+// ExitCanceled exit; a worker that fails to do so within KillTimeout is
+// killed and Run returns ErrWorkerExited.
+func (vm *VM) Run(ctx context.Context) (hypervisor.ExitInfo, error) {
+	resp, err := vm.call(ctx, request{Op: opRun})
+	return resp.Exit, err
+}
+
+// Close destroys the VM and returns its worker to the pool. Idempotent.
+func (vm *VM) Close() error {
+	vm.mu.Lock()
+	if vm.closed {
+		vm.mu.Unlock()
+		return nil
+	}
+	vm.closed = true
+	vm.mu.Unlock()
+
+	resp, err := vm.w.call(context.Background(), request{Op: opClose}, vm.pool.cfg.KillTimeout)
+	if err != nil {
+		// The worker has exited and taken the VM with it.
+		err = nil
+	} else if err = resp.Error.err(); err != nil {
+		// A worker whose VM failed to close could not create another.
+		vm.pool.stop(vm.w)
+	}
+	vm.pool.inUse.Add(-1)
+	vm.pool.release(vm.w)
+	return err
+}
@@ -0,0 +1,208 @@
+package supervisor
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+
+	"github.com/blacktop/go-hypervisor"
+)
+
+// Serve runs a worker: it executes the requests read from r against a VM
+// of its own and writes the responses to w, until r ends. The hv command's
+// hidden "worker" subcommand calls it with stdin and stdout, so nothing
+// else may write to w.
+func Serve(r io.Reader, w io.Writer) error {
+	s := &server{}
+	defer s.closeVM()
+
+	reqs := make(chan request)
+	done := make(chan error, 1)
+	go func() {
+		out := bufio.NewWriter(w)
+		var err error
+		for req := range reqs {
+			// Keep draining after a write error so the reader never blocks.
+			if err != nil {
+				continue
+			}
+			if err = writeFrame(out, s.handle(req)); err == nil {
+				err = out.Flush()
+			}
+		}
+		done <- err
+	}()
+
+	in := bufio.NewReader(r)
+	var readErr error
+	for {
+		var req request
+		if err := readFrame(in, &req); err != nil {
+			if err != io.EOF {
+				readErr = err
+			}
+			break
+		}
+		switch req.Op {
+		case opCancel:
+			s.cancel(req.Target)
+			continue
+		case opRun:
+			// Register the run before handing it over, so a cancel that
+			// follows it closely is not lost.
+			s.prepareRun(req.ID)
+		}
+		reqs <- req
+	}
+	close(reqs)
+	if err := <-done; err != nil {
+		return err
+	}
+	return readErr
+}
+
+// server is the worker's side of the protocol. handle runs on one
+// goroutine; only prepareRun and cancel are called concurrently with it.
+type server struct {
+	vm   *hypervisor.VM
+	vcpu *hypervisor.VCPU
+
+	mu        sync.Mutex
+	runID     uint64
+	runCtx    context.Context
+	runCancel context.CancelFunc
+}
+
+func (s *server) handle(req request) response {
+	if req.Op == opRun {
+		// Serve prepared the run whether or not it can start.
+		defer s.endRun()
+	}
+	resp := response{ID: req.ID}
+	var err error
+	if req.Op != opOpen && s.vm == nil {
+		err = fmt.Errorf("supervisor: no VM is open")
+	} else {
+		err = s.do(req, &resp)
+	}
+	resp.Error = newWireError(err)
+	return resp
+}
+
+func (s *server) do(req request, resp *response) error {
+	switch req.Op {
+	case opOpen:
+		return s.openVM(req.Backend)
+	case opClose:
+		return s.closeVM()
+	case opMap:
+		// AllocRegion bounds the size before allocating
+		_, err := s.vm.AllocRegion(req.GPA, req.Size, req.Perms, hypervisor.AllocOptions{Label: req.Label})
+		return err
+	case opUnmap:
+		return s.vm.Unmap(req.GPA, req.Size)
+	case opRead:
+		if req.Size > maxTransfer || req.GPA > math.MaxInt64 {
+			return fmt.Errorf("supervisor: invalid read of %d bytes at 0x%x", req.Size, req.GPA)
+		}
+		resp.Data = make([]byte, req.Size)
+		_, err := s.vm.ReadAt(resp.Data, int64(req.GPA))
+		return err
+	case opWrite:
+		if len(req.Data) > maxTransfer || req.GPA > math.MaxInt64 {
+			return fmt.Errorf("supervisor: invalid write of %d bytes at 0x%x", len(req.Data), req.GPA)
+		}
+		_, err := s.vm.WriteAt(req.Data, int64(req.GPA))
+		return err
+	case opGetReg:
+		v, err := s.vcpu.GetReg(hypervisor.Reg(req.Reg))
+		resp.Value = v
+		return err
+	case opSetReg:
+		return s.vcpu.SetReg(hypervisor.Reg(req.Reg), req.Value)
+	case opGetSysReg:
+		v, err := s.vcpu.GetSysReg(hypervisor.SysReg(req.Reg))
+		resp.Value = v
+		return err
+	case opSetSysReg:
+		return s.vcpu.SetSysReg(hypervisor.SysReg(req.Reg), req.Value)
+	case opSaveState:
+		state, err := s.vcpu.SaveState()
+		resp.State = state
+		return err
+	case opRestoreState:
+		return s.vcpu.RestoreState(req.State)
+	case opRun:
+		info, err := s.vcpu.RunContext(s.runContext())
+		resp.Exit = info
+		return err
+	}
+	return fmt.Errorf("supervisor: unknown operation %q", req.Op)
+}
+
+// prepareRun creates the context for the run request id.
+func (s *server) prepareRun(id uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.runID = id
+	s.runCtx, s.runCancel = context.WithCancel(context.Background())
+}
+
+func (s *server) runContext() context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.runCtx
+}
+
+func (s *server) endRun() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.runCancel()
+	s.runID, s.runCtx, s.runCancel = 0, nil, nil
+}
+
+// cancel forces the run started by request id, if it is still going, out
+// of the guest.
+func (s *server) cancel(id uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.runCancel != nil && s.runID == id {
+		s.runCancel()
+	}
+}
+
+func (s *server) openVM(backend string) error {
+	if s.vm != nil {
+		return fmt.Errorf("supervisor: a VM is already open")
+	}
+	var vm *hypervisor.VM
+	var err error
+	if backend != "" {
+		vm, err = hypervisor.NewVMWithBackend(backend)
+	} else {
+		vm, err = hypervisor.NewVM()
+	}
+	if err != nil {
+		return err
+	}
+	vcpu, err := vm.NewVCPU()
+	if err != nil {
+		vm.Close()
+		return err
+	}
+	s.vm, s.vcpu = vm, vcpu
+	return nil
+}
+
+func (s *server) closeVM() error {
+	if s.vm == nil {
+		return nil
+	}
+	err := errors.Join(s.vcpu.Close(), s.vm.Close())
+	s.vm, s.vcpu = nil, nil
+	return err
+}
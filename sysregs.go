@@ -0,0 +1,170 @@
+package hypervisor
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SysReg identifies an AArch64 system register by its MRS encoding
+// (op0<<14 | op1<<11 | CRn<<7 | CRm<<3 | op2), the same value
+// Hypervisor.framework uses for hv_sys_reg_t.
+type SysReg uint16
+
+const (
+	SysMDSCR_EL1        SysReg = 0x8012
+	SysMIDR_EL1         SysReg = 0xC000
+	SysMPIDR_EL1        SysReg = 0xC005
+	SysID_AA64PFR0_EL1  SysReg = 0xC020
+	SysID_AA64PFR1_EL1  SysReg = 0xC021
+	SysID_AA64DFR0_EL1  SysReg = 0xC028
+	SysID_AA64DFR1_EL1  SysReg = 0xC029
+	SysID_AA64ISAR0_EL1 SysReg = 0xC030
+	SysID_AA64ISAR1_EL1 SysReg = 0xC031
+	SysID_AA64MMFR0_EL1 SysReg = 0xC038
+	SysID_AA64MMFR1_EL1 SysReg = 0xC039
+	SysID_AA64MMFR2_EL1 SysReg = 0xC03A
+	SysSCTLR_EL1        SysReg = 0xC080
+	SysACTLR_EL1        SysReg = 0xC081
+	SysCPACR_EL1        SysReg = 0xC082
+	SysTTBR0_EL1        SysReg = 0xC100
+	SysTTBR1_EL1        SysReg = 0xC101
+	SysTCR_EL1          SysReg = 0xC102
+	SysSPSR_EL1         SysReg = 0xC200
+	SysELR_EL1          SysReg = 0xC201
+	SysSP_EL0           SysReg = 0xC208
+	SysAFSR0_EL1        SysReg = 0xC288
+	SysAFSR1_EL1        SysReg = 0xC289
+	SysESR_EL1          SysReg = 0xC290
+	SysFAR_EL1          SysReg = 0xC300
+	SysPAR_EL1          SysReg = 0xC3A0
+	SysMAIR_EL1         SysReg = 0xC510
+	SysAMAIR_EL1        SysReg = 0xC518
+	SysVBAR_EL1         SysReg = 0xC600
+	SysCONTEXTIDR_EL1   SysReg = 0xC681
+	SysTPIDR_EL1        SysReg = 0xC684
+	SysCNTKCTL_EL1      SysReg = 0xC708
+	SysCSSELR_EL1       SysReg = 0xD000
+	SysTPIDR_EL0        SysReg = 0xDE82
+	SysTPIDRRO_EL0      SysReg = 0xDE83
+	SysCNTV_CTL_EL0     SysReg = 0xDF19
+	SysCNTV_CVAL_EL0    SysReg = 0xDF1A
+	SysSP_EL1           SysReg = 0xE208
+)
+
+// sysRegNames are the registers GetSysReg and SetSysReg accept.
+var sysRegNames = map[SysReg]string{
+	SysMDSCR_EL1:        "MDSCR_EL1",
+	SysMIDR_EL1:         "MIDR_EL1",
+	SysMPIDR_EL1:        "MPIDR_EL1",
+	SysID_AA64PFR0_EL1:  "ID_AA64PFR0_EL1",
+	SysID_AA64PFR1_EL1:  "ID_AA64PFR1_EL1",
+	SysID_AA64DFR0_EL1:  "ID_AA64DFR0_EL1",
+	SysID_AA64DFR1_EL1:  "ID_AA64DFR1_EL1",
+	SysID_AA64ISAR0_EL1: "ID_AA64ISAR0_EL1",
+	SysID_AA64ISAR1_EL1: "ID_AA64ISAR1_EL1",
+	SysID_AA64MMFR0_EL1: "ID_AA64MMFR0_EL1",
+	SysID_AA64MMFR1_EL1: "ID_AA64MMFR1_EL1",
+	SysID_AA64MMFR2_EL1: "ID_AA64MMFR2_EL1",
+	SysSCTLR_EL1:        "SCTLR_EL1",
+	SysACTLR_EL1:        "ACTLR_EL1",
+	SysCPACR_EL1:        "CPACR_EL1",
+	SysTTBR0_EL1:        "TTBR0_EL1",
+	SysTTBR1_EL1:        "TTBR1_EL1",
+	SysTCR_EL1:          "TCR_EL1",
+	SysSPSR_EL1:         "SPSR_EL1",
+	SysELR_EL1:          "ELR_EL1",
+	SysSP_EL0:           "SP_EL0",
+	SysAFSR0_EL1:        "AFSR0_EL1",
+	SysAFSR1_EL1:        "AFSR1_EL1",
+	SysESR_EL1:          "ESR_EL1",
+	SysFAR_EL1:          "FAR_EL1",
+	SysPAR_EL1:          "PAR_EL1",
+	SysMAIR_EL1:         "MAIR_EL1",
+	SysAMAIR_EL1:        "AMAIR_EL1",
+	SysVBAR_EL1:         "VBAR_EL1",
+	SysCONTEXTIDR_EL1:   "CONTEXTIDR_EL1",
+	SysTPIDR_EL1:        "TPIDR_EL1",
+	SysCNTKCTL_EL1:      "CNTKCTL_EL1",
+	SysCSSELR_EL1:       "CSSELR_EL1",
+	SysTPIDR_EL0:        "TPIDR_EL0",
+	SysTPIDRRO_EL0:      "TPIDRRO_EL0",
+	SysCNTV_CTL_EL0:     "CNTV_CTL_EL0",
+	SysCNTV_CVAL_EL0:    "CNTV_CVAL_EL0",
+	SysSP_EL1:           "SP_EL1",
+}
+
+// SysRegs returns every system register GetSysReg and SetSysReg accept, in
+// encoding order.
+func SysRegs() []SysReg {
+	regs := make([]SysReg, 0, len(sysRegNames))
+	for r := range sysRegNames {
+		regs = append(regs, r)
+	}
+	sort.Slice(regs, func(i, j int) bool { return regs[i] < regs[j] })
+	return regs
+}
+
+// Valid reports whether r is one of the registers listed by SysRegs.
+func (r SysReg) Valid() bool {
+	_, ok := sysRegNames[r]
+	return ok
+}
+
+// IsID reports whether r is an identification register (op0=3, op1=0,
+// CRn=0). Guests cannot write them, and not every backend lets the host
+// change them.
+func (r SysReg) IsID() bool { return r&0xFF80 == 0xC000 }
+
+// String returns the architectural name, or the generic S<op0>_<op1>_C<n>_C<m>_<op2>
+// form for registers without one.
+func (r SysReg) String() string {
+	if name, ok := sysRegNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("S%d_%d_C%d_C%d_%d", r>>14&3, r>>11&7, r>>7&15, r>>3&15, r&7)
+}
+
+func (r SysReg) MarshalText() ([]byte, error) { return []byte(r.String()), nil }
+
+func (r *SysReg) UnmarshalText(text []byte) error {
+	v, err := ParseSysReg(string(text))
+	if err != nil {
+		return err
+	}
+	*r = v
+	return nil
+}
+
+// ParseSysReg parses a system register name such as "ttbr0_el1" or a
+// generic encoding such as "s3_0_c2_c0_0". Names are case-insensitive.
+func ParseSysReg(s string) (SysReg, error) {
+	upper := strings.ToUpper(strings.TrimSpace(s))
+	for r, name := range sysRegNames {
+		if name == upper {
+			return r, nil
+		}
+	}
+
+	var f [5]uint64
+	parts := strings.Split(upper, "_")
+	if len(parts) == 5 && strings.HasPrefix(parts[0], "S") &&
+		strings.HasPrefix(parts[2], "C") && strings.HasPrefix(parts[3], "C") {
+		parts[0], parts[2], parts[3] = parts[0][1:], parts[2][1:], parts[3][1:]
+		limits := [5]uint64{3, 7, 15, 15, 7}
+		ok := true
+		for i, p := range parts {
+			v, err := strconv.ParseUint(p, 10, 8)
+			if err != nil || v > limits[i] {
+				ok = false
+				break
+			}
+			f[i] = v
+		}
+		if ok {
+			return SysReg(f[0]<<14 | f[1]<<11 | f[2]<<7 | f[3]<<3 | f[4]), nil
+		}
+	}
+	return 0, fmt.Errorf("hv: unknown system register %q", s)
+}
@@ -0,0 +1,148 @@
+package hypervisor
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestRegNames(t *testing.T) {
+	regs := []struct {
+		name string
+		want Reg
+	}{
+		{"x0", RegX0},
+		{"X17", RegX17},
+		{"x29", RegFP},
+		{"fp", RegFP},
+		{"x30", RegLR},
+		{"sp", RegSP},
+		{"PC", RegPC},
+		{"cpsr", RegCPSR},
+		{"fpcr", RegFPCR},
+		{"FPSR", RegFPSR},
+	}
+	for _, tt := range regs {
+		got, err := ParseReg(tt.name)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseReg(%q) = %v, %v, want %v", tt.name, got, err, tt.want)
+		}
+	}
+	for r := RegX0; r < regCount; r++ {
+		if got, err := ParseReg(r.String()); err != nil || got != r {
+			t.Errorf("ParseReg(%v.String()) = %v, %v", r, got, err)
+		}
+	}
+
+	simd := []struct {
+		name string
+		want SIMDReg
+	}{
+		{"q0", RegQ0},
+		{"Q31", RegQ31},
+		{"v7", RegQ7},
+	}
+	for _, tt := range simd {
+		got, err := ParseSIMDReg(tt.name)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseSIMDReg(%q) = %v, %v, want %v", tt.name, got, err, tt.want)
+		}
+	}
+
+	sys := []struct {
+		name string
+		want SysReg
+	}{
+		{"ttbr0_el1", SysTTBR0_EL1},
+		{"SCTLR_EL1", SysSCTLR_EL1},
+		{"cntv_cval_el0", SysCNTV_CVAL_EL0},
+		{"s3_0_c2_c0_0", SysTTBR0_EL1},
+		{"S3_3_C13_C0_2", SysTPIDR_EL0},
+	}
+	for _, tt := range sys {
+		got, err := ParseSysReg(tt.name)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseSysReg(%q) = %v, %v, want %v", tt.name, got, err, tt.want)
+		}
+	}
+	for _, r := range SysRegs() {
+		if got, err := ParseSysReg(r.String()); err != nil || got != r {
+			t.Errorf("ParseSysReg(%v.String()) = %v, %v", r, got, err)
+		}
+	}
+	if s := SysReg(0xC7FF).String(); s != "S3_0_C15_C15_7" {
+		t.Errorf("String() of unnamed register = %q", s)
+	}
+
+	bad := []string{"x31", "x01", "q32", "r0", "", "s4_0_c0_c0_0", "ttbr2_el1"}
+	for _, name := range bad {
+		if _, err := ParseReg(name); err == nil {
+			t.Errorf("ParseReg(%q) succeeded", name)
+		}
+		if _, err := ParseSIMDReg(name); err == nil {
+			t.Errorf("ParseSIMDReg(%q) succeeded", name)
+		}
+		if _, err := ParseSysReg(name); err == nil {
+			t.Errorf("ParseSysReg(%q) succeeded", name)
+		}
+	}
+}
+
+func TestSysRegAccess(t *testing.T) {
+	_, vcpu, _ := newInterpVM(t,
+		0xD5382000, // mrs  x0, ttbr0_el1
+		0xD53BD041, // mrs  x1, tpidr_el0
+		0x4E083C22, // umov x2, v1.d[0]
+		0x4E183C23, // umov x3, v1.d[1]
+		0xD4200000, // brk  #0
+	)
+
+	if err := vcpu.SetSysReg(SysTTBR0_EL1, 0x80000000); err != nil {
+		t.Fatalf("SetSysReg failed: %v", err)
+	}
+	if err := vcpu.SetSysReg(SysTPIDR_EL0, 0xfeed); err != nil {
+		t.Fatalf("SetSysReg failed: %v", err)
+	}
+	var q [16]byte
+	binary.LittleEndian.PutUint64(q[:8], 0x1111)
+	binary.LittleEndian.PutUint64(q[8:], 0x2222)
+	if err := vcpu.SetSIMD(RegQ1, q); err != nil {
+		t.Fatalf("SetSIMD failed: %v", err)
+	}
+	if err := vcpu.SetReg(RegFPCR, 0x3000000); err != nil {
+		t.Fatalf("SetReg(FPCR) failed: %v", err)
+	}
+
+	if _, err := vcpu.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	want := map[Reg]uint64{RegX0: 0x80000000, RegX1: 0xfeed, RegX2: 0x1111, RegX3: 0x2222, RegFPCR: 0x3000000}
+	for r, v := range want {
+		if got, _ := vcpu.GetReg(r); got != v {
+			t.Errorf("%v = 0x%x, want 0x%x", r, got, v)
+		}
+	}
+	if got, _ := vcpu.GetSIMD(RegQ1); got != q {
+		t.Errorf("Q1 = %x, want %x", got, q)
+	}
+	if got, _ := vcpu.GetSysReg(SysTTBR0_EL1); got != 0x80000000 {
+		t.Errorf("TTBR0_EL1 = 0x%x", got)
+	}
+	if got, _ := vcpu.GetSysReg(SysID_AA64PFR0_EL1); got&0xF != 1 {
+		t.Errorf("ID_AA64PFR0_EL1 = 0x%x, want EL0 AArch64", got)
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		if err := vcpu.SetSysReg(SysID_AA64MMFR0_EL1, 0); err == nil {
+			t.Error("Expected error writing an interpreter ID register")
+		}
+		if _, err := vcpu.GetSysReg(SysReg(0xC7FF)); err == nil {
+			t.Error("Expected error for unsupported system register")
+		}
+		if _, err := vcpu.GetSIMD(32); err == nil {
+			t.Error("Expected error for Q32")
+		}
+		if _, err := vcpu.GetReg(regCount); err == nil {
+			t.Error("Expected error for out of range register")
+		}
+	})
+}